@@ -0,0 +1,30 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/aws/smithy-go"
+)
+
+// isAccessDenied reports whether S3 rejected a call for lack of permission
+func isAccessDenied(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == "AccessDenied"
+}
+
+// requiredPermission names the IAM action the failed S3 operation needs, e.g. s3:PutObject
+func requiredPermission(err error) string {
+	var opErr *smithy.OperationError
+	if !errors.As(err, &opErr) {
+		return "the required S3 permissions"
+	}
+	switch opErr.Operation() {
+	case "CopyObject":
+		return "s3:GetObject and s3:PutObject"
+	case "CreateMultipartUpload", "UploadPart", "CompleteMultipartUpload":
+		return "s3:PutObject"
+	case "HeadObject":
+		return "s3:GetObject"
+	}
+	return "s3:" + opErr.Operation()
+}
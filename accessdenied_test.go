@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/aws/smithy-go"
+)
+
+func TestUploadAccessDenied(t *testing.T) {
+	tests := []struct {
+		name      string
+		operation string
+		report    string
+		status    int
+		hint      string
+	}{
+		{name: "PutObject", operation: "PutObject", report: "true", status: http.StatusForbidden, hint: "grants s3:PutObject"},
+		{name: "CreateBucket", operation: "CreateBucket", report: "true", status: http.StatusForbidden, hint: "grants s3:CreateBucket"},
+		{name: "multipart", operation: "CreateMultipartUpload", report: "true", status: http.StatusForbidden, hint: "grants s3:PutObject"},
+		{name: "not reported", operation: "PutObject", report: "false", status: http.StatusInternalServerError, hint: "grants s3:PutObject"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("S3_UPLOAD_REPORT_ACCESS_DENIED", test.report)
+			t.Setenv("S3_UPLOAD_BREAKER_THRESHOLD", "0")
+			body := "denied upload"
+			if test.operation == "CreateMultipartUpload" {
+				t.Setenv("S3_UPLOAD_MULTIPART_THRESHOLD", "8")
+				body = string(randomBytes(t, 6<<20))
+			}
+			fake := newFakeS3(t)
+			fake.Fail = func(operation string, bucket string, key string) (int, string) {
+				if operation == test.operation {
+					return http.StatusForbidden, "AccessDenied"
+				}
+				return 0, ""
+			}
+			logs := captureLogs(t)
+			response := handle(t, map[string]string{"Content-Type": "application/octet-stream"}, body)
+			if response.StatusCode != test.status {
+				t.Errorf("Handler() status = %d, want %d", response.StatusCode, test.status)
+			}
+			if test.status == http.StatusForbidden && !strings.Contains(response.Body, "not permitted") {
+				t.Errorf("Handler() body = %q", response.Body)
+			}
+			if !strings.Contains(logs.String(), test.hint) {
+				t.Errorf("logs don't mention %q:\n%s", test.hint, logs)
+			}
+		})
+	}
+}
+
+func TestRequiredPermission(t *testing.T) {
+	denied := &smithy.GenericAPIError{Code: "AccessDenied"}
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{&smithy.OperationError{ServiceID: "S3", OperationName: "PutObject", Err: denied}, "s3:PutObject"},
+		{&smithy.OperationError{ServiceID: "S3", OperationName: "UploadPart", Err: denied}, "s3:PutObject"},
+		{&smithy.OperationError{ServiceID: "S3", OperationName: "HeadObject", Err: denied}, "s3:GetObject"},
+		{&smithy.OperationError{ServiceID: "S3", OperationName: "CopyObject", Err: denied}, "s3:GetObject and s3:PutObject"},
+		{&smithy.OperationError{ServiceID: "S3", OperationName: "PutBucketPolicy", Err: denied}, "s3:PutBucketPolicy"},
+		{denied, "the required S3 permissions"},
+	}
+	for _, test := range tests {
+		if got := requiredPermission(test.err); got != test.want {
+			t.Errorf("requiredPermission(%v) = %q, want %q", test.err, got, test.want)
+		}
+		if !isAccessDenied(test.err) {
+			t.Errorf("isAccessDenied(%v) = false", test.err)
+		}
+	}
+	if isAccessDenied(errors.New("AccessDenied")) || isAccessDenied(&smithy.GenericAPIError{Code: "NoSuchBucket"}) {
+		t.Error("isAccessDenied() matched another error")
+	}
+}
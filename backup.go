@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// ObjectExists reports whether a key exists in a bucket
+func (basics BucketBasics) ObjectExists(bucketName string, fileName string) (bool, error) {
+	_, err := basics.S3Client.HeadObject(context.TODO(), &s3.HeadObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(fileName),
+	})
+	var notFound *types.NotFound
+	if errors.As(err, &notFound) {
+		return false, nil
+	}
+	if err != nil {
+		log.Printf("Couldn't check for %v:%v. Here's why: %v\n", bucketName, fileName, err)
+		return false, err
+	}
+	return true, nil
+}
+
+// BackupExisting copies the current object at a key to a timestamped key under the
+// backup prefix, so overwriting it in a non-versioned bucket doesn't lose it.
+// Keys that don't exist yet are left alone.
+func (basics BucketBasics) BackupExisting(bucketName string, fileName string) error {
+	exists, err := basics.ObjectExists(bucketName, fileName)
+	if err != nil || !exists {
+		return err
+	}
+
+	backupName := basics.Config.BackupPrefix + fileName + "." + time.Now().UTC().Format("20060102-150405.000000000")
+	return basics.CopyObject(bucketName, fileName, bucketName, backupName)
+}
+
+// copySource returns the CopySource of an object, which for access points takes
+// the form <access point ARN>/object/<key>
+func copySource(bucketName string, fileName string) string {
+	if arn.IsARN(bucketName) {
+		return url.PathEscape(bucketName + "/object/" + fileName)
+	}
+	return url.PathEscape(bucketName + "/" + fileName)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestBackupBeforeOverwrite(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing bool
+		calls    []string
+	}{
+		{name: "existing key", existing: true, calls: []string{"HeadObject", "HeadObject", "CopyObject", "PutObject"}},
+		{name: "new key", existing: false, calls: []string{"HeadObject", "PutObject"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := newFakeS3(t)
+			if test.existing {
+				fake.put("bucket", "docs/report.txt", []byte("previous version"), nil)
+			}
+			// The backup must hold the previous version when the overwrite arrives
+			fake.Before = func(operation string, bucket string, key string) {
+				if operation == "PutObject" && test.existing && len(backups(fake)) != 1 {
+					t.Error("object overwritten before it was backed up")
+				}
+			}
+			basics := fake.basics(Config{BackupPrefix: "backups/", MultipartThreshold: 1 << 20})
+			if err := basics.BackupExisting("bucket", "docs/report.txt"); err != nil {
+				t.Fatal(err)
+			}
+			if err := basics.UploadFileToS3("bucket", "docs/report.txt", []byte("new version"), UploadOptions{}); err != nil {
+				t.Fatal(err)
+			}
+
+			if !slices.Equal(fake.calls, test.calls) {
+				t.Errorf("calls = %v, want %v", fake.calls, test.calls)
+			}
+			if data, _, _ := fake.object("bucket", "docs/report.txt"); string(data) != "new version" {
+				t.Errorf("object holds %q", data)
+			}
+			found := backups(fake)
+			if !test.existing {
+				if len(found) != 0 {
+					t.Errorf("backed up a new key to %v", found)
+				}
+				return
+			}
+			if len(found) != 1 || !strings.HasPrefix(found[0], "backups/docs/report.txt.") {
+				t.Fatalf("backups = %v", found)
+			}
+			if data, _, _ := fake.object("bucket", found[0]); string(data) != "previous version" {
+				t.Errorf("backup holds %q, want the previous version", data)
+			}
+		})
+	}
+}
+
+// backups returns the backup keys in the test bucket
+func backups(fake *fakeS3) []string {
+	var keys []string
+	for _, key := range fake.keys("bucket") {
+		if strings.HasPrefix(key, "backups/") {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func TestUploadBackupOnOverwrite(t *testing.T) {
+	tests := []struct {
+		enabled string
+		heads   int
+	}{
+		{enabled: "true", heads: 1},
+		{enabled: "false", heads: 0},
+	}
+	for _, test := range tests {
+		t.Run(test.enabled, func(t *testing.T) {
+			t.Setenv("S3_UPLOAD_BACKUP_ON_OVERWRITE", test.enabled)
+			fake := newFakeS3(t)
+			upload(t, nil, "first upload")
+			if got := fake.count("HeadObject"); got != test.heads {
+				t.Errorf("HeadObject called %d times, want %d", got, test.heads)
+			}
+			if got := fake.count("CopyObject"); got != 0 {
+				t.Errorf("new key backed up %d times", got)
+			}
+		})
+	}
+}
+
+func TestCopySource(t *testing.T) {
+	tests := []struct {
+		bucket, key, want string
+	}{
+		{"bucket", "docs/a b.txt", "bucket%2Fdocs%2Fa%20b.txt"},
+		{"arn:aws:s3:ap-south-1:123456789012:accesspoint/uploads", "a.txt", "arn:aws:s3:ap-south-1:123456789012:accesspoint%2Fuploads%2Fobject%2Fa.txt"},
+	}
+	for _, test := range tests {
+		if got := copySource(test.bucket, test.key); got != test.want {
+			t.Errorf("copySource(%q, %q) = %q, want %q", test.bucket, test.key, got, test.want)
+		}
+	}
+}
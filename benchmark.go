@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/klauspost/compress/zstd"
+)
+
+// maxBenchmarkSize bounds the body ?action=benchmark compresses, since every level
+// runs within one invocation
+const maxBenchmarkSize = 8 << 20
+
+// benchmarkResponse compares the configured compressor's levels on one body
+type benchmarkResponse struct {
+	Algorithm    string           `json:"algorithm"`
+	OriginalSize int              `json:"originalSize"`
+	Levels       []benchmarkLevel `json:"levels"`
+}
+
+// benchmarkLevel is the outcome of compressing the body at one level
+type benchmarkLevel struct {
+	Level        string  `json:"level"`
+	Size         int     `json:"size"`
+	Ratio        float64 `json:"ratio"`
+	Milliseconds float64 `json:"milliseconds"`
+}
+
+// benchmarkCompressor compresses data at one named level
+type benchmarkCompressor struct {
+	level    string
+	compress func(data []byte) ([]byte, error)
+}
+
+// benchmarkCompressors lists the levels worth comparing for an algorithm
+func benchmarkCompressors(algorithm string) []benchmarkCompressor {
+	if algorithm == "gzip" {
+		var compressors []benchmarkCompressor
+		for _, level := range []int{gzip.BestSpeed, gzip.DefaultCompression, gzip.BestCompression} {
+			level := level
+			name := fmt.Sprint(level)
+			if level == gzip.DefaultCompression {
+				name = "default"
+			}
+			compressors = append(compressors, benchmarkCompressor{name, func(data []byte) ([]byte, error) {
+				return compressGzipLevel(data, level)
+			}})
+		}
+		return compressors
+	}
+
+	var compressors []benchmarkCompressor
+	for _, level := range []zstd.EncoderLevel{zstd.SpeedFastest, zstd.SpeedDefault, zstd.SpeedBetterCompression, zstd.SpeedBestCompression} {
+		level := level
+		compressors = append(compressors, benchmarkCompressor{level.String(), func(data []byte) ([]byte, error) {
+			return compressZstd(data, level)
+		}})
+	}
+	return compressors
+}
+
+// compressGzipLevel compresses data using gzip at the given level
+func compressGzipLevel(data []byte, level int) ([]byte, error) {
+	var buf bytes.Buffer
+	writer, err := gzip.NewWriterLevel(&buf, level)
+	if err != nil {
+		return nil, fmt.Errorf("gzip compression initialization error: %v", err)
+	}
+	if _, err := writer.Write(data); err != nil {
+		return nil, fmt.Errorf("gzip compression error: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("gzip compression error: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// handleBenchmark serves ?action=benchmark: it compresses the request body at
+// several levels of the compressor configured for its content type and returns the
+// sizes and times, to help tune S3_UPLOAD_COMPRESSION_LEVEL. Content types stored
+// uncompressed are benchmarked with zstd. Nothing is uploaded.
+func handleBenchmark(request events.APIGatewayProxyRequest, appCfg Config) events.APIGatewayProxyResponse {
+	if !appCfg.Benchmark {
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusNotFound}
+	}
+
+	data, err := requestBody(request)
+	if err != nil {
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusBadRequest}
+	}
+	if len(data) > maxBenchmarkSize {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusRequestEntityTooLarge,
+			Body:       fmt.Sprintf("Benchmark takes bodies of at most %d bytes.", maxBenchmarkSize),
+		}
+	}
+
+	algorithm := appCfg.compressionFor(headerValue(request.Headers, "Content-Type"), len(data))
+	if algorithm == "none" {
+		algorithm = "zstd"
+	}
+	response := benchmarkResponse{Algorithm: algorithm, OriginalSize: len(data)}
+	for _, compressor := range benchmarkCompressors(algorithm) {
+		start := time.Now()
+		compressed, err := compressor.compress(data)
+		if err != nil {
+			return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}
+		}
+		result := benchmarkLevel{
+			Level:        compressor.level,
+			Size:         len(compressed),
+			Milliseconds: milliseconds(time.Since(start)),
+		}
+		if len(compressed) > 0 {
+			result.Ratio = float64(len(data)) / float64(len(compressed))
+		}
+		response.Levels = append(response.Levels, result)
+	}
+
+	body, err := json.Marshal(response)
+	if err != nil {
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}
+	}
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(body),
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestHandleBenchmark(t *testing.T) {
+	body := strings.Repeat("benchmark me, benchmark me again. ", 1000)
+	tests := []struct {
+		name        string
+		contentType string
+		env         map[string]string
+		algorithm   string
+		levels      []string
+	}{
+		{
+			name:        "zstd",
+			contentType: "text/plain",
+			algorithm:   "zstd",
+			levels:      []string{"fastest", "default", "better", "best"},
+		},
+		{
+			name:        "gzip",
+			contentType: "text/csv",
+			env:         map[string]string{"S3_UPLOAD_COMPRESSION_MAP": "text/csv=gzip"},
+			algorithm:   "gzip",
+			levels:      []string{"1", "default", "9"},
+		},
+		{
+			name:        "stored uncompressed",
+			contentType: "image/png",
+			env:         map[string]string{"S3_UPLOAD_COMPRESSION_MAP": "image/png=none"},
+			algorithm:   "zstd",
+			levels:      []string{"fastest", "default", "better", "best"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			env := map[string]string{"S3_UPLOAD_BENCHMARK": "true"}
+			for name, value := range test.env {
+				env[name] = value
+			}
+			response := handleBenchmark(events.APIGatewayProxyRequest{
+				Headers: map[string]string{"Content-Type": test.contentType},
+				Body:    body,
+			}, testConfig(t, env))
+			if response.StatusCode != http.StatusOK {
+				t.Fatalf("handleBenchmark() = %d %q", response.StatusCode, response.Body)
+			}
+			var comparison benchmarkResponse
+			if err := json.Unmarshal([]byte(response.Body), &comparison); err != nil {
+				t.Fatalf("response %q isn't JSON: %v", response.Body, err)
+			}
+			if comparison.Algorithm != test.algorithm || comparison.OriginalSize != len(body) {
+				t.Errorf("benchmark of %s over %d bytes, want %s over %d", comparison.Algorithm, comparison.OriginalSize, test.algorithm, len(body))
+			}
+			if len(comparison.Levels) != len(test.levels) {
+				t.Fatalf("levels = %+v, want %v", comparison.Levels, test.levels)
+			}
+			for i, level := range comparison.Levels {
+				if level.Level != test.levels[i] {
+					t.Errorf("level %d = %q, want %q", i, level.Level, test.levels[i])
+				}
+				// Repetitive text shrinks at every level, so each ratio is above 1
+				if level.Size <= 0 || level.Size >= len(body) || level.Ratio != float64(len(body))/float64(level.Size) || level.Milliseconds < 0 {
+					t.Errorf("level %q = %+v", level.Level, level)
+				}
+			}
+		})
+	}
+}
+
+func TestHandleBenchmarkRejects(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled string
+		request events.APIGatewayProxyRequest
+		status  int
+	}{
+		{name: "disabled by default", request: events.APIGatewayProxyRequest{Body: "data"}, status: http.StatusNotFound},
+		{name: "disabled", enabled: "false", request: events.APIGatewayProxyRequest{Body: "data"}, status: http.StatusNotFound},
+		{name: "too large", enabled: "true", request: events.APIGatewayProxyRequest{Body: strings.Repeat("a", maxBenchmarkSize+1)}, status: http.StatusRequestEntityTooLarge},
+		{name: "invalid base64", enabled: "true", request: events.APIGatewayProxyRequest{Body: "not base64!", IsBase64Encoded: true}, status: http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			env := map[string]string{}
+			if test.enabled != "" {
+				env["S3_UPLOAD_BENCHMARK"] = test.enabled
+			}
+			if response := handleBenchmark(test.request, testConfig(t, env)); response.StatusCode != test.status {
+				t.Errorf("handleBenchmark() = %d %q, want %d", response.StatusCode, response.Body, test.status)
+			}
+		})
+	}
+}
+
+func TestHandlerBenchmark(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled string
+		status  int
+	}{
+		{name: "disabled", enabled: "false", status: http.StatusNotFound},
+		{name: "enabled", enabled: "true", status: http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("S3_UPLOAD_BENCHMARK", test.enabled)
+			fake := newFakeS3(t)
+			response, err := Handler(t.Context(), events.APIGatewayProxyRequest{
+				HTTPMethod:            "POST",
+				Headers:               map[string]string{"Content-Type": "text/plain"},
+				QueryStringParameters: map[string]string{"action": "benchmark"},
+				Body:                  "benchmark through the handler",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response.StatusCode != test.status {
+				t.Errorf("Handler() = %d %q, want %d", response.StatusCode, response.Body, test.status)
+			}
+			// A benchmark never stores anything, enabled or not
+			if len(fake.calls) != 0 {
+				t.Errorf("benchmark made S3 calls %v", fake.calls)
+			}
+		})
+	}
+}
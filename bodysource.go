@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// ErrNotZstd is returned when a body sent with Content-Encoding: zstd isn't a zstd stream
+var ErrNotZstd = errors.New("body is not zstd-compressed")
+
+// zstdMagic starts every Zstandard frame
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// BodyPart is a single file yielded by a BodySource
+type BodyPart struct {
+	Reader      io.Reader
+	Name        string
+	ContentType string
+	// PreCompressed is set when the client already zstd-compressed the content
+	PreCompressed bool
+}
+
+// BodySource yields the files carried by a request body
+type BodySource interface {
+	// Next returns the next file, or io.EOF once the body is exhausted. The
+	// previous part's Reader must not be used after calling Next.
+	Next() (*BodyPart, error)
+}
+
+// uploadFile is a single file extracted from an incoming request
+type uploadFile struct {
+	Name        string
+	ContentType string
+	Data        []byte
+	// PreCompressed is set when the client already zstd-compressed Data
+	PreCompressed bool
+}
+
+// newBodySource picks the source for a request: multipart/form-data bodies yield
+// one file per file part, text/uri-list bodies one file per URL fetched, JSON
+// envelopes the file they carry, and any other body is a single file. Base64-encoded
+// bodies from API Gateway are decoded as they are read.
+func newBodySource(request events.APIGatewayProxyRequest, cfg Config) (BodySource, error) {
+	body := requestBodyReader(request)
+
+	contentType := headerValue(request.Headers, "Content-Type")
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	switch {
+	case err != nil:
+	case mediaType == "multipart/form-data":
+		if params["boundary"] == "" {
+			return nil, errors.New("multipart body is missing a boundary")
+		}
+		return newMultipartSource(body, params["boundary"], cfg.MaxFiles), nil
+	case mediaType == uriListMediaType:
+		if len(cfg.FetchAllowlist) == 0 {
+			return nil, ErrFetchNotAllowed
+		}
+		return newFetchSource(body, cfg)
+	case mediaType == envelopeMediaType, mediaType == "application/json" && cfg.JSONEnvelope:
+		return &envelopeSource{body: body}, nil
+	}
+
+	return &singleSource{part: &BodyPart{
+		Reader:        body,
+		ContentType:   contentType,
+		PreCompressed: strings.EqualFold(headerValue(request.Headers, "Content-Encoding"), "zstd"),
+	}}, nil
+}
+
+// singleSource yields a whole request body as one file
+type singleSource struct {
+	part *BodyPart
+}
+
+func (src *singleSource) Next() (*BodyPart, error) {
+	part := src.part
+	if part == nil {
+		return nil, io.EOF
+	}
+	src.part = nil
+
+	// Clients may compress the body themselves to save Lambda CPU
+	if part.PreCompressed {
+		reader := bufio.NewReader(part.Reader)
+		magic, _ := reader.Peek(len(zstdMagic))
+		if !bytes.Equal(magic, zstdMagic) {
+			return nil, ErrNotZstd
+		}
+		part.Reader = reader
+	}
+	return part, nil
+}
+
+// requestFiles reads every file carried by the request into memory
+func requestFiles(request events.APIGatewayProxyRequest, cfg Config) ([]uploadFile, error) {
+	src, err := newBodySource(request, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []uploadFile
+	seen := map[string]bool{}
+	for {
+		part, err := src.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// Files sharing a name would be stored under the same key
+		name := part.Name
+		if name != "" && seen[name] {
+			if cfg.DuplicateNames == "reject" {
+				return nil, ErrDuplicateName
+			}
+			name = uniqueName(name, seen)
+		}
+		seen[name] = true
+
+		data, err := io.ReadAll(part.Reader)
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, ErrTruncatedBody
+		}
+		if err != nil {
+			return nil, fmt.Errorf("request body read error: %w", err)
+		}
+		files = append(files, uploadFile{
+			Name:          name,
+			ContentType:   part.ContentType,
+			Data:          data,
+			PreCompressed: part.PreCompressed,
+		})
+	}
+}
+
+// requestBodyReader streams the raw request body, decoding it if API Gateway base64-encoded it
+func requestBodyReader(request events.APIGatewayProxyRequest) io.Reader {
+	body := io.Reader(strings.NewReader(request.Body))
+	if request.IsBase64Encoded {
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	}
+	return body
+}
+
+// requestBody returns the raw request body, decoding it if API Gateway base64-encoded it
+func requestBody(request events.APIGatewayProxyRequest) ([]byte, error) {
+	body, err := io.ReadAll(requestBodyReader(request))
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64 body: %v", err)
+	}
+	return body, nil
+}
+
+// headerValue looks up a request header case-insensitively
+func headerValue(headers map[string]string, name string) string {
+	if value, ok := headers[name]; ok {
+		return value
+	}
+	for key, value := range headers {
+		if strings.EqualFold(key, name) {
+			return value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestRequestFilesPreCompressed(t *testing.T) {
+	compressed, err := compressZstd([]byte("compressed by the client"), zstd.SpeedFastest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name          string
+		encoding      string
+		body          []byte
+		preCompressed bool
+		err           error
+	}{
+		{name: "zstd body", encoding: "zstd", body: compressed, preCompressed: true},
+		{name: "encoding case", encoding: "ZSTD", body: compressed, preCompressed: true},
+		{name: "plain body labelled zstd", encoding: "zstd", body: []byte("not compressed at all"), err: ErrNotZstd},
+		{name: "body shorter than the magic", encoding: "zstd", body: compressed[:2], err: ErrNotZstd},
+		{name: "zstd body without the header", body: compressed},
+		{name: "plain body", body: []byte("not compressed at all")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			files, err := requestFiles(events.APIGatewayProxyRequest{
+				Headers: map[string]string{"Content-Encoding": test.encoding},
+				Body:    string(test.body),
+			}, Config{})
+			if !errors.Is(err, test.err) {
+				t.Fatalf("requestFiles() error = %v, want %v", err, test.err)
+			}
+			if test.err != nil {
+				return
+			}
+			if len(files) != 1 || files[0].PreCompressed != test.preCompressed || !bytes.Equal(files[0].Data, test.body) {
+				t.Errorf("requestFiles() = %+v", files)
+			}
+		})
+	}
+}
+
+func TestUploadPreCompressed(t *testing.T) {
+	content := bytes.Repeat([]byte("compressed by the client "), 1000)
+	compressed, err := compressZstd(content, zstd.SpeedBestCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := newFakeS3(t)
+	upload(t, map[string]string{"Content-Encoding": "zstd"}, string(compressed))
+
+	bucket := fake.bucketNames()[0]
+	data, metadata, _ := fake.object(bucket, fake.keys(bucket)[0])
+	if metadata["compression"] != "zstd" || metadata["compressed-by"] != "client" {
+		t.Errorf("metadata = %v, want zstd compressed by the client", metadata)
+	}
+	// The client's stream is stored as-is rather than compressed again
+	stored, err := decryptPayload(data, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stored, compressed) {
+		t.Error("stored stream differs from the one the client sent")
+	}
+	if decoded, err := decodeObject(data, metadata); err != nil || !bytes.Equal(decoded, content) {
+		t.Errorf("decodeObject() = %d bytes, %v", len(decoded), err)
+	}
+}
+
+func TestUploadRejectsMislabelledZstd(t *testing.T) {
+	fake := newFakeS3(t)
+	response := handle(t, map[string]string{"Content-Encoding": "zstd"}, "not compressed at all")
+	if response.StatusCode != http.StatusBadRequest {
+		t.Errorf("Handler() status = %d, want %d", response.StatusCode, http.StatusBadRequest)
+	}
+	if fake.count("PutObject") != 0 {
+		t.Error("mislabelled body was stored")
+	}
+}
+
+// sourcePart is what a BodySource yielded for one file
+type sourcePart struct {
+	name, contentType, data string
+}
+
+// readSource drains a BodySource, reading every part before moving to the next
+func readSource(t *testing.T, src BodySource) []sourcePart {
+	t.Helper()
+	var parts []sourcePart
+	for {
+		part, err := src.Next()
+		if err == io.EOF {
+			return parts
+		}
+		if err != nil {
+			t.Fatalf("Next() error = %v", err)
+		}
+		data, err := io.ReadAll(part.Reader)
+		if err != nil {
+			t.Fatalf("reading %q: %v", part.Name, err)
+		}
+		parts = append(parts, sourcePart{part.Name, part.ContentType, string(data)})
+	}
+}
+
+func TestBodySources(t *testing.T) {
+	form, formType := multipartBody(t,
+		testFile{name: "a.txt", contentType: "text/plain", data: "first file"},
+		testFile{name: "dir/b.json", contentType: "application/json", data: `{"second": true}`},
+		testFile{name: "c.bin", data: "\x00\x01binary"},
+	)
+	formParts := []sourcePart{
+		{"a.txt", "text/plain", "first file"},
+		{"b.json", "application/json", `{"second": true}`},
+		{"c.bin", "", "\x00\x01binary"},
+	}
+	tests := []struct {
+		name    string
+		request events.APIGatewayProxyRequest
+		want    []sourcePart
+	}{
+		{
+			name:    "raw body",
+			request: events.APIGatewayProxyRequest{Headers: map[string]string{"Content-Type": "text/csv"}, Body: "a,b\n1,2\n"},
+			want:    []sourcePart{{"", "text/csv", "a,b\n1,2\n"}},
+		},
+		{
+			name: "base64 body",
+			request: events.APIGatewayProxyRequest{
+				Headers:         map[string]string{"content-type": "text/csv"},
+				Body:            base64.StdEncoding.EncodeToString([]byte("a,b\n1,2\n")),
+				IsBase64Encoded: true,
+			},
+			want: []sourcePart{{"", "text/csv", "a,b\n1,2\n"}},
+		},
+		{
+			name:    "empty body",
+			request: events.APIGatewayProxyRequest{},
+			want:    []sourcePart{{"", "", ""}},
+		},
+		{
+			name:    "multipart body",
+			request: events.APIGatewayProxyRequest{Headers: map[string]string{"Content-Type": formType}, Body: form},
+			want:    formParts,
+		},
+		{
+			name: "base64 multipart body",
+			request: events.APIGatewayProxyRequest{
+				Headers:         map[string]string{"Content-Type": formType},
+				Body:            base64.StdEncoding.EncodeToString([]byte(form)),
+				IsBase64Encoded: true,
+			},
+			want: formParts,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			src, err := newBodySource(test.request, Config{MaxFiles: 10})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := readSource(t, src)
+			if len(got) != len(test.want) {
+				t.Fatalf("got %d parts %+v, want %+v", len(got), got, test.want)
+			}
+			for i := range got {
+				if got[i] != test.want[i] {
+					t.Errorf("part %d = %+v, want %+v", i, got[i], test.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestBodySourceMissingBoundary(t *testing.T) {
+	_, err := newBodySource(events.APIGatewayProxyRequest{
+		Headers: map[string]string{"Content-Type": "multipart/form-data"},
+		Body:    "--x\r\n",
+	}, Config{})
+	if err == nil {
+		t.Error("newBodySource() accepted a multipart body without a boundary")
+	}
+}
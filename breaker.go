@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/aws/smithy-go"
+)
+
+// s3Breaker is shared by invocations in the same warm Lambda container, so a
+// sustained S3 outage short-circuits requests instead of burning their budget
+var s3Breaker = &circuitBreaker{}
+
+// circuitBreaker opens after a run of consecutive failures. Once the cooldown has
+// passed a single probe request is let through; its outcome closes the breaker
+// again or restarts the cooldown. A probe that never reports back is replaced by
+// a new one after another cooldown.
+type circuitBreaker struct {
+	mu       sync.Mutex
+	failures int
+	open     bool
+	openedAt time.Time
+	probedAt time.Time
+}
+
+// allow reports whether a request may call S3
+func (b *circuitBreaker) allow(cfg Config, now time.Time) bool {
+	if cfg.BreakerThreshold <= 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.open {
+		return true
+	}
+	if now.Sub(b.openedAt) < cfg.BreakerCooldown {
+		return false
+	}
+	if !b.probedAt.IsZero() && now.Sub(b.probedAt) < cfg.BreakerCooldown {
+		return false
+	}
+	b.probedAt = now
+	return true
+}
+
+// success records a successful S3 interaction and closes the breaker
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	b.open = false
+	b.probedAt = time.Time{}
+}
+
+// record reports the outcome of an S3 interaction. Only outages count towards
+// opening the breaker; client errors such as a missing key or a denied permission
+// show S3 is answering, so they close it like a success.
+func (b *circuitBreaker) record(cfg Config, err error, now time.Time) {
+	if err != nil && isOutage(err) {
+		b.failure(cfg, now)
+		return
+	}
+	b.success()
+}
+
+// throttlingCodes are the error codes AWS services answer with while shedding load
+var throttlingCodes = map[string]bool{
+	"SlowDown":                               true,
+	"Throttling":                             true,
+	"ThrottlingException":                    true,
+	"RequestLimitExceeded":                   true,
+	"TooManyRequestsException":               true,
+	"ProvisionedThroughputExceededException": true,
+}
+
+// isOutage reports whether an error means S3 is failing rather than refusing the
+// request: a 5xx or throttling response, or an AWS call that got no response at all.
+// Errors raised locally, e.g. by the rate limiter or local storage, aren't outages.
+func isOutage(err error) bool {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && throttlingCodes[apiErr.ErrorCode()] {
+		return true
+	}
+	var response interface{ HTTPStatusCode() int }
+	if errors.As(err, &response) {
+		status := response.HTTPStatusCode()
+		return status >= 500 || status == 429
+	}
+	var opErr *smithy.OperationError
+	return errors.As(err, &opErr) && !errors.Is(err, ErrRateLimited)
+}
+
+// failure records a failed S3 interaction, opening the breaker at the threshold
+func (b *circuitBreaker) failure(cfg Config, now time.Time) {
+	if cfg.BreakerThreshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if b.open || b.failures >= cfg.BreakerThreshold {
+		b.open = true
+		b.openedAt = now
+		b.probedAt = time.Time{}
+	}
+}
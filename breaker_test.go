@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// s3Error builds the error the SDK returns for an S3 error response
+func s3Error(operation string, status int, err error) error {
+	return &smithy.OperationError{
+		ServiceID:     "S3",
+		OperationName: operation,
+		Err: &awshttp.ResponseError{
+			ResponseError: &smithyhttp.ResponseError{
+				Response: &smithyhttp.Response{Response: &http.Response{StatusCode: status}},
+				Err:      err,
+			},
+		},
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	cfg := Config{BreakerThreshold: 3, BreakerCooldown: time.Minute}
+	outage := s3Error("PutObject", http.StatusInternalServerError, &smithy.GenericAPIError{Code: "InternalError"})
+	start := time.Now()
+
+	breaker := &circuitBreaker{}
+	for i := 0; i < cfg.BreakerThreshold-1; i++ {
+		breaker.record(cfg, outage, start)
+	}
+	if !breaker.allow(cfg, start) {
+		t.Fatal("breaker opened below the threshold")
+	}
+	breaker.record(cfg, outage, start)
+	if breaker.allow(cfg, start.Add(cfg.BreakerCooldown/2)) {
+		t.Fatal("breaker let a request through during the cooldown")
+	}
+
+	probe := start.Add(cfg.BreakerCooldown)
+	if !breaker.allow(cfg, probe) {
+		t.Fatal("breaker didn't let a probe through after the cooldown")
+	}
+	if breaker.allow(cfg, probe.Add(time.Second)) {
+		t.Fatal("breaker let a second request through while probing")
+	}
+
+	// A failed probe restarts the cooldown
+	breaker.record(cfg, outage, probe)
+	if breaker.allow(cfg, probe.Add(time.Second)) {
+		t.Fatal("breaker closed after a failed probe")
+	}
+
+	// A successful probe closes it
+	next := probe.Add(cfg.BreakerCooldown)
+	if !breaker.allow(cfg, next) {
+		t.Fatal("breaker didn't probe again after the restarted cooldown")
+	}
+	breaker.record(cfg, nil, next)
+	for i := 0; i < 10; i++ {
+		if !breaker.allow(cfg, next) {
+			t.Fatal("breaker stayed open after a successful probe")
+		}
+	}
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	cfg := Config{BreakerThreshold: 0, BreakerCooldown: time.Minute}
+	outage := s3Error("PutObject", http.StatusServiceUnavailable, &smithy.GenericAPIError{Code: "ServiceUnavailable"})
+	breaker := &circuitBreaker{}
+	for i := 0; i < 100; i++ {
+		breaker.record(cfg, outage, time.Now())
+	}
+	if !breaker.allow(cfg, time.Now()) {
+		t.Fatal("disabled breaker opened")
+	}
+}
+
+func TestIsOutage(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"internal error", s3Error("PutObject", 500, &smithy.GenericAPIError{Code: "InternalError"}), true},
+		{"slow down", s3Error("PutObject", 503, &smithy.GenericAPIError{Code: "SlowDown"}), true},
+		{"too many requests", s3Error("PutObject", 429, &smithy.GenericAPIError{Code: "TooManyRequests"}), true},
+		{"throttling code", &smithy.GenericAPIError{Code: "ThrottlingException"}, true},
+		{"no response", &smithy.OperationError{ServiceID: "S3", OperationName: "PutObject", Err: errors.New("dial tcp: connection refused")}, true},
+		{"missing key", s3Error("GetObject", 404, &types.NoSuchKey{}), false},
+		{"access denied", s3Error("PutObject", 403, &smithy.GenericAPIError{Code: "AccessDenied"}), false},
+		{"bucket name taken", s3Error("CreateBucket", 409, &types.BucketAlreadyExists{}), false},
+		{"precondition failed", s3Error("PutObject", 412, &smithy.GenericAPIError{Code: "PreconditionFailed"}), false},
+		{"rate limited locally", &smithy.OperationError{ServiceID: "S3", OperationName: "PutObject", Err: ErrRateLimited}, false},
+		{"checksum mismatch", ErrChecksumMismatch, false},
+		{"expired", fmt.Errorf("download: %w", ErrObjectExpired), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := isOutage(test.err); got != test.want {
+				t.Errorf("isOutage(%v) = %v, want %v", test.err, got, test.want)
+			}
+		})
+	}
+}
+
+func TestClientErrorsDontOpenBreaker(t *testing.T) {
+	cfg := Config{BreakerThreshold: 2, BreakerCooldown: time.Minute}
+	breaker := &circuitBreaker{}
+	missing := s3Error("GetObject", 404, &types.NoSuchKey{})
+	for i := 0; i < 10; i++ {
+		breaker.record(cfg, missing, time.Now())
+	}
+	if !breaker.allow(cfg, time.Now()) {
+		t.Fatal("downloads of a missing key opened the breaker")
+	}
+
+	// A client error between outages breaks the run of consecutive failures
+	outage := s3Error("PutObject", 500, &smithy.GenericAPIError{Code: "InternalError"})
+	breaker.record(cfg, outage, time.Now())
+	breaker.record(cfg, missing, time.Now())
+	breaker.record(cfg, outage, time.Now())
+	if !breaker.allow(cfg, time.Now()) {
+		t.Fatal("non-consecutive outages opened the breaker")
+	}
+}
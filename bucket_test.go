@@ -0,0 +1,112 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+func TestCreateBucketOwnershipControls(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      Config
+		enforced bool
+	}{
+		{name: "default", cfg: Config{}, enforced: true},
+		{name: "ACLs requested", cfg: Config{EnableACLs: true}, enforced: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := newFakeS3(t)
+			if err := fake.basics(test.cfg).CreateBucket("uploads", "ap-south-1"); err != nil {
+				t.Fatal(err)
+			}
+			if calls := fake.count("PutBucket:ownershipControls"); calls != map[bool]int{true: 1, false: 0}[test.enforced] {
+				t.Fatalf("PutBucketOwnershipControls called %d times", calls)
+			}
+			controls := fake.bucketConfig("uploads", "ownershipControls")
+			if test.enforced && !strings.Contains(controls, "<ObjectOwnership>BucketOwnerEnforced</ObjectOwnership>") {
+				t.Errorf("ownership controls = %s, want BucketOwnerEnforced", controls)
+			}
+		})
+	}
+}
+
+func TestCreateBucketOwnershipControlsFailure(t *testing.T) {
+	fake := newFakeS3(t)
+	fake.Fail = func(operation string, bucket string, key string) (int, string) {
+		if operation == "PutBucket:ownershipControls" {
+			return 403, "AccessDenied"
+		}
+		return 0, ""
+	}
+	if err := fake.basics(Config{}).CreateBucket("uploads", "ap-south-1"); err == nil {
+		t.Error("CreateBucket() succeeded though its ownership controls couldn't be applied")
+	}
+}
+
+func TestCreateBucketObjectLock(t *testing.T) {
+	tests := []struct {
+		name  string
+		mode  types.ObjectLockRetentionMode
+		days  int
+		rules []string
+	}{
+		{name: "governance", mode: types.ObjectLockRetentionModeGovernance, days: 30,
+			rules: []string{"<Mode>GOVERNANCE</Mode>", "<Days>30</Days>"}},
+		{name: "compliance", mode: types.ObjectLockRetentionModeCompliance, days: 365,
+			rules: []string{"<Mode>COMPLIANCE</Mode>", "<Days>365</Days>"}},
+		{name: "disabled"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := newFakeS3(t)
+			cfg := Config{ObjectLockMode: test.mode, ObjectLockDays: test.days}
+			if err := fake.basics(cfg).CreateBucket("uploads", "ap-south-1"); err != nil {
+				t.Fatal(err)
+			}
+			lock := fake.bucketConfig("uploads", "object-lock")
+			if test.mode == "" {
+				if fake.count("PutBucket:object-lock") != 0 || fake.bucketConfig("uploads", "objectLockEnabled") == "true" {
+					t.Errorf("object lock configured though disabled: %s", lock)
+				}
+				return
+			}
+			if enabled := fake.bucketConfig("uploads", "objectLockEnabled"); enabled != "true" {
+				t.Errorf("bucket created with object lock enabled = %q", enabled)
+			}
+			// The bucket must exist with Object Lock before its configuration is set
+			if create, put := slices.Index(fake.calls, "CreateBucket"), slices.Index(fake.calls, "PutBucket:object-lock"); put < create {
+				t.Errorf("calls = %v, want the lock configuration after bucket creation", fake.calls)
+			}
+			for _, rule := range append(test.rules, "<ObjectLockEnabled>Enabled</ObjectLockEnabled>") {
+				if !strings.Contains(lock, rule) {
+					t.Errorf("lock configuration %s is missing %s", lock, rule)
+				}
+			}
+		})
+	}
+}
+
+func TestObjectLockConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		ok   bool
+	}{
+		{name: "governance", env: map[string]string{"S3_UPLOAD_OBJECT_LOCK_MODE": "governance", "S3_UPLOAD_OBJECT_LOCK_DAYS": "7"}, ok: true},
+		{name: "compliance", env: map[string]string{"S3_UPLOAD_OBJECT_LOCK_MODE": "COMPLIANCE", "S3_UPLOAD_OBJECT_LOCK_DAYS": "36500"}, ok: true},
+		{name: "unknown mode", env: map[string]string{"S3_UPLOAD_OBJECT_LOCK_MODE": "LEGAL_HOLD", "S3_UPLOAD_OBJECT_LOCK_DAYS": "7"}},
+		{name: "missing period", env: map[string]string{"S3_UPLOAD_OBJECT_LOCK_MODE": "GOVERNANCE"}},
+		{name: "period too long", env: map[string]string{"S3_UPLOAD_OBJECT_LOCK_MODE": "GOVERNANCE", "S3_UPLOAD_OBJECT_LOCK_DAYS": "36501"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := configError(t, test.env); (err == nil) != test.ok {
+				t.Errorf("loadConfig() error = %v, want ok %v", err, test.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// bucketPolicyTemplates are the built-in S3_UPLOAD_BUCKET_POLICY policies.
+// tls-only denies every request not made over TLS.
+var bucketPolicyTemplates = map[string]string{
+	"tls-only": `{
+  "Version": "2012-10-17",
+  "Statement": [
+    {
+      "Sid": "DenyInsecureTransport",
+      "Effect": "Deny",
+      "Principal": "*",
+      "Action": "s3:*",
+      "Resource": ["arn:aws:s3:::{bucket}", "arn:aws:s3:::{bucket}/*"],
+      "Condition": {"Bool": {"aws:SecureTransport": "false"}}
+    }
+  ]
+}`,
+}
+
+// ApplyBucketPolicy attaches the configured bucket policy to a bucket, with
+// {bucket} replaced by its name
+func (basics BucketBasics) ApplyBucketPolicy(name string) error {
+	_, err := basics.S3Client.PutBucketPolicy(context.TODO(), &s3.PutBucketPolicyInput{
+		Bucket: aws.String(name),
+		Policy: aws.String(bucketPolicy(basics.Config.BucketPolicy, name)),
+	})
+	if err != nil {
+		log.Printf("Couldn't apply bucket policy to %v. Here's why: %v\n", name, err)
+	}
+	return err
+}
+
+// bucketPolicy renders a policy template for a bucket
+func bucketPolicy(template string, name string) string {
+	return strings.ReplaceAll(template, "{bucket}", name)
+}
+
+// validateBucketPolicy checks that a policy is a JSON object with statements, so a
+// malformed one fails at startup rather than on every bucket creation
+func validateBucketPolicy(policy string) error {
+	var document struct {
+		Statement json.RawMessage
+	}
+	if err := json.Unmarshal([]byte(bucketPolicy(policy, "bucket")), &document); err != nil {
+		return fmt.Errorf("S3_UPLOAD_BUCKET_POLICY is not valid JSON: %v", err)
+	}
+	if len(document.Statement) == 0 {
+		return fmt.Errorf("S3_UPLOAD_BUCKET_POLICY has no Statement")
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestCreateBucketPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		applied bool
+		tlsOnly bool
+	}{
+		{name: "none", applied: false},
+		{name: "tls-only template", env: map[string]string{"S3_UPLOAD_BUCKET_POLICY": "tls-only"}, applied: true, tlsOnly: true},
+		{
+			name: "custom",
+			env: map[string]string{"S3_UPLOAD_BUCKET_POLICY": `{"Version": "2012-10-17", "Statement": [{"Effect": "Deny", "Principal": "*",
+				"Action": "s3:DeleteObject", "Resource": "arn:aws:s3:::{bucket}/*"}]}`},
+			applied: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := newFakeS3(t)
+			if err := fake.basics(testConfig(t, test.env)).CreateBucket("uploads", "ap-south-1"); err != nil {
+				t.Fatal(err)
+			}
+			if !test.applied {
+				if puts := fake.count("PutBucket:policy"); puts != 0 {
+					t.Errorf("PutBucketPolicy called %d times without a policy", puts)
+				}
+				return
+			}
+			// The stored policy names the new bucket in place of {bucket}
+			stored := fake.bucketConfig("uploads", "policy")
+			var policy struct {
+				Statement []struct {
+					Condition map[string]map[string]string
+				}
+			}
+			if err := json.Unmarshal([]byte(stored), &policy); err != nil || len(policy.Statement) != 1 {
+				t.Fatalf("stored policy %q, want one statement: %v", stored, err)
+			}
+			if !strings.Contains(stored, `"arn:aws:s3:::uploads/*"`) || strings.Contains(stored, "{bucket}") {
+				t.Errorf("stored policy %s doesn't name the bucket", stored)
+			}
+			if test.tlsOnly && policy.Statement[0].Condition["Bool"]["aws:SecureTransport"] != "false" {
+				t.Errorf("policy condition = %v, want requests without TLS denied", policy.Statement[0].Condition)
+			}
+		})
+	}
+}
+
+func TestCreateBucketPolicyFailure(t *testing.T) {
+	fake := newFakeS3(t)
+	fake.Fail = func(operation string, bucket string, key string) (int, string) {
+		if operation == "PutBucket:policy" {
+			return 403, "AccessDenied"
+		}
+		return 0, ""
+	}
+	if err := fake.basics(testConfig(t, map[string]string{"S3_UPLOAD_BUCKET_POLICY": "tls-only"})).CreateBucket("uploads", "ap-south-1"); err == nil {
+		t.Error("CreateBucket() succeeded though the policy couldn't be applied")
+	}
+}
+
+func TestBucketPolicyConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		ok     bool
+	}{
+		{name: "unset", ok: true},
+		{name: "template", policy: "tls-only", ok: true},
+		{name: "custom", policy: `{"Statement": [{"Effect": "Allow"}]}`, ok: true},
+		{name: "unknown template", policy: "tls", ok: false},
+		{name: "malformed JSON", policy: `{"Statement": [`, ok: false},
+		{name: "not an object", policy: `["Statement"]`, ok: false},
+		{name: "no statements", policy: `{"Version": "2012-10-17"}`, ok: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := configError(t, map[string]string{"S3_UPLOAD_BUCKET_POLICY": test.policy})
+			if (err == nil) != test.ok {
+				t.Errorf("loadConfig() error = %v, want ok %v", err, test.ok)
+			}
+		})
+	}
+
+	// An invalid policy fails before any bucket is created, let alone given the policy
+	fake := newFakeS3(t)
+	t.Setenv("S3_UPLOAD_BUCKET_POLICY", `{"Statement": [`)
+	handle(t, map[string]string{"Content-Type": "text/plain"}, "never stored")
+	if len(fake.calls) != 0 {
+		t.Errorf("calls = %v, want none with an invalid policy", fake.calls)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// isBucketCreateRace reports whether CreateBucket failed only because another
+// invocation created the bucket first, or is still creating it
+func isBucketCreateRace(err error) bool {
+	var owned *types.BucketAlreadyOwnedByYou
+	if errors.As(err, &owned) {
+		return true
+	}
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == "OperationAborted"
+}
+
+// waitForBucket waits until a bucket another invocation is creating answers
+// HeadBucket, for at most BucketRaceWait
+func (basics BucketBasics) waitForBucket(name string) error {
+	waiter := s3.NewBucketExistsWaiter(basics.S3Client, func(o *s3.BucketExistsWaiterOptions) {
+		o.MinDelay = 100 * time.Millisecond
+		o.MaxDelay = time.Second
+	})
+	err := waiter.Wait(context.TODO(), &s3.HeadBucketInput{Bucket: aws.String(name)}, basics.Config.BucketRaceWait)
+	if err != nil {
+		log.Printf("Bucket %v created concurrently never became available. Here's why: %v\n", name, err)
+	}
+	return err
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+func TestIsBucketCreateRace(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{err: &types.BucketAlreadyOwnedByYou{}, want: true},
+		{err: &smithy.GenericAPIError{Code: "OperationAborted"}, want: true},
+		{err: fmt.Errorf("create failed: %w", &types.BucketAlreadyOwnedByYou{}), want: true},
+		// A bucket someone else owns is a real failure
+		{err: &types.BucketAlreadyExists{}},
+		{err: &smithy.GenericAPIError{Code: "AccessDenied"}},
+		{err: errors.New("OperationAborted")},
+		{err: nil},
+	}
+	for _, test := range tests {
+		if got := isBucketCreateRace(test.err); got != test.want {
+			t.Errorf("isBucketCreateRace(%v) = %v, want %v", test.err, got, test.want)
+		}
+	}
+}
+
+func TestCreateBucketRace(t *testing.T) {
+	const callers = 8
+	fake := newFakeS3(t)
+	// The first create is slow to land; the rest see it in progress until it does
+	var creates atomic.Int32
+	var landing atomic.Bool
+	fake.Before = func(operation string, bucket string, key string) {
+		if operation == "CreateBucket" && creates.Add(1) == 1 {
+			time.Sleep(150 * time.Millisecond)
+			landing.Store(true)
+		}
+	}
+	var aborted atomic.Int32
+	fake.Fail = func(operation string, bucket string, key string) (int, string) {
+		if operation == "CreateBucket" && !landing.Load() {
+			aborted.Add(1)
+			return http.StatusConflict, "OperationAborted"
+		}
+		return 0, ""
+	}
+
+	basics := fake.basics(Config{BucketRaceWait: 5 * time.Second})
+	errs := make([]error, callers)
+	var wg sync.WaitGroup
+	for i := range callers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = basics.CreateBucket("uploads", "ap-south-1")
+		}()
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("caller %d: CreateBucket() = %v", i, err)
+		}
+	}
+	if aborted.Load() == 0 {
+		t.Fatal("no caller raced the slow create")
+	}
+	// Callers that lost the race waited on the bucket rather than configuring it again
+	if heads := fake.count("HeadBucket"); heads < int(aborted.Load()) {
+		t.Errorf("HeadBucket called %d times for %d aborted creates", heads, aborted.Load())
+	}
+	if puts := fake.count("PutBucket:ownershipControls"); puts != 1 {
+		t.Errorf("ownership controls applied %d times, want once by the creator", puts)
+	}
+}
+
+func TestCreateBucketAlreadyOwned(t *testing.T) {
+	fake := newFakeS3(t)
+	basics := fake.basics(Config{BucketRaceWait: time.Second})
+	for i := range 2 {
+		if err := basics.CreateBucket("uploads", "ap-south-1"); err != nil {
+			t.Fatalf("CreateBucket() call %d = %v", i+1, err)
+		}
+	}
+}
+
+func TestCreateBucketRaceTimeout(t *testing.T) {
+	fake := newFakeS3(t)
+	// The concurrent create never lands
+	fake.Fail = func(operation string, bucket string, key string) (int, string) {
+		if operation == "CreateBucket" {
+			return http.StatusConflict, "OperationAborted"
+		}
+		return 0, ""
+	}
+	start := time.Now()
+	if err := fake.basics(Config{BucketRaceWait: 300 * time.Millisecond}).CreateBucket("uploads", "ap-south-1"); err == nil {
+		t.Error("CreateBucket() succeeded though the bucket never appeared")
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("CreateBucket() waited %v, want about the 300ms race wait", elapsed)
+	}
+}
+
+func TestBucketRaceWaitConfig(t *testing.T) {
+	if cfg := testConfig(t, nil); cfg.BucketRaceWait != 10*time.Second {
+		t.Errorf("BucketRaceWait = %v, want 10s", cfg.BucketRaceWait)
+	}
+	if err := configError(t, map[string]string{"S3_UPLOAD_BUCKET_RACE_WAIT": "0s"}); err == nil {
+		t.Error("loadConfig() accepted a zero race wait")
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"time"
+)
+
+// bundleIndexName is the first member of every bundle, listing the files after it
+const bundleIndexName = "index.json"
+
+// ErrBundleCorrupt is returned when a bundle's files don't match its index
+var ErrBundleCorrupt = errors.New("bundle does not match its index")
+
+// bundleIndex lists a bundle's files, so they can be found and checked on extraction
+type bundleIndex struct {
+	Created string        `json:"created"`
+	Files   []bundleEntry `json:"files"`
+}
+
+// bundleEntry describes one file in a bundle
+type bundleEntry struct {
+	Name        string `json:"name"`
+	ContentType string `json:"contentType,omitempty"`
+	Size        int    `json:"size"`
+	SHA256      string `json:"sha256"`
+}
+
+// bundleFiles packs a batch of files into a single tar archive, led by an index,
+// so many small files are stored as one object. The archive is compressed like
+// any other application/x-tar upload.
+func bundleFiles(files []uploadFile, now time.Time) (uploadFile, error) {
+	index := bundleIndex{Created: now.UTC().Format(time.RFC3339)}
+	for i, file := range files {
+		// Member names are plain file names, so extracting with tar can't escape its directory
+		name := path.Base(file.Name)
+		if file.Name == "" || name == "." || name == "/" || name == bundleIndexName {
+			name = fmt.Sprintf("file-%d", i+1)
+		}
+		sum := sha256.Sum256(file.Data)
+		index.Files = append(index.Files, bundleEntry{
+			Name:        name,
+			ContentType: file.ContentType,
+			Size:        len(file.Data),
+			SHA256:      hex.EncodeToString(sum[:]),
+		})
+	}
+	encodedIndex, err := json.Marshal(index)
+	if err != nil {
+		return uploadFile{}, err
+	}
+
+	var buf bytes.Buffer
+	writer := tar.NewWriter(&buf)
+	add := func(name string, data []byte) error {
+		if err := writer.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(data)), ModTime: now}); err != nil {
+			return err
+		}
+		_, err := writer.Write(data)
+		return err
+	}
+	if err = add(bundleIndexName, encodedIndex); err != nil {
+		return uploadFile{}, fmt.Errorf("bundle error: %v", err)
+	}
+	for i, file := range files {
+		if err = add(index.Files[i].Name, file.Data); err != nil {
+			return uploadFile{}, fmt.Errorf("bundle error: %v", err)
+		}
+	}
+	if err = writer.Close(); err != nil {
+		return uploadFile{}, fmt.Errorf("bundle error: %v", err)
+	}
+	return uploadFile{Name: "bundle.tar", ContentType: "application/x-tar", Data: buf.Bytes()}, nil
+}
+
+// ExtractBundle unpacks a decoded bundle into its files, checking each against the
+// size and checksum in the index
+func ExtractBundle(data []byte) ([]uploadFile, error) {
+	reader := tar.NewReader(bytes.NewReader(data))
+	header, err := reader.Next()
+	if err != nil || header.Name != bundleIndexName {
+		return nil, fmt.Errorf("bundle has no index")
+	}
+	var index bundleIndex
+	if err = json.NewDecoder(reader).Decode(&index); err != nil {
+		return nil, fmt.Errorf("invalid bundle index: %v", err)
+	}
+
+	files := make([]uploadFile, 0, len(index.Files))
+	for _, entry := range index.Files {
+		header, err := reader.Next()
+		if err != nil || header.Name != entry.Name {
+			return nil, ErrBundleCorrupt
+		}
+		fileData, err := io.ReadAll(reader)
+		if err != nil {
+			return nil, fmt.Errorf("bundle read error: %v", err)
+		}
+		sum := sha256.Sum256(fileData)
+		if len(fileData) != entry.Size || hex.EncodeToString(sum[:]) != entry.SHA256 {
+			return nil, ErrBundleCorrupt
+		}
+		files = append(files, uploadFile{Name: entry.Name, ContentType: entry.ContentType, Data: fileData})
+	}
+	return files, nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestBundleRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []uploadFile
+		names []string
+	}{
+		{
+			name: "plain names",
+			files: []uploadFile{
+				{Name: "a.txt", ContentType: "text/plain", Data: []byte("first")},
+				{Name: "b.csv", ContentType: "text/csv", Data: []byte("x,y\n1,2\n")},
+			},
+			names: []string{"a.txt", "b.csv"},
+		},
+		{
+			// Names that could escape the extraction directory or clash with the index are replaced
+			name: "unsafe names",
+			files: []uploadFile{
+				{Name: "../../etc/passwd", Data: []byte("escape")},
+				{Name: "", Data: []byte("unnamed")},
+				{Name: bundleIndexName, Data: []byte("not the index")},
+				{Name: "dir/", Data: []byte("trailing slash")},
+			},
+			names: []string{"passwd", "file-2", "file-3", "dir"},
+		},
+		{
+			name: "binary and empty files",
+			files: []uploadFile{
+				{Name: "random.bin", Data: randomBytes(t, 64<<10)},
+				{Name: "empty.txt", Data: []byte{}},
+			},
+			names: []string{"random.bin", "empty.txt"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bundle, err := bundleFiles(test.files, time.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bundle.Name != "bundle.tar" || bundle.ContentType != "application/x-tar" {
+				t.Errorf("bundle = %q %q", bundle.Name, bundle.ContentType)
+			}
+			extracted, err := ExtractBundle(bundle.Data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(extracted) != len(test.files) {
+				t.Fatalf("extracted %d files, want %d", len(extracted), len(test.files))
+			}
+			for i, file := range extracted {
+				if file.Name != test.names[i] || file.ContentType != test.files[i].ContentType || !bytes.Equal(file.Data, test.files[i].Data) {
+					t.Errorf("file %d = %q %q %d bytes, want %q %q %d bytes", i,
+						file.Name, file.ContentType, len(file.Data), test.names[i], test.files[i].ContentType, len(test.files[i].Data))
+				}
+			}
+		})
+	}
+}
+
+// rewriteBundle re-archives a bundle's members after edit has changed them
+func rewriteBundle(t *testing.T, data []byte, edit func(names []string, contents [][]byte) ([]string, [][]byte)) []byte {
+	t.Helper()
+	var names []string
+	var contents [][]byte
+	reader := tar.NewReader(bytes.NewReader(data))
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names, contents = append(names, header.Name), append(contents, content)
+	}
+	names, contents = edit(names, contents)
+
+	var buf bytes.Buffer
+	writer := tar.NewWriter(&buf)
+	for i, name := range names {
+		if err := writer.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(contents[i]))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := writer.Write(contents[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestExtractBundleCorrupt(t *testing.T) {
+	bundle, err := bundleFiles([]uploadFile{
+		{Name: "a.txt", Data: []byte("first")},
+		{Name: "b.txt", Data: []byte("second")},
+	}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		edit func(names []string, contents [][]byte) ([]string, [][]byte)
+		err  error
+	}{
+		{name: "changed file", edit: func(names []string, contents [][]byte) ([]string, [][]byte) {
+			contents[2] = []byte("SECOND")
+			return names, contents
+		}, err: ErrBundleCorrupt},
+		{name: "truncated file", edit: func(names []string, contents [][]byte) ([]string, [][]byte) {
+			contents[1] = contents[1][:2]
+			return names, contents
+		}, err: ErrBundleCorrupt},
+		{name: "renamed file", edit: func(names []string, contents [][]byte) ([]string, [][]byte) {
+			names[1] = "c.txt"
+			return names, contents
+		}, err: ErrBundleCorrupt},
+		{name: "missing file", edit: func(names []string, contents [][]byte) ([]string, [][]byte) {
+			return names[:2], contents[:2]
+		}, err: ErrBundleCorrupt},
+		{name: "missing index", edit: func(names []string, contents [][]byte) ([]string, [][]byte) {
+			return names[1:], contents[1:]
+		}},
+		{name: "garbled index", edit: func(names []string, contents [][]byte) ([]string, [][]byte) {
+			contents[0] = []byte("{not json")
+			return names, contents
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ExtractBundle(rewriteBundle(t, bundle.Data, test.edit))
+			if err == nil {
+				t.Fatal("ExtractBundle() accepted a corrupt bundle")
+			}
+			if test.err != nil && !errors.Is(err, test.err) {
+				t.Errorf("ExtractBundle() error = %v, want %v", err, test.err)
+			}
+		})
+	}
+	if _, err := ExtractBundle([]byte("not a tar archive")); err == nil {
+		t.Error("ExtractBundle() accepted data that isn't a tar archive")
+	}
+}
+
+func TestUploadBundle(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled string
+		files   []testFile
+		objects int
+		bundled bool
+	}{
+		{name: "bundled", enabled: "true", files: numberedFiles(5), objects: 1, bundled: true},
+		{name: "single file", enabled: "true", files: numberedFiles(1), objects: 1},
+		{name: "disabled", enabled: "false", files: numberedFiles(5), objects: 5},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("S3_UPLOAD_BUNDLE", test.enabled)
+			fake := newFakeS3(t)
+			body, contentType := multipartBody(t, test.files...)
+			upload(t, map[string]string{"Content-Type": contentType}, body)
+
+			bucket := fake.bucketNames()[0]
+			keys := fake.keys(bucket)
+			if len(keys) != test.objects {
+				t.Fatalf("stored %v, want %d objects", keys, test.objects)
+			}
+			if !test.bundled {
+				return
+			}
+			// Downloading and extracting the archive gives back every file intact
+			stored, metadata, _ := fake.object(bucket, keys[0])
+			decoded, err := decodeObject(stored, metadata)
+			if err != nil {
+				t.Fatal(err)
+			}
+			extracted, err := ExtractBundle(decoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(extracted) != len(test.files) {
+				t.Fatalf("extracted %d files, want %d", len(extracted), len(test.files))
+			}
+			for i, file := range extracted {
+				if file.Name != test.files[i].name || string(file.Data) != test.files[i].data {
+					t.Errorf("file %d = %q %q, want %q %q", i, file.Name, file.Data, test.files[i].name, test.files[i].data)
+				}
+			}
+		})
+	}
+}
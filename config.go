@@ -0,0 +1,1073 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Config holds the upload handler settings read from the environment
+type Config struct {
+	// MaxFiles caps the number of file parts accepted in one multipart request
+	MaxFiles int
+	// DuplicateNames handles files repeating a name within one request: "suffix" renames
+	// them (report-2.pdf) and "reject" fails the request
+	DuplicateNames string
+	// VerifyChecksums re-checks downloaded bytes against the checksum stored at upload
+	VerifyChecksums bool
+	// GzipDownloads is how downloads treat objects stored with Content-Encoding: gzip:
+	// "negotiate" returns them compressed only to clients that accept gzip,
+	// "decompress" always decompresses them and "passthrough" never does
+	GzipDownloads string
+	// EnableACLs skips enforcing bucket-owner object ownership on new buckets
+	EnableACLs bool
+	// StorageClass is the storage class for objects whose content type isn't mapped
+	StorageClass types.StorageClass
+	// StorageClassByType routes content types (e.g. "image/*") to storage classes
+	StorageClassByType map[string]types.StorageClass
+	// PresignExpiry is how long presigned download URLs remain valid
+	PresignExpiry time.Duration
+	// DeadLetterBucket receives payloads whose upload failed; empty disables dead-lettering
+	DeadLetterBucket string
+	// DeadLetterPrefix is prepended to dead-letter object keys
+	DeadLetterPrefix string
+	// DeadLetterMaxBytes bounds the payload size written to the dead-letter bucket
+	DeadLetterMaxBytes int
+	// DedupWindow is how long identical uploads are deduplicated; zero disables dedup
+	DedupWindow time.Duration
+	// DedupMaxEntries bounds the number of recent uploads remembered for dedup
+	DedupMaxEntries int
+	// ResultCacheTTL is how long the response to an upload is replayed to retries of
+	// the same request, identified by Idempotency-Key or content; zero disables it
+	ResultCacheTTL time.Duration
+	// ResultCacheMaxEntries bounds the number of upload responses remembered for retries
+	ResultCacheMaxEntries int
+	// MetadataSidecar writes each object's full metadata as a <key>.meta.json object
+	MetadataSidecar bool
+	// BreakerThreshold is the number of consecutive S3 outages (5xx, throttling or no
+	// response) that opens the circuit breaker; zero disables it
+	BreakerThreshold int
+	// BreakerCooldown is how long the open breaker rejects requests before probing S3 again
+	BreakerCooldown time.Duration
+	// TrustSecret signs requests allowed to disable client-side encryption; empty disallows it
+	TrustSecret string
+	// TrustMaxSkew is how far a signed request's X-Upload-Timestamp may be from the
+	// current time before the signature is refused as stale
+	TrustMaxSkew time.Duration
+	// ExtensionPolicy picks object key extensions: "legacy" (always .zst), "transforms"
+	// (reflects the applied pipeline, e.g. .zst.enc), "neutral" (like transforms, but
+	// encrypted objects lose their file extension and get .bin) or "none"
+	ExtensionPolicy string
+	// ServerSideEncryption is the S3 server-side encryption applied to uploads, e.g. "aws:kms"
+	ServerSideEncryption types.ServerSideEncryption
+	// KMSKeyID is the KMS key used for SSE-KMS; empty uses the AWS managed key
+	KMSKeyID string
+	// KMSBucketKey enables S3 Bucket Keys under SSE-KMS to cut KMS request costs
+	KMSBucketKey bool
+	// MultipartThreshold is the object size in bytes above which the multipart uploader
+	// is used; it defaults to a share of the function's memory
+	MultipartThreshold int
+	// PartSize is the size in bytes of each multipart upload part
+	PartSize int
+	// PartConcurrency is the number of parts of one object uploaded at once; each
+	// in-flight part holds a PartSize buffer
+	PartConcurrency int
+	// PartMemoryBudget caps PartSize × PartConcurrency in bytes, lowering the concurrency
+	// to fit; zero leaves it unbounded
+	PartMemoryBudget int
+	// BackupOnOverwrite copies an existing object under BackupPrefix before it is overwritten
+	BackupOnOverwrite bool
+	// CollisionRetries is how many numbered keys a create-only upload tries when its key
+	// is taken; zero answers 409 straight away
+	CollisionRetries int
+	// CollisionBackoff bounds the random wait before the first collision retry; the
+	// bound doubles with each retry
+	CollisionBackoff time.Duration
+	// VerifyWrites reads back the ETag of every upload before reporting success
+	VerifyWrites bool
+	// VerifyWriteRetries is how many more times a stale read is retried
+	VerifyWriteRetries int
+	// VerifyWriteDelay is the wait before the first retry; it doubles with each retry
+	VerifyWriteDelay time.Duration
+	// VerifyRoundtrip decodes every object in memory before uploading it, failing the
+	// upload if it doesn't reproduce the original file
+	VerifyRoundtrip bool
+	// CreateOnly refuses to overwrite existing objects, failing such uploads with 409 Conflict
+	CreateOnly bool
+	// ReserveKeys claims each key with a zero-byte placeholder before uploading to it,
+	// and deletes the placeholder if the upload fails
+	ReserveKeys bool
+	// BackupPrefix is prepended to the keys of backup copies
+	BackupPrefix string
+	// CopyMetadataDirective is COPY to let S3 carry metadata over to copies, or
+	// REPLACE to set it on them explicitly from the source object
+	CopyMetadataDirective types.MetadataDirective
+	// ObjectLockMode enables Object Lock on new buckets with this default retention mode
+	ObjectLockMode types.ObjectLockRetentionMode
+	// ObjectLockDays is the default retention period for Object Lock
+	ObjectLockDays int
+	// ReplicationDestination is the ARN of the bucket new buckets replicate to; empty
+	// disables replication
+	ReplicationDestination string
+	// ReplicationRole is the ARN of the IAM role S3 assumes to replicate objects
+	ReplicationRole string
+	// BucketRaceWait bounds how long to wait for a bucket another invocation is creating
+	BucketRaceWait time.Duration
+	// BucketPolicy is the policy JSON attached to new buckets, with {bucket} standing
+	// for the bucket name; empty attaches none
+	BucketPolicy string
+	// Thumbnails uploads a downscaled JPEG of every image under thumbnails/
+	Thumbnails bool
+	// ThumbnailSize bounds the width and height of thumbnails in pixels
+	ThumbnailSize int
+	// CompressionLevel is the zstd level uploads are compressed at
+	CompressionLevel zstd.EncoderLevel
+	// KeyStrategy names objects by upload "timestamp" or by "content-hash" of the plaintext
+	KeyStrategy string
+	// HashCollisionCheck makes content-hash keyed uploads whose key is taken check the
+	// stored object's size, reusing it when it matches and failing with 409 Conflict
+	// when it doesn't
+	HashCollisionCheck bool
+	// KeyTemplate overrides KeyStrategy with a template such as "batches/{seq}-{name}",
+	// which may reference {name} (or {filename}), {timestamp}, {hash}, {seq} and, for
+	// JSON uploads, fields of the document such as {.userId}
+	KeyTemplate string
+	// SequenceTable is the DynamoDB table holding the counters behind {seq}
+	SequenceTable string
+	// AccessPointARN targets an S3 Access Point instead of creating a bucket per request
+	AccessPointARN string
+	// RateLimit caps S3 calls per second from one container; zero disables rate limiting
+	RateLimit float64
+	// RateBurst is the number of S3 calls allowed at once before pacing starts
+	RateBurst int
+	// CompressionMinSize maps content types to the smallest body size in bytes worth compressing
+	CompressionMinSize map[string]int
+	// CompressionBudget caps the time spent compressing one file, beyond which it is
+	// stored uncompressed; zero leaves it unbounded
+	CompressionBudget time.Duration
+	// CompressionByType maps content types to the algorithm they are compressed with:
+	// "zstd", "gzip" or "none"
+	CompressionByType map[string]string
+	// ReportAccessDenied answers S3 AccessDenied errors with 403 instead of a generic 500
+	ReportAccessDenied bool
+	// ReportQuota answers S3 errors for an over-quota or restricted account or bucket
+	// with 507 Insufficient Storage instead of a generic 500
+	ReportQuota bool
+	// Namespaces maps content types to the leading key segment objects of that type are
+	// filed under, followed by the upload date, e.g. "image/*=images" stores
+	// images/2024/06/15/<key>; unmapped types keep their key as-is
+	Namespaces map[string]string
+	// HashPrefix prepends a short hash of each key as its leading path segment, spreading
+	// high upload rates across S3 partitions
+	HashPrefix bool
+	// HashPrefixLength is the number of hex characters in the hash prefix
+	HashPrefixLength int
+	// EmptyKeyPolicy is "generate" to name uploads whose key comes out empty
+	// upload-<timestamp>-<uuid>, or "reject" to fail them with 400 Bad Request
+	EmptyKeyPolicy string
+	// KeyCharset matches one character allowed in object keys; nil allows any
+	KeyCharset *regexp.Regexp
+	// KeyCharsetAction is "replace" to substitute KeyCharsetReplacement for disallowed
+	// characters, or "reject" to fail such uploads with 400 Bad Request
+	KeyCharsetAction string
+	// KeyCharsetReplacement replaces each disallowed key character
+	KeyCharsetReplacement string
+	// MaxBodySize rejects direct (Function URL) requests declaring a larger Content-Length
+	// before their body is read, and chunked ones once it has been; zero disables the check
+	MaxBodySize int
+	// AllowChunked accepts direct requests with a chunked body and no Content-Length;
+	// off answers them with 411 Length Required
+	AllowChunked bool
+	// JSONEnvelope reads application/json bodies as upload envelopes carrying a
+	// base64-encoded file; application/vnd.upload-envelope+json bodies always are
+	JSONEnvelope bool
+	// FetchAllowlist lists the scheme://host origins text/uri-list bodies may name
+	// files to fetch from; empty disables fetching
+	FetchAllowlist []fetchOrigin
+	// FetchMaxSize is the largest file in bytes fetched from a URL
+	FetchMaxSize int
+	// FetchTimeout bounds fetching each URL, body included
+	FetchTimeout time.Duration
+	// Location makes uploads answer 201 Created with a Location header holding a "path"
+	// to the download action or a "presigned" URL; "none" keeps the plain 200
+	Location string
+	// ForwardHeaders lists the request headers stored as header-* object metadata; "*"
+	// forwards every header not blocked
+	ForwardHeaders map[string]bool
+	// BlockedHeaders are never forwarded, in addition to the always-sensitive ones
+	BlockedHeaders map[string]bool
+	// CaptureSource records the client's source IP and user agent as uploaded-from and
+	// user-agent object metadata
+	CaptureSource bool
+	// ManifestSecret signs a manifest of every request's stored objects, written under
+	// ManifestPrefix; empty disables manifests
+	ManifestSecret string
+	// ManifestPrefix is prepended to batch manifest keys
+	ManifestPrefix string
+	// HTTPMaxIdleConns caps the idle connections kept open to AWS across all hosts
+	HTTPMaxIdleConns int
+	// HTTPMaxIdleConnsPerHost caps the idle connections kept open to one host, e.g. a bucket endpoint
+	HTTPMaxIdleConnsPerHost int
+	// HTTPIdleConnTimeout is how long an idle connection is kept open
+	HTTPIdleConnTimeout time.Duration
+	// ObjectTTL is recorded as an expires-at time on every object; zero stores none
+	ObjectTTL time.Duration
+	// EnforceTTL makes reads refuse objects past their expires-at time
+	EnforceTTL bool
+	// DeleteExpired deletes expired objects when a read refuses them
+	DeleteExpired bool
+	// PreHookStatus is the status returned when PreUploadHook rejects an upload
+	PreHookStatus int
+	// PostHookStrict fails the request when PostUploadHook errors instead of logging it
+	PostHookStrict bool
+	// ObjectHeader prepends a self-describing header recording the applied pipeline to stored objects
+	ObjectHeader bool
+	// StatsTarget is where aggregate compression statistics are flushed: "s3" for a JSON
+	// object under StatsPrefix in StatsBucket, or "cloudwatch" for embedded metrics in
+	// the function's logs; empty keeps none
+	StatsTarget string
+	// StatsInterval is the minimum time between compression statistics flushes
+	StatsInterval time.Duration
+	// StatsBucket receives compression statistics objects
+	StatsBucket string
+	// StatsPrefix is prepended to compression statistics keys
+	StatsPrefix string
+	// DictionaryBucket stores trained zstd dictionaries under DictionaryPrefix; uploads
+	// are compressed with the active one. Empty disables dictionaries.
+	DictionaryBucket string
+	// DictionaryPrefix is prepended to dictionary keys
+	DictionaryPrefix string
+	// DictionaryRefresh is how often a container re-reads which dictionary is active
+	DictionaryRefresh time.Duration
+	// DictionarySamples caps the objects a dictionary is trained on
+	DictionarySamples int
+	// DictionarySize is the maximum size in bytes of a trained dictionary
+	DictionarySize int
+	// AdminPrincipals may run admin actions such as ?action=train-dictionary; they are
+	// matched case-insensitively
+	AdminPrincipals map[string]bool
+	// ResponseVersion is the upload response shape returned to clients that don't ask
+	// for one with Accept-Version; 0 is the plain-text message
+	ResponseVersion int
+	// BundleFiles stores the files of a multi-file request as one tar archive, led by
+	// an index.json listing them
+	BundleFiles bool
+	// LocalDir stores objects as files under this directory, for development without
+	// AWS; empty stores them in S3 only
+	LocalDir string
+	// LocalMode is "only" to store objects in LocalDir instead of S3, or "dual" to
+	// mirror them there in addition to S3
+	LocalMode string
+	// Benchmark enables ?action=benchmark, which compares compression levels on the
+	// request body; leave it off in production
+	Benchmark bool
+}
+
+// loadConfig reads the handler configuration from S3_UPLOAD_* environment variables
+func loadConfig() (Config, error) {
+	var cfg Config
+	var err error
+
+	if cfg.MaxFiles, err = envInt("S3_UPLOAD_MAX_FILES", 20); err != nil {
+		return cfg, err
+	}
+	if cfg.MaxFiles < 1 {
+		return cfg, fmt.Errorf("S3_UPLOAD_MAX_FILES must be at least 1, got %d", cfg.MaxFiles)
+	}
+	cfg.DuplicateNames = strings.ToLower(envString("S3_UPLOAD_DUPLICATE_NAMES", "suffix"))
+	if cfg.DuplicateNames != "suffix" && cfg.DuplicateNames != "reject" {
+		return cfg, fmt.Errorf("unknown S3_UPLOAD_DUPLICATE_NAMES %q", cfg.DuplicateNames)
+	}
+
+	if cfg.VerifyChecksums, err = envBool("S3_UPLOAD_VERIFY_CHECKSUM", true); err != nil {
+		return cfg, err
+	}
+
+	cfg.GzipDownloads = envString("S3_UPLOAD_GZIP_DOWNLOADS", "negotiate")
+	switch cfg.GzipDownloads {
+	case "negotiate", "decompress", "passthrough":
+	default:
+		return cfg, fmt.Errorf("unknown S3_UPLOAD_GZIP_DOWNLOADS %q", cfg.GzipDownloads)
+	}
+
+	if cfg.EnableACLs, err = envBool("S3_UPLOAD_ENABLE_ACLS", false); err != nil {
+		return cfg, err
+	}
+
+	storageClass := envString("S3_UPLOAD_STORAGE_CLASS", string(types.StorageClassStandard))
+	if cfg.StorageClass, err = parseStorageClass(storageClass); err != nil {
+		return cfg, err
+	}
+	storageClasses, err := envMap("S3_UPLOAD_STORAGE_CLASS_MAP")
+	if err != nil {
+		return cfg, err
+	}
+	cfg.StorageClassByType = make(map[string]types.StorageClass, len(storageClasses))
+	for contentType, class := range storageClasses {
+		if cfg.StorageClassByType[contentType], err = parseStorageClass(class); err != nil {
+			return cfg, err
+		}
+	}
+
+	if cfg.PresignExpiry, err = envDuration("S3_UPLOAD_PRESIGN_EXPIRY", 15*time.Minute); err != nil {
+		return cfg, err
+	}
+	if cfg.PresignExpiry <= 0 || cfg.PresignExpiry > 7*24*time.Hour {
+		return cfg, fmt.Errorf("S3_UPLOAD_PRESIGN_EXPIRY must be between 1s and 168h, got %v", cfg.PresignExpiry)
+	}
+
+	cfg.DeadLetterBucket = os.Getenv("S3_UPLOAD_DLQ_BUCKET")
+	cfg.DeadLetterPrefix = envString("S3_UPLOAD_DLQ_PREFIX", "failed/")
+	if cfg.DeadLetterMaxBytes, err = envInt("S3_UPLOAD_DLQ_MAX_BYTES", 5<<20); err != nil {
+		return cfg, err
+	}
+
+	if cfg.DedupWindow, err = envDuration("S3_UPLOAD_DEDUP_WINDOW", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.DedupMaxEntries, err = envInt("S3_UPLOAD_DEDUP_MAX_ENTRIES", 1000); err != nil {
+		return cfg, err
+	}
+
+	if cfg.ResultCacheTTL, err = envDuration("S3_UPLOAD_RESULT_CACHE_TTL", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.ResultCacheMaxEntries, err = envInt("S3_UPLOAD_RESULT_CACHE_MAX_ENTRIES", 100); err != nil {
+		return cfg, err
+	}
+	if cfg.ResultCacheMaxEntries < 1 {
+		return cfg, fmt.Errorf("S3_UPLOAD_RESULT_CACHE_MAX_ENTRIES must be at least 1, got %d", cfg.ResultCacheMaxEntries)
+	}
+
+	if cfg.MetadataSidecar, err = envBool("S3_UPLOAD_METADATA_SIDECAR", false); err != nil {
+		return cfg, err
+	}
+
+	if cfg.BreakerThreshold, err = envInt("S3_UPLOAD_BREAKER_THRESHOLD", 5); err != nil {
+		return cfg, err
+	}
+	if cfg.BreakerCooldown, err = envDuration("S3_UPLOAD_BREAKER_COOLDOWN", 30*time.Second); err != nil {
+		return cfg, err
+	}
+
+	// A missing key fails every request up front rather than only the encrypted ones
+	if _, err := encryptionKey(); err != nil {
+		return cfg, err
+	}
+	cfg.TrustSecret = os.Getenv("S3_UPLOAD_TRUST_SECRET")
+	if cfg.TrustMaxSkew, err = envDuration("S3_UPLOAD_TRUST_MAX_SKEW", 5*time.Minute); err != nil {
+		return cfg, err
+	}
+	if cfg.TrustMaxSkew <= 0 {
+		return cfg, fmt.Errorf("S3_UPLOAD_TRUST_MAX_SKEW must be positive, got %v", cfg.TrustMaxSkew)
+	}
+
+	cfg.ExtensionPolicy = strings.ToLower(envString("S3_UPLOAD_EXTENSION_POLICY", "legacy"))
+	switch cfg.ExtensionPolicy {
+	case "legacy", "transforms", "neutral", "none":
+	default:
+		return cfg, fmt.Errorf("unknown S3_UPLOAD_EXTENSION_POLICY %q", cfg.ExtensionPolicy)
+	}
+
+	if sse := os.Getenv("S3_UPLOAD_SSE"); sse != "" {
+		cfg.ServerSideEncryption = types.ServerSideEncryption(sse)
+		valid := false
+		for _, known := range cfg.ServerSideEncryption.Values() {
+			valid = valid || cfg.ServerSideEncryption == known
+		}
+		if !valid {
+			return cfg, fmt.Errorf("unknown S3_UPLOAD_SSE %q", sse)
+		}
+	}
+	cfg.KMSKeyID = os.Getenv("S3_UPLOAD_KMS_KEY_ID")
+	if cfg.KMSBucketKey, err = envBool("S3_UPLOAD_KMS_BUCKET_KEY", false); err != nil {
+		return cfg, err
+	}
+
+	if cfg.MultipartThreshold, err = envInt("S3_UPLOAD_MULTIPART_THRESHOLD", defaultMultipartThreshold(lambdaMemory())); err != nil {
+		return cfg, err
+	}
+	if cfg.PartSize, err = envInt("S3_UPLOAD_PART_SIZE", int(manager.DefaultUploadPartSize)); err != nil {
+		return cfg, err
+	}
+	if int64(cfg.PartSize) < manager.MinUploadPartSize {
+		return cfg, fmt.Errorf("S3_UPLOAD_PART_SIZE must be at least %d, got %d", manager.MinUploadPartSize, cfg.PartSize)
+	}
+	if cfg.PartConcurrency, err = envInt("S3_UPLOAD_PART_CONCURRENCY", manager.DefaultUploadConcurrency); err != nil {
+		return cfg, err
+	}
+	if cfg.PartConcurrency < 1 {
+		return cfg, fmt.Errorf("S3_UPLOAD_PART_CONCURRENCY must be at least 1, got %d", cfg.PartConcurrency)
+	}
+	if cfg.PartMemoryBudget, err = envInt("S3_UPLOAD_PART_MEMORY_BUDGET", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.PartConcurrency, err = clampPartConcurrency(cfg.PartSize, cfg.PartConcurrency, cfg.PartMemoryBudget, lambdaMemory()); err != nil {
+		return cfg, err
+	}
+
+	if cfg.BackupOnOverwrite, err = envBool("S3_UPLOAD_BACKUP_ON_OVERWRITE", false); err != nil {
+		return cfg, err
+	}
+	cfg.BackupPrefix = envString("S3_UPLOAD_BACKUP_PREFIX", "backups/")
+	cfg.CopyMetadataDirective = types.MetadataDirective(strings.ToUpper(envString("S3_UPLOAD_COPY_METADATA_DIRECTIVE", "copy")))
+	if cfg.CopyMetadataDirective != types.MetadataDirectiveCopy && cfg.CopyMetadataDirective != types.MetadataDirectiveReplace {
+		return cfg, fmt.Errorf("unknown S3_UPLOAD_COPY_METADATA_DIRECTIVE %q", cfg.CopyMetadataDirective)
+	}
+	if cfg.CreateOnly, err = envBool("S3_UPLOAD_CREATE_ONLY", false); err != nil {
+		return cfg, err
+	}
+	if cfg.CreateOnly && cfg.BackupOnOverwrite {
+		return cfg, fmt.Errorf("S3_UPLOAD_CREATE_ONLY and S3_UPLOAD_BACKUP_ON_OVERWRITE are mutually exclusive")
+	}
+	if cfg.ReserveKeys, err = envBool("S3_UPLOAD_RESERVE_KEYS", false); err != nil {
+		return cfg, err
+	}
+	if cfg.ReserveKeys && !cfg.CreateOnly {
+		return cfg, fmt.Errorf("S3_UPLOAD_RESERVE_KEYS requires S3_UPLOAD_CREATE_ONLY")
+	}
+	if cfg.CollisionRetries, err = envInt("S3_UPLOAD_COLLISION_RETRIES", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.CollisionRetries < 0 {
+		return cfg, fmt.Errorf("S3_UPLOAD_COLLISION_RETRIES must not be negative, got %d", cfg.CollisionRetries)
+	}
+	if cfg.CollisionRetries > 0 && !cfg.CreateOnly {
+		return cfg, fmt.Errorf("S3_UPLOAD_COLLISION_RETRIES requires S3_UPLOAD_CREATE_ONLY")
+	}
+	if cfg.CollisionBackoff, err = envDuration("S3_UPLOAD_COLLISION_BACKOFF", 50*time.Millisecond); err != nil {
+		return cfg, err
+	}
+
+	if cfg.HashCollisionCheck, err = envBool("S3_UPLOAD_HASH_COLLISION_CHECK", false); err != nil {
+		return cfg, err
+	}
+
+	if cfg.VerifyWrites, err = envBool("S3_UPLOAD_VERIFY_WRITES", false); err != nil {
+		return cfg, err
+	}
+	if cfg.VerifyWriteRetries, err = envInt("S3_UPLOAD_VERIFY_WRITE_RETRIES", 3); err != nil {
+		return cfg, err
+	}
+	if cfg.VerifyWriteRetries < 0 {
+		return cfg, fmt.Errorf("S3_UPLOAD_VERIFY_WRITE_RETRIES must not be negative, got %d", cfg.VerifyWriteRetries)
+	}
+	if cfg.VerifyWriteDelay, err = envDuration("S3_UPLOAD_VERIFY_WRITE_DELAY", 200*time.Millisecond); err != nil {
+		return cfg, err
+	}
+	if cfg.VerifyRoundtrip, err = envBool("S3_UPLOAD_VERIFY_ROUNDTRIP", false); err != nil {
+		return cfg, err
+	}
+
+	if mode := os.Getenv("S3_UPLOAD_OBJECT_LOCK_MODE"); mode != "" {
+		cfg.ObjectLockMode = types.ObjectLockRetentionMode(strings.ToUpper(mode))
+		if cfg.ObjectLockMode != types.ObjectLockRetentionModeGovernance &&
+			cfg.ObjectLockMode != types.ObjectLockRetentionModeCompliance {
+			return cfg, fmt.Errorf("S3_UPLOAD_OBJECT_LOCK_MODE must be GOVERNANCE or COMPLIANCE, got %q", mode)
+		}
+		if cfg.ObjectLockDays, err = envInt("S3_UPLOAD_OBJECT_LOCK_DAYS", 0); err != nil {
+			return cfg, err
+		}
+		if cfg.ObjectLockDays < 1 || cfg.ObjectLockDays > 36500 {
+			return cfg, fmt.Errorf("S3_UPLOAD_OBJECT_LOCK_DAYS must be between 1 and 36500, got %d", cfg.ObjectLockDays)
+		}
+	}
+
+	cfg.ReplicationDestination = os.Getenv("S3_UPLOAD_REPLICATION_DESTINATION")
+	cfg.ReplicationRole = os.Getenv("S3_UPLOAD_REPLICATION_ROLE")
+	if cfg.ReplicationDestination != "" || cfg.ReplicationRole != "" {
+		if err = validateReplication(cfg.ReplicationDestination, cfg.ReplicationRole); err != nil {
+			return cfg, err
+		}
+	}
+
+	if cfg.BucketRaceWait, err = envDuration("S3_UPLOAD_BUCKET_RACE_WAIT", 10*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.BucketRaceWait <= 0 {
+		return cfg, fmt.Errorf("S3_UPLOAD_BUCKET_RACE_WAIT must be positive, got %v", cfg.BucketRaceWait)
+	}
+
+	// A template name stands for the built-in policy
+	if cfg.BucketPolicy = os.Getenv("S3_UPLOAD_BUCKET_POLICY"); cfg.BucketPolicy != "" {
+		if template, ok := bucketPolicyTemplates[cfg.BucketPolicy]; ok {
+			cfg.BucketPolicy = template
+		}
+		if err = validateBucketPolicy(cfg.BucketPolicy); err != nil {
+			return cfg, err
+		}
+	}
+
+	if cfg.Thumbnails, err = envBool("S3_UPLOAD_THUMBNAILS", false); err != nil {
+		return cfg, err
+	}
+	if cfg.ThumbnailSize, err = envInt("S3_UPLOAD_THUMBNAIL_SIZE", 128); err != nil {
+		return cfg, err
+	}
+	if cfg.ThumbnailSize < 1 {
+		return cfg, fmt.Errorf("S3_UPLOAD_THUMBNAIL_SIZE must be at least 1, got %d", cfg.ThumbnailSize)
+	}
+
+	level := envString("S3_UPLOAD_COMPRESSION_LEVEL", "default")
+	var ok bool
+	if ok, cfg.CompressionLevel = zstd.EncoderLevelFromString(level); !ok {
+		return cfg, fmt.Errorf("unknown S3_UPLOAD_COMPRESSION_LEVEL %q", level)
+	}
+	cfg.KeyStrategy = strings.ToLower(envString("S3_UPLOAD_KEY_STRATEGY", "timestamp"))
+	if cfg.KeyStrategy != "timestamp" && cfg.KeyStrategy != "content-hash" {
+		return cfg, fmt.Errorf("unknown S3_UPLOAD_KEY_STRATEGY %q", cfg.KeyStrategy)
+	}
+	if cfg.KeyTemplate = os.Getenv("S3_UPLOAD_KEY_TEMPLATE"); cfg.KeyTemplate != "" {
+		if err = validateKeyTemplate(cfg.KeyTemplate); err != nil {
+			return cfg, err
+		}
+	}
+	cfg.SequenceTable = os.Getenv("S3_UPLOAD_SEQUENCE_TABLE")
+	if cfg.usesSequence() && cfg.SequenceTable == "" {
+		return cfg, fmt.Errorf("S3_UPLOAD_KEY_TEMPLATE uses {seq} but S3_UPLOAD_SEQUENCE_TABLE is not set")
+	}
+
+	if cfg.AccessPointARN = os.Getenv("S3_UPLOAD_ACCESS_POINT_ARN"); cfg.AccessPointARN != "" {
+		if err = validateAccessPointARN(cfg.AccessPointARN); err != nil {
+			return cfg, err
+		}
+	}
+
+	if value := os.Getenv("S3_UPLOAD_RATE_LIMIT"); value != "" {
+		if cfg.RateLimit, err = strconv.ParseFloat(value, 64); err != nil || cfg.RateLimit < 0 {
+			return cfg, fmt.Errorf("invalid S3_UPLOAD_RATE_LIMIT %q", value)
+		}
+	}
+	if cfg.RateBurst, err = envInt("S3_UPLOAD_RATE_BURST", 1); err != nil {
+		return cfg, err
+	}
+	if cfg.RateBurst < 1 {
+		return cfg, fmt.Errorf("S3_UPLOAD_RATE_BURST must be at least 1, got %d", cfg.RateBurst)
+	}
+
+	// Text compresses well even when small, while small binary payloads rarely shrink
+	cfg.CompressionMinSize = map[string]int{
+		"text/*":           0,
+		"application/json": 0,
+		"application/xml":  0,
+		"*":                1024,
+	}
+	minSizes, err := envMap("S3_UPLOAD_COMPRESSION_MIN_SIZE")
+	if err != nil {
+		return cfg, err
+	}
+	for contentType, value := range minSizes {
+		size, err := strconv.Atoi(value)
+		if err != nil || size < 0 {
+			return cfg, fmt.Errorf("invalid S3_UPLOAD_COMPRESSION_MIN_SIZE for %q: %q", contentType, value)
+		}
+		cfg.CompressionMinSize[contentType] = size
+	}
+
+	if cfg.CompressionBudget, err = envDuration("S3_UPLOAD_COMPRESSION_BUDGET", 0); err != nil {
+		return cfg, err
+	}
+
+	// Media and archives are already compressed, so compressing them again only costs CPU
+	cfg.CompressionByType = map[string]string{
+		"image/jpeg":       "none",
+		"image/png":        "none",
+		"image/gif":        "none",
+		"image/webp":       "none",
+		"video/*":          "none",
+		"audio/*":          "none",
+		"application/zip":  "none",
+		"application/gzip": "none",
+		"application/zstd": "none",
+		"*":                "zstd",
+	}
+	algorithms, err := envMap("S3_UPLOAD_COMPRESSION_MAP")
+	if err != nil {
+		return cfg, err
+	}
+	for contentType, algorithm := range algorithms {
+		algorithm = strings.ToLower(algorithm)
+		if algorithm != "zstd" && algorithm != "gzip" && algorithm != "none" {
+			return cfg, fmt.Errorf("unknown S3_UPLOAD_COMPRESSION_MAP algorithm %q for %q", algorithm, contentType)
+		}
+		cfg.CompressionByType[contentType] = algorithm
+	}
+
+	if cfg.ReportAccessDenied, err = envBool("S3_UPLOAD_REPORT_ACCESS_DENIED", true); err != nil {
+		return cfg, err
+	}
+	if cfg.ReportQuota, err = envBool("S3_UPLOAD_REPORT_QUOTA", true); err != nil {
+		return cfg, err
+	}
+
+	if cfg.Namespaces, err = envMap("S3_UPLOAD_NAMESPACES"); err != nil {
+		return cfg, err
+	}
+
+	if cfg.HashPrefix, err = envBool("S3_UPLOAD_HASH_PREFIX", false); err != nil {
+		return cfg, err
+	}
+	if cfg.HashPrefixLength, err = envInt("S3_UPLOAD_HASH_PREFIX_LENGTH", 4); err != nil {
+		return cfg, err
+	}
+	if cfg.HashPrefixLength < 1 || cfg.HashPrefixLength > 64 {
+		return cfg, fmt.Errorf("S3_UPLOAD_HASH_PREFIX_LENGTH must be between 1 and 64, got %d", cfg.HashPrefixLength)
+	}
+
+	cfg.EmptyKeyPolicy = envString("S3_UPLOAD_EMPTY_KEY_POLICY", "generate")
+	switch cfg.EmptyKeyPolicy {
+	case "generate", "reject":
+	default:
+		return cfg, fmt.Errorf("unknown S3_UPLOAD_EMPTY_KEY_POLICY %q", cfg.EmptyKeyPolicy)
+	}
+
+	switch charset := envString("S3_UPLOAD_KEY_CHARSET", "permissive"); charset {
+	case "permissive":
+	case "custom":
+		// The pattern describes a single character, so it's anchored to one
+		pattern := os.Getenv("S3_UPLOAD_KEY_CHARSET_REGEX")
+		if pattern == "" {
+			return cfg, fmt.Errorf("S3_UPLOAD_KEY_CHARSET=custom requires S3_UPLOAD_KEY_CHARSET_REGEX")
+		}
+		if cfg.KeyCharset, err = regexp.Compile("^(?:" + pattern + ")$"); err != nil {
+			return cfg, fmt.Errorf("invalid S3_UPLOAD_KEY_CHARSET_REGEX %q: %v", pattern, err)
+		}
+	default:
+		var ok bool
+		if cfg.KeyCharset, ok = keyCharsets[charset]; !ok {
+			return cfg, fmt.Errorf("unknown S3_UPLOAD_KEY_CHARSET %q", charset)
+		}
+	}
+	cfg.KeyCharsetAction = envString("S3_UPLOAD_KEY_CHARSET_ACTION", "replace")
+	switch cfg.KeyCharsetAction {
+	case "replace", "reject":
+	default:
+		return cfg, fmt.Errorf("unknown S3_UPLOAD_KEY_CHARSET_ACTION %q", cfg.KeyCharsetAction)
+	}
+	cfg.KeyCharsetReplacement = envString("S3_UPLOAD_KEY_CHARSET_REPLACEMENT", "_")
+	if _, err = enforceKeyCharset(cfg.KeyCharsetReplacement, cfg.KeyCharset, "reject", ""); err != nil {
+		return cfg, fmt.Errorf("S3_UPLOAD_KEY_CHARSET_REPLACEMENT %q is itself disallowed", cfg.KeyCharsetReplacement)
+	}
+
+	if cfg.MaxBodySize, err = envInt("S3_UPLOAD_MAX_BODY_SIZE", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.MaxBodySize < 0 {
+		return cfg, fmt.Errorf("S3_UPLOAD_MAX_BODY_SIZE must not be negative, got %d", cfg.MaxBodySize)
+	}
+
+	if cfg.AllowChunked, err = envBool("S3_UPLOAD_ALLOW_CHUNKED", true); err != nil {
+		return cfg, err
+	}
+
+	if cfg.JSONEnvelope, err = envBool("S3_UPLOAD_JSON_ENVELOPE", false); err != nil {
+		return cfg, err
+	}
+	if cfg.FetchAllowlist, err = parseFetchAllowlist(os.Getenv("S3_UPLOAD_FETCH_ALLOWLIST")); err != nil {
+		return cfg, err
+	}
+	if cfg.FetchMaxSize, err = envInt("S3_UPLOAD_FETCH_MAX_SIZE", 50<<20); err != nil {
+		return cfg, err
+	}
+	if cfg.FetchMaxSize < 1 {
+		return cfg, fmt.Errorf("S3_UPLOAD_FETCH_MAX_SIZE must be at least 1, got %d", cfg.FetchMaxSize)
+	}
+	if cfg.FetchTimeout, err = envDuration("S3_UPLOAD_FETCH_TIMEOUT", 30*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.FetchTimeout <= 0 {
+		return cfg, fmt.Errorf("S3_UPLOAD_FETCH_TIMEOUT must be positive, got %v", cfg.FetchTimeout)
+	}
+
+	if cfg.ObjectHeader, err = envBool("S3_UPLOAD_OBJECT_HEADER", false); err != nil {
+		return cfg, err
+	}
+
+	cfg.Location = strings.ToLower(envString("S3_UPLOAD_LOCATION", "none"))
+	switch cfg.Location {
+	case "none", "path", "presigned":
+	default:
+		return cfg, fmt.Errorf("unknown S3_UPLOAD_LOCATION %q", cfg.Location)
+	}
+
+	cfg.ForwardHeaders = envSet("S3_UPLOAD_FORWARD_HEADERS", "content-language,x-request-id,x-correlation-id")
+	cfg.BlockedHeaders = envSet("S3_UPLOAD_BLOCKED_HEADERS", "")
+	if cfg.CaptureSource, err = envBool("S3_UPLOAD_CAPTURE_SOURCE", false); err != nil {
+		return cfg, err
+	}
+
+	cfg.ManifestSecret = os.Getenv("S3_UPLOAD_MANIFEST_SECRET")
+	cfg.ManifestPrefix = envString("S3_UPLOAD_MANIFEST_PREFIX", "manifests/")
+
+	// Uploads hit one bucket endpoint, so allow as many idle connections to it as overall
+	if cfg.HTTPMaxIdleConns, err = envInt("S3_UPLOAD_HTTP_MAX_IDLE_CONNS", 100); err != nil {
+		return cfg, err
+	}
+	if cfg.HTTPMaxIdleConnsPerHost, err = envInt("S3_UPLOAD_HTTP_MAX_IDLE_CONNS_PER_HOST", 100); err != nil {
+		return cfg, err
+	}
+	if cfg.HTTPMaxIdleConns < 0 || cfg.HTTPMaxIdleConnsPerHost < 0 {
+		return cfg, fmt.Errorf("S3_UPLOAD_HTTP_MAX_IDLE_CONNS and S3_UPLOAD_HTTP_MAX_IDLE_CONNS_PER_HOST must not be negative")
+	}
+	if cfg.HTTPIdleConnTimeout, err = envDuration("S3_UPLOAD_HTTP_IDLE_CONN_TIMEOUT", 90*time.Second); err != nil {
+		return cfg, err
+	}
+
+	if cfg.ObjectTTL, err = envDuration("S3_UPLOAD_OBJECT_TTL", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.EnforceTTL, err = envBool("S3_UPLOAD_ENFORCE_TTL", true); err != nil {
+		return cfg, err
+	}
+	if cfg.DeleteExpired, err = envBool("S3_UPLOAD_DELETE_EXPIRED", false); err != nil {
+		return cfg, err
+	}
+
+	if cfg.PreHookStatus, err = envInt("S3_UPLOAD_PRE_HOOK_STATUS", http.StatusBadRequest); err != nil {
+		return cfg, err
+	}
+	if cfg.PreHookStatus < 400 || cfg.PreHookStatus > 599 {
+		return cfg, fmt.Errorf("S3_UPLOAD_PRE_HOOK_STATUS must be an error status, got %d", cfg.PreHookStatus)
+	}
+	if cfg.PostHookStrict, err = envBool("S3_UPLOAD_POST_HOOK_STRICT", false); err != nil {
+		return cfg, err
+	}
+
+	if cfg.Benchmark, err = envBool("S3_UPLOAD_BENCHMARK", false); err != nil {
+		return cfg, err
+	}
+
+	cfg.StatsTarget = os.Getenv("S3_UPLOAD_STATS_TARGET")
+	switch cfg.StatsTarget {
+	case "", "cloudwatch":
+	case "s3":
+		if cfg.StatsBucket = os.Getenv("S3_UPLOAD_STATS_BUCKET"); cfg.StatsBucket == "" {
+			return cfg, fmt.Errorf("S3_UPLOAD_STATS_TARGET=s3 requires S3_UPLOAD_STATS_BUCKET")
+		}
+	default:
+		return cfg, fmt.Errorf("unknown S3_UPLOAD_STATS_TARGET %q", cfg.StatsTarget)
+	}
+	if cfg.StatsInterval, err = envDuration("S3_UPLOAD_STATS_INTERVAL", 5*time.Minute); err != nil {
+		return cfg, err
+	}
+	cfg.StatsPrefix = envString("S3_UPLOAD_STATS_PREFIX", "stats/compression/")
+
+	cfg.DictionaryBucket = os.Getenv("S3_UPLOAD_DICTIONARY_BUCKET")
+	cfg.DictionaryPrefix = envString("S3_UPLOAD_DICTIONARY_PREFIX", "dictionaries/")
+	if cfg.DictionaryRefresh, err = envDuration("S3_UPLOAD_DICTIONARY_REFRESH", time.Minute); err != nil {
+		return cfg, err
+	}
+	if cfg.DictionarySamples, err = envInt("S3_UPLOAD_DICTIONARY_SAMPLES", 100); err != nil {
+		return cfg, err
+	}
+	if cfg.DictionarySamples < minDictionarySamples {
+		return cfg, fmt.Errorf("S3_UPLOAD_DICTIONARY_SAMPLES must be at least %d, got %d", minDictionarySamples, cfg.DictionarySamples)
+	}
+	if cfg.DictionarySize, err = envInt("S3_UPLOAD_DICTIONARY_SIZE", 64<<10); err != nil {
+		return cfg, err
+	}
+	if cfg.DictionarySize < 256 {
+		return cfg, fmt.Errorf("S3_UPLOAD_DICTIONARY_SIZE must be at least 256, got %d", cfg.DictionarySize)
+	}
+	cfg.AdminPrincipals = envSet("S3_UPLOAD_ADMIN_PRINCIPALS", "")
+
+	if cfg.ResponseVersion, err = envInt("S3_UPLOAD_RESPONSE_VERSION", plainResponseVersion); err != nil {
+		return cfg, err
+	}
+	if cfg.ResponseVersion < plainResponseVersion || cfg.ResponseVersion > latestResponseVersion {
+		return cfg, fmt.Errorf("S3_UPLOAD_RESPONSE_VERSION must be between 0 and %d, got %d", latestResponseVersion, cfg.ResponseVersion)
+	}
+
+	if cfg.BundleFiles, err = envBool("S3_UPLOAD_BUNDLE", false); err != nil {
+		return cfg, err
+	}
+
+	cfg.LocalDir = os.Getenv("S3_UPLOAD_LOCAL_DIR")
+	cfg.LocalMode = envString("S3_UPLOAD_LOCAL_MODE", "only")
+	switch cfg.LocalMode {
+	case "only", "dual":
+	default:
+		return cfg, fmt.Errorf("unknown S3_UPLOAD_LOCAL_MODE %q", cfg.LocalMode)
+	}
+	if !cfg.usesS3() {
+		if err = validateLocalOnly(cfg); err != nil {
+			return cfg, err
+		}
+	}
+
+	return cfg, nil
+}
+
+// usesS3 reports whether objects are stored in S3, rather than only in LocalDir
+func (cfg Config) usesS3() bool {
+	return cfg.LocalDir == "" || cfg.LocalMode == "dual"
+}
+
+// validateLocalOnly rejects settings that need S3 when objects are stored only in LocalDir
+func validateLocalOnly(cfg Config) error {
+	needsS3 := []struct {
+		setting string
+		set     bool
+	}{
+		{"S3_UPLOAD_RESERVE_KEYS", cfg.ReserveKeys},
+		{"S3_UPLOAD_HASH_COLLISION_CHECK", cfg.HashCollisionCheck},
+		{"S3_UPLOAD_BACKUP_ON_OVERWRITE", cfg.BackupOnOverwrite},
+		{"S3_UPLOAD_METADATA_SIDECAR", cfg.MetadataSidecar},
+		{"S3_UPLOAD_MANIFEST_SECRET", cfg.ManifestSecret != ""},
+		{"S3_UPLOAD_DLQ_BUCKET", cfg.DeadLetterBucket != ""},
+		{"S3_UPLOAD_STATS_TARGET=s3", cfg.StatsTarget == "s3"},
+		{"S3_UPLOAD_DICTIONARY_BUCKET", cfg.DictionaryBucket != ""},
+		{"S3_UPLOAD_LOCATION=presigned", cfg.Location == "presigned"},
+	}
+	for _, option := range needsS3 {
+		if option.set {
+			return fmt.Errorf("%s needs S3 and can't be used with S3_UPLOAD_LOCAL_MODE=only", option.setting)
+		}
+	}
+	return nil
+}
+
+// forwardsHeader reports whether a request header is stored as object metadata
+func (cfg Config) forwardsHeader(name string) bool {
+	name = strings.ToLower(name)
+	if sensitiveHeaders[name] || cfg.BlockedHeaders[name] {
+		return false
+	}
+	return cfg.ForwardHeaders[name] || cfg.ForwardHeaders["*"]
+}
+
+// usesSequence reports whether object keys are numbered from the sequence counter
+func (cfg Config) usesSequence() bool {
+	return strings.Contains(cfg.KeyTemplate, "{seq}")
+}
+
+// lambdaMemory returns the memory in bytes configured for the function, or zero
+// outside Lambda
+func lambdaMemory() int {
+	megabytes, err := strconv.Atoi(os.Getenv("AWS_LAMBDA_FUNCTION_MEMORY_SIZE"))
+	if err != nil {
+		return 0
+	}
+	return megabytes << 20
+}
+
+// defaultMultipartThreshold picks the multipart threshold for a function with the
+// given memory: an eighth of it, so small functions switch to multipart sooner,
+// between the minimum part size and 100 MB
+func defaultMultipartThreshold(memory int) int {
+	const maxThreshold = 100 << 20
+	if memory == 0 {
+		return maxThreshold
+	}
+	return min(max(memory/8, int(manager.MinUploadPartSize)), maxThreshold)
+}
+
+// clampPartConcurrency lowers concurrency until the part buffers fit the budget.
+// Budgets that can't hold a single part, and part buffers that would exceed the
+// function's memory, are rejected.
+func clampPartConcurrency(partSize int, concurrency int, budget int, memory int) (int, error) {
+	if budget > 0 {
+		if memory > 0 && budget > memory {
+			return 0, fmt.Errorf("S3_UPLOAD_PART_MEMORY_BUDGET of %d bytes exceeds the function's %d bytes of memory", budget, memory)
+		}
+		if partSize > budget {
+			return 0, fmt.Errorf("S3_UPLOAD_PART_MEMORY_BUDGET of %d bytes can't hold a %d byte part", budget, partSize)
+		}
+		if partSize*concurrency > budget {
+			concurrency = budget / partSize
+		}
+	}
+	if memory > 0 && partSize*concurrency > memory {
+		return 0, fmt.Errorf("%d concurrent parts of %d bytes exceed the function's %d bytes of memory", concurrency, partSize, memory)
+	}
+	return concurrency, nil
+}
+
+// compressionFor returns the algorithm a body of the given type and size is compressed with
+func (cfg Config) compressionFor(contentType string, size int) string {
+	algorithm, ok := lookupContentType(cfg.CompressionByType, contentType)
+	if !ok {
+		algorithm = "zstd"
+	}
+	if algorithm != "none" && !cfg.shouldCompress(contentType, size) {
+		return "none"
+	}
+	return algorithm
+}
+
+// shouldCompress reports whether a body of the given type and size is worth compressing
+func (cfg Config) shouldCompress(contentType string, size int) bool {
+	minSize, ok := lookupContentType(cfg.CompressionMinSize, contentType)
+	return !ok || size >= minSize
+}
+
+// validateAccessPointARN checks that value is an S3 Access Point ARN such as
+// arn:aws:s3:ap-south-1:123456789012:accesspoint/uploads
+func validateAccessPointARN(value string) error {
+	parsed, err := arn.Parse(value)
+	if err != nil {
+		return fmt.Errorf("invalid S3_UPLOAD_ACCESS_POINT_ARN %q: %v", value, err)
+	}
+	name, ok := strings.CutPrefix(parsed.Resource, "accesspoint/")
+	if parsed.Service != "s3" || !ok || name == "" || strings.Contains(name, "/") {
+		return fmt.Errorf("S3_UPLOAD_ACCESS_POINT_ARN %q is not an S3 access point ARN", value)
+	}
+	if parsed.Region == "" || len(parsed.AccountID) != 12 {
+		return fmt.Errorf("S3_UPLOAD_ACCESS_POINT_ARN %q must include a region and a 12-digit account ID", value)
+	}
+	return nil
+}
+
+// validateReplication checks that destination is an S3 bucket ARN such as
+// arn:aws:s3:::uploads-replica and role an IAM role ARN
+func validateReplication(destination string, role string) error {
+	if destination == "" || role == "" {
+		return fmt.Errorf("S3_UPLOAD_REPLICATION_DESTINATION and S3_UPLOAD_REPLICATION_ROLE must be set together")
+	}
+	parsed, err := arn.Parse(destination)
+	if err != nil {
+		return fmt.Errorf("invalid S3_UPLOAD_REPLICATION_DESTINATION %q: %v", destination, err)
+	}
+	if parsed.Service != "s3" || parsed.Resource == "" || strings.Contains(parsed.Resource, "/") {
+		return fmt.Errorf("S3_UPLOAD_REPLICATION_DESTINATION %q is not an S3 bucket ARN", destination)
+	}
+	parsed, err = arn.Parse(role)
+	if err != nil {
+		return fmt.Errorf("invalid S3_UPLOAD_REPLICATION_ROLE %q: %v", role, err)
+	}
+	if parsed.Service != "iam" || !strings.HasPrefix(parsed.Resource, "role/") {
+		return fmt.Errorf("S3_UPLOAD_REPLICATION_ROLE %q is not an IAM role ARN", role)
+	}
+	return nil
+}
+
+// usesKMS reports whether uploads are encrypted with SSE-KMS
+func (cfg Config) usesKMS() bool {
+	return cfg.ServerSideEncryption == types.ServerSideEncryptionAwsKms ||
+		cfg.ServerSideEncryption == types.ServerSideEncryptionAwsKmsDsse
+}
+
+// storageClassFor returns the storage class configured for a content type
+func (cfg Config) storageClassFor(contentType string) types.StorageClass {
+	if class, ok := lookupContentType(cfg.StorageClassByType, contentType); ok {
+		return class
+	}
+	return cfg.StorageClass
+}
+
+// envInt reads an integer environment variable, returning fallback when it is unset
+func envInt(name string, fallback int) (int, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok || value == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %v", name, value, err)
+	}
+	return n, nil
+}
+
+// envBool reads a boolean environment variable, returning fallback when it is unset
+func envBool(name string, fallback bool) (bool, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok || value == "" {
+		return fallback, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q: %v", name, value, err)
+	}
+	return b, nil
+}
+
+// envDuration reads a duration environment variable such as "15m", returning fallback when it is unset
+func envDuration(name string, fallback time.Duration) (time.Duration, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok || value == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %v", name, value, err)
+	}
+	return d, nil
+}
+
+// envString reads a string environment variable, returning fallback when it is unset
+func envString(name string, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// envSet reads a comma-separated list of names, lowercased, e.g. "x-request-id,user-agent"
+func envSet(name string, fallback string) map[string]bool {
+	values := make(map[string]bool)
+	for _, value := range strings.Split(envString(name, fallback), ",") {
+		if value = strings.ToLower(strings.TrimSpace(value)); value != "" {
+			values[value] = true
+		}
+	}
+	return values
+}
+
+// envMap reads a comma-separated list of key=value pairs, e.g. "image/*=STANDARD,text/plain=GLACIER_IR"
+func envMap(name string) (map[string]string, error) {
+	values := make(map[string]string)
+	for _, pair := range strings.Split(os.Getenv(name), ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(key) == "" {
+			return nil, fmt.Errorf("invalid %s entry %q, expected key=value", name, pair)
+		}
+		values[strings.ToLower(strings.TrimSpace(key))] = strings.TrimSpace(value)
+	}
+	return values, nil
+}
+
+// parseStorageClass validates a storage class name
+func parseStorageClass(value string) (types.StorageClass, error) {
+	class := types.StorageClass(strings.ToUpper(value))
+	for _, known := range class.Values() {
+		if class == known {
+			return class, nil
+		}
+	}
+	return "", fmt.Errorf("unknown storage class %q", value)
+}
+
+// lookupContentType finds the entry for a content type in a mapping keyed by
+// media type patterns. An exact match wins over "type/*", which wins over "*".
+func lookupContentType[V any](mapping map[string]V, contentType string) (V, bool) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = strings.ToLower(strings.TrimSpace(contentType))
+	}
+	candidates := []string{mediaType}
+	if major, _, ok := strings.Cut(mediaType, "/"); ok {
+		candidates = append(candidates, major+"/*")
+	}
+	candidates = append(candidates, "*")
+	for _, candidate := range candidates {
+		if value, ok := mapping[candidate]; ok {
+			return value, true
+		}
+	}
+	var zero V
+	return zero, false
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// testConfig loads the configuration from the given S3_UPLOAD_* settings
+func testConfig(t *testing.T, env map[string]string) Config {
+	t.Helper()
+	for name, value := range env {
+		t.Setenv(name, value)
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatalf("loadConfig() error = %v", err)
+	}
+	return cfg
+}
+
+// configError returns the error loadConfig fails with under the given settings
+func configError(t *testing.T, env map[string]string) error {
+	t.Helper()
+	for name, value := range env {
+		t.Setenv(name, value)
+	}
+	_, err := loadConfig()
+	return err
+}
+
+func TestStorageClassFor(t *testing.T) {
+	cfg := testConfig(t, map[string]string{
+		"S3_UPLOAD_STORAGE_CLASS":     "standard_ia",
+		"S3_UPLOAD_STORAGE_CLASS_MAP": "text/plain=GLACIER_IR, image/*=STANDARD, application/x-ndjson=deep_archive",
+	})
+	tests := []struct {
+		contentType string
+		want        types.StorageClass
+	}{
+		{"text/plain", types.StorageClassGlacierIr},
+		{"Text/Plain; charset=utf-8", types.StorageClassGlacierIr},
+		{"image/png", types.StorageClassStandard},
+		{"image/jpeg", types.StorageClassStandard},
+		{"application/x-ndjson", types.StorageClassDeepArchive},
+		{"application/pdf", types.StorageClassStandardIa},
+		{"", types.StorageClassStandardIa},
+	}
+	for _, test := range tests {
+		if got := cfg.storageClassFor(test.contentType); got != test.want {
+			t.Errorf("storageClassFor(%q) = %q, want %q", test.contentType, got, test.want)
+		}
+	}
+}
+
+func TestStorageClassDefault(t *testing.T) {
+	if got := testConfig(t, nil).storageClassFor("image/png"); got != types.StorageClassStandard {
+		t.Errorf("default storage class = %q, want STANDARD", got)
+	}
+	for _, env := range []map[string]string{
+		{"S3_UPLOAD_STORAGE_CLASS": "COLD"},
+		{"S3_UPLOAD_STORAGE_CLASS_MAP": "text/plain=FROZEN"},
+		{"S3_UPLOAD_STORAGE_CLASS_MAP": "text/plain"},
+	} {
+		if err := configError(t, env); err == nil {
+			t.Errorf("loadConfig() accepted %v", env)
+		}
+	}
+}
+
+func TestUploadStorageClass(t *testing.T) {
+	t.Setenv("S3_UPLOAD_STORAGE_CLASS_MAP", "text/plain=GLACIER_IR")
+	tests := []struct {
+		contentType string
+		want        string
+	}{
+		{contentType: "text/plain", want: "GLACIER_IR"},
+		{contentType: "application/octet-stream", want: "STANDARD"},
+	}
+	for _, test := range tests {
+		t.Run(test.contentType, func(t *testing.T) {
+			fake := newFakeS3(t)
+			response := upload(t, map[string]string{"Content-Type": test.contentType}, "some data")
+			if response.Headers["X-Amz-Storage-Class"] != test.want {
+				t.Errorf("X-Amz-Storage-Class = %q, want %q", response.Headers["X-Amz-Storage-Class"], test.want)
+			}
+			bucket := fake.bucketNames()[0]
+			key := fake.keys(bucket)[0]
+			if stored := fake.header(bucket, key).Get("X-Amz-Storage-Class"); stored != test.want {
+				t.Errorf("object stored as %q, want %q", stored, test.want)
+			}
+			if !strings.HasPrefix(bucket, uploadBucketPrefix) {
+				t.Errorf("uploaded into %q", bucket)
+			}
+		})
+	}
+}
+
+func TestValidateAccessPointARN(t *testing.T) {
+	tests := []struct {
+		value string
+		ok    bool
+	}{
+		{"arn:aws:s3:ap-south-1:123456789012:accesspoint/uploads", true},
+		{"arn:aws-cn:s3:cn-north-1:123456789012:accesspoint/uploads", true},
+		{"uploads", false},
+		{"arn:aws:s3:::uploads", false},
+		{"arn:aws:s3:ap-south-1:123456789012:accesspoint/", false},
+		{"arn:aws:s3:ap-south-1:123456789012:accesspoint/uploads/object/a.txt", false},
+		{"arn:aws:s3::123456789012:accesspoint/uploads", false},
+		{"arn:aws:s3:ap-south-1:1234:accesspoint/uploads", false},
+		{"arn:aws:s3-object-lambda:ap-south-1:123456789012:accesspoint/uploads", false},
+	}
+	for _, test := range tests {
+		if err := validateAccessPointARN(test.value); (err == nil) != test.ok {
+			t.Errorf("validateAccessPointARN(%q) = %v, want ok %v", test.value, err, test.ok)
+		}
+	}
+}
+
+func TestCompressionFor(t *testing.T) {
+	cfg := testConfig(t, map[string]string{
+		"S3_UPLOAD_COMPRESSION_MIN_SIZE": "application/pdf=4096, text/csv=100",
+		"S3_UPLOAD_COMPRESSION_MAP":      "text/csv=gzip",
+	})
+	tests := []struct {
+		contentType string
+		size        int
+		want        string
+	}{
+		{"text/plain", 10, "zstd"},
+		{"text/html; charset=utf-8", 1, "zstd"},
+		{"application/json", 5, "zstd"},
+		{"application/octet-stream", 1023, "none"},
+		{"application/octet-stream", 1024, "zstd"},
+		{"", 100, "none"},
+		{"application/pdf", 4095, "none"},
+		{"application/pdf", 4096, "zstd"},
+		{"text/csv", 99, "none"},
+		{"text/csv", 100, "gzip"},
+		{"image/png", 1 << 20, "none"},
+	}
+	for _, test := range tests {
+		if got := cfg.compressionFor(test.contentType, test.size); got != test.want {
+			t.Errorf("compressionFor(%q, %d) = %q, want %q", test.contentType, test.size, got, test.want)
+		}
+	}
+	if err := configError(t, map[string]string{"S3_UPLOAD_COMPRESSION_MIN_SIZE": "text/plain=-1"}); err == nil {
+		t.Error("loadConfig() accepted a negative minimum size")
+	}
+}
+
+func TestCompressionByType(t *testing.T) {
+	const size = 1 << 20
+	tests := []struct {
+		name    string
+		mapping string
+		want    map[string]string
+	}{
+		{
+			name: "defaults",
+			want: map[string]string{
+				"text/plain":               "zstd",
+				"application/json":         "zstd",
+				"image/jpeg":               "none",
+				"video/mp4":                "none",
+				"audio/mpeg; codecs=mp3":   "none",
+				"application/zip":          "none",
+				"application/octet-stream": "zstd",
+			},
+		},
+		{
+			name:    "mapped types",
+			mapping: "text/*=gzip,image/png=zstd,application/json=none",
+			want: map[string]string{
+				"text/plain":       "gzip",
+				"text/csv":         "gzip",
+				"image/png":        "zstd",
+				"image/jpeg":       "none",
+				"application/json": "none",
+				"application/xml":  "zstd",
+			},
+		},
+		{
+			name:    "default fallback",
+			mapping: "*=GZIP",
+			want:    map[string]string{"application/octet-stream": "gzip", "text/plain": "gzip", "image/gif": "none"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := testConfig(t, map[string]string{"S3_UPLOAD_COMPRESSION_MAP": test.mapping})
+			for contentType, want := range test.want {
+				if got := cfg.compressionFor(contentType, size); got != want {
+					t.Errorf("compressionFor(%q) = %q, want %q", contentType, got, want)
+				}
+			}
+		})
+	}
+	if err := configError(t, map[string]string{"S3_UPLOAD_COMPRESSION_MAP": "text/plain=brotli"}); err == nil {
+		t.Error("loadConfig() accepted an unknown algorithm")
+	}
+}
+
+func TestUploadCompressionByType(t *testing.T) {
+	t.Setenv("S3_UPLOAD_COMPRESSION_MAP", "text/csv=gzip")
+	data := strings.Repeat("region,amount\nnorth,42\n", 500)
+	for contentType, want := range map[string]string{"text/csv": "gzip", "text/plain": "zstd", "image/png": "none"} {
+		t.Run(contentType, func(t *testing.T) {
+			fake := newFakeS3(t)
+			upload(t, map[string]string{"Content-Type": contentType}, data)
+			bucket := fake.bucketNames()[0]
+			stored, metadata, _ := fake.object(bucket, fake.keys(bucket)[0])
+			if metadata["compression"] != want {
+				t.Fatalf("compression metadata = %q, want %q", metadata["compression"], want)
+			}
+			got, err := decodeObject(stored, metadata)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != data {
+				t.Errorf("decoded %d bytes, want %d", len(got), len(data))
+			}
+		})
+	}
+}
+
+func TestUploadCompressionThreshold(t *testing.T) {
+	tests := []struct {
+		contentType string
+		compression string
+	}{
+		{contentType: "text/plain", compression: "zstd"},
+		{contentType: "application/octet-stream", compression: "none"},
+	}
+	for _, test := range tests {
+		t.Run(test.contentType, func(t *testing.T) {
+			fake := newFakeS3(t)
+			upload(t, map[string]string{"Content-Type": test.contentType}, "a small file")
+			bucket := fake.bucketNames()[0]
+			_, metadata, _ := fake.object(bucket, fake.keys(bucket)[0])
+			if metadata["compression"] != test.compression {
+				t.Errorf("small %s stored with compression %q, want %q", test.contentType, metadata["compression"], test.compression)
+			}
+		})
+	}
+}
+
+func TestClampPartConcurrency(t *testing.T) {
+	const part = 8 << 20
+	tests := []struct {
+		name        string
+		concurrency int
+		budget      int
+		memory      int
+		want        int
+		ok          bool
+	}{
+		{name: "no budget", concurrency: 5, want: 5, ok: true},
+		{name: "within the budget", concurrency: 4, budget: 32 << 20, memory: 512 << 20, want: 4, ok: true},
+		{name: "clamped to the budget", concurrency: 10, budget: 40 << 20, memory: 512 << 20, want: 5, ok: true},
+		{name: "clamped to a single part", concurrency: 10, budget: part + 1, want: 1, ok: true},
+		{name: "budget can't hold a part", concurrency: 2, budget: part - 1},
+		{name: "budget over memory", concurrency: 2, budget: 256 << 20, memory: 128 << 20},
+		{name: "unbudgeted parts over memory", concurrency: 20, memory: 128 << 20},
+		{name: "unbudgeted parts within memory", concurrency: 16, memory: 128 << 20, want: 16, ok: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := clampPartConcurrency(part, test.concurrency, test.budget, test.memory)
+			if (err == nil) != test.ok {
+				t.Fatalf("clampPartConcurrency() error = %v, want ok %v", err, test.ok)
+			}
+			if got != test.want {
+				t.Errorf("clampPartConcurrency() = %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPartConcurrencyConfig(t *testing.T) {
+	cfg := testConfig(t, map[string]string{
+		"AWS_LAMBDA_FUNCTION_MEMORY_SIZE": "256",
+		"S3_UPLOAD_PART_SIZE":             "8388608",
+		"S3_UPLOAD_PART_CONCURRENCY":      "8",
+		"S3_UPLOAD_PART_MEMORY_BUDGET":    "33554432",
+	})
+	if cfg.PartConcurrency != 4 {
+		t.Errorf("PartConcurrency = %d, want 4 parts within the 32 MB budget", cfg.PartConcurrency)
+	}
+	if err := configError(t, map[string]string{"S3_UPLOAD_PART_MEMORY_BUDGET": "536870912"}); err == nil {
+		t.Error("loadConfig() accepted a budget beyond the function's memory")
+	}
+}
+
+func TestMemoryMultipartPath(t *testing.T) {
+	const size = 20 << 20
+	tests := []struct {
+		name      string
+		env       map[string]string
+		multipart bool
+	}{
+		{name: "128 MB function", env: map[string]string{"AWS_LAMBDA_FUNCTION_MEMORY_SIZE": "128"}, multipart: true},
+		{name: "1 GB function", env: map[string]string{"AWS_LAMBDA_FUNCTION_MEMORY_SIZE": "1024"}},
+		{name: "outside Lambda", env: map[string]string{"AWS_LAMBDA_FUNCTION_MEMORY_SIZE": ""}},
+		{
+			name: "overridden threshold",
+			env:  map[string]string{"AWS_LAMBDA_FUNCTION_MEMORY_SIZE": "128", "S3_UPLOAD_MULTIPART_THRESHOLD": "33554432"},
+		},
+	}
+	data := randomBytes(t, size)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := testConfig(t, test.env)
+			fake := newFakeS3(t)
+			if err := fake.basics(cfg).UploadFileToS3("uploads", "a.bin", data, UploadOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			if multipart := fake.count("CreateMultipartUpload") == 1; multipart != test.multipart {
+				t.Errorf("threshold %d: multipart = %v, want %v", cfg.MultipartThreshold, multipart, test.multipart)
+			}
+		})
+	}
+}
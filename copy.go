@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// CopyObject copies an object, keeping everything the stored data depends on. A
+// bare CopyObject keeps the metadata but drops the storage class and falls back to
+// the destination bucket's default encryption, so both are read from the source
+// and set explicitly. With the "replace" CopyMetadataDirective the metadata and
+// content headers are also rewritten from the source rather than left to S3.
+func (basics BucketBasics) CopyObject(srcBucket string, srcKey string, dstBucket string, dstKey string) error {
+	source, err := basics.S3Client.HeadObject(context.TODO(), &s3.HeadObjectInput{
+		Bucket: aws.String(srcBucket),
+		Key:    aws.String(srcKey),
+	})
+	if err != nil {
+		log.Printf("Couldn't read %v:%v to copy it. Here's why: %v\n", srcBucket, srcKey, err)
+		return err
+	}
+
+	input := &s3.CopyObjectInput{
+		Bucket:           aws.String(dstBucket),
+		Key:              aws.String(dstKey),
+		CopySource:       aws.String(copySource(srcBucket, srcKey)),
+		StorageClass:     types.StorageClass(source.StorageClass),
+		TaggingDirective: types.TaggingDirectiveCopy,
+		// Keep a whole-object checksum so the copy can be verified like the original
+		ChecksumAlgorithm: types.ChecksumAlgorithmSha256,
+	}
+	if source.ServerSideEncryption != "" {
+		input.ServerSideEncryption = source.ServerSideEncryption
+		input.SSEKMSKeyId = source.SSEKMSKeyId
+		input.BucketKeyEnabled = source.BucketKeyEnabled
+	}
+	if basics.Config.CopyMetadataDirective == types.MetadataDirectiveReplace {
+		input.MetadataDirective = types.MetadataDirectiveReplace
+		input.Metadata = source.Metadata
+		input.ContentType = source.ContentType
+		input.ContentEncoding = source.ContentEncoding
+		input.ContentDisposition = source.ContentDisposition
+		input.ContentLanguage = source.ContentLanguage
+		input.CacheControl = source.CacheControl
+	} else {
+		input.MetadataDirective = types.MetadataDirectiveCopy
+	}
+
+	if _, err = basics.S3Client.CopyObject(context.TODO(), input); err != nil {
+		log.Printf("Couldn't copy %v:%v to %v:%v. Here's why: %v\n", srcBucket, srcKey, dstBucket, dstKey, err)
+	}
+	return err
+}
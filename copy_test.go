@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+func TestCopyObjectKeepsMetadata(t *testing.T) {
+	source := http.Header{}
+	for name, value := range map[string]string{
+		"Content-Type":                                    "text/csv",
+		"Content-Encoding":                                "zstd",
+		"Content-Disposition":                             `attachment; filename="report.csv"`,
+		"Content-Language":                                "en-GB",
+		"Cache-Control":                                   "max-age=3600",
+		"X-Amz-Storage-Class":                             "STANDARD_IA",
+		"X-Amz-Server-Side-Encryption":                    "aws:kms",
+		"X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id":     "arn:aws:kms:ap-south-1:123456789012:key/uploads",
+		"X-Amz-Server-Side-Encryption-Bucket-Key-Enabled": "true",
+		"X-Amz-Meta-Compression":                          "zstd",
+		"X-Amz-Meta-Encryption":                           "aes-gcm",
+		"X-Amz-Meta-Original-Name":                        "report.csv",
+	} {
+		source.Set(name, value)
+	}
+	tests := []struct {
+		name      string
+		directive types.MetadataDirective
+	}{
+		{name: "copy", directive: types.MetadataDirectiveCopy},
+		{name: "replace", directive: types.MetadataDirectiveReplace},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := newFakeS3(t)
+			fake.put("uploads", "report.csv.zst", []byte("stored bytes"), source.Clone())
+			basics := fake.basics(Config{CopyMetadataDirective: test.directive})
+			if err := basics.CopyObject("uploads", "report.csv.zst", "archive", "2024/report.csv.zst"); err != nil {
+				t.Fatal(err)
+			}
+
+			data, _, ok := fake.object("archive", "2024/report.csv.zst")
+			if !ok || string(data) != "stored bytes" {
+				t.Fatalf("copy = %q, %v", data, ok)
+			}
+			// Every header the read path or S3 relies on survives, whichever side sets it
+			copied := fake.header("archive", "2024/report.csv.zst")
+			for name := range source {
+				if got, want := copied.Get(name), source.Get(name); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+			if copied.Get("X-Amz-Checksum-Sha256") != sha256Checksum([]byte("stored bytes")) {
+				t.Errorf("copy checksum = %q, want a whole-object SHA-256", copied.Get("X-Amz-Checksum-Sha256"))
+			}
+		})
+	}
+}
+
+func TestCopyObjectDefaultEncryption(t *testing.T) {
+	// A source without SSE headers leaves the copy to the bucket's default encryption
+	fake := newFakeS3(t)
+	fake.put("uploads", "a.txt", []byte("plain"), http.Header{"X-Amz-Meta-Compression": {"none"}})
+	if err := fake.basics(Config{CopyMetadataDirective: types.MetadataDirectiveCopy}).CopyObject("uploads", "a.txt", "uploads", "b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	copied := fake.header("uploads", "b.txt")
+	if copied.Get("X-Amz-Server-Side-Encryption") != "" || copied.Get("X-Amz-Meta-Compression") != "none" {
+		t.Errorf("copy headers = %v", copied)
+	}
+}
+
+func TestCopyObjectMissingSource(t *testing.T) {
+	fake := newFakeS3(t)
+	if err := fake.basics(Config{}).CopyObject("uploads", "missing.txt", "uploads", "copy.txt"); err == nil {
+		t.Error("CopyObject() of a missing object succeeded")
+	}
+	if copies := fake.count("CopyObject"); copies != 0 {
+		t.Errorf("CopyObject called %d times without a source", copies)
+	}
+}
+
+func TestCopyMetadataDirectiveConfig(t *testing.T) {
+	tests := []struct {
+		value string
+		want  types.MetadataDirective
+		ok    bool
+	}{
+		{value: "", want: types.MetadataDirectiveCopy, ok: true},
+		{value: "replace", want: types.MetadataDirectiveReplace, ok: true},
+		{value: "COPY", want: types.MetadataDirectiveCopy, ok: true},
+		{value: "merge"},
+	}
+	for _, test := range tests {
+		env := map[string]string{"S3_UPLOAD_COPY_METADATA_DIRECTIVE": test.value}
+		if !test.ok {
+			if err := configError(t, env); err == nil {
+				t.Errorf("loadConfig() accepted directive %q", test.value)
+			}
+			continue
+		}
+		if cfg := testConfig(t, env); cfg.CopyMetadataDirective != test.want {
+			t.Errorf("CopyMetadataDirective for %q = %q, want %q", test.value, cfg.CopyMetadataDirective, test.want)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// createOnlyMiddleware makes multipart uploads conditional on the key not existing.
+// The uploader doesn't pass IfNoneMatch through to CompleteMultipartUpload, where
+// S3 evaluates the condition, so it is set on the request here.
+func createOnlyMiddleware(stack *middleware.Stack) error {
+	return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("S3UploadCreateOnly",
+		func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+			if input, ok := in.Parameters.(*s3.CompleteMultipartUploadInput); ok {
+				input.IfNoneMatch = aws.String("*")
+			}
+			return next.HandleInitialize(ctx, in)
+		}), middleware.Before)
+}
+
+// isObjectExists reports whether a create-only upload failed because the key was
+// already taken, or was being written by a concurrent request
+func isObjectExists(err error) bool {
+	if errors.Is(err, fs.ErrExist) {
+		return true
+	}
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	return apiErr.ErrorCode() == "PreconditionFailed" || apiErr.ErrorCode() == "ConditionalRequestConflict"
+}
+
+// collisionKey numbers a key that is already taken, before its extension:
+// report.pdf.zst becomes report.pdf-2.zst on the first retry
+func collisionKey(key string, extension string, attempt int) string {
+	if !strings.HasSuffix(key, extension) {
+		extension = ""
+	}
+	return fmt.Sprintf("%s-%d%s", strings.TrimSuffix(key, extension), attempt+1, extension)
+}
+
+// collisionDelay is a random wait before a collision retry, so concurrent uploads
+// of one name spread out instead of colliding on every attempt
+func collisionDelay(backoff time.Duration, attempt int) time.Duration {
+	window := int64(backoff) << (attempt - 1)
+	if window <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(window))
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/smithy-go"
+)
+
+func TestUploadFileToS3CreateOnly(t *testing.T) {
+	original := []byte("the original object")
+	tests := []struct {
+		name       string
+		size       int
+		existing   bool
+		createOnly bool
+		conflict   bool
+	}{
+		{name: "single part new key", size: 1024, createOnly: true},
+		{name: "single part existing key", size: 1024, existing: true, createOnly: true, conflict: true},
+		{name: "multipart new key", size: 12 << 20, createOnly: true},
+		{name: "multipart existing key", size: 12 << 20, existing: true, createOnly: true, conflict: true},
+		{name: "overwrite allowed", size: 1024, existing: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := newFakeS3(t)
+			if test.existing {
+				fake.put("uploads", "a.bin", original, nil)
+			}
+			data := bytes.Repeat([]byte("n"), test.size)
+			basics := fake.basics(Config{MultipartThreshold: 8 << 20, PartSize: 5 << 20, PartConcurrency: 2})
+			err := basics.UploadFileToS3("uploads", "a.bin", data, UploadOptions{CreateOnly: test.createOnly})
+			if isObjectExists(err) != test.conflict {
+				t.Fatalf("UploadFileToS3() error = %v, want conflict %v", err, test.conflict)
+			}
+			if !test.conflict && err != nil {
+				t.Fatal(err)
+			}
+			if multipart := fake.count("CompleteMultipartUpload") > 0; multipart != (test.size > basics.Config.MultipartThreshold) {
+				t.Errorf("calls = %v, want multipart %v", fake.calls, !multipart)
+			}
+
+			stored, _, _ := fake.object("uploads", "a.bin")
+			want := data
+			if test.conflict {
+				want = original
+			}
+			if !bytes.Equal(stored, want) {
+				t.Errorf("stored %d bytes, want %d", len(stored), len(want))
+			}
+		})
+	}
+}
+
+func TestUploadCreateOnlyConflict(t *testing.T) {
+	t.Setenv("S3_UPLOAD_CREATE_ONLY", "true")
+	t.Setenv("S3_UPLOAD_KEY_TEMPLATE", "{name}")
+	t.Setenv("S3_UPLOAD_BREAKER_THRESHOLD", "1")
+	fake := newFakeS3(t)
+	first, contentType := multipartBody(t, testFile{name: "report.txt", contentType: "text/plain", data: "first"})
+	upload(t, map[string]string{"Content-Type": contentType}, first)
+
+	second, contentType := multipartBody(t, testFile{name: "report.txt", contentType: "text/plain", data: "second"})
+	response := handle(t, map[string]string{"Content-Type": contentType}, second)
+	if response.StatusCode != http.StatusConflict {
+		t.Fatalf("Handler() = %d %q, want 409", response.StatusCode, response.Body)
+	}
+	bucket := fake.bucketNames()[0]
+	if keys := fake.keys(bucket); len(keys) != 1 {
+		t.Errorf("stored %v, want only the first upload", keys)
+	}
+
+	// A conflict is the caller's mistake and must not trip the breaker
+	third, contentType := multipartBody(t, testFile{name: "other.txt", contentType: "text/plain", data: "third"})
+	upload(t, map[string]string{"Content-Type": contentType}, third)
+	if keys := fake.keys(bucket); len(keys) != 2 {
+		t.Errorf("stored %v, want the first and third uploads", keys)
+	}
+}
+
+func TestIsObjectExists(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{err: &smithy.GenericAPIError{Code: "PreconditionFailed"}, want: true},
+		{err: &smithy.GenericAPIError{Code: "ConditionalRequestConflict"}, want: true},
+		{err: fmt.Errorf("upload failed: %w", &smithy.GenericAPIError{Code: "PreconditionFailed"}), want: true},
+		{err: &smithy.GenericAPIError{Code: "AccessDenied"}},
+		{err: errors.New("PreconditionFailed")},
+		{err: nil},
+	}
+	for _, test := range tests {
+		if got := isObjectExists(test.err); got != test.want {
+			t.Errorf("isObjectExists(%v) = %v, want %v", test.err, got, test.want)
+		}
+	}
+}
+
+func TestCreateOnlyConfig(t *testing.T) {
+	err := configError(t, map[string]string{"S3_UPLOAD_CREATE_ONLY": "true", "S3_UPLOAD_BACKUP_ON_OVERWRITE": "true"})
+	if err == nil {
+		t.Error("loadConfig() accepted create-only uploads together with overwrite backups")
+	}
+}
+
+func TestCollisionKey(t *testing.T) {
+	tests := []struct {
+		key       string
+		extension string
+		attempt   int
+		want      string
+	}{
+		{key: "report.pdf.zst", extension: ".zst", attempt: 1, want: "report.pdf-2.zst"},
+		{key: "report.pdf.zst", extension: ".zst", attempt: 4, want: "report.pdf-5.zst"},
+		{key: "report.pdf", extension: "", attempt: 1, want: "report.pdf-2"},
+		// A key the extension was hashed away from is numbered at its end
+		{key: "ab/report.zst.x", extension: ".zst", attempt: 1, want: "ab/report.zst.x-2"},
+	}
+	for _, test := range tests {
+		if got := collisionKey(test.key, test.extension, test.attempt); got != test.want {
+			t.Errorf("collisionKey(%q, %q, %d) = %q, want %q", test.key, test.extension, test.attempt, got, test.want)
+		}
+	}
+}
+
+func TestCollisionDelay(t *testing.T) {
+	const backoff = 10 * time.Millisecond
+	for attempt := 1; attempt <= 4; attempt++ {
+		window := backoff << (attempt - 1)
+		for range 100 {
+			if delay := collisionDelay(backoff, attempt); delay < 0 || delay >= window {
+				t.Fatalf("collisionDelay(%v, %d) = %v, want within [0, %v)", backoff, attempt, delay, window)
+			}
+		}
+	}
+	if delay := collisionDelay(0, 1); delay != 0 {
+		t.Errorf("collisionDelay(0, 1) = %v, want no wait", delay)
+	}
+}
+
+func TestUploadCollisionRetries(t *testing.T) {
+	const uploaders = 12
+	t.Setenv("S3_UPLOAD_CREATE_ONLY", "true")
+	t.Setenv("S3_UPLOAD_COLLISION_RETRIES", fmt.Sprint(uploaders))
+	t.Setenv("S3_UPLOAD_COLLISION_BACKOFF", "1ms")
+	t.Setenv("S3_UPLOAD_KEY_TEMPLATE", "{name}")
+	fake := newFakeS3(t)
+
+	var wg sync.WaitGroup
+	statuses := make([]int, uploaders)
+	for i := range uploaders {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			body, contentType := multipartBody(t, testFile{name: "report.txt", contentType: "text/plain", data: fmt.Sprintf("upload %d", i)})
+			response, err := Handler(t.Context(), events.APIGatewayProxyRequest{
+				HTTPMethod: "POST",
+				Headers:    map[string]string{"Content-Type": contentType},
+				Body:       body,
+			})
+			if err != nil {
+				t.Error(err)
+			}
+			statuses[i] = response.StatusCode
+		}()
+	}
+	wg.Wait()
+	for i, status := range statuses {
+		if status != http.StatusOK {
+			t.Errorf("upload %d answered %d", i, status)
+		}
+	}
+
+	// Every upload must own a distinct key holding its own content
+	contents := map[string]bool{}
+	for _, bucket := range fake.bucketNames() {
+		for _, key := range fake.keys(bucket) {
+			stored, metadata, _ := fake.object(bucket, key)
+			data, err := decodeObject(stored, metadata)
+			if err != nil {
+				t.Fatalf("%s: %v", key, err)
+			}
+			contents[string(data)] = true
+		}
+	}
+	if len(contents) != uploaders {
+		t.Errorf("stored %d distinct uploads, want %d", len(contents), uploaders)
+	}
+}
+
+func TestUploadCollisionRetriesExhausted(t *testing.T) {
+	t.Setenv("S3_UPLOAD_CREATE_ONLY", "true")
+	t.Setenv("S3_UPLOAD_COLLISION_RETRIES", "2")
+	t.Setenv("S3_UPLOAD_COLLISION_BACKOFF", "1ms")
+	t.Setenv("S3_UPLOAD_KEY_TEMPLATE", "{name}")
+	fake := newFakeS3(t)
+	fake.Fail = func(operation string, bucket string, key string) (int, string) {
+		if operation == "PutObject" {
+			return http.StatusPreconditionFailed, "PreconditionFailed"
+		}
+		return 0, ""
+	}
+	body, contentType := multipartBody(t, testFile{name: "report.txt", contentType: "text/plain", data: "taken"})
+	response := handle(t, map[string]string{"Content-Type": contentType}, body)
+	if response.StatusCode != http.StatusConflict || !strings.Contains(response.Body, "after 3 attempts") {
+		t.Errorf("Handler() = %d %q, want 409 after 3 attempts", response.StatusCode, response.Body)
+	}
+	if puts := fake.count("PutObject"); puts != 3 {
+		t.Errorf("PutObject called %d times, want 3", puts)
+	}
+}
+
+func TestCollisionRetriesConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		ok   bool
+	}{
+		{name: "create-only", env: map[string]string{"S3_UPLOAD_CREATE_ONLY": "true", "S3_UPLOAD_COLLISION_RETRIES": "5"}, ok: true},
+		{name: "without create-only", env: map[string]string{"S3_UPLOAD_COLLISION_RETRIES": "5"}},
+		{name: "negative", env: map[string]string{"S3_UPLOAD_CREATE_ONLY": "true", "S3_UPLOAD_COLLISION_RETRIES": "-1"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := configError(t, test.env); (err == nil) != test.ok {
+				t.Errorf("loadConfig() error = %v, want ok %v", err, test.ok)
+			}
+		})
+	}
+}
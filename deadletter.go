@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// maxFailureReasonLength keeps the failure reason well within the 2 KB user metadata limit
+const maxFailureReasonLength = 1024
+
+// WriteDeadLetter stores the payload of an upload that failed after the SDK's retries
+// in the configured dead-letter bucket, along with the failure reason, so it can be
+// reprocessed later. It is a no-op when no dead-letter bucket is configured.
+func (basics BucketBasics) WriteDeadLetter(bucketName string, fileName string, fileData []byte, reason error) {
+	if basics.Config.DeadLetterBucket == "" {
+		return
+	}
+	if len(fileData) > basics.Config.DeadLetterMaxBytes {
+		log.Printf("Not dead-lettering %v:%v, payload of %d bytes exceeds the %d byte limit\n",
+			bucketName, fileName, len(fileData), basics.Config.DeadLetterMaxBytes)
+		return
+	}
+
+	deadLetterKey := basics.Config.DeadLetterPrefix + bucketName + "/" + fileName
+	_, err := basics.S3Client.PutObject(context.TODO(), &s3.PutObjectInput{
+		Bucket: aws.String(basics.Config.DeadLetterBucket),
+		Key:    aws.String(deadLetterKey),
+		Body:   bytes.NewReader(fileData),
+		Metadata: map[string]string{
+			"failure-reason":  failureReason(reason),
+			"original-bucket": bucketName,
+			"original-key":    fileName,
+		},
+	})
+	if err != nil {
+		log.Printf("Couldn't dead-letter %v:%v to %v. Here's why: %v\n", bucketName, fileName, basics.Config.DeadLetterBucket, err)
+	}
+}
+
+// failureReason renders an error as a printable ASCII metadata value
+func failureReason(reason error) string {
+	message := strings.Map(func(r rune) rune {
+		if r < ' ' || r > '~' {
+			return ' '
+		}
+		return r
+	}, reason.Error())
+	if len(message) > maxFailureReasonLength {
+		message = message[:maxFailureReasonLength]
+	}
+	return message
+}
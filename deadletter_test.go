@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestUploadDeadLetter(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxBytes string
+		fail     bool
+		want     bool
+	}{
+		{name: "terminal failure", maxBytes: "1048576", fail: true, want: true},
+		{name: "success", maxBytes: "1048576", fail: false, want: false},
+		{name: "payload over the limit", maxBytes: "8", fail: true, want: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("S3_UPLOAD_DLQ_BUCKET", "upload-dlq")
+			t.Setenv("S3_UPLOAD_DLQ_MAX_BYTES", test.maxBytes)
+			t.Setenv("S3_UPLOAD_BREAKER_THRESHOLD", "0")
+			fake := newFakeS3(t)
+			fake.Fail = func(operation string, bucket string, key string) (int, string) {
+				if test.fail && operation == "PutObject" && bucket != "upload-dlq" {
+					return http.StatusInternalServerError, "InternalError"
+				}
+				return 0, ""
+			}
+
+			response := handle(t, nil, "payload worth keeping")
+			if test.fail != (response.StatusCode >= http.StatusInternalServerError) {
+				t.Fatalf("Handler() status = %d: %s", response.StatusCode, response.Body)
+			}
+			keys := fake.keys("upload-dlq")
+			if !test.want {
+				if len(keys) != 0 {
+					t.Errorf("dead-lettered %v", keys)
+				}
+				return
+			}
+			if len(keys) != 1 || !strings.HasPrefix(keys[0], "failed/"+uploadBucketPrefix) {
+				t.Fatalf("dead-letter keys = %v", keys)
+			}
+			data, metadata, _ := fake.object("upload-dlq", keys[0])
+			bucket, key, _ := strings.Cut(strings.TrimPrefix(keys[0], "failed/"), "/")
+			if metadata["original-bucket"] != bucket || metadata["original-key"] != key {
+				t.Errorf("metadata = %v, want the original %v:%v", metadata, bucket, key)
+			}
+			if !strings.Contains(metadata["failure-reason"], "InternalError") {
+				t.Errorf("failure-reason = %q", metadata["failure-reason"])
+			}
+			// Payloads this small are stored uncompressed
+			if decoded, err := decodeObject(data, map[string]string{"compression": "none", "encryption": "aes-gcm"}); err != nil || !bytes.Equal(decoded, []byte("payload worth keeping")) {
+				t.Errorf("dead-lettered payload decodes to %q, %v", decoded, err)
+			}
+		})
+	}
+}
+
+func TestFailureReason(t *testing.T) {
+	tests := []struct {
+		reason error
+		want   string
+	}{
+		{errors.New("upload failed"), "upload failed"},
+		{errors.New("line one\nline two\té"), "line one line two  "},
+		{errors.New(strings.Repeat("x", 2000)), strings.Repeat("x", maxFailureReasonLength)},
+	}
+	for _, test := range tests {
+		if got := failureReason(test.reason); got != test.want {
+			t.Errorf("failureReason(%.20q) = %.20q, want %.20q", test.reason.Error(), got, test.want)
+		}
+	}
+}
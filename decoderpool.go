@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io"
+	"log"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// decoders is the process-wide warm pool of zstd decoders used on the read path.
+// It is sized once from S3_UPLOAD_DECODER_POOL_SIZE when the container starts.
+var decoders = newDecoderPool(decoderPoolSize())
+
+// decoderPool keeps idle zstd decoders for reuse, avoiding a fresh allocation and
+// decoder goroutines per download. Decoders are reset rather than closed between
+// uses; only those that don't fit back in the pool are closed.
+type decoderPool struct {
+	idle chan *zstd.Decoder
+}
+
+func newDecoderPool(size int) *decoderPool {
+	return &decoderPool{idle: make(chan *zstd.Decoder, size)}
+}
+
+// get returns a decoder reading from r
+func (p *decoderPool) get(r io.Reader) (*zstd.Decoder, error) {
+	select {
+	case decoder := <-p.idle:
+		if err := decoder.Reset(r); err != nil {
+			decoder.Close()
+			return nil, err
+		}
+		return decoder, nil
+	default:
+		// Synchronous decoding keeps idle pooled decoders free of background goroutines
+		return zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+	}
+}
+
+// put returns a decoder to the pool once the caller is done with it
+func (p *decoderPool) put(decoder *zstd.Decoder) {
+	// Drop the reference to the previous input
+	if err := decoder.Reset(nil); err != nil {
+		decoder.Close()
+		return
+	}
+	select {
+	case p.idle <- decoder:
+	default:
+		decoder.Close()
+	}
+}
+
+// decoderPoolSize reads the pool size, falling back to the default on invalid values
+func decoderPoolSize() int {
+	size, err := envInt("S3_UPLOAD_DECODER_POOL_SIZE", 4)
+	if err != nil || size < 0 {
+		log.Printf("Invalid S3_UPLOAD_DECODER_POOL_SIZE, using 4: %v", err)
+		return 4
+	}
+	return size
+}
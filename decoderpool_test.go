@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// zstdObjects returns compressed test objects of assorted sizes with their plaintext
+func zstdObjects(t testing.TB) (compressed [][]byte, plain [][]byte) {
+	t.Helper()
+	for i, size := range []int{0, 1, 1000, 200_000, 3 << 20} {
+		data := bytes.Repeat([]byte{byte('a' + i), byte(i), 'x'}, size/3+1)[:size]
+		encoded, err := compressZstd(data, zstd.SpeedDefault)
+		if err != nil {
+			t.Fatal(err)
+		}
+		compressed, plain = append(compressed, encoded), append(plain, data)
+	}
+	return compressed, plain
+}
+
+// decodeFresh decodes with a decoder created just for data
+func decodeFresh(data []byte) ([]byte, error) {
+	decoder, err := zstd.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer decoder.Close()
+	return io.ReadAll(decoder)
+}
+
+// decodePooled decodes with a decoder borrowed from pool
+func decodePooled(pool *decoderPool, data []byte) ([]byte, error) {
+	decoder, err := pool.get(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer pool.put(decoder)
+	return io.ReadAll(decoder)
+}
+
+func TestDecoderPoolMatchesFresh(t *testing.T) {
+	compressed, plain := zstdObjects(t)
+	pool := newDecoderPool(1)
+	// Go through the objects twice so every decoder is reused across sizes
+	for round := 0; round < 2; round++ {
+		for i, data := range compressed {
+			fresh, err := decodeFresh(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pooled, err := decodePooled(pool, data)
+			if err != nil {
+				t.Fatalf("round %d object %d: %v", round, i, err)
+			}
+			if !bytes.Equal(pooled, fresh) || !bytes.Equal(pooled, plain[i]) {
+				t.Errorf("round %d object %d: pooled decoder output differs", round, i)
+			}
+		}
+	}
+	if len(pool.idle) != 1 {
+		t.Errorf("pool holds %d decoders, want 1", len(pool.idle))
+	}
+}
+
+func TestDecoderPoolConcurrent(t *testing.T) {
+	compressed, plain := zstdObjects(t)
+	pool := newDecoderPool(2)
+	var wg sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range compressed {
+				got, err := decodePooled(pool, compressed[(i+worker)%len(compressed)])
+				if err != nil || !bytes.Equal(got, plain[(i+worker)%len(compressed)]) {
+					t.Errorf("worker %d object %d: %v", worker, i, err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if len(pool.idle) > 2 {
+		t.Errorf("pool grew to %d decoders", len(pool.idle))
+	}
+}
+
+func TestDecoderPoolAfterCorruptInput(t *testing.T) {
+	compressed, plain := zstdObjects(t)
+	pool := newDecoderPool(1)
+	corrupt := append([]byte{}, compressed[3]...)
+	corrupt[len(corrupt)/2] ^= 0xff
+	if _, err := decodePooled(pool, corrupt); err == nil {
+		t.Fatal("corrupt object decoded")
+	}
+	// A decoder that saw bad input must still decode the next object correctly
+	if got, err := decodePooled(pool, compressed[3]); err != nil || !bytes.Equal(got, plain[3]) {
+		t.Errorf("decode after corrupt input: %v", err)
+	}
+}
+
+func BenchmarkDecodeFresh(b *testing.B) {
+	compressed, _ := zstdObjects(b)
+	data := compressed[3]
+	b.SetBytes(200_000)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := decodeFresh(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodePooled(b *testing.B) {
+	compressed, _ := zstdObjects(b)
+	data := compressed[3]
+	pool := newDecoderPool(4)
+	b.SetBytes(200_000)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := decodePooled(pool, data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// recentUploads remembers content uploaded by this warm Lambda container so
+// identical uploads within the dedup window reuse the existing object
+var recentUploads = newDedupCache()
+
+// dedupEntry records where a piece of content was uploaded
+type dedupEntry struct {
+	hash       string
+	bucketName string
+	fileName   string
+	uploadedAt time.Time
+}
+
+// dedupCache is an LRU of recent uploads keyed by content hash
+type dedupCache struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+func newDedupCache() *dedupCache {
+	return &dedupCache{entries: make(map[string]*list.Element), order: list.New()}
+}
+
+// lookup returns the location content was uploaded to, if that happened within window
+func (c *dedupCache) lookup(hash string, window time.Duration, now time.Time) (bucketName string, fileName string, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[hash]
+	if !ok {
+		return "", "", false
+	}
+	entry := element.Value.(*dedupEntry)
+	if now.Sub(entry.uploadedAt) > window {
+		c.order.Remove(element)
+		delete(c.entries, hash)
+		return "", "", false
+	}
+	c.order.MoveToFront(element)
+	return entry.bucketName, entry.fileName, true
+}
+
+// add records an upload, evicting the least recently used entries beyond maxEntries
+func (c *dedupCache) add(hash string, bucketName string, fileName string, maxEntries int, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[hash]; ok {
+		c.order.Remove(element)
+	}
+	c.entries[hash] = c.order.PushFront(&dedupEntry{
+		hash:       hash,
+		bucketName: bucketName,
+		fileName:   fileName,
+		uploadedAt: now,
+	})
+	for c.order.Len() > maxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*dedupEntry).hash)
+	}
+}
+
+// plaintextHash returns the hex-encoded SHA-256 digest of a file's original content,
+// and its size. It is computed before compression so the same content always hashes
+// the same, whatever compression level it is stored at; client-compressed files are
+// decompressed to hash them.
+func plaintextHash(file uploadFile) (string, int, error) {
+	if !file.PreCompressed {
+		sum := sha256.Sum256(file.Data)
+		return hex.EncodeToString(sum[:]), len(file.Data), nil
+	}
+
+	decoder, err := decoders.get(bytes.NewReader(file.Data))
+	if err != nil {
+		return "", 0, fmt.Errorf("zstandard decompression initialization error: %v", err)
+	}
+	defer decoders.put(decoder)
+	hash := sha256.New()
+	size, err := io.Copy(hash, decoder)
+	if err != nil {
+		return "", 0, fmt.Errorf("zstandard decompression error: %v", err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), int(size), nil
+}
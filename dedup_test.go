@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestDedupCache(t *testing.T) {
+	start := time.Date(2024, 1, 31, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		adds   []string
+		lookup string
+		after  time.Duration
+		want   bool
+	}{
+		{name: "hit within the window", adds: []string{"a"}, lookup: "a", after: 30 * time.Second, want: true},
+		{name: "hit at the window's end", adds: []string{"a"}, lookup: "a", after: time.Minute, want: true},
+		{name: "miss after the window", adds: []string{"a"}, lookup: "a", after: time.Minute + time.Nanosecond, want: false},
+		{name: "miss for other content", adds: []string{"a"}, lookup: "b", want: false},
+		{name: "miss after eviction by size", adds: []string{"a", "b", "c"}, lookup: "a", want: false},
+		{name: "most recent entries kept", adds: []string{"a", "b", "c"}, lookup: "c", want: true},
+		{name: "re-added entry kept", adds: []string{"a", "b", "a", "c"}, lookup: "a", want: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cache := newDedupCache()
+			for i, hash := range test.adds {
+				cache.add(hash, "bucket", "key-"+hash, 2, start.Add(time.Duration(i)*time.Millisecond))
+			}
+			_, fileName, ok := cache.lookup(test.lookup, time.Minute, start.Add(time.Duration(len(test.adds)-1)*time.Millisecond+test.after))
+			if ok != test.want {
+				t.Fatalf("lookup(%q) = %v, want %v", test.lookup, ok, test.want)
+			}
+			if ok && fileName != "key-"+test.lookup {
+				t.Errorf("lookup(%q) = %q", test.lookup, fileName)
+			}
+		})
+	}
+}
+
+func TestDedupCacheLRU(t *testing.T) {
+	now := time.Now()
+	cache := newDedupCache()
+	cache.add("a", "bucket", "key-a", 2, now)
+	cache.add("b", "bucket", "key-b", 2, now)
+	// Looking a up makes b the least recently used
+	if _, _, ok := cache.lookup("a", time.Minute, now); !ok {
+		t.Fatal("lookup(a) missed")
+	}
+	cache.add("c", "bucket", "key-c", 2, now)
+	if _, _, ok := cache.lookup("b", time.Minute, now); ok {
+		t.Error("b survived eviction")
+	}
+	if _, _, ok := cache.lookup("a", time.Minute, now); !ok {
+		t.Error("a was evicted")
+	}
+}
+
+func TestUploadDedup(t *testing.T) {
+	t.Setenv("S3_UPLOAD_DEDUP_WINDOW", "1m")
+	t.Cleanup(func() { recentUploads = newDedupCache() })
+	fake := newFakeS3(t)
+	accept := map[string]string{"Accept": "application/json"}
+
+	first := uploadedFiles(t, upload(t, accept, "the same content"))
+	puts := fake.count("PutObject")
+	second := uploadedFiles(t, upload(t, accept, "the same content"))
+	if len(first) != 1 || len(second) != 1 || first[0].Bucket != second[0].Bucket || first[0].Key != second[0].Key {
+		t.Fatalf("second upload went to %+v, want %+v", second, first)
+	}
+	if fake.count("PutObject") != puts || fake.count("HeadObject") != 0 {
+		t.Errorf("deduplicated upload called PutObject %d and HeadObject %d times", fake.count("PutObject")-puts, fake.count("HeadObject"))
+	}
+
+	// Once the entry is evicted the content is stored again
+	recentUploads = newDedupCache()
+	third := uploadedFiles(t, upload(t, accept, "the same content"))
+	if len(third) != 1 || fake.count("PutObject") == puts {
+		t.Errorf("upload after eviction was deduplicated to %+v", third)
+	}
+}
+
+func TestPlaintextHashIgnoresCompressionLevel(t *testing.T) {
+	content := bytes.Repeat([]byte("identical content "), 5000)
+	raw, rawSize, err := plaintextHash(uploadFile{Data: content})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rawSize != len(content) {
+		t.Errorf("plaintext size = %d, want %d", rawSize, len(content))
+	}
+	for _, level := range []zstd.EncoderLevel{zstd.SpeedFastest, zstd.SpeedDefault, zstd.SpeedBestCompression} {
+		compressed, err := compressZstd(content, level)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hash, size, err := plaintextHash(uploadFile{Data: compressed, PreCompressed: true})
+		if err != nil {
+			t.Fatalf("level %v: %v", level, err)
+		}
+		if hash != raw || size != rawSize {
+			t.Errorf("level %v: plaintextHash() = %s, %d, want %s, %d", level, hash, size, raw, rawSize)
+		}
+	}
+}
+
+func TestContentHashKeyIgnoresCompressionLevel(t *testing.T) {
+	t.Setenv("S3_UPLOAD_KEY_STRATEGY", "content-hash")
+	content := strings.Repeat("identical content ", 5000)
+	preCompressed, err := compressZstd([]byte(content), zstd.SpeedBetterCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests := []map[string]string{
+		{"X-Compression-Level": "fastest"},
+		{"X-Compression-Level": "best"},
+		{"Content-Encoding": "zstd"},
+	}
+	var keys []string
+	for _, headers := range requests {
+		fake := newFakeS3(t)
+		body := content
+		if headers["Content-Encoding"] == "zstd" {
+			body = string(preCompressed)
+		}
+		upload(t, headers, body)
+		bucket := fake.bucketNames()[0]
+		keys = append(keys, fake.keys(bucket)[0])
+	}
+	sum := sha256.Sum256([]byte(content))
+	for i, key := range keys {
+		if !strings.HasPrefix(key, hex.EncodeToString(sum[:])) {
+			t.Errorf("upload %v stored as %q, want the plaintext hash", requests[i], key)
+		}
+	}
+}
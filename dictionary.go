@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/klauspost/compress/dict"
+	"github.com/klauspost/compress/zstd"
+)
+
+// maxDictionarySampleSize skips objects too large to be typical of the small files
+// a dictionary helps with
+const maxDictionarySampleSize = 128 << 10
+
+// minDictionarySamples is the fewest samples a useful dictionary can be trained on
+const minDictionarySamples = 8
+
+// activeDictionaryName is the object under DictionaryPrefix holding the ID of the
+// dictionary new uploads are compressed with
+const activeDictionaryName = "active"
+
+// ErrTooFewSamples is returned when a prefix holds too few small objects to train on
+var ErrTooFewSamples = errors.New("too few objects to train a dictionary")
+
+// dictionaries caches trained zstd dictionaries by ID for the life of the container
+var dictionaries = &dictionaryCache{dicts: map[uint32][]byte{}}
+
+// dictionaryCache holds the dictionaries seen so far and which one is active
+type dictionaryCache struct {
+	mu    sync.Mutex
+	dicts map[uint32][]byte
+	// load fetches a dictionary missing from the cache; nil when none are stored
+	load func(id uint32) ([]byte, error)
+	// active is the active dictionary's ID as of activeChecked, zero for none
+	active        uint32
+	activeChecked time.Time
+}
+
+// lookup returns a dictionary by ID, loading it on first use
+func (cache *dictionaryCache) lookup(id uint32) ([]byte, error) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if d, ok := cache.dicts[id]; ok {
+		return d, nil
+	}
+	if cache.load == nil {
+		return nil, zstd.ErrUnknownDictionary
+	}
+	d, err := cache.load(id)
+	if err != nil {
+		return nil, err
+	}
+	cache.dicts[id] = d
+	return d, nil
+}
+
+// activate records a dictionary as the one new uploads use
+func (cache *dictionaryCache) activate(id uint32, d []byte, now time.Time) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.dicts[id] = d
+	cache.active, cache.activeChecked = id, now
+}
+
+// useDictionaries lets the read path load dictionaries from DictionaryBucket
+func (basics BucketBasics) useDictionaries() {
+	if basics.Config.DictionaryBucket == "" {
+		return
+	}
+	dictionaries.mu.Lock()
+	defer dictionaries.mu.Unlock()
+	dictionaries.load = basics.loadDictionary
+}
+
+// dictionaryKey returns the key a dictionary is stored under
+func (basics BucketBasics) dictionaryKey(id uint32) string {
+	return fmt.Sprintf("%s%d.dict", basics.Config.DictionaryPrefix, id)
+}
+
+// loadDictionary downloads a stored dictionary
+func (basics BucketBasics) loadDictionary(id uint32) ([]byte, error) {
+	result, err := basics.S3Client.GetObject(context.TODO(), &s3.GetObjectInput{
+		Bucket: aws.String(basics.Config.DictionaryBucket),
+		Key:    aws.String(basics.dictionaryKey(id)),
+	})
+	if err != nil {
+		log.Printf("Couldn't load dictionary %d. Here's why: %v\n", id, err)
+		return nil, err
+	}
+	defer result.Body.Close()
+	return io.ReadAll(result.Body)
+}
+
+// activeDictionary returns the dictionary new uploads are compressed with, or nil when
+// none has been trained. The active ID is re-read every DictionaryRefresh so a newly
+// trained dictionary reaches every container.
+func (basics BucketBasics) activeDictionary() ([]byte, error) {
+	dictionaries.mu.Lock()
+	active, checked := dictionaries.active, dictionaries.activeChecked
+	dictionaries.mu.Unlock()
+
+	if time.Since(checked) >= basics.Config.DictionaryRefresh {
+		result, err := basics.S3Client.GetObject(context.TODO(), &s3.GetObjectInput{
+			Bucket: aws.String(basics.Config.DictionaryBucket),
+			Key:    aws.String(basics.Config.DictionaryPrefix + activeDictionaryName),
+		})
+		var noSuchKey *types.NoSuchKey
+		switch {
+		case errors.As(err, &noSuchKey):
+			active = 0
+		case err != nil:
+			log.Printf("Couldn't read the active dictionary. Here's why: %v\n", err)
+			return nil, err
+		default:
+			encoded, err := io.ReadAll(result.Body)
+			result.Body.Close()
+			if err != nil {
+				return nil, err
+			}
+			id, err := strconv.ParseUint(strings.TrimSpace(string(encoded)), 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid active dictionary ID %q", encoded)
+			}
+			active = uint32(id)
+		}
+		dictionaries.mu.Lock()
+		dictionaries.active, dictionaries.activeChecked = active, time.Now()
+		dictionaries.mu.Unlock()
+	}
+
+	if active == 0 {
+		return nil, nil
+	}
+	return dictionaries.lookup(active)
+}
+
+// frameDictionary returns the dictionary a zstd frame was compressed with, or nil
+// for frames compressed without one
+func frameDictionary(frame []byte) ([]byte, error) {
+	var header zstd.Header
+	if err := header.Decode(frame); err != nil || header.DictionaryID == 0 {
+		return nil, nil
+	}
+	return dictionaries.lookup(header.DictionaryID)
+}
+
+// sampleObjects downloads and decodes up to DictionarySamples small objects under a prefix
+func (basics BucketBasics) sampleObjects(bucketName string, prefix string) ([][]byte, error) {
+	var samples [][]byte
+	paginator := s3.NewListObjectsV2Paginator(basics.S3Client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucketName),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() && len(samples) < basics.Config.DictionarySamples {
+		page, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			log.Printf("Couldn't list %v:%v. Here's why: %v\n", bucketName, prefix, err)
+			return nil, err
+		}
+		for _, object := range page.Contents {
+			if len(samples) == basics.Config.DictionarySamples {
+				break
+			}
+			if aws.ToInt64(object.Size) == 0 || aws.ToInt64(object.Size) > maxDictionarySampleSize {
+				continue
+			}
+			data, metadata, err := basics.DownloadFile(bucketName, aws.ToString(object.Key), false)
+			if err != nil {
+				return nil, err
+			}
+			// Objects that aren't ours, such as sidecars, can't be decoded and are skipped
+			plainData, err := decodeObject(data, metadata)
+			if err != nil {
+				continue
+			}
+			samples = append(samples, plainData)
+		}
+	}
+	return samples, nil
+}
+
+// TrainDictionary trains a zstd dictionary on a sample of the objects under a
+// prefix, stores it in DictionaryBucket and makes it the active dictionary, so
+// uploads from this container on, and from others within DictionaryRefresh, are
+// compressed with it. It returns the dictionary's ID and the sample count.
+func (basics BucketBasics) TrainDictionary(bucketName string, prefix string) (uint32, int, error) {
+	samples, err := basics.sampleObjects(bucketName, prefix)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(samples) < minDictionarySamples {
+		return 0, len(samples), ErrTooFewSamples
+	}
+
+	trained, err := dict.BuildZstdDict(samples, dict.Options{MaxDictSize: basics.Config.DictionarySize, HashBytes: 6})
+	if err != nil {
+		return 0, len(samples), fmt.Errorf("dictionary training error: %v", err)
+	}
+	// A zstd dictionary starts with its magic number and then its ID
+	id := binary.LittleEndian.Uint32(trained[4:8])
+
+	_, err = basics.S3Client.PutObject(context.TODO(), &s3.PutObjectInput{
+		Bucket: aws.String(basics.Config.DictionaryBucket),
+		Key:    aws.String(basics.dictionaryKey(id)),
+		Body:   bytes.NewReader(trained),
+	})
+	if err != nil {
+		log.Printf("Couldn't store dictionary %d. Here's why: %v\n", id, err)
+		return 0, len(samples), err
+	}
+	// Activate only once the dictionary itself is stored, so every reader can load it
+	_, err = basics.S3Client.PutObject(context.TODO(), &s3.PutObjectInput{
+		Bucket: aws.String(basics.Config.DictionaryBucket),
+		Key:    aws.String(basics.Config.DictionaryPrefix + activeDictionaryName),
+		Body:   strings.NewReader(strconv.FormatUint(uint64(id), 10)),
+	})
+	if err != nil {
+		log.Printf("Couldn't activate dictionary %d. Here's why: %v\n", id, err)
+		return 0, len(samples), err
+	}
+	dictionaries.activate(id, trained, time.Now())
+	return id, len(samples), nil
+}
+
+// handleTrainDictionary serves ?action=train-dictionary&bucket=<bucket>&prefix=<prefix>
+// for the principals in S3_UPLOAD_ADMIN_PRINCIPALS
+func handleTrainDictionary(ctx context.Context, request events.APIGatewayProxyRequest, appCfg Config) events.APIGatewayProxyResponse {
+	if appCfg.DictionaryBucket == "" {
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusNotFound}
+	}
+	if principal := requestPrincipal(request); principal == "" || !appCfg.AdminPrincipals[strings.ToLower(principal)] {
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusForbidden, Body: "Training dictionaries is an admin action."}
+	}
+	bucketName := requestBucket(request.QueryStringParameters, appCfg)
+	if bucketName == "" {
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusBadRequest, Body: "The bucket query parameter is required."}
+	}
+
+	s3Client, err := newS3Client(ctx, appCfg)
+	if err != nil {
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}
+	}
+	basics := BucketBasics{S3Client: s3Client, Config: appCfg}
+	basics.useDictionaries()
+
+	id, samples, err := basics.TrainDictionary(bucketName, request.QueryStringParameters["prefix"])
+	if errors.Is(err, ErrTooFewSamples) {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusUnprocessableEntity,
+			Body:       fmt.Sprintf("Found %d usable objects, at least %d are needed.", samples, minDictionarySamples),
+		}
+	}
+	if err != nil {
+		return s3ErrorResponse(err, appCfg)
+	}
+
+	body, err := json.Marshal(map[string]interface{}{"dictionary": id, "samples": samples})
+	if err != nil {
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}
+	}
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(body),
+	}
+}
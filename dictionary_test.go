@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/klauspost/compress/zstd"
+)
+
+// useDictionaryCache gives the test an empty dictionary cache
+func useDictionaryCache(t *testing.T) *dictionaryCache {
+	t.Helper()
+	previous := dictionaries
+	dictionaries = &dictionaryCache{dicts: map[uint32][]byte{}}
+	t.Cleanup(func() { dictionaries = previous })
+	return dictionaries
+}
+
+// invoice returns a small JSON document like the others of its kind
+func invoice(i int) []byte {
+	return fmt.Appendf(nil, `{"invoiceId": "INV-%05d", "customer": {"name": "Customer %d", "country": "IN"}, "currency": "INR", "status": "paid", "lines": [{"sku": "SKU-%d", "quantity": %d}]}`,
+		i, i, i*7, i%5+1)
+}
+
+// storeInvoices stores count invoices under prefix the way Handler does
+func storeInvoices(t *testing.T, fake *fakeS3, bucket string, prefix string, count int) {
+	t.Helper()
+	basics := fake.basics(Config{})
+	for i := range count {
+		stored, metadata := pipelineObject(t, invoice(i))
+		if err := basics.UploadFileToS3(bucket, fmt.Sprintf("%sinvoice-%03d.json.zst", prefix, i), stored, UploadOptions{Metadata: metadata}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func dictionaryConfig() Config {
+	return Config{DictionaryBucket: "dicts", DictionaryPrefix: "dictionaries/", DictionaryRefresh: time.Hour, DictionarySamples: 100, DictionarySize: 64 << 10}
+}
+
+func TestSampleObjects(t *testing.T) {
+	fake := newFakeS3(t)
+	storeInvoices(t, fake, "uploads", "invoices/", 12)
+	storeInvoices(t, fake, "uploads", "receipts/", 3)
+	// Empty, oversized and undecodable objects aren't useful samples
+	fake.put("uploads", "invoices/empty.txt", nil, nil)
+	large, metadata := pipelineObject(t, testPayload(maxDictionarySampleSize*4))
+	if err := fake.basics(Config{}).UploadFileToS3("uploads", "invoices/large.bin.zst", large, UploadOptions{Metadata: metadata}); err != nil {
+		t.Fatal(err)
+	}
+	if len(large) <= maxDictionarySampleSize {
+		t.Fatalf("large object is only %d bytes", len(large))
+	}
+	fake.put("uploads", "invoices/sidecar.json.zst", []byte("not compressed"), http.Header{"X-Amz-Meta-Compression": {"zstd"}, "X-Amz-Meta-Encryption": {"none"}})
+
+	tests := []struct {
+		name    string
+		prefix  string
+		samples int
+		want    int
+	}{
+		{name: "every usable object", prefix: "invoices/", samples: 100, want: 12},
+		{name: "capped", prefix: "invoices/", samples: 5, want: 5},
+		{name: "other prefix", prefix: "receipts/", samples: 100, want: 3},
+		{name: "nothing there", prefix: "missing/", samples: 100, want: 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			samples, err := fake.basics(Config{DictionarySamples: test.samples}).sampleObjects("uploads", test.prefix)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(samples) != test.want {
+				t.Fatalf("sampleObjects() returned %d samples, want %d", len(samples), test.want)
+			}
+			// Samples are the decoded files, not the stored bytes
+			for _, sample := range samples {
+				if !bytes.HasPrefix(sample, []byte(`{"invoiceId": "INV-`)) {
+					t.Errorf("sample %q isn't a decoded invoice", sample)
+				}
+			}
+		})
+	}
+}
+
+func TestTrainDictionary(t *testing.T) {
+	cache := useDictionaryCache(t)
+	fake := newFakeS3(t)
+	storeInvoices(t, fake, "uploads", "invoices/", 20)
+	basics := fake.basics(dictionaryConfig())
+	var stored []string
+	fake.Before = func(operation string, bucket string, key string) {
+		if operation == "PutObject" && bucket == "dicts" {
+			stored = append(stored, key)
+		}
+	}
+
+	id, samples, err := basics.TrainDictionary("uploads", "invoices/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id == 0 || samples != 20 {
+		t.Fatalf("TrainDictionary() = %d, %d", id, samples)
+	}
+	// The dictionary is stored before the active object names it
+	trained, _, ok := fake.object("dicts", basics.dictionaryKey(id))
+	if !ok {
+		t.Fatalf("dictionary %d wasn't stored; dicts holds %v", id, fake.keys("dicts"))
+	}
+	if active, _, _ := fake.object("dicts", "dictionaries/active"); string(active) != strconv.FormatUint(uint64(id), 10) {
+		t.Errorf("active dictionary = %q, want %d", active, id)
+	}
+	if !slices.Equal(stored, []string{basics.dictionaryKey(id), "dictionaries/active"}) {
+		t.Errorf("stored %v, want the dictionary stored before it's activated", stored)
+	}
+	if cache.active != id || !bytes.Equal(cache.dicts[id], trained) {
+		t.Errorf("cache active = %d, want the trained dictionary %d", cache.active, id)
+	}
+
+	// Uploads compressed with it name it in their frame and decode back
+	dictionary, err := basics.activeDictionary()
+	if err != nil || !bytes.Equal(dictionary, trained) {
+		t.Fatalf("activeDictionary() = %d bytes, %v", len(dictionary), err)
+	}
+	compressed, err := compressData(t.Context(), invoice(99), "zstd", zstd.SpeedDefault, dictionary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var header zstd.Header
+	if err := header.Decode(compressed); err != nil || header.DictionaryID != id {
+		t.Errorf("frame dictionary = %d, %v, want %d", header.DictionaryID, err, id)
+	}
+	if plain, err := decompressZstd(compressed); err != nil || !bytes.Equal(plain, invoice(99)) {
+		t.Errorf("decompressZstd() = %q, %v", plain, err)
+	}
+}
+
+func TestTrainDictionaryFailures(t *testing.T) {
+	tests := []struct {
+		name     string
+		invoices int
+		fail     string
+		err      error
+	}{
+		{name: "too few samples", invoices: minDictionarySamples - 1, err: ErrTooFewSamples},
+		{name: "dictionary not stored", invoices: 20, fail: ".dict"},
+		{name: "not activated", invoices: 20, fail: "/active"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cache := useDictionaryCache(t)
+			fake := newFakeS3(t)
+			storeInvoices(t, fake, "uploads", "invoices/", test.invoices)
+			fake.Fail = func(operation string, bucket string, key string) (int, string) {
+				if test.fail != "" && operation == "PutObject" && bucket == "dicts" && strings.HasSuffix(key, test.fail) {
+					return http.StatusForbidden, "AccessDenied"
+				}
+				return 0, ""
+			}
+			_, _, err := fake.basics(dictionaryConfig()).TrainDictionary("uploads", "invoices/")
+			if err == nil {
+				t.Fatal("TrainDictionary() succeeded")
+			}
+			if test.err != nil && !errors.Is(err, test.err) {
+				t.Errorf("TrainDictionary() error = %v, want %v", err, test.err)
+			}
+			// A dictionary that isn't stored and active everywhere isn't used here either
+			if cache.active != 0 {
+				t.Errorf("dictionary %d activated after a failed training", cache.active)
+			}
+			if _, _, ok := fake.object("dicts", "dictionaries/active"); ok {
+				t.Error("active dictionary stored after a failed training")
+			}
+		})
+	}
+}
+
+func TestActiveDictionary(t *testing.T) {
+	fake := newFakeS3(t)
+	storeInvoices(t, fake, "uploads", "invoices/", 20)
+	trainer := fake.basics(dictionaryConfig())
+	useDictionaryCache(t)
+	if dictionary, err := trainer.activeDictionary(); err != nil || dictionary != nil {
+		t.Fatalf("activeDictionary() before training = %d bytes, %v", len(dictionary), err)
+	}
+	id, _, err := trainer.TrainDictionary("uploads", "invoices/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trained, _, _ := fake.object("dicts", trainer.dictionaryKey(id))
+
+	tests := []struct {
+		name    string
+		refresh time.Duration
+		want    []byte
+	}{
+		// Another container only sees the new dictionary once its refresh comes round
+		{name: "before refresh", refresh: time.Hour},
+		{name: "after refresh", refresh: 0, want: trained},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cache := useDictionaryCache(t)
+			cache.activeChecked = time.Now()
+			cfg := dictionaryConfig()
+			cfg.DictionaryRefresh = test.refresh
+			container := fake.basics(cfg)
+			container.useDictionaries()
+			dictionary, err := container.activeDictionary()
+			if err != nil || !bytes.Equal(dictionary, test.want) {
+				t.Errorf("activeDictionary() = %d bytes, %v, want %d bytes", len(dictionary), err, len(test.want))
+			}
+		})
+	}
+
+	cache := useDictionaryCache(t)
+	fake.put("dicts", "dictionaries/active", []byte("latest"), nil)
+	if _, err := fake.basics(dictionaryConfig()).activeDictionary(); err == nil {
+		t.Error("activeDictionary() accepted an invalid active ID")
+	}
+	if cache.active != 0 {
+		t.Errorf("cache active = %d after an invalid active ID", cache.active)
+	}
+}
+
+// trainRequest asks Handler to train a dictionary on a prefix as principal
+func trainRequest(principal string, bucket string, prefix string) events.APIGatewayProxyRequest {
+	return events.APIGatewayProxyRequest{
+		HTTPMethod:            "POST",
+		QueryStringParameters: map[string]string{"action": "train-dictionary", "bucket": bucket, "prefix": prefix},
+		RequestContext:        events.APIGatewayProxyRequestContext{Authorizer: map[string]interface{}{"principalId": principal}},
+	}
+}
+
+func TestHandleTrainDictionary(t *testing.T) {
+	tests := []struct {
+		name      string
+		bucketEnv string
+		principal string
+		bucket    string
+		prefix    string
+		status    int
+	}{
+		{name: "disabled", principal: "Admin-1", bucket: "uploads", prefix: "invoices/", status: http.StatusNotFound},
+		{name: "not an admin", bucketEnv: "dicts", principal: "user-1", bucket: "uploads", prefix: "invoices/", status: http.StatusForbidden},
+		{name: "anonymous", bucketEnv: "dicts", bucket: "uploads", prefix: "invoices/", status: http.StatusForbidden},
+		{name: "no bucket", bucketEnv: "dicts", principal: "Admin-1", prefix: "invoices/", status: http.StatusBadRequest},
+		{name: "too few samples", bucketEnv: "dicts", principal: "Admin-1", bucket: "uploads", prefix: "receipts/", status: http.StatusUnprocessableEntity},
+		{name: "trained", bucketEnv: "dicts", principal: "Admin-1", bucket: "uploads", prefix: "invoices/", status: http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useDictionaryCache(t)
+			t.Setenv("S3_UPLOAD_DICTIONARY_BUCKET", test.bucketEnv)
+			t.Setenv("S3_UPLOAD_ADMIN_PRINCIPALS", "admin-1")
+			fake := newFakeS3(t)
+			storeInvoices(t, fake, "uploads", "invoices/", 20)
+			storeInvoices(t, fake, "uploads", "receipts/", 2)
+			puts := fake.count("PutObject")
+
+			response, err := Handler(t.Context(), trainRequest(test.principal, test.bucket, test.prefix))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response.StatusCode != test.status {
+				t.Fatalf("Handler() = %d %q, want %d", response.StatusCode, response.Body, test.status)
+			}
+			if test.status != http.StatusOK {
+				if fake.count("PutObject") != puts {
+					t.Errorf("calls = %v, want no dictionary stored", fake.calls)
+				}
+				return
+			}
+			var body struct {
+				Dictionary uint32
+				Samples    int
+			}
+			if err := json.Unmarshal([]byte(response.Body), &body); err != nil || body.Dictionary == 0 || body.Samples != 20 {
+				t.Errorf("response = %q, %v", response.Body, err)
+			}
+			if _, _, ok := fake.object("dicts", fmt.Sprintf("dictionaries/%d.dict", body.Dictionary)); !ok {
+				t.Errorf("dictionary %d wasn't stored", body.Dictionary)
+			}
+		})
+	}
+}
+
+func TestUploadWithTrainedDictionary(t *testing.T) {
+	useDictionaryCache(t)
+	t.Setenv("S3_UPLOAD_DICTIONARY_BUCKET", "dicts")
+	t.Setenv("S3_UPLOAD_ADMIN_PRINCIPALS", "admin-1")
+	t.Setenv("S3_UPLOAD_KEY_TEMPLATE", "{name}")
+	fake := newFakeS3(t)
+	storeInvoices(t, fake, "uploads", "invoices/", 20)
+	if response, err := Handler(t.Context(), trainRequest("admin-1", "uploads", "invoices/")); err != nil || response.StatusCode != http.StatusOK {
+		t.Fatalf("training = %d %q, %v", response.StatusCode, response.Body, err)
+	}
+
+	body, contentType := multipartBody(t, testFile{name: "next.json", contentType: "application/json", data: string(invoice(100))})
+	upload(t, map[string]string{"Content-Type": contentType}, body)
+	bucket := uploadBucketName(time.Now())
+	stored, metadata, ok := fake.object(bucket, "next.json.zst")
+	if !ok {
+		t.Fatalf("%s holds %v", bucket, fake.keys(bucket))
+	}
+
+	// A fresh container without the dictionary can't decode it
+	useDictionaryCache(t)
+	if _, err := decodeObject(stored, metadata); err == nil {
+		t.Fatal("upload decoded without its dictionary")
+	}
+	// One that can load dictionaries fetches it from the dictionary bucket
+	fake.basics(dictionaryConfig()).useDictionaries()
+	if plain, err := decodeObject(stored, metadata); err != nil || !bytes.Equal(plain, invoice(100)) {
+		t.Errorf("decodeObject() = %q, %v", plain, err)
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go/middleware"
+	"github.com/klauspost/compress/zstd"
+)
+
+// ErrChecksumMismatch is returned when downloaded bytes don't match the checksum stored with the object
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// storedEncodingMetadata carries an object's Content-Encoding alongside its user
+// metadata. Objects put by other tools with Content-Encoding: gzip, e.g. for
+// CloudFront to serve as-is, come back from GetObject still compressed.
+const storedEncodingMetadata = "stored-content-encoding"
+
+// DownloadFile downloads an object and its user metadata from an S3 bucket into memory
+func (basics BucketBasics) DownloadFile(bucketName string, fileName string, verify bool) ([]byte, map[string]string, error) {
+	var buf bytes.Buffer
+	metadata, err := basics.DownloadTo(bucketName, fileName, &buf, verify)
+	if err != nil {
+		return nil, nil, err
+	}
+	return buf.Bytes(), metadata, nil
+}
+
+// DownloadTo streams an object from an S3 bucket into w and returns its user
+// metadata. When verify is set the streamed bytes are re-checked against the SHA-256
+// checksum stored at upload; a mismatch is only known once w has received everything,
+// so callers must discard what was written when it fails with ErrChecksumMismatch.
+// Objects past their TTL fail with ErrObjectExpired before anything is written.
+func (basics BucketBasics) DownloadTo(bucketName string, fileName string, w io.Writer, verify bool) (map[string]string, error) {
+	object, err := basics.OpenObject(bucketName, fileName, verify)
+	if err != nil {
+		return nil, err
+	}
+	defer object.Body.Close()
+
+	err = copyVerified(w, object)
+	if errors.Is(err, ErrChecksumMismatch) {
+		log.Printf("Checksum mismatch for %v:%v\n", bucketName, fileName)
+		return nil, err
+	}
+	if err != nil {
+		log.Printf("Couldn't read file %v:%v. Here's why: %v\n", bucketName, fileName, err)
+		return nil, err
+	}
+	return object.Metadata, nil
+}
+
+// storedObject is an object opened for reading
+type storedObject struct {
+	// Body streams the stored bytes and must be closed
+	Body io.ReadCloser
+	// Metadata is the object's user metadata, with its Content-Encoding under storedEncodingMetadata
+	Metadata map[string]string
+	// Checksum is the base64 SHA-256 digest Body must match, empty when it isn't verified
+	Checksum string
+}
+
+// OpenObject opens an object in an S3 bucket for streaming. When verify is set and
+// the object has a whole-object SHA-256 checksum it is returned to check the body
+// against. Objects past their TTL fail with ErrObjectExpired.
+func (basics BucketBasics) OpenObject(bucketName string, fileName string, verify bool) (storedObject, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(fileName),
+	}
+	if verify {
+		input.ChecksumMode = types.ChecksumModeEnabled
+	}
+	result, err := basics.S3Client.GetObject(context.TODO(), input, s3.WithAPIOptions(skipChecksumValidation))
+	if err != nil {
+		log.Printf("Couldn't download file %v:%v. Here's why: %v\n", bucketName, fileName, err)
+		return storedObject{}, err
+	}
+
+	if err := basics.checkExpiry(bucketName, fileName, result.Metadata); err != nil {
+		result.Body.Close()
+		return storedObject{}, err
+	}
+
+	var checksum string
+	if verify {
+		if result.ChecksumSHA256 == nil || isCompositeChecksum(*result.ChecksumSHA256) {
+			log.Printf("No whole-object checksum for %v:%v, skipping verification\n", bucketName, fileName)
+		} else {
+			checksum = *result.ChecksumSHA256
+		}
+	}
+
+	metadata := result.Metadata
+	if encoding := aws.ToString(result.ContentEncoding); encoding != "" {
+		metadata = make(map[string]string, len(result.Metadata)+1)
+		for name, value := range result.Metadata {
+			metadata[name] = value
+		}
+		metadata[storedEncodingMetadata] = strings.ToLower(encoding)
+	}
+	return storedObject{Body: result.Body, Metadata: metadata, Checksum: checksum}, nil
+}
+
+// skipChecksumValidation removes the SDK's own check of downloaded bytes against the
+// checksum, which fails the read with an error callers can't tell apart from a
+// dropped connection. The same checksum is checked by copyVerified and decodeStream,
+// which report ErrChecksumMismatch.
+func skipChecksumValidation(stack *middleware.Stack) error {
+	stack.Deserialize.Remove("AWSChecksum:ValidateOutputPayloadChecksum")
+	return nil
+}
+
+// copyVerified copies an opened object's body to w, failing with ErrChecksumMismatch
+// once it has all been copied if it doesn't match the object's checksum
+func copyVerified(w io.Writer, object storedObject) error {
+	hash := sha256.New()
+	if object.Checksum != "" {
+		w = io.MultiWriter(w, hash)
+	}
+	if _, err := io.Copy(w, object.Body); err != nil {
+		return err
+	}
+	if object.Checksum != "" && base64.StdEncoding.EncodeToString(hash.Sum(nil)) != object.Checksum {
+		return ErrChecksumMismatch
+	}
+	return nil
+}
+
+// PresignOptions overrides response headers on a presigned download, so one stored
+// object can be served under different filenames or content types
+type PresignOptions struct {
+	ResponseContentDisposition string
+	ResponseContentType        string
+}
+
+// PresignDownload returns a presigned GetObject URL for an object
+func (basics BucketBasics) PresignDownload(bucketName string, fileName string, lifetime time.Duration, opts PresignOptions) (string, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(fileName),
+	}
+	if opts.ResponseContentDisposition != "" {
+		input.ResponseContentDisposition = aws.String(opts.ResponseContentDisposition)
+	}
+	if opts.ResponseContentType != "" {
+		input.ResponseContentType = aws.String(opts.ResponseContentType)
+	}
+
+	presignClient := s3.NewPresignClient(basics.S3Client)
+	request, err := presignClient.PresignGetObject(context.TODO(), input, s3.WithPresignExpires(lifetime))
+	if err != nil {
+		log.Printf("Couldn't presign download of %v:%v. Here's why: %v\n", bucketName, fileName, err)
+		return "", err
+	}
+	return request.URL, nil
+}
+
+// sha256Checksum returns the base64-encoded SHA-256 digest in the form S3 stores it
+func sha256Checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// isCompositeChecksum reports whether a checksum is a multipart checksum-of-checksums
+// ("<digest>-<parts>"), which can't be compared with a digest of the whole object
+func isCompositeChecksum(checksum string) bool {
+	return strings.Contains(checksum, "-")
+}
+
+// decodeObject reverses the upload pipeline recorded in an object's header or, for
+// objects stored without one, in its metadata
+func decodeObject(data []byte, metadata map[string]string) ([]byte, error) {
+	if isGzipEncoded(metadata) {
+		var err error
+		if data, err = decompressGzip(data); err != nil {
+			return nil, err
+		}
+		// Objects this handler didn't write carry the file itself under the encoding
+		if !isPipelineObject(data, metadata) {
+			return data, nil
+		}
+	}
+
+	if hasObjectHeader(data) {
+		header, err := parseObjectHeader(data)
+		if err != nil {
+			return nil, err
+		}
+		data, metadata = data[objectHeaderSize:], header.metadata()
+	}
+
+	compressedData := data
+	if metadata["encryption"] != "none" {
+		var err error
+		if compressedData, err = decryptPayload(data, metadata["encryption"] == "aes-gcm"); err != nil {
+			return nil, err
+		}
+	}
+	switch metadata["compression"] {
+	case "none":
+		return compressedData, nil
+	case "gzip":
+		return decompressGzip(compressedData)
+	}
+
+	plainData, err := decompressZstd(compressedData)
+	if err != nil {
+		return nil, fmt.Errorf("zstandard decompression error: %v", err)
+	}
+	return plainData, nil
+}
+
+// isGzipEncoded reports whether an object was stored with Content-Encoding: gzip
+func isGzipEncoded(metadata map[string]string) bool {
+	return metadata[storedEncodingMetadata] == "gzip"
+}
+
+// isPipelineObject reports whether an object was written by this handler, so its
+// bytes still have to go through decodeObject to get the uploaded file back
+func isPipelineObject(data []byte, metadata map[string]string) bool {
+	return hasObjectHeader(data) || metadata["compression"] != ""
+}
+
+// acceptsGzip reports whether a client's Accept-Encoding lists gzip
+func acceptsGzip(headers map[string]string) bool {
+	for _, coding := range strings.Split(headerValue(headers, "Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(coding, ";")
+		name = strings.TrimSpace(name)
+		if !strings.EqualFold(name, "gzip") && name != "*" {
+			continue
+		}
+		// q=0 means the client refuses the coding
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if weight, err := strconv.ParseFloat(q, 64); err == nil && weight == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// decryptAndDecompress reverses compressAndEncrypt
+func decryptAndDecompress(data []byte) ([]byte, error) {
+	decryptedData, err := decryptPayload(data, true)
+	if err != nil {
+		return nil, err
+	}
+
+	// Decompress the data using Zstandard
+	plainData, err := decompressZstd(decryptedData)
+	if err != nil {
+		return nil, fmt.Errorf("zstandard decompression error: %v", err)
+	}
+
+	return plainData, nil
+}
+
+// decryptPayload reverses encryptCompressed. Objects recorded as encrypted must hold
+// an authenticated stream and fail with ErrDecryption otherwise, and objects still
+// carrying the legacy key prefix fail with ErrLegacyKeyPrefix.
+func decryptPayload(data []byte, encrypted bool) ([]byte, error) {
+	if bytes.HasPrefix(data, legacyKeyPrefix) {
+		return nil, ErrLegacyKeyPrefix
+	}
+	key, err := encryptionKey()
+	if err != nil {
+		return nil, err
+	}
+
+	decryptedData, err := decrypt(data, key, encrypted)
+	if errors.Is(err, ErrDecryption) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("AES decryption error: %v", err)
+	}
+	return decryptedData, nil
+}
+
+// decompressGzip decompresses gzip-compressed data
+func decompressGzip(data []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("gzip decompression error: %v", err)
+	}
+	plainData, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("gzip decompression error: %v", err)
+	}
+	return plainData, nil
+}
+
+// decompressZstd decompresses Zstandard-compressed data, with the trained dictionary
+// its frame names if it has one
+func decompressZstd(data []byte) ([]byte, error) {
+	dictionary, err := frameDictionary(data)
+	if err != nil {
+		return nil, err
+	}
+	if dictionary != nil {
+		decoder, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderDicts(dictionary))
+		if err != nil {
+			return nil, fmt.Errorf("zstandard decompression initialization error: %v", err)
+		}
+		defer decoder.Close()
+		return decoder.DecodeAll(data, nil)
+	}
+
+	decoder, err := decoders.get(nil)
+	if err != nil {
+		return nil, fmt.Errorf("zstandard decompression initialization error: %v", err)
+	}
+	defer decoders.put(decoder)
+	return decoder.DecodeAll(data, nil)
+}
+
+// decrypt reverses encrypt. Objects written before encryption was implemented hold
+// the plain zstd stream, which is only accepted when encrypted is false: a stream
+// that should be encrypted but lacks the magic was truncated or tampered with.
+func decrypt(data []byte, key []byte, encrypted bool) ([]byte, error) {
+	if !bytes.HasPrefix(data, encryptionMagic) {
+		if encrypted {
+			return nil, ErrDecryption
+		}
+		return data, nil
+	}
+	var buf bytes.Buffer
+	if err := decryptStream(&buf, bytes.NewReader(data), key); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+)
+
+func TestDownloadVerifiesChecksum(t *testing.T) {
+	data := []byte("bytes that must arrive intact")
+	tests := []struct {
+		name    string
+		corrupt func(stored []byte) []byte
+		header  string
+		verify  bool
+		want    []byte
+		err     error
+	}{
+		{name: "matching bytes", verify: true, want: data},
+		{name: "corrupted bytes", corrupt: flipByte, verify: true, err: ErrChecksumMismatch},
+		{name: "truncated bytes", corrupt: func(stored []byte) []byte { return stored[:len(stored)-1] }, verify: true, err: ErrChecksumMismatch},
+		{name: "verification disabled", corrupt: flipByte, verify: false, want: flipByte(data)},
+		{name: "composite checksum skipped", corrupt: flipByte, header: "qUiQTy8PR5uPgZdpSzAYSw==-3", verify: true, want: flipByte(data)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := newFakeS3(t)
+			basics := fake.basics(Config{MultipartThreshold: 1 << 20})
+			if err := basics.UploadFileToS3("uploads", "a.txt", data, UploadOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			header := fake.header("uploads", "a.txt")
+			if header.Get("X-Amz-Checksum-Sha256") != sha256Checksum(data) {
+				t.Fatalf("upload stored checksum %q, want %q", header.Get("X-Amz-Checksum-Sha256"), sha256Checksum(data))
+			}
+			if test.header != "" {
+				header.Set("X-Amz-Checksum-Sha256", test.header)
+			}
+			if test.corrupt != nil {
+				stored, _, _ := fake.object("uploads", "a.txt")
+				fake.put("uploads", "a.txt", test.corrupt(stored), header)
+			}
+
+			got, _, err := basics.DownloadFile("uploads", "a.txt", test.verify)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("DownloadFile() error = %v, want %v", err, test.err)
+			}
+			if err == nil && !bytes.Equal(got, test.want) {
+				t.Errorf("DownloadFile() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+// flipByte returns data with its first byte altered
+func flipByte(data []byte) []byte {
+	corrupted := append([]byte{}, data...)
+	corrupted[0] ^= 0xff
+	return corrupted
+}
+
+func TestIsCompositeChecksum(t *testing.T) {
+	for checksum, want := range map[string]bool{
+		sha256Checksum([]byte("x")):  false,
+		"qUiQTy8PR5uPgZdpSzAYSw==-3": true,
+		"":                           false,
+		"abc=-10000":                 true,
+	} {
+		if got := isCompositeChecksum(checksum); got != want {
+			t.Errorf("isCompositeChecksum(%q) = %v, want %v", checksum, got, want)
+		}
+	}
+}
+
+func TestHandleDownloadChecksumMismatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     string
+		corrupt bool
+		status  int
+	}{
+		{name: "intact", env: "true", status: http.StatusOK},
+		{name: "corrupted", env: "true", corrupt: true, status: http.StatusBadGateway},
+		{name: "corrupted without verification", env: "false", corrupt: true, status: http.StatusInternalServerError},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("S3_UPLOAD_VERIFY_CHECKSUM", test.env)
+			cfg, err := loadConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			fake := newFakeS3(t)
+			bucket := uploadBucketName(time.Now())
+			stored, metadata := pipelineObject(t, []byte("stored through the pipeline"))
+			if err := fake.basics(cfg).UploadFileToS3(bucket, "a.txt.zst", stored, UploadOptions{Metadata: metadata}); err != nil {
+				t.Fatal(err)
+			}
+			if test.corrupt {
+				data, _, _ := fake.object(bucket, "a.txt.zst")
+				fake.put(bucket, "a.txt.zst", flipByte(data[:len(data)-1]), fake.header(bucket, "a.txt.zst"))
+			}
+
+			response := handleDownload(t.Context(), events.APIGatewayProxyRequest{
+				QueryStringParameters: map[string]string{"action": "download", "bucket": bucket, "key": "a.txt.zst"},
+				RequestContext:        events.APIGatewayProxyRequestContext{Authorizer: map[string]interface{}{"principalId": "user-1"}},
+			}, cfg)
+			if response.StatusCode != test.status {
+				t.Errorf("handleDownload() status = %d, want %d", response.StatusCode, test.status)
+			}
+		})
+	}
+}
+
+func TestPresignDownloadOverrides(t *testing.T) {
+	basics := newFakeS3(t).basics(Config{})
+	tests := []struct {
+		name string
+		opts PresignOptions
+		want url.Values
+	}{
+		{name: "no overrides", want: url.Values{}},
+		{
+			name: "disposition",
+			opts: PresignOptions{ResponseContentDisposition: `attachment; filename="report 2024.csv"`},
+			want: url.Values{"response-content-disposition": {`attachment; filename="report 2024.csv"`}},
+		},
+		{
+			name: "disposition and content type",
+			opts: PresignOptions{ResponseContentDisposition: "inline", ResponseContentType: "text/csv"},
+			want: url.Values{"response-content-disposition": {"inline"}, "response-content-type": {"text/csv"}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			signed, err := basics.PresignDownload("filename20240131-235959", "report.csv", 15*time.Minute, test.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			parsed, err := url.Parse(signed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			query := parsed.Query()
+			if query.Get("X-Amz-Signature") == "" || query.Get("X-Amz-Expires") != "900" {
+				t.Errorf("URL %q is not presigned for 15 minutes", signed)
+			}
+			for _, name := range []string{"response-content-disposition", "response-content-type"} {
+				if got, want := query[name], test.want[name]; !slices.Equal(got, want) {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestHandlePresignOverrides(t *testing.T) {
+	newFakeS3(t)
+	response := handlePresign(t.Context(), events.APIGatewayProxyRequest{
+		QueryStringParameters: map[string]string{
+			"action": "presign", "bucket": uploadBucketName(time.Now()), "key": "a.txt",
+			"disposition": "attachment; filename=b.txt", "content_type": "text/plain",
+		},
+		RequestContext: events.APIGatewayProxyRequestContext{Authorizer: map[string]interface{}{"principalId": "user-1"}},
+	}, Config{PresignExpiry: time.Minute})
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("handlePresign() status = %d: %s", response.StatusCode, response.Body)
+	}
+	parsed, err := url.Parse(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := parsed.Query()
+	if query.Get("response-content-disposition") != "attachment; filename=b.txt" || query.Get("response-content-type") != "text/plain" {
+		t.Errorf("presigned URL %q is missing the response overrides", response.Body)
+	}
+}
+
+// syntheticStream returns size reproducible pseudo-random bytes without holding them
+func syntheticStream(size int64) io.Reader {
+	return io.LimitReader(rand.New(rand.NewSource(size)), size)
+}
+
+// streamDigest returns the SHA-256 of everything read from r
+func streamDigest(t *testing.T, r io.Reader) []byte {
+	t.Helper()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		t.Fatal(err)
+	}
+	return hash.Sum(nil)
+}
+
+func TestUploadFromReaderDownloadTo(t *testing.T) {
+	tests := []struct {
+		name  string
+		size  int64
+		parts int
+	}{
+		{name: "empty", size: 0, parts: 0},
+		{name: "below one part", size: 1 << 20, parts: 0},
+		{name: "several parts", size: 22 << 20, parts: 5},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := newFakeS3(t)
+			basics := fake.basics(Config{PartSize: int(manager.MinUploadPartSize), PartConcurrency: 2})
+			if err := basics.UploadFromReader("uploads", "large.bin", syntheticStream(test.size), UploadOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			// The uploader sends a body that fits in one part as a plain PutObject
+			if parts := fake.count("UploadPart"); parts != test.parts {
+				t.Errorf("UploadPart called %d times, want %d", parts, test.parts)
+			}
+
+			hash := sha256.New()
+			var written countingWriter
+			if _, err := basics.DownloadTo("uploads", "large.bin", io.MultiWriter(hash, &written), true); err != nil {
+				t.Fatal(err)
+			}
+			if written.n != test.size {
+				t.Errorf("DownloadTo() wrote %d bytes, want %d", written.n, test.size)
+			}
+			if !bytes.Equal(hash.Sum(nil), streamDigest(t, syntheticStream(test.size))) {
+				t.Error("DownloadTo() streamed different bytes from those uploaded")
+			}
+		})
+	}
+}
+
+func TestDownloadToVerifiesLargeStream(t *testing.T) {
+	const size = 12 << 20
+	data, err := io.ReadAll(syntheticStream(size))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		corrupt bool
+		err     error
+	}{
+		{name: "intact"},
+		{name: "corrupted", corrupt: true, err: ErrChecksumMismatch},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := newFakeS3(t)
+			header := http.Header{}
+			header.Set("X-Amz-Checksum-Sha256", sha256Checksum(data))
+			stored := data
+			if test.corrupt {
+				stored = append(append([]byte{}, data[:size-1]...), data[size-1]^0xff)
+			}
+			fake.put("uploads", "large.bin", stored, header)
+
+			// The checksum is only known to fail once every byte has been written
+			var written countingWriter
+			_, err := fake.basics(Config{}).DownloadTo("uploads", "large.bin", &written, true)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("DownloadTo() error = %v, want %v", err, test.err)
+			}
+			if written.n != size {
+				t.Errorf("DownloadTo() wrote %d bytes, want %d", written.n, size)
+			}
+		})
+	}
+}
+
+func TestDownloadToWriteError(t *testing.T) {
+	fake := newFakeS3(t)
+	fake.put("uploads", "large.bin", bytes.Repeat([]byte("x"), 1<<20), nil)
+	if _, err := fake.basics(Config{}).DownloadTo("uploads", "large.bin", &failingWriter{limit: 64 << 10}, false); !errors.Is(err, io.ErrShortWrite) {
+		t.Errorf("DownloadTo() error = %v, want %v", err, io.ErrShortWrite)
+	}
+}
+
+// countingWriter counts the bytes written to it and discards them
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		want           bool
+	}{
+		{acceptEncoding: "", want: false},
+		{acceptEncoding: "gzip", want: true},
+		{acceptEncoding: "br, GZIP;q=0.8", want: true},
+		{acceptEncoding: "*", want: true},
+		{acceptEncoding: "gzip;q=0", want: false},
+		{acceptEncoding: "deflate, br", want: false},
+		{acceptEncoding: "x-gzip", want: false},
+	}
+	for _, test := range tests {
+		if got := acceptsGzip(map[string]string{"accept-encoding": test.acceptEncoding}); got != test.want {
+			t.Errorf("acceptsGzip(%q) = %v, want %v", test.acceptEncoding, got, test.want)
+		}
+	}
+}
+
+func TestHandleDownloadGzipEncoded(t *testing.T) {
+	foreign := []byte("body { color: teal }")
+	plain := []byte("uploaded through the handler")
+	stored, metadata := pipelineObject(t, plain)
+	wrapped := http.Header{"Content-Encoding": {"gzip"}}
+	for name, value := range metadata {
+		wrapped.Set("X-Amz-Meta-"+name, value)
+	}
+	tests := []struct {
+		name           string
+		mode           string
+		key            string
+		acceptEncoding string
+		want           []byte
+		encoding       string
+	}{
+		{name: "gzip client", mode: "negotiate", key: "site.css", acceptEncoding: "gzip, br", want: gzipped(t, foreign), encoding: "gzip"},
+		{name: "plain client", mode: "negotiate", key: "site.css", want: foreign},
+		{name: "gzip refused", mode: "negotiate", key: "site.css", acceptEncoding: "gzip;q=0", want: foreign},
+		{name: "always decompress", mode: "decompress", key: "site.css", acceptEncoding: "gzip", want: foreign},
+		{name: "always pass through", mode: "passthrough", key: "site.css", want: gzipped(t, foreign), encoding: "gzip"},
+		// The handler's own objects are decoded whatever the client accepts
+		{name: "gzip-wrapped pipeline object", mode: "passthrough", key: "wrapped.txt.zst.enc", acceptEncoding: "gzip", want: plain},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := newFakeS3(t)
+			bucket := uploadBucketName(time.Now())
+			fake.put(bucket, "site.css", gzipped(t, foreign), http.Header{"Content-Encoding": {"gzip"}, "Content-Type": {"text/css"}})
+			fake.put(bucket, "wrapped.txt.zst.enc", gzipped(t, stored), wrapped)
+
+			response := handleDownload(t.Context(), events.APIGatewayProxyRequest{
+				Headers:               map[string]string{"Accept-Encoding": test.acceptEncoding},
+				QueryStringParameters: map[string]string{"action": "download", "bucket": bucket, "key": test.key},
+				RequestContext:        events.APIGatewayProxyRequestContext{Authorizer: map[string]interface{}{"principalId": "user-1"}},
+			}, testConfig(t, map[string]string{"S3_UPLOAD_GZIP_DOWNLOADS": test.mode}))
+			if response.StatusCode != http.StatusOK {
+				t.Fatalf("handleDownload() = %d %q", response.StatusCode, response.Body)
+			}
+			body, err := base64.StdEncoding.DecodeString(response.Body)
+			if err != nil || !response.IsBase64Encoded {
+				t.Fatalf("body isn't base64: %v", err)
+			}
+			if !bytes.Equal(body, test.want) {
+				t.Errorf("body = %q, want %q", body, test.want)
+			}
+			if response.Headers["Content-Encoding"] != test.encoding {
+				t.Errorf("Content-Encoding = %q, want %q", response.Headers["Content-Encoding"], test.encoding)
+			}
+			if test.encoding != "" && response.Headers["Vary"] != "Accept-Encoding" {
+				t.Errorf("Vary = %q, want Accept-Encoding on a negotiated response", response.Headers["Vary"])
+			}
+		})
+	}
+}
+
+func TestDownloadToStoredEncoding(t *testing.T) {
+	fake := newFakeS3(t)
+	fake.put("uploads", "site.css", []byte("gzip bytes"), http.Header{"Content-Encoding": {"GZIP"}, "X-Amz-Meta-Owner": {"web"}})
+	fake.put("uploads", "plain.txt", []byte("plain"), http.Header{"X-Amz-Meta-Owner": {"web"}})
+	basics := fake.basics(Config{})
+
+	metadata, err := basics.DownloadTo("uploads", "site.css", io.Discard, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isGzipEncoded(metadata) || metadata["owner"] != "web" {
+		t.Errorf("metadata = %v, want the stored encoding alongside the user metadata", metadata)
+	}
+	if metadata, err = basics.DownloadTo("uploads", "plain.txt", io.Discard, false); err != nil || isGzipEncoded(metadata) {
+		t.Errorf("metadata = %v, %v for an object stored without an encoding", metadata, err)
+	}
+}
+
+func TestGzipDownloadsConfig(t *testing.T) {
+	if cfg := testConfig(t, map[string]string{"S3_UPLOAD_GZIP_DOWNLOADS": ""}); cfg.GzipDownloads != "negotiate" {
+		t.Errorf("GzipDownloads = %q, want negotiate", cfg.GzipDownloads)
+	}
+	if err := configError(t, map[string]string{"S3_UPLOAD_GZIP_DOWNLOADS": "always"}); err == nil {
+		t.Error("loadConfig() accepted an unknown gzip download mode")
+	}
+}
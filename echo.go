@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// maxEchoSize keeps echoed content, once base64-encoded, within Lambda's 6 MB
+// response limit
+const maxEchoSize = 4 << 20
+
+// echoObject serves ?action=echo: it reads back the object just uploaded for file,
+// reverses the pipeline and returns the content, proving the full round trip
+func (basics BucketBasics) echoObject(storage Storage, uploaded uploadedFile, file uploadFile) events.APIGatewayProxyResponse {
+	data, metadata, err := storage.Get(uploaded.Bucket, uploaded.Key, basics.Config.VerifyChecksums)
+	if errors.Is(err, ErrChecksumMismatch) {
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusBadGateway, Body: "Stored object failed checksum verification."}
+	}
+	if err != nil {
+		return s3ErrorResponse(err, basics.Config)
+	}
+	plainData, err := decodeObject(data, metadata)
+	if err != nil {
+		log.Printf("Couldn't decode %v:%v. Here's why: %v\n", uploaded.Bucket, uploaded.Key, err)
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}
+	}
+
+	// Client-compressed files come back decompressed, so only plain input can be compared
+	if !file.PreCompressed && !bytes.Equal(plainData, file.Data) {
+		log.Printf("Echoed %v:%v doesn't match the uploaded file\n", uploaded.Bucket, uploaded.Key)
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError, Body: "Echoed content doesn't match the upload."}
+	}
+	if len(plainData) > maxEchoSize {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusRequestEntityTooLarge,
+			Body:       "The file was uploaded but is too large to echo.",
+		}
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode:      http.StatusOK,
+		Headers:         map[string]string{"Content-Type": "application/octet-stream"},
+		Body:            base64.StdEncoding.EncodeToString(plainData),
+		IsBase64Encoded: true,
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// echo sends files through Handler's echo action
+func echo(t *testing.T, files ...testFile) events.APIGatewayProxyResponse {
+	t.Helper()
+	body, contentType := multipartBody(t, files...)
+	response, err := Handler(t.Context(), events.APIGatewayProxyRequest{
+		HTTPMethod:            "POST",
+		Headers:               map[string]string{"Content-Type": contentType},
+		QueryStringParameters: map[string]string{"action": "echo"},
+		Body:                  body,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func TestUploadEcho(t *testing.T) {
+	tests := []struct {
+		name string
+		file testFile
+	}{
+		{name: "compressed text", file: testFile{name: "notes.txt", contentType: "text/plain", data: string(bytes.Repeat([]byte("echo "), 10_000))}},
+		{name: "small binary", file: testFile{name: "a.bin", contentType: "application/octet-stream", data: "\x00\x01\x02\xff"}},
+		{name: "incompressible", file: testFile{name: "b.bin", contentType: "application/octet-stream", data: string(randomBytes(t, 512<<10))}},
+		{name: "at the limit", file: testFile{name: "c.txt", contentType: "text/plain", data: string(bytes.Repeat([]byte("x"), maxEchoSize))}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := newFakeS3(t)
+			response := echo(t, test.file)
+			if response.StatusCode != http.StatusOK {
+				t.Fatalf("Handler() = %d %q", response.StatusCode, response.Body)
+			}
+			if !response.IsBase64Encoded {
+				t.Fatal("echoed content isn't base64-encoded")
+			}
+			got, err := base64.StdEncoding.DecodeString(response.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, []byte(test.file.data)) {
+				t.Errorf("echoed %d bytes, want the %d uploaded", len(got), len(test.file.data))
+			}
+
+			// The content must have come back from S3 rather than the request
+			if fake.count("PutObject") != 1 || fake.count("GetObject") != 1 {
+				t.Errorf("calls = %v, want one upload and one read back", fake.calls)
+			}
+			bucket := fake.bucketNames()[0]
+			stored, _, _ := fake.object(bucket, fake.keys(bucket)[0])
+			if bytes.Equal(stored, got) {
+				t.Error("object was stored without compression or encryption")
+			}
+		})
+	}
+}
+
+func TestUploadEchoRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		files  []testFile
+		status int
+	}{
+		{name: "over the limit", files: []testFile{{name: "big.txt", contentType: "text/plain", data: string(bytes.Repeat([]byte("x"), maxEchoSize+1))}}, status: http.StatusRequestEntityTooLarge},
+		{name: "several files", files: numberedFiles(2), status: http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := newFakeS3(t)
+			response := echo(t, test.files...)
+			if response.StatusCode != test.status {
+				t.Fatalf("Handler() = %d %q, want %d", response.StatusCode, response.Body, test.status)
+			}
+			// Nothing is stored that couldn't be echoed
+			if puts := fake.count("PutObject"); puts != 0 {
+				t.Errorf("stored %d objects", puts)
+			}
+		})
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Encrypted streams are a sequence of AES-GCM frames so arbitrarily large bodies
+// can be encrypted and decrypted without buffering them whole:
+//
+//	magic | salt | base nonce | frame...
+//	frame = uint32 ciphertext length | AES-GCM(plaintext chunk)
+//
+// Each frame's nonce is the base nonce XORed with its index, so reordered frames
+// fail to open, and the final frame is sealed with distinct additional data, so a
+// truncated stream is detected too.
+const (
+	frameSize = 64 << 10
+	saltSize  = 16
+)
+
+// encryptionMagic identifies a framed AES-GCM stream
+var encryptionMagic = []byte("S3E1")
+
+// ErrDecryption is returned when an encrypted stream was tampered with, reordered or truncated
+var ErrDecryption = errors.New("encrypted stream failed authentication")
+
+// ErrNoEncryptionKey is returned when S3_UPLOAD_ENCRYPTION_KEY is unset or invalid
+var ErrNoEncryptionKey = fmt.Errorf("S3_UPLOAD_ENCRYPTION_KEY must be base64-encoded key material of at least %d bytes", minEncryptionKeySize)
+
+// ErrLegacyKeyPrefix is returned for objects written by earlier releases, which
+// stored the encryption key in plaintext in front of the encrypted data. Anyone
+// able to read such an object could decrypt and re-seal it, so it can't be trusted.
+var ErrLegacyKeyPrefix = errors.New("object carries the legacy plaintext key prefix")
+
+// legacyKeyPrefix is the key earlier releases prepended to every object
+var legacyKeyPrefix = []byte("your-encryption-key")
+
+// minEncryptionKeySize is the least key material accepted, in bytes
+const minEncryptionKeySize = 32
+
+// encryptionKey returns the key material objects are encrypted with, read from the
+// base64-encoded S3_UPLOAD_ENCRYPTION_KEY. Deployments resolve it from an SSM
+// SecureString or Secrets Manager; it is never written to the objects themselves.
+func encryptionKey() ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(os.Getenv("S3_UPLOAD_ENCRYPTION_KEY"))
+	if err != nil || len(key) < minEncryptionKeySize {
+		return nil, ErrNoEncryptionKey
+	}
+	return key, nil
+}
+
+var (
+	frameAAD      = []byte{0}
+	finalFrameAAD = []byte{1}
+)
+
+// encryptStream encrypts everything read from src into dst
+func encryptStream(dst io.Writer, src io.Reader, key []byte) error {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	aead, err := newFrameCipher(key, salt)
+	if err != nil {
+		return err
+	}
+	baseNonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(baseNonce); err != nil {
+		return err
+	}
+	for _, header := range [][]byte{encryptionMagic, salt, baseNonce} {
+		if _, err := dst.Write(header); err != nil {
+			return err
+		}
+	}
+
+	reader := bufio.NewReaderSize(src, frameSize)
+	plaintext := make([]byte, frameSize)
+	var sealed []byte
+	for index := uint64(0); ; index++ {
+		n, err := io.ReadFull(reader, plaintext)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		final := n < frameSize
+		if !final {
+			// A full frame is the last one only if nothing follows it
+			if _, err := reader.Peek(1); err == io.EOF {
+				final = true
+			}
+		}
+
+		aad := frameAAD
+		if final {
+			aad = finalFrameAAD
+		}
+		sealed = aead.Seal(sealed[:0], frameNonce(baseNonce, index), plaintext[:n], aad)
+		if err := writeFrame(dst, sealed); err != nil {
+			return err
+		}
+		if final {
+			return nil
+		}
+	}
+}
+
+// decryptStream decrypts a stream written by encryptStream from src into dst
+func decryptStream(dst io.Writer, src io.Reader, key []byte) error {
+	header := make([]byte, len(encryptionMagic)+saltSize)
+	if _, err := io.ReadFull(src, header); err != nil {
+		return fmt.Errorf("encrypted stream header: %v", err)
+	}
+	if !bytes.Equal(header[:len(encryptionMagic)], encryptionMagic) {
+		return errors.New("not an encrypted stream")
+	}
+	aead, err := newFrameCipher(key, header[len(encryptionMagic):])
+	if err != nil {
+		return err
+	}
+	baseNonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(src, baseNonce); err != nil {
+		return fmt.Errorf("encrypted stream header: %v", err)
+	}
+
+	reader := bufio.NewReaderSize(src, frameSize+aead.Overhead())
+	var length [4]byte
+	sealed := make([]byte, frameSize+aead.Overhead())
+	var plaintext []byte
+	for index := uint64(0); ; index++ {
+		if _, err := io.ReadFull(reader, length[:]); err != nil {
+			return ErrDecryption
+		}
+		size := binary.BigEndian.Uint32(length[:])
+		if int(size) > len(sealed) {
+			return ErrDecryption
+		}
+		if _, err := io.ReadFull(reader, sealed[:size]); err != nil {
+			return ErrDecryption
+		}
+
+		_, err := reader.Peek(1)
+		final := err == io.EOF
+		aad := frameAAD
+		if final {
+			aad = finalFrameAAD
+		}
+		plaintext, err = aead.Open(plaintext[:0], frameNonce(baseNonce, index), sealed[:size], aad)
+		if err != nil {
+			return ErrDecryption
+		}
+		if _, err := dst.Write(plaintext); err != nil {
+			return err
+		}
+		if final {
+			return nil
+		}
+	}
+}
+
+// newFrameCipher derives the per-object AES-256 key from the key material and salt
+func newFrameCipher(key []byte, salt []byte) (cipher.AEAD, error) {
+	derived := sha256.Sum256(append(append([]byte{}, salt...), key...))
+	block, err := aes.NewCipher(derived[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// frameNonce returns the nonce of the frame at index
+func frameNonce(baseNonce []byte, index uint64) []byte {
+	nonce := append([]byte{}, baseNonce...)
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], index)
+	for i := range counter {
+		nonce[len(nonce)-len(counter)+i] ^= counter[i]
+	}
+	return nonce
+}
+
+// writeFrame writes one length-prefixed sealed frame
+func writeFrame(dst io.Writer, sealed []byte) error {
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(sealed)))
+	if _, err := dst.Write(length[:]); err != nil {
+		return err
+	}
+	_, err := dst.Write(sealed)
+	return err
+}
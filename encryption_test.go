@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var testEncryptionKey = []byte("unit-test-encryption-key-0123456789")
+
+// randomBytes returns n bytes of incompressible test data
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+	data := make([]byte, n)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// encryptedFrames splits an encrypted stream into its header and its frames
+func encryptedFrames(t *testing.T, stream []byte) ([]byte, [][]byte) {
+	t.Helper()
+	headerSize := len(encryptionMagic) + saltSize + 12
+	header, rest := stream[:headerSize], stream[headerSize:]
+	var frames [][]byte
+	for len(rest) > 0 {
+		size := int(binary.BigEndian.Uint32(rest[:4]))
+		frames = append(frames, rest[:4+size])
+		rest = rest[4+size:]
+	}
+	return header, frames
+}
+
+func TestEncryptStreamRoundTrip(t *testing.T) {
+	sizes := []int{0, 1, frameSize - 1, frameSize, frameSize + 1, 3*frameSize + 17}
+	for _, size := range sizes {
+		plaintext := randomBytes(t, size)
+		var encrypted bytes.Buffer
+		if err := encryptStream(&encrypted, bytes.NewReader(plaintext), testEncryptionKey); err != nil {
+			t.Fatalf("size %d: encrypt: %v", size, err)
+		}
+		_, frames := encryptedFrames(t, encrypted.Bytes())
+		if want := max(1, (size+frameSize-1)/frameSize); len(frames) != want {
+			t.Errorf("size %d: got %d frames, want %d", size, len(frames), want)
+		}
+
+		var decrypted bytes.Buffer
+		if err := decryptStream(&decrypted, bytes.NewReader(encrypted.Bytes()), testEncryptionKey); err != nil {
+			t.Fatalf("size %d: decrypt: %v", size, err)
+		}
+		if !bytes.Equal(decrypted.Bytes(), plaintext) {
+			t.Errorf("size %d: round trip changed the data", size)
+		}
+	}
+}
+
+func TestDecryptStreamDetectsTampering(t *testing.T) {
+	plaintext := randomBytes(t, 3*frameSize+100)
+	var encrypted bytes.Buffer
+	if err := encryptStream(&encrypted, bytes.NewReader(plaintext), testEncryptionKey); err != nil {
+		t.Fatal(err)
+	}
+	header, frames := encryptedFrames(t, encrypted.Bytes())
+	if len(frames) != 4 {
+		t.Fatalf("got %d frames, want 4", len(frames))
+	}
+	join := func(frames ...[]byte) []byte {
+		return bytes.Join(append([][]byte{header}, frames...), nil)
+	}
+	flipped := append([]byte{}, frames[1]...)
+	flipped[len(flipped)/2] ^= 0x01
+
+	tests := []struct {
+		name   string
+		stream []byte
+	}{
+		{"reordered frames", join(frames[1], frames[0], frames[2], frames[3])},
+		{"dropped middle frame", join(frames[0], frames[2], frames[3])},
+		{"truncated after a full frame", join(frames[0], frames[1])},
+		{"duplicated frame", join(frames[0], frames[0], frames[2], frames[3])},
+		{"flipped ciphertext bit", join(frames[0], flipped, frames[2], frames[3])},
+		{"cut mid-frame", join(frames...)[:len(join(frames...))-10]},
+		{"appended frame", join(frames[0], frames[1], frames[2], frames[3], frames[3])},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := decryptStream(&bytes.Buffer{}, bytes.NewReader(test.stream), testEncryptionKey)
+			if !errors.Is(err, ErrDecryption) {
+				t.Errorf("got %v, want ErrDecryption", err)
+			}
+		})
+	}
+
+	if err := decryptStream(&bytes.Buffer{}, bytes.NewReader(encrypted.Bytes()), []byte("another-key")); !errors.Is(err, ErrDecryption) {
+		t.Errorf("wrong key: got %v, want ErrDecryption", err)
+	}
+}
+
+func TestDecryptRequiresStreamWhenRecordedEncrypted(t *testing.T) {
+	compressed, err := compressZstd([]byte("plain zstd stream"), zstd.SpeedDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Objects from before encryption carry no encryption metadata and still decode
+	plain, err := decodeObject(compressed, map[string]string{"compression": "zstd"})
+	if err != nil || string(plain) != "plain zstd stream" {
+		t.Fatalf("unencrypted object: got %q, %v", plain, err)
+	}
+
+	recorded := map[string]string{"compression": "zstd", "encryption": "aes-gcm"}
+	if _, err := decodeObject(compressed, recorded); !errors.Is(err, ErrDecryption) {
+		t.Errorf("encrypted object without a stream: got %v, want ErrDecryption", err)
+	}
+	if err := decodeStream(&bytes.Buffer{}, bytes.NewReader(compressed), "", recorded); !errors.Is(err, ErrDecryption) {
+		t.Errorf("streamed encrypted object without a stream: got %v, want ErrDecryption", err)
+	}
+}
+
+func TestLegacyKeyPrefixRejected(t *testing.T) {
+	compressed, err := compressZstd([]byte("written by an earlier release"), zstd.SpeedDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sealed bytes.Buffer
+	if err := encryptStream(&sealed, bytes.NewReader(compressed), legacyKeyPrefix); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		stored   []byte
+		metadata map[string]string
+	}{
+		{"encrypted", append(append([]byte{}, legacyKeyPrefix...), sealed.Bytes()...), map[string]string{"compression": "zstd", "encryption": "aes-gcm"}},
+		{"unrecorded encryption", append(append([]byte{}, legacyKeyPrefix...), sealed.Bytes()...), map[string]string{"compression": "zstd"}},
+		{"plain zstd", append(append([]byte{}, legacyKeyPrefix...), compressed...), map[string]string{"compression": "zstd"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := decodeObject(test.stored, test.metadata); !errors.Is(err, ErrLegacyKeyPrefix) {
+				t.Errorf("decodeObject() error = %v, want ErrLegacyKeyPrefix", err)
+			}
+			if err := decodeStream(&bytes.Buffer{}, bytes.NewReader(test.stored), "", test.metadata); !errors.Is(err, ErrLegacyKeyPrefix) {
+				t.Errorf("decodeStream() error = %v, want ErrLegacyKeyPrefix", err)
+			}
+		})
+	}
+}
+
+func TestEncryptionKey(t *testing.T) {
+	stored, err := compressAndEncrypt([]byte("sealed with the configured key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(stored, encryptionMagic) {
+		t.Errorf("stored object starts %q, want the encryption magic", stored[:min(len(stored), 8)])
+	}
+	if bytes.Contains(stored, testEncryptionKey) || bytes.Contains(stored, []byte(os.Getenv("S3_UPLOAD_ENCRYPTION_KEY"))) {
+		t.Error("stored object contains the encryption key")
+	}
+
+	// Only the configured key opens the object
+	t.Setenv("S3_UPLOAD_ENCRYPTION_KEY", base64.StdEncoding.EncodeToString(bytes.Repeat([]byte("k"), minEncryptionKeySize)))
+	if _, err := decryptAndDecompress(stored); !errors.Is(err, ErrDecryption) {
+		t.Errorf("decrypting with another key: got %v, want ErrDecryption", err)
+	}
+
+	for _, value := range []string{"", "not base64!", base64.StdEncoding.EncodeToString([]byte("too short"))} {
+		t.Setenv("S3_UPLOAD_ENCRYPTION_KEY", value)
+		if _, err := compressAndEncrypt([]byte("data")); !errors.Is(err, ErrNoEncryptionKey) {
+			t.Errorf("encrypting with key %q: got %v, want ErrNoEncryptionKey", value, err)
+		}
+		if err := configError(t, nil); !errors.Is(err, ErrNoEncryptionKey) {
+			t.Errorf("loadConfig() with key %q error = %v, want ErrNoEncryptionKey", value, err)
+		}
+	}
+}
+
+func TestCompressAndEncryptRoundTrip(t *testing.T) {
+	for _, size := range []int{0, 10, 5 * frameSize} {
+		data := bytes.Repeat([]byte("round trip "), size/11+1)[:size]
+		stored, err := compressAndEncrypt(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plain, err := decryptAndDecompress(stored)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(plain, data) {
+			t.Errorf("size %d: round trip changed the data", size)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+)
+
+// envelopeMediaType is the content type of a JSON envelope carrying one file
+const envelopeMediaType = "application/vnd.upload-envelope+json"
+
+// ErrInvalidEnvelope is returned for a JSON envelope that can't be decoded or carries no data
+var ErrInvalidEnvelope = errors.New("invalid upload envelope")
+
+// uploadEnvelope wraps a file in JSON for clients that can't send binary bodies or
+// multipart forms, e.g. {"filename": "a.txt", "contentType": "text/plain", "data": "aGk="}
+type uploadEnvelope struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"contentType"`
+	// Data is the file, base64-encoded
+	Data *[]byte `json:"data"`
+}
+
+// envelopeSource yields the file carried by a JSON envelope
+type envelopeSource struct {
+	body io.Reader
+}
+
+func (src *envelopeSource) Next() (*BodyPart, error) {
+	if src.body == nil {
+		return nil, io.EOF
+	}
+	body := src.body
+	src.body = nil
+
+	var envelope uploadEnvelope
+	decoder := json.NewDecoder(body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&envelope); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidEnvelope, err)
+	}
+	if envelope.Data == nil {
+		return nil, fmt.Errorf("%w: no data", ErrInvalidEnvelope)
+	}
+	name := filepath.Base(envelope.Filename)
+	if name == "." || name == "/" {
+		name = ""
+	}
+	return &BodyPart{
+		Reader:      bytes.NewReader(*envelope.Data),
+		Name:        name,
+		ContentType: envelope.ContentType,
+	}, nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestEnvelopeSource(t *testing.T) {
+	data := "\x00\x01binary file"
+	tests := []struct {
+		name     string
+		envelope string
+		want     sourcePart
+	}{
+		{
+			name:     "full envelope",
+			envelope: `{"filename": "reports/q1.bin", "contentType": "application/octet-stream", "data": "` + base64.StdEncoding.EncodeToString([]byte(data)) + `"}`,
+			want:     sourcePart{"q1.bin", "application/octet-stream", data},
+		},
+		{
+			name:     "data only",
+			envelope: `{"data": "aGVsbG8="}`,
+			want:     sourcePart{"", "", "hello"},
+		},
+		{
+			name:     "empty file",
+			envelope: `{"filename": "empty.txt", "contentType": "text/plain", "data": ""}`,
+			want:     sourcePart{"empty.txt", "text/plain", ""},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := readSource(t, &envelopeSource{body: strings.NewReader(test.envelope)})
+			if len(got) != 1 || got[0] != test.want {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestEnvelopeSourceInvalid(t *testing.T) {
+	for _, envelope := range []string{
+		`{"filename": "a.txt"}`,
+		`{"filename": "a.txt", "data": "not base64!"}`,
+		`{"filename": "a.txt", "data": "aGk=", "extra": true}`,
+		`["a.txt"]`,
+		`{"filename": "a.txt", "data": "aGk=`,
+	} {
+		src := &envelopeSource{body: strings.NewReader(envelope)}
+		if _, err := src.Next(); !errors.Is(err, ErrInvalidEnvelope) {
+			t.Errorf("Next() of %s error = %v, want ErrInvalidEnvelope", envelope, err)
+		}
+	}
+}
+
+func TestUploadEnvelope(t *testing.T) {
+	t.Setenv("S3_UPLOAD_KEY_TEMPLATE", "{name}")
+	envelope := `{"filename": "notes.txt", "contentType": "text/plain", "data": "` + base64.StdEncoding.EncodeToString([]byte("enveloped notes")) + `"}`
+	tests := []struct {
+		name        string
+		contentType string
+		enabled     string
+		status      int
+		key         string
+		want        string
+	}{
+		{name: "envelope type", contentType: envelopeMediaType, status: http.StatusOK, key: "notes.txt.zst", want: "enveloped notes"},
+		{name: "json as envelope", contentType: "application/json", enabled: "true", status: http.StatusOK, key: "notes.txt.zst", want: "enveloped notes"},
+		// Without the option a JSON body is just a JSON file
+		{name: "json as a file", contentType: "application/json", enabled: "false", status: http.StatusOK, want: envelope},
+		{name: "invalid envelope", contentType: envelopeMediaType, status: http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("S3_UPLOAD_JSON_ENVELOPE", test.enabled)
+			fake := newFakeS3(t)
+			body := envelope
+			if test.status == http.StatusBadRequest {
+				body = `{"filename": "notes.txt"}`
+			}
+			response, err := Handler(t.Context(), events.APIGatewayProxyRequest{
+				HTTPMethod: "POST",
+				Headers:    map[string]string{"Content-Type": test.contentType},
+				Body:       body,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response.StatusCode != test.status {
+				t.Fatalf("Handler() = %d %q, want %d", response.StatusCode, response.Body, test.status)
+			}
+			if test.status != http.StatusOK {
+				if puts := fake.count("PutObject"); puts != 0 {
+					t.Errorf("PutObject called %d times for an invalid envelope", puts)
+				}
+				return
+			}
+			bucket := fake.bucketNames()[0]
+			keys := fake.keys(bucket)
+			if len(keys) != 1 || (test.key != "" && keys[0] != test.key) {
+				t.Fatalf("stored %v, want %q", keys, test.key)
+			}
+			stored, metadata, _ := fake.object(bucket, keys[0])
+			if data, err := decodeObject(stored, metadata); err != nil || string(data) != test.want {
+				t.Errorf("stored %q, %v, want %q", data, err, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// normalizeRequest fills in the maps a malformed or hand-built event may leave
+// nil, so the rest of the handler can rely on them
+func normalizeRequest(request *events.APIGatewayProxyRequest) {
+	if request.Headers == nil {
+		request.Headers = map[string]string{}
+	}
+	if request.MultiValueHeaders == nil {
+		request.MultiValueHeaders = map[string][]string{}
+	}
+	if request.QueryStringParameters == nil {
+		request.QueryStringParameters = map[string]string{}
+	}
+	if request.MultiValueQueryStringParameters == nil {
+		request.MultiValueQueryStringParameters = map[string][]string{}
+	}
+	if request.PathParameters == nil {
+		request.PathParameters = map[string]string{}
+	}
+	if request.StageVariables == nil {
+		request.StageVariables = map[string]string{}
+	}
+	if request.RequestContext.Authorizer == nil {
+		request.RequestContext.Authorizer = map[string]interface{}{}
+	}
+}
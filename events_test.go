@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestNormalizeRequest(t *testing.T) {
+	var request events.APIGatewayProxyRequest
+	normalizeRequest(&request)
+	if request.Headers == nil || request.MultiValueHeaders == nil || request.QueryStringParameters == nil ||
+		request.MultiValueQueryStringParameters == nil || request.PathParameters == nil ||
+		request.StageVariables == nil || request.RequestContext.Authorizer == nil {
+		t.Fatalf("normalizeRequest() left a nil map in %+v", request)
+	}
+
+	// Maps the event already carries are kept as they are
+	request = events.APIGatewayProxyRequest{Headers: map[string]string{"Content-Type": "text/plain"}}
+	normalizeRequest(&request)
+	if request.Headers["Content-Type"] != "text/plain" {
+		t.Errorf("normalizeRequest() replaced the headers with %v", request.Headers)
+	}
+}
+
+func TestHandlerMalformedEvents(t *testing.T) {
+	tests := []struct {
+		name    string
+		request events.APIGatewayProxyRequest
+		status  int
+	}{
+		{name: "zero event", request: events.APIGatewayProxyRequest{}, status: http.StatusBadRequest},
+		{name: "empty body", request: events.APIGatewayProxyRequest{HTTPMethod: "POST", Headers: map[string]string{"Content-Type": "text/plain"}}, status: http.StatusBadRequest},
+		// Without headers the body is still a plain upload, as long as nothing dereferences the nil maps
+		{name: "nil headers with a body", request: events.APIGatewayProxyRequest{HTTPMethod: "POST", Body: "contents"}, status: http.StatusOK},
+		{name: "invalid base64", request: events.APIGatewayProxyRequest{
+			HTTPMethod:      "POST",
+			Headers:         map[string]string{"Content-Type": "text/plain"},
+			Body:            "not base64!",
+			IsBase64Encoded: true,
+		}, status: http.StatusBadRequest},
+		{name: "multipart without a boundary", request: events.APIGatewayProxyRequest{
+			HTTPMethod: "POST",
+			Headers:    map[string]string{"Content-Type": "multipart/form-data"},
+			Body:       "--x\r\n\r\ncontents\r\n--x--\r\n",
+		}, status: http.StatusBadRequest},
+		{name: "multipart without files", request: events.APIGatewayProxyRequest{
+			HTTPMethod: "POST",
+			Headers:    map[string]string{"Content-Type": "multipart/form-data; boundary=x"},
+			Body:       "--x--\r\n",
+		}, status: http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := newFakeS3(t)
+			response, err := Handler(t.Context(), test.request)
+			if err != nil {
+				t.Fatalf("Handler() error = %v", err)
+			}
+			if response.StatusCode != test.status {
+				t.Fatalf("Handler() = %d %q, want %d", response.StatusCode, response.Body, test.status)
+			}
+			if puts := fake.count("PutObject"); test.status == http.StatusBadRequest && puts != 0 {
+				t.Errorf("PutObject called %d times for a rejected event", puts)
+			}
+		})
+	}
+}
+
+func TestStreamHandlerMatchesHandler(t *testing.T) {
+	// Events missing maps are answered the same whichever entrypoint receives them
+	tests := []struct {
+		name    string
+		request events.LambdaFunctionURLRequest
+		status  int
+	}{
+		{name: "zero event", status: http.StatusBadRequest},
+		{name: "nil headers with a body", request: events.LambdaFunctionURLRequest{
+			Body:           "contents",
+			RequestContext: events.LambdaFunctionURLRequestContext{HTTP: events.LambdaFunctionURLRequestContextHTTPDescription{Method: "POST"}},
+		}, status: http.StatusOK},
+		{name: "anonymous download", request: events.LambdaFunctionURLRequest{
+			QueryStringParameters: map[string]string{"action": "download", "bucket": "filename20240131-120000", "key": "a.txt"},
+		}, status: http.StatusForbidden},
+		{name: "download without a key", request: events.LambdaFunctionURLRequest{
+			QueryStringParameters: map[string]string{"action": "download"},
+			RequestContext:        iamCaller,
+		}, status: http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			newFakeS3(t)
+			streamed, err := StreamHandler(t.Context(), test.request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			buffered, err := Handler(t.Context(), proxyRequest(test.request))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if streamed.StatusCode != test.status || buffered.StatusCode != test.status {
+				t.Errorf("StreamHandler() = %d, Handler() = %d, want %d", streamed.StatusCode, buffered.StatusCode, test.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// uriListMediaType is the content type of a body listing URLs to fetch, one per line
+const uriListMediaType = "text/uri-list"
+
+// ErrFetchNotAllowed is returned for a URL whose scheme and host aren't on the fetch allowlist
+var ErrFetchNotAllowed = errors.New("URL is not on the fetch allowlist")
+
+// ErrFetchFailed is returned when a listed URL can't be fetched
+var ErrFetchFailed = errors.New("fetch failed")
+
+// ErrFetchTooLarge is returned when a fetched file is larger than FetchMaxSize
+var ErrFetchTooLarge = errors.New("fetched file is too large")
+
+// fetchOrigin is an allowlist entry: a scheme and a host, optionally with a port,
+// where a leading "*." matches any subdomain
+type fetchOrigin struct {
+	scheme string
+	host   string
+}
+
+// parseFetchAllowlist parses a comma-separated list of origins, e.g.
+// "https://files.example.com,https://*.cdn.example.com"
+func parseFetchAllowlist(value string) ([]fetchOrigin, error) {
+	var origins []fetchOrigin
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parsed, err := url.Parse(entry)
+		if err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Host == "" || strings.Trim(parsed.Path, "/") != "" {
+			return nil, fmt.Errorf("invalid S3_UPLOAD_FETCH_ALLOWLIST entry %q, expected scheme://host", entry)
+		}
+		origins = append(origins, fetchOrigin{scheme: parsed.Scheme, host: strings.ToLower(parsed.Host)})
+	}
+	return origins, nil
+}
+
+// fetchAllowed reports whether a URL's scheme and host are on the allowlist
+func fetchAllowed(target *url.URL, allowlist []fetchOrigin) bool {
+	host := strings.ToLower(target.Host)
+	for _, origin := range allowlist {
+		if target.Scheme != origin.scheme {
+			continue
+		}
+		if suffix, ok := strings.CutPrefix(origin.host, "*"); ok {
+			if strings.HasSuffix(host, suffix) && len(host) > len(suffix) {
+				return true
+			}
+		} else if host == origin.host {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchSource yields one file per URL listed in a text/uri-list body, downloading
+// each from an allowlisted origin. Fetches are bounded by FetchTimeout and files
+// are cut off once they pass FetchMaxSize.
+type fetchSource struct {
+	urls     []string
+	client   *http.Client
+	cfg      Config
+	response *http.Response
+}
+
+func newFetchSource(body io.Reader, cfg Config) (*fetchSource, error) {
+	var urls []string
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		// Lines starting with # are comments
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			urls = append(urls, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("URL list read error: %v", err)
+	}
+	if len(urls) > cfg.MaxFiles {
+		return nil, ErrTooManyFiles
+	}
+
+	src := &fetchSource{urls: urls, cfg: cfg}
+	src.client = &http.Client{
+		Timeout: cfg.FetchTimeout,
+		// A redirect must not lead off the allowlist
+		CheckRedirect: func(request *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return errors.New("too many redirects")
+			}
+			if !fetchAllowed(request.URL, cfg.FetchAllowlist) {
+				return ErrFetchNotAllowed
+			}
+			return nil
+		},
+	}
+	return src, nil
+}
+
+func (src *fetchSource) Next() (*BodyPart, error) {
+	if src.response != nil {
+		src.response.Body.Close()
+		src.response = nil
+	}
+	if len(src.urls) == 0 {
+		return nil, io.EOF
+	}
+	raw := src.urls[0]
+	src.urls = src.urls[1:]
+
+	target, err := url.Parse(raw)
+	if err != nil || !fetchAllowed(target, src.cfg.FetchAllowlist) {
+		log.Printf("Refused to fetch %q\n", raw)
+		return nil, ErrFetchNotAllowed
+	}
+	response, err := src.client.Get(target.String())
+	if errors.Is(err, ErrFetchNotAllowed) {
+		log.Printf("Refused to follow a redirect from %v off the allowlist\n", target)
+		return nil, ErrFetchNotAllowed
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrFetchFailed, err)
+	}
+	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		return nil, fmt.Errorf("%w: %v returned %s", ErrFetchFailed, target, response.Status)
+	}
+	if response.ContentLength > int64(src.cfg.FetchMaxSize) {
+		response.Body.Close()
+		return nil, ErrFetchTooLarge
+	}
+	src.response = response
+
+	return &BodyPart{
+		Reader:      &cappedReader{r: response.Body, remaining: int64(src.cfg.FetchMaxSize)},
+		Name:        fetchedName(response),
+		ContentType: response.Header.Get("Content-Type"),
+	}, nil
+}
+
+// fetchedName is the name a fetched file is stored under: the filename of its
+// Content-Disposition, or else the last segment of the URL it was fetched from
+func fetchedName(response *http.Response) string {
+	if _, params, err := mime.ParseMediaType(response.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		return path.Base(params["filename"])
+	}
+	if name := path.Base(response.Request.URL.Path); name != "/" && name != "." {
+		return name
+	}
+	return ""
+}
+
+// cappedReader fails with ErrFetchTooLarge once more than remaining bytes are read,
+// for bodies whose Content-Length was missing or understated
+type cappedReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (c *cappedReader) Read(p []byte) (int, error) {
+	if c.remaining < 0 {
+		return 0, ErrFetchTooLarge
+	}
+	// Read one byte past the cap, so a body of exactly the cap still ends cleanly
+	if int64(len(p)) > c.remaining+1 {
+		p = p[:c.remaining+1]
+	}
+	n, err := c.r.Read(p)
+	c.remaining -= int64(n)
+	if c.remaining < 0 {
+		return 0, ErrFetchTooLarge
+	}
+	return n, err
+}
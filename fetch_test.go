@@ -0,0 +1,224 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// fileServer serves the fixed files the fetch tests download
+func fileServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/files/report.csv", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/csv")
+		io.WriteString(w, "a,b\n1,2\n")
+	})
+	mux.HandleFunc("/export", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="../export-2024.json"`)
+		io.WriteString(w, `{"rows": 2}`)
+	})
+	mux.HandleFunc("/large", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, strings.Repeat("x", 2048))
+	})
+	mux.HandleFunc("/streamed", func(w http.ResponseWriter, r *http.Request) {
+		// No Content-Length: the cap has to be enforced while reading
+		for range 4 {
+			io.WriteString(w, strings.Repeat("y", 512))
+			w.(http.Flusher).Flush()
+		}
+	})
+	mux.HandleFunc("/missing", http.NotFound)
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	})
+	mux.HandleFunc("/elsewhere", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://files.example.net/payload", http.StatusFound)
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestFetchAllowed(t *testing.T) {
+	allowlist, err := parseFetchAllowlist("https://files.example.com, https://*.cdn.example.com,http://127.0.0.1:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		url  string
+		want bool
+	}{
+		{url: "https://files.example.com/a.txt", want: true},
+		{url: "https://FILES.example.com/a.txt", want: true},
+		{url: "https://eu.cdn.example.com/a.txt", want: true},
+		{url: "http://127.0.0.1:8080/a.txt", want: true},
+		{url: "http://files.example.com/a.txt"},
+		{url: "https://cdn.example.com/a.txt"},
+		{url: "https://files.example.com.evil.net/a.txt"},
+		{url: "https://files.example.com:8443/a.txt"},
+		{url: "http://127.0.0.1:9090/a.txt"},
+		{url: "file:///etc/passwd"},
+	}
+	for _, test := range tests {
+		target, err := url.Parse(test.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fetchAllowed(target, allowlist); got != test.want {
+			t.Errorf("fetchAllowed(%q) = %v, want %v", test.url, got, test.want)
+		}
+	}
+
+	for _, entry := range []string{"files.example.com", "ftp://files.example.com", "https://files.example.com/uploads"} {
+		if _, err := parseFetchAllowlist(entry); err == nil {
+			t.Errorf("parseFetchAllowlist(%q) accepted an entry that isn't scheme://host", entry)
+		}
+	}
+}
+
+func TestFetchSource(t *testing.T) {
+	server := fileServer(t)
+	allowlist, err := parseFetchAllowlist(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{MaxFiles: 10, FetchAllowlist: allowlist, FetchMaxSize: 1024, FetchTimeout: 500 * time.Millisecond}
+
+	body := "# exported at midnight\n" + server.URL + "/files/report.csv\r\n\n" + server.URL + "/export\n"
+	src, err := newFetchSource(strings.NewReader(body), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := readSource(t, src)
+	want := []sourcePart{
+		{"report.csv", "text/csv", "a,b\n1,2\n"},
+		{"export-2024.json", "application/json", `{"rows": 2}`},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d parts %+v, want %+v", len(got), got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Errorf("part %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestFetchSourceRejects(t *testing.T) {
+	server := fileServer(t)
+	allowlist, err := parseFetchAllowlist(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		url  string
+		err  error
+	}{
+		{name: "not allowlisted", url: "http://files.example.net/payload", err: ErrFetchNotAllowed},
+		{name: "redirect off the allowlist", url: server.URL + "/elsewhere", err: ErrFetchNotAllowed},
+		{name: "declared too large", url: server.URL + "/large", err: ErrFetchTooLarge},
+		{name: "streamed too large", url: server.URL + "/streamed", err: ErrFetchTooLarge},
+		{name: "not found", url: server.URL + "/missing", err: ErrFetchFailed},
+		{name: "timeout", url: server.URL + "/slow", err: ErrFetchFailed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := Config{MaxFiles: 10, FetchAllowlist: allowlist, FetchMaxSize: 1024, FetchTimeout: 200 * time.Millisecond}
+			src, err := newFetchSource(strings.NewReader(test.url), cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			part, err := src.Next()
+			if err == nil {
+				_, err = io.ReadAll(part.Reader)
+			}
+			if !errors.Is(err, test.err) {
+				t.Errorf("fetching %s error = %v, want %v", test.url, err, test.err)
+			}
+		})
+	}
+
+	urls := strings.Repeat(server.URL+"/files/report.csv\n", 3)
+	if _, err := newFetchSource(strings.NewReader(urls), Config{MaxFiles: 2, FetchAllowlist: allowlist}); !errors.Is(err, ErrTooManyFiles) {
+		t.Errorf("newFetchSource() of 3 URLs with MaxFiles 2 error = %v, want ErrTooManyFiles", err)
+	}
+}
+
+func TestUploadFetched(t *testing.T) {
+	server := fileServer(t)
+	t.Setenv("S3_UPLOAD_KEY_TEMPLATE", "{name}")
+	t.Setenv("S3_UPLOAD_FETCH_MAX_SIZE", "1024")
+	tests := []struct {
+		name      string
+		allowlist string
+		body      string
+		status    int
+		key       string
+	}{
+		{name: "fetched", allowlist: server.URL, body: server.URL + "/files/report.csv", status: http.StatusOK, key: "report.csv.zst"},
+		{name: "fetching disabled", body: server.URL + "/files/report.csv", status: http.StatusForbidden},
+		{name: "off the allowlist", allowlist: "https://files.example.com", body: server.URL + "/files/report.csv", status: http.StatusForbidden},
+		{name: "too large", allowlist: server.URL, body: server.URL + "/large", status: http.StatusRequestEntityTooLarge},
+		{name: "fetch failed", allowlist: server.URL, body: server.URL + "/missing", status: http.StatusBadGateway},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("S3_UPLOAD_FETCH_ALLOWLIST", test.allowlist)
+			fake := newFakeS3(t)
+			response, err := Handler(t.Context(), events.APIGatewayProxyRequest{
+				HTTPMethod: "POST",
+				Headers:    map[string]string{"Content-Type": "text/uri-list"},
+				Body:       test.body,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response.StatusCode != test.status {
+				t.Fatalf("Handler() = %d %q, want %d", response.StatusCode, response.Body, test.status)
+			}
+			if test.key == "" {
+				if puts := fake.count("PutObject"); puts != 0 {
+					t.Errorf("PutObject called %d times for a refused fetch", puts)
+				}
+				return
+			}
+			bucket := fake.bucketNames()[0]
+			stored, metadata, ok := fake.object(bucket, test.key)
+			if !ok {
+				t.Fatalf("stored %v, want %q", fake.keys(bucket), test.key)
+			}
+			if data, err := decodeObject(stored, metadata); err != nil || string(data) != "a,b\n1,2\n" {
+				t.Errorf("stored %q, %v, want the fetched file", data, err)
+			}
+		})
+	}
+}
+
+func TestFetchConfig(t *testing.T) {
+	cfg := testConfig(t, map[string]string{"S3_UPLOAD_FETCH_ALLOWLIST": "", "S3_UPLOAD_FETCH_MAX_SIZE": "", "S3_UPLOAD_FETCH_TIMEOUT": ""})
+	if len(cfg.FetchAllowlist) != 0 || cfg.FetchMaxSize != 50<<20 || cfg.FetchTimeout != 30*time.Second {
+		t.Errorf("fetch defaults = %v %d %v", cfg.FetchAllowlist, cfg.FetchMaxSize, cfg.FetchTimeout)
+	}
+	for _, env := range []map[string]string{
+		{"S3_UPLOAD_FETCH_ALLOWLIST": "files.example.com"},
+		{"S3_UPLOAD_FETCH_ALLOWLIST": "", "S3_UPLOAD_FETCH_MAX_SIZE": "0"},
+		{"S3_UPLOAD_FETCH_MAX_SIZE": "", "S3_UPLOAD_FETCH_TIMEOUT": "0s"},
+	} {
+		if err := configError(t, env); err == nil {
+			t.Errorf("loadConfig() accepted %v", env)
+		}
+	}
+}
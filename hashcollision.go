@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// originalSizeMetadata records the plaintext size of content-hash keyed objects, so
+// a later upload hashing to the same key can be checked against it
+const originalSizeMetadata = "original-size"
+
+// ErrHashCollision is returned when a content-hash key is already taken by an object
+// holding content of a different size: a SHA-256 collision or, far more likely, an
+// object left truncated by an earlier upload
+var ErrHashCollision = errors.New("content hash collides with a stored object of a different size")
+
+// CheckHashKey reports whether an object holding the same content already exists at
+// a content-hash key. It fails with ErrHashCollision when the stored object's
+// recorded plaintext size differs from size, rather than deduplicating against the
+// wrong content.
+func (basics BucketBasics) CheckHashKey(bucketName string, fileName string, size int) (bool, error) {
+	result, err := basics.S3Client.HeadObject(context.TODO(), &s3.HeadObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(fileName),
+	})
+	var notFound *types.NotFound
+	if errors.As(err, &notFound) {
+		return false, nil
+	}
+	if err != nil {
+		log.Printf("Couldn't check for %v:%v. Here's why: %v\n", bucketName, fileName, err)
+		return false, err
+	}
+
+	recorded, ok := result.Metadata[originalSizeMetadata]
+	if !ok {
+		// Objects stored before sizes were recorded can only be trusted
+		log.Printf("No recorded size for %v:%v, assuming it holds the same content\n", bucketName, fileName)
+		return true, nil
+	}
+	if stored, err := strconv.Atoi(recorded); err != nil || stored != size {
+		log.Printf("Hash collision at %v:%v: stored object has %v bytes, upload has %d\n", bucketName, fileName, recorded, size)
+		return false, ErrHashCollision
+	}
+	return true, nil
+}
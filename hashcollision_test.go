@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCheckHashKey(t *testing.T) {
+	tests := []struct {
+		name     string
+		metadata http.Header
+		stored   bool
+		fail     int
+		exists   bool
+		err      error
+	}{
+		{name: "free key", exists: false},
+		{name: "same size", stored: true, metadata: http.Header{"X-Amz-Meta-Original-Size": {"16"}}, exists: true},
+		{name: "different size", stored: true, metadata: http.Header{"X-Amz-Meta-Original-Size": {"9"}}, err: ErrHashCollision},
+		{name: "unreadable size", stored: true, metadata: http.Header{"X-Amz-Meta-Original-Size": {"sixteen"}}, err: ErrHashCollision},
+		// Objects stored before sizes were recorded are trusted
+		{name: "no recorded size", stored: true, metadata: http.Header{}, exists: true},
+		{name: "head fails", fail: http.StatusInternalServerError},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := newFakeS3(t)
+			if test.stored {
+				fake.put("uploads", "0f3a.zst", []byte("stored"), test.metadata)
+			}
+			fake.Fail = func(operation string, bucket string, key string) (int, string) {
+				if operation == "HeadObject" && test.fail != 0 {
+					return test.fail, "InternalError"
+				}
+				return 0, ""
+			}
+			exists, err := fake.basics(Config{}).CheckHashKey("uploads", "0f3a.zst", 16)
+			if test.fail != 0 {
+				if err == nil || errors.Is(err, ErrHashCollision) {
+					t.Errorf("CheckHashKey() error = %v, want the HeadObject failure", err)
+				}
+				return
+			}
+			if exists != test.exists || !errors.Is(err, test.err) {
+				t.Errorf("CheckHashKey() = %v, %v, want %v, %v", exists, err, test.exists, test.err)
+			}
+		})
+	}
+}
+
+func TestUploadHashCollision(t *testing.T) {
+	const accessPoint = "arn:aws:s3:ap-south-1:123456789012:accesspoint/uploads"
+	const bucket = "uploads-123456789012"
+	content := "content stored under its own hash"
+	sum := sha256.Sum256([]byte(content))
+	t.Setenv("S3_UPLOAD_ACCESS_POINT_ARN", accessPoint)
+	t.Setenv("S3_UPLOAD_KEY_STRATEGY", "content-hash")
+	t.Setenv("S3_UPLOAD_BREAKER_THRESHOLD", "0")
+	accept := map[string]string{"Content-Type": "text/plain", "Accept": "application/json"}
+
+	tests := []struct {
+		name    string
+		check   string
+		size    string
+		status  int
+		written bool
+	}{
+		{name: "matching size", check: "true", size: "33", status: http.StatusOK},
+		{name: "mismatching size", check: "true", size: "12", status: http.StatusConflict},
+		{name: "check disabled", check: "false", size: "12", status: http.StatusOK, written: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("S3_UPLOAD_HASH_COLLISION_CHECK", test.check)
+			fake := newFakeS3(t)
+			first := uploadedFiles(t, upload(t, accept, content))
+			if len(first) != 1 || !strings.HasPrefix(first[0].Key, hex.EncodeToString(sum[:])) {
+				t.Fatalf("first upload stored %+v, want a content-hash key", first)
+			}
+			key := first[0].Key
+			stored, metadata, _ := fake.object(bucket, key)
+			if metadata[originalSizeMetadata] != "33" {
+				t.Fatalf("original-size = %q, want the 33 byte plaintext", metadata[originalSizeMetadata])
+			}
+
+			// Stand in for a truncated object, or a true collision, where the sizes differ
+			header := fake.header(bucket, key)
+			header.Set("X-Amz-Meta-Original-Size", test.size)
+			fake.put(bucket, key, stored, header)
+			puts := fake.count("PutObject")
+
+			response := handle(t, accept, content)
+			if response.StatusCode != test.status {
+				t.Fatalf("Handler() = %d %q, want %d", response.StatusCode, response.Body, test.status)
+			}
+			if written := fake.count("PutObject") != puts; written != test.written {
+				t.Errorf("second upload written = %v, want %v", written, test.written)
+			}
+			switch test.status {
+			case http.StatusOK:
+				if second := uploadedFiles(t, response); len(second) != 1 || second[0].Key != key {
+					t.Errorf("second upload went to %+v, want %q", second, key)
+				}
+			case http.StatusConflict:
+				if !strings.Contains(response.Body, key) {
+					t.Errorf("Handler() body = %q, want the colliding key", response.Body)
+				}
+				// The stored object is left as it was
+				if data, _, _ := fake.object(bucket, key); string(data) != string(stored) {
+					t.Error("colliding upload replaced the stored object")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Objects can carry a self-describing header in front of the stored bytes, so the
+// read path can reconstruct the pipeline even when S3 metadata was lost in a copy:
+//
+//	magic | version | compression | level | encryption
+//
+// The salt and nonce of encrypted objects are carried by the encrypted stream's own
+// header, which follows.
+var objectHeaderMagic = []byte("\x89S3UH\r\n\x1a")
+
+const (
+	objectHeaderVersion = 1
+	objectHeaderSize    = 8 + 4
+)
+
+// Pipeline identifiers stored in the object header
+const (
+	headerCompressionNone byte = 0
+	headerCompressionZstd byte = 1
+	headerCompressionGzip byte = 2
+
+	headerEncryptionNone   byte = 0
+	headerEncryptionAESGCM byte = 1
+)
+
+// objectHeader describes the transforms applied to an object's data
+type objectHeader struct {
+	// Compression is the algorithm the data was compressed with: "zstd", "gzip" or "none"
+	Compression string
+	// Level is the zstd level the data was compressed at, zero when unknown
+	Level     zstd.EncoderLevel
+	Encrypted bool
+}
+
+// encode returns the binary form of the header
+func (header objectHeader) encode() []byte {
+	compression, encryption := headerCompressionNone, headerEncryptionNone
+	switch header.Compression {
+	case "zstd":
+		compression = headerCompressionZstd
+	case "gzip":
+		compression = headerCompressionGzip
+	}
+	if header.Encrypted {
+		encryption = headerEncryptionAESGCM
+	}
+	return append(append([]byte{}, objectHeaderMagic...), objectHeaderVersion, compression, byte(header.Level), encryption)
+}
+
+// metadata returns the pipeline metadata equivalent to the header, as read by decodeObject
+func (header objectHeader) metadata() map[string]string {
+	metadata := map[string]string{"compression": header.Compression, "encryption": "none"}
+	if header.Encrypted {
+		metadata["encryption"] = "aes-gcm"
+	}
+	return metadata
+}
+
+// hasObjectHeader reports whether data starts with an object header
+func hasObjectHeader(data []byte) bool {
+	return len(data) >= objectHeaderSize && bytes.Equal(data[:len(objectHeaderMagic)], objectHeaderMagic)
+}
+
+// parseObjectHeader decodes the object header at the start of data
+func parseObjectHeader(data []byte) (objectHeader, error) {
+	fields := data[len(objectHeaderMagic):objectHeaderSize]
+	if fields[0] != objectHeaderVersion {
+		return objectHeader{}, fmt.Errorf("unsupported object header version %d", fields[0])
+	}
+	header := objectHeader{Level: zstd.EncoderLevel(fields[2])}
+	switch fields[1] {
+	case headerCompressionNone:
+		header.Compression = "none"
+	case headerCompressionZstd:
+		header.Compression = "zstd"
+	case headerCompressionGzip:
+		header.Compression = "gzip"
+	default:
+		return objectHeader{}, fmt.Errorf("unknown compression %d in object header", fields[1])
+	}
+	switch fields[3] {
+	case headerEncryptionNone:
+	case headerEncryptionAESGCM:
+		header.Encrypted = true
+	default:
+		return objectHeader{}, fmt.Errorf("unknown encryption %d in object header", fields[3])
+	}
+	return header, nil
+}
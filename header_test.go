@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestObjectHeaderEncoding(t *testing.T) {
+	tests := []objectHeader{
+		{Compression: "zstd", Level: zstd.SpeedBestCompression, Encrypted: true},
+		{Compression: "zstd", Encrypted: false},
+		{Compression: "gzip", Encrypted: true},
+		{Compression: "none", Encrypted: true},
+		{Compression: "none", Encrypted: false},
+	}
+	for _, header := range tests {
+		encoded := header.encode()
+		if len(encoded) != objectHeaderSize || !hasObjectHeader(encoded) {
+			t.Fatalf("%+v encodes to %x", header, encoded)
+		}
+		parsed, err := parseObjectHeader(encoded)
+		if err != nil {
+			t.Fatalf("%+v: %v", header, err)
+		}
+		if parsed != header {
+			t.Errorf("round trip of %+v gave %+v", header, parsed)
+		}
+	}
+}
+
+func TestParseObjectHeaderRejects(t *testing.T) {
+	valid := objectHeader{Compression: "zstd", Encrypted: true}.encode()
+	tests := []struct {
+		name  string
+		field int
+		value byte
+	}{
+		{name: "future version", field: 0, value: objectHeaderVersion + 1},
+		{name: "unknown compression", field: 1, value: 9},
+		{name: "unknown encryption", field: 3, value: 9},
+	}
+	for _, test := range tests {
+		header := append([]byte{}, valid...)
+		header[len(objectHeaderMagic)+test.field] = test.value
+		if _, err := parseObjectHeader(header); err == nil {
+			t.Errorf("%s: parseObjectHeader() accepted %x", test.name, header)
+		}
+	}
+	if hasObjectHeader(valid[:objectHeaderSize-1]) || hasObjectHeader([]byte("plain file contents")) {
+		t.Error("hasObjectHeader() matched data without a header")
+	}
+}
+
+func TestObjectHeaderRoundTrip(t *testing.T) {
+	plain := bytes.Repeat([]byte("described by its header "), 10_000)
+	tests := []struct {
+		compression string
+		encrypted   bool
+	}{
+		{"zstd", true},
+		{"zstd", false},
+		{"gzip", true},
+		{"gzip", false},
+		{"none", true},
+		{"none", false},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%s/encrypted=%v", test.compression, test.encrypted), func(t *testing.T) {
+			data, err := compressData(t.Context(), plain, test.compression, zstd.SpeedDefault, nil)
+			if test.compression == "none" {
+				data, err = plain, nil
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.encrypted {
+				if data, err = encryptCompressed(data); err != nil {
+					t.Fatal(err)
+				}
+			}
+			stored := append(objectHeader{Compression: test.compression, Encrypted: test.encrypted}.encode(), data...)
+
+			// Metadata lost or contradicting the header must not matter
+			for _, metadata := range []map[string]string{nil, {"compression": "gzip", "encryption": "bogus"}} {
+				got, err := decodeObject(stored, metadata)
+				if err != nil || !bytes.Equal(got, plain) {
+					t.Errorf("encrypted %v, metadata %v: decodeObject() = %d bytes, %v", test.encrypted, metadata, len(got), err)
+				}
+				var out bytes.Buffer
+				if err := decodeStream(&out, bytes.NewReader(stored), sha256Checksum(stored), metadata); err != nil || !bytes.Equal(out.Bytes(), plain) {
+					t.Errorf("encrypted %v, metadata %v: decodeStream() = %d bytes, %v", test.encrypted, metadata, out.Len(), err)
+				}
+			}
+		})
+	}
+}
+
+func TestDownloadWithoutMetadata(t *testing.T) {
+	t.Setenv("S3_UPLOAD_OBJECT_HEADER", "true")
+	fake := newFakeS3(t)
+	content := string(bytes.Repeat([]byte("survives a metadata-dropping copy "), 1000))
+	files := uploadedFiles(t, upload(t, map[string]string{"Content-Type": "text/plain", "Accept": "application/json"}, content))
+
+	// Replace the object with its bytes alone, as a copy that drops metadata would
+	data, _, _ := fake.object(files[0].Bucket, files[0].Key)
+	fake.put(files[0].Bucket, files[0].Key, data, nil)
+
+	response := handleDownload(t.Context(), events.APIGatewayProxyRequest{
+		QueryStringParameters: map[string]string{"action": "download", "bucket": files[0].Bucket, "key": files[0].Key},
+		RequestContext:        events.APIGatewayProxyRequestContext{Authorizer: map[string]interface{}{"principalId": "user-1"}},
+	}, testConfig(t, nil))
+	body, _ := base64.StdEncoding.DecodeString(response.Body)
+	if response.StatusCode != http.StatusOK || string(body) != content {
+		t.Errorf("handleDownload() = %d with %d bytes, want the original %d", response.StatusCode, len(body), len(content))
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// UploadContext describes a file about to be uploaded. Pre-upload hooks may change
+// its Key and Metadata.
+type UploadContext struct {
+	Request     events.APIGatewayProxyRequest
+	Bucket      string
+	Key         string
+	Name        string
+	ContentType string
+	// Data is the file as received, before compression and encryption
+	Data []byte
+	// Metadata is the user metadata stored with the object
+	Metadata map[string]string
+}
+
+// PreUploadHook, when set, runs for every file after the request is parsed and
+// before the file is compressed and uploaded, for custom validation or enrichment.
+// An error rejects the request with the configured S3_UPLOAD_PRE_HOOK_STATUS.
+var PreUploadHook func(ctx context.Context, upload *UploadContext) error
+
+// UploadResult describes a file that was uploaded successfully
+type UploadResult struct {
+	Request      events.APIGatewayProxyRequest
+	Bucket       string
+	Key          string
+	Name         string
+	ContentType  string
+	StorageClass string
+	// Size is the stored object's size, OriginalSize the size of the file as received
+	Size         int
+	OriginalSize int
+	Metadata     map[string]string
+	// Thumbnail is the key of the image's thumbnail, if one was uploaded
+	Thumbnail string
+}
+
+// PostUploadHook, when set, runs after every successful upload, for notifications,
+// indexing and similar side effects. An error fails the request when
+// S3_UPLOAD_POST_HOOK_STRICT is set and is only logged otherwise; either way the
+// object stays uploaded.
+var PostUploadHook func(ctx context.Context, result *UploadResult) error
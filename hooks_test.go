@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// setPreUploadHook installs hook for the rest of the test
+func setPreUploadHook(t *testing.T, hook func(ctx context.Context, upload *UploadContext) error) {
+	previous := PreUploadHook
+	PreUploadHook = hook
+	t.Cleanup(func() { PreUploadHook = previous })
+}
+
+func TestPreUploadHook(t *testing.T) {
+	data := "quarterly figures"
+	tests := []struct {
+		name   string
+		env    map[string]string
+		hook   func(ctx context.Context, upload *UploadContext) error
+		status int
+		body   string
+		key    string
+		meta   map[string]string
+	}{
+		{
+			name: "enriches metadata and key",
+			hook: func(ctx context.Context, upload *UploadContext) error {
+				if string(upload.Data) != data || upload.ContentType != "text/plain" {
+					return errors.New("hook didn't see the file as received")
+				}
+				upload.Metadata["department"] = "finance"
+				upload.Key = "reviewed/" + upload.Key
+				return nil
+			},
+			status: http.StatusOK,
+			key:    "reviewed/",
+			meta:   map[string]string{"department": "finance", "project": "apollo"},
+		},
+		{
+			name:   "rejects with the default status",
+			hook:   func(ctx context.Context, upload *UploadContext) error { return errors.New("file is not approved") },
+			status: http.StatusBadRequest,
+			body:   "file is not approved",
+		},
+		{
+			name:   "rejects with the configured status",
+			env:    map[string]string{"S3_UPLOAD_PRE_HOOK_STATUS": "422"},
+			hook:   func(ctx context.Context, upload *UploadContext) error { return errors.New("file is not approved") },
+			status: http.StatusUnprocessableEntity,
+			body:   "file is not approved",
+		},
+		{
+			name: "invalid metadata",
+			hook: func(ctx context.Context, upload *UploadContext) error {
+				upload.Metadata["Not Valid"] = "x"
+				return nil
+			},
+			status: http.StatusInternalServerError,
+		},
+		{
+			name: "oversized metadata",
+			hook: func(ctx context.Context, upload *UploadContext) error {
+				upload.Metadata["notes"] = strings.Repeat("x", maxUserMetadataSize)
+				return nil
+			},
+			status: http.StatusInternalServerError,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+			fake := newFakeS3(t)
+			setPreUploadHook(t, test.hook)
+			response := handle(t, map[string]string{"Content-Type": "text/plain", "X-Upload-Meta-Project": "apollo"}, data)
+			if response.StatusCode != test.status {
+				t.Fatalf("Handler() = %d %q, want %d", response.StatusCode, response.Body, test.status)
+			}
+			if test.status != http.StatusOK {
+				if test.body != "" && response.Body != test.body {
+					t.Errorf("Handler() body = %q, want %q", response.Body, test.body)
+				}
+				if puts := fake.count("PutObject"); puts != 0 {
+					t.Errorf("stored %d objects of a rejected upload", puts)
+				}
+				return
+			}
+
+			bucket := fake.bucketNames()[0]
+			keys := fake.keys(bucket)
+			if len(keys) != 1 || !strings.HasPrefix(keys[0], test.key) {
+				t.Fatalf("stored %v, want one key under %q", keys, test.key)
+			}
+			_, metadata, _ := fake.object(bucket, keys[0])
+			for key, want := range test.meta {
+				if metadata[key] != want {
+					t.Errorf("metadata %s = %q, want %q", key, metadata[key], want)
+				}
+			}
+		})
+	}
+}
+
+func TestPreHookStatusConfig(t *testing.T) {
+	for value, ok := range map[string]bool{"": true, "403": true, "599": true, "200": false, "600": false, "teapot": false} {
+		t.Run(value, func(t *testing.T) {
+			if err := configError(t, map[string]string{"S3_UPLOAD_PRE_HOOK_STATUS": value}); (err == nil) != ok {
+				t.Errorf("loadConfig() error = %v, want ok %v", err, ok)
+			}
+		})
+	}
+}
+
+// setPostUploadHook installs hook for the rest of the test
+func setPostUploadHook(t *testing.T, hook func(ctx context.Context, result *UploadResult) error) {
+	previous := PostUploadHook
+	PostUploadHook = hook
+	t.Cleanup(func() { PostUploadHook = previous })
+}
+
+func TestPostUploadHook(t *testing.T) {
+	tests := []struct {
+		name   string
+		strict string
+		err    error
+		status int
+	}{
+		{name: "records the result", status: http.StatusOK},
+		{name: "error logged when lenient", strict: "false", err: errors.New("index unavailable"), status: http.StatusOK},
+		{name: "error fails the request when strict", strict: "true", err: errors.New("index unavailable"), status: http.StatusInternalServerError},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("S3_UPLOAD_POST_HOOK_STRICT", test.strict)
+			fake := newFakeS3(t)
+			var results []UploadResult
+			setPostUploadHook(t, func(ctx context.Context, result *UploadResult) error {
+				results = append(results, *result)
+				return test.err
+			})
+			files := numberedFiles(2)
+			body, contentType := multipartBody(t, files...)
+			response := handle(t, map[string]string{"Content-Type": contentType}, body)
+			if response.StatusCode != test.status {
+				t.Fatalf("Handler() = %d %q, want %d", response.StatusCode, response.Body, test.status)
+			}
+
+			// A strict failure stops the batch, but what was stored stays stored
+			wantResults := 2
+			if test.status != http.StatusOK {
+				wantResults = 1
+			}
+			if len(results) != wantResults {
+				t.Fatalf("hook ran %d times, want %d", len(results), wantResults)
+			}
+			if puts := fake.count("PutObject"); puts != wantResults {
+				t.Errorf("stored %d objects, want %d", puts, wantResults)
+			}
+			for i, result := range results {
+				data, _, ok := fake.object(result.Bucket, result.Key)
+				if !ok {
+					t.Errorf("result %d names %s/%s, which wasn't stored", i, result.Bucket, result.Key)
+					continue
+				}
+				if result.Name != files[i].name || result.OriginalSize != len(files[i].data) || result.Size != len(data) {
+					t.Errorf("result %d = %+v, want %s of %d bytes stored in %d", i, result, files[i].name, len(files[i].data), len(data))
+				}
+				if result.Metadata["compression"] == "" {
+					t.Errorf("result %d metadata = %v, want the applied pipeline", i, result.Metadata)
+				}
+			}
+		})
+	}
+}
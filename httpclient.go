@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/config"
+)
+
+// httpPool is the connection pooling of the HTTP client shared by AWS clients
+type httpPool struct {
+	maxIdleConns        int
+	maxIdleConnsPerHost int
+	idleConnTimeout     time.Duration
+}
+
+// sharedHTTPClient outlives invocations, so warm containers reuse their connections
+// to S3 instead of dialling again for every request
+var sharedHTTPClient struct {
+	mu     sync.Mutex
+	pool   httpPool
+	client *awshttp.BuildableClient
+}
+
+// httpClientFor returns the shared HTTP client, rebuilt if the pooling settings changed
+func httpClientFor(cfg Config) *awshttp.BuildableClient {
+	pool := httpPool{
+		maxIdleConns:        cfg.HTTPMaxIdleConns,
+		maxIdleConnsPerHost: cfg.HTTPMaxIdleConnsPerHost,
+		idleConnTimeout:     cfg.HTTPIdleConnTimeout,
+	}
+
+	sharedHTTPClient.mu.Lock()
+	defer sharedHTTPClient.mu.Unlock()
+	if sharedHTTPClient.client == nil || sharedHTTPClient.pool != pool {
+		sharedHTTPClient.pool = pool
+		sharedHTTPClient.client = awshttp.NewBuildableClient().WithTransportOptions(func(transport *http.Transport) {
+			transport.MaxIdleConns = pool.maxIdleConns
+			transport.MaxIdleConnsPerHost = pool.maxIdleConnsPerHost
+			transport.IdleConnTimeout = pool.idleConnTimeout
+		})
+	}
+	return sharedHTTPClient.client
+}
+
+// loadDefaultConfig resolves the AWS configuration through the default credential
+// chain. Tests replace it, so they never pick up real credentials from the
+// environment, shared config files or instance metadata.
+var loadDefaultConfig = config.LoadDefaultConfig
+
+// loadAWSConfig loads the default AWS configuration with the shared HTTP client
+func loadAWSConfig(ctx context.Context, appCfg Config) (aws.Config, error) {
+	cfg, err := loadDefaultConfig(ctx, config.WithHTTPClient(httpClientFor(appCfg)))
+	if err != nil {
+		log.Printf("Failed to load AWS config: %v", err)
+	}
+	return cfg, err
+}
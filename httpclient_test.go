@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+)
+
+func TestHTTPClientTransport(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		want httpPool
+	}{
+		{name: "defaults", want: httpPool{maxIdleConns: 100, maxIdleConnsPerHost: 100, idleConnTimeout: 90 * time.Second}},
+		{
+			name: "tuned",
+			env: map[string]string{
+				"S3_UPLOAD_HTTP_MAX_IDLE_CONNS":          "256",
+				"S3_UPLOAD_HTTP_MAX_IDLE_CONNS_PER_HOST": "64",
+				"S3_UPLOAD_HTTP_IDLE_CONN_TIMEOUT":       "30s",
+			},
+			want: httpPool{maxIdleConns: 256, maxIdleConnsPerHost: 64, idleConnTimeout: 30 * time.Second},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := testConfig(t, test.env)
+			transport := httpClientFor(cfg).GetTransport()
+			got := httpPool{
+				maxIdleConns:        transport.MaxIdleConns,
+				maxIdleConnsPerHost: transport.MaxIdleConnsPerHost,
+				idleConnTimeout:     transport.IdleConnTimeout,
+			}
+			if got != test.want {
+				t.Errorf("transport pooling = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+	if err := configError(t, map[string]string{"S3_UPLOAD_HTTP_MAX_IDLE_CONNS_PER_HOST": "-1"}); err == nil {
+		t.Error("loadConfig() accepted a negative connection limit")
+	}
+}
+
+func TestHTTPClientShared(t *testing.T) {
+	cfg := Config{HTTPMaxIdleConns: 10, HTTPMaxIdleConnsPerHost: 10, HTTPIdleConnTimeout: time.Minute}
+	first := httpClientFor(cfg)
+	if again := httpClientFor(cfg); again != first {
+		t.Error("httpClientFor() built a new client for unchanged settings")
+	}
+	cfg.HTTPMaxIdleConnsPerHost = 20
+	rebuilt := httpClientFor(cfg)
+	if rebuilt == first {
+		t.Fatal("httpClientFor() kept the client after its settings changed")
+	}
+	if transport := rebuilt.GetTransport(); transport.MaxIdleConnsPerHost != 20 {
+		t.Errorf("MaxIdleConnsPerHost = %d, want 20", transport.MaxIdleConnsPerHost)
+	}
+}
+
+func TestLoadAWSConfigHTTPClient(t *testing.T) {
+	var options config.LoadOptions
+	previous := loadDefaultConfig
+	loadDefaultConfig = func(ctx context.Context, optFns ...func(*config.LoadOptions) error) (aws.Config, error) {
+		for _, fn := range optFns {
+			if err := fn(&options); err != nil {
+				return aws.Config{}, err
+			}
+		}
+		return aws.Config{HTTPClient: options.HTTPClient}, nil
+	}
+	t.Cleanup(func() { loadDefaultConfig = previous })
+
+	appCfg := Config{HTTPMaxIdleConns: 50, HTTPMaxIdleConnsPerHost: 25, HTTPIdleConnTimeout: 45 * time.Second}
+	cfg, err := loadAWSConfig(t.Context(), appCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The SDK clients must be handed the pooled client rather than their own default
+	if cfg.HTTPClient != httpClientFor(appCfg) {
+		t.Fatalf("HTTPClient = %T %p, want the shared pooled client", cfg.HTTPClient, cfg.HTTPClient)
+	}
+	if transport := httpClientFor(appCfg).GetTransport(); transport.MaxIdleConnsPerHost != 25 || transport.IdleConnTimeout != 45*time.Second {
+		t.Errorf("transport = %d idle per host for %v, want 25 for 45s", transport.MaxIdleConnsPerHost, transport.IdleConnTimeout)
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrDisallowedKeyCharacter is returned when a key breaks the reject key charset policy
+var ErrDisallowedKeyCharacter = errors.New("key contains a disallowed character")
+
+// keyCharsets are the preset S3_UPLOAD_KEY_CHARSET policies, each matching one
+// allowed character. safe-ascii is the set S3 documents as safe; url-safe is the
+// unreserved URL characters. Both keep "/" for prefixes.
+var keyCharsets = map[string]*regexp.Regexp{
+	"safe-ascii": regexp.MustCompile(`^[A-Za-z0-9!_.*'()/-]$`),
+	"url-safe":   regexp.MustCompile(`^[A-Za-z0-9._~/-]$`),
+}
+
+// jsonField looks up a dotted path such as .items.0.id in a decoded JSON document.
+// Only strings, numbers and booleans can name an object; anything else is missing.
+func jsonField(document interface{}, path string) (string, bool) {
+	value := document
+	for _, segment := range strings.Split(strings.TrimPrefix(path, "."), ".") {
+		switch node := value.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if value, ok = node[segment]; !ok {
+				return "", false
+			}
+		case []interface{}:
+			index, err := strconv.Atoi(segment)
+			if err != nil || index < 0 || index >= len(node) {
+				return "", false
+			}
+			value = node[index]
+		default:
+			return "", false
+		}
+	}
+	switch value := value.(type) {
+	case string:
+		return value, value != ""
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(value), true
+	}
+	return "", false
+}
+
+// keySegment makes a client-supplied value safe to use as part of a key: it can't
+// add path segments, traverse with "..", or introduce placeholders
+func keySegment(value string) string {
+	if len(value) > maxKeyFieldLength {
+		value = value[:maxKeyFieldLength]
+	}
+	value = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.' {
+			return r
+		}
+		return '_'
+	}, value)
+	return strings.ReplaceAll(value, "..", "__")
+}
+
+// isEmptyKey reports whether a key has no file name left of its own: it is empty,
+// ends in "/", or its last segment is only the extension
+func isEmptyKey(key string, extension string) bool {
+	name := key[strings.LastIndex(key, "/")+1:]
+	return name == "" || name == extension
+}
+
+// generatedKey replaces the empty file name of key with upload-<timestamp>-<uuid>,
+// keeping its prefix and extension
+func generatedKey(key string, extension string, timestamp string) string {
+	var id [16]byte
+	rand.Read(id[:])
+	id[6] = id[6]&0x0f | 0x40 // version 4
+	id[8] = id[8]&0x3f | 0x80 // RFC 4122 variant
+	uuid := fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:])
+	return key[:strings.LastIndex(key, "/")+1] + "upload-" + timestamp + "-" + uuid + extension
+}
+
+// enforceKeyCharset replaces every character of key that allowed doesn't match,
+// or with the reject action fails with ErrDisallowedKeyCharacter. A nil allowed
+// permits every character.
+func enforceKeyCharset(key string, allowed *regexp.Regexp, action string, replacement string) (string, error) {
+	if allowed == nil {
+		return key, nil
+	}
+	var b strings.Builder
+	for _, r := range key {
+		if allowed.MatchString(string(r)) {
+			b.WriteRune(r)
+			continue
+		}
+		if action == "reject" {
+			return "", ErrDisallowedKeyCharacter
+		}
+		b.WriteString(replacement)
+	}
+	return b.String(), nil
+}
+
+// neutralExtension is the extension the neutral policy gives encrypted objects,
+// whose bytes are neither the original file type nor a readable .zst
+const neutralExtension = ".bin"
+
+// objectExtension returns the object key extension for the transforms applied to
+// its data. The legacy policy keeps the historical .zst for every object.
+func objectExtension(policy string, compression string, encrypted bool) string {
+	switch policy {
+	case "none":
+		return ""
+	case "transforms", "neutral":
+		if policy == "neutral" && encrypted {
+			return neutralExtension
+		}
+		extension := ""
+		switch compression {
+		case "zstd":
+			extension += ".zst"
+		case "gzip":
+			extension += ".gz"
+		}
+		if encrypted {
+			extension += ".enc"
+		}
+		return extension
+	default:
+		return ".zst"
+	}
+}
+
+// stripExtension removes the file extension from the last segment of a key and
+// returns it separately, e.g. "upload-report.pdf" gives "upload-report" and ".pdf".
+// Keys without one, or whose last segment is nothing but an extension, give "none".
+func stripExtension(key string) (string, string) {
+	extension := path.Ext(key)
+	if extension == "" || extension == path.Base(key) {
+		return key, "none"
+	}
+	return strings.TrimSuffix(key, extension), extension
+}
+
+// originalName reconstructs the name an object was uploaded under from its key and
+// the extension the neutral policy recorded in its metadata
+func originalName(key string, metadata map[string]string) string {
+	name := path.Base(key)
+	extension, ok := metadata["original-extension"]
+	if !ok {
+		return name
+	}
+	if extension == "none" {
+		extension = ""
+	}
+	return strings.TrimSuffix(name, neutralExtension) + extension
+}
+
+// hashedKey prepends the first length hex characters of the key's SHA-256 as a path
+// segment. The prefix depends only on the key, so the object can always be located again.
+func hashedKey(key string, length int) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])[:length] + "/" + key
+}
+
+// detectContentType returns the declared content type of a file, sniffing it from
+// the data when the client didn't declare one
+func detectContentType(file uploadFile) string {
+	if file.ContentType != "" || file.PreCompressed {
+		return file.ContentType
+	}
+	return http.DetectContentType(file.Data)
+}
+
+// namespacedKey files a key under its namespace and the UTC date of the upload
+func namespacedKey(key string, namespace string, uploaded time.Time) string {
+	return strings.TrimSuffix(namespace, "/") + "/" + uploaded.UTC().Format("2006/01/02") + "/" + key
+}
+
+// keyPlaceholders are the fields a key template may reference
+var keyPlaceholders = []string{"{name}", "{filename}", "{timestamp}", "{hash}", "{seq}"}
+
+// jsonFieldPlaceholder matches key template references to fields of a JSON upload,
+// such as {.userId} or {.items.0.id}
+var jsonFieldPlaceholder = regexp.MustCompile(`\{(\.[A-Za-z0-9_-]+)+\}`)
+
+// maxKeyFieldLength truncates JSON field values substituted into keys
+const maxKeyFieldLength = 128
+
+// ErrMissingKeyField is returned when a key template references a field the uploaded JSON lacks
+var ErrMissingKeyField = errors.New("key template field is missing from the upload")
+
+// keyFields are the values substituted into a key template
+type keyFields struct {
+	Name      string
+	Timestamp string
+	Hash      string
+	// Document is the uploaded content, read as JSON for {.field} placeholders
+	Document []byte
+}
+
+// validateKeyTemplate rejects templates referencing unknown placeholders
+func validateKeyTemplate(template string) error {
+	rest := jsonFieldPlaceholder.ReplaceAllString(template, "")
+	for _, placeholder := range keyPlaceholders {
+		rest = strings.ReplaceAll(rest, placeholder, "")
+	}
+	if strings.ContainsAny(rest, "{}") {
+		return fmt.Errorf("key template %q has an unknown placeholder", template)
+	}
+	return nil
+}
+
+// renderKey expands a key template. {seq} is drawn from a counter named after the
+// key text preceding it, so each prefix is numbered independently, and is zero
+// padded so keys sort in sequence order. {.field} placeholders are filled from the
+// uploaded JSON document and fail with ErrMissingKeyField when it lacks the field.
+func renderKey(ctx context.Context, template string, fields keyFields, counter sequenceCounter) (string, error) {
+	// Fields are expanded first, so placeholders in the file name are left as typed
+	if jsonFieldPlaceholder.MatchString(template) {
+		var document interface{}
+		if err := json.Unmarshal(fields.Document, &document); err != nil {
+			log.Printf("Key template %v needs a JSON upload. Here's why: %v\n", template, err)
+			return "", ErrMissingKeyField
+		}
+		var missing string
+		template = jsonFieldPlaceholder.ReplaceAllStringFunc(template, func(placeholder string) string {
+			path := strings.Trim(placeholder, "{}")
+			value, ok := jsonField(document, path)
+			if !ok && missing == "" {
+				missing = path
+			}
+			return keySegment(value)
+		})
+		if missing != "" {
+			log.Printf("Key template field %v is missing from the upload\n", missing)
+			return "", ErrMissingKeyField
+		}
+	}
+
+	replacer := strings.NewReplacer(
+		"{name}", fields.Name,
+		"{filename}", fields.Name,
+		"{timestamp}", fields.Timestamp,
+		"{hash}", fields.Hash,
+	)
+	// Split before substituting, so a {seq} inside a filename isn't expanded
+	parts := strings.Split(template, "{seq}")
+	for i, part := range parts {
+		parts[i] = replacer.Replace(part)
+	}
+	if len(parts) == 1 {
+		return parts[0], nil
+	}
+	seq, err := counter.Next(ctx, parts[0])
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(parts, fmt.Sprintf("%012d", seq)), nil
+}
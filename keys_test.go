@@ -0,0 +1,607 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestObjectExtension(t *testing.T) {
+	tests := []struct {
+		policy      string
+		compression string
+		encrypted   bool
+		want        string
+	}{
+		{"legacy", "zstd", true, ".zst"},
+		{"legacy", "none", false, ".zst"},
+		{"legacy", "gzip", true, ".zst"},
+		{"transforms", "zstd", true, ".zst.enc"},
+		{"transforms", "zstd", false, ".zst"},
+		{"transforms", "gzip", true, ".gz.enc"},
+		{"transforms", "gzip", false, ".gz"},
+		{"transforms", "none", true, ".enc"},
+		{"transforms", "none", false, ""},
+		{"neutral", "zstd", true, neutralExtension},
+		{"neutral", "none", true, neutralExtension},
+		{"neutral", "zstd", false, ".zst"},
+		{"neutral", "none", false, ""},
+		{"none", "zstd", true, ""},
+	}
+	for _, test := range tests {
+		if got := objectExtension(test.policy, test.compression, test.encrypted); got != test.want {
+			t.Errorf("objectExtension(%q, %q, %v) = %q, want %q", test.policy, test.compression, test.encrypted, got, test.want)
+		}
+	}
+}
+
+func TestOriginalName(t *testing.T) {
+	tests := []struct {
+		key       string
+		wantKey   string
+		extension string
+		name      string
+	}{
+		{key: "docs/upload-1-report.pdf", wantKey: "docs/upload-1-report", extension: ".pdf", name: "upload-1-report.pdf"},
+		{key: "upload-1-notes", wantKey: "upload-1-notes", extension: "none", name: "upload-1-notes"},
+		{key: "a/.env", wantKey: "a/.env", extension: "none", name: ".env"},
+		{key: "archive.tar.gz", wantKey: "archive.tar", extension: ".gz", name: "archive.tar.gz"},
+	}
+	for _, test := range tests {
+		key, extension := stripExtension(test.key)
+		if key != test.wantKey || extension != test.extension {
+			t.Errorf("stripExtension(%q) = %q, %q, want %q, %q", test.key, key, extension, test.wantKey, test.extension)
+		}
+		stored := key + neutralExtension
+		if name := originalName(stored, map[string]string{"original-extension": extension}); name != test.name {
+			t.Errorf("originalName(%q) = %q, want %q", stored, name, test.name)
+		}
+	}
+	if name := originalName("docs/upload-1.zst", nil); name != "upload-1.zst" {
+		t.Errorf("originalName() without metadata = %q", name)
+	}
+}
+
+func TestUploadExtensionPolicy(t *testing.T) {
+	compressible := strings.Repeat("compress me ", 10_000)
+	t.Setenv("S3_UPLOAD_COMPRESSION_MAP", "text/csv=gzip")
+	tests := []struct {
+		policy      string
+		contentType string
+		suffix      string
+	}{
+		{policy: "", contentType: "text/plain", suffix: ".zst"},
+		{policy: "legacy", contentType: "application/zip", suffix: ".zst"},
+		{policy: "transforms", contentType: "text/plain", suffix: ".zst.enc"},
+		{policy: "transforms", contentType: "text/csv", suffix: ".gz.enc"},
+		{policy: "transforms", contentType: "application/zip", suffix: ".enc"},
+		{policy: "neutral", contentType: "text/plain", suffix: neutralExtension},
+		{policy: "none", contentType: "text/plain"},
+	}
+	for _, test := range tests {
+		t.Run(test.policy+"/"+test.contentType, func(t *testing.T) {
+			t.Setenv("S3_UPLOAD_EXTENSION_POLICY", test.policy)
+			fake := newFakeS3(t)
+			upload(t, map[string]string{"Content-Type": test.contentType}, compressible)
+			bucket := fake.bucketNames()[0]
+			key := fake.keys(bucket)[0]
+			_, metadata, _ := fake.object(bucket, key)
+			if test.policy == "none" {
+				if strings.Contains(key, ".") {
+					t.Errorf("key %q has an extension", key)
+				}
+				return
+			}
+			if !strings.HasSuffix(key, test.suffix) || strings.HasSuffix(key, ".zst"+test.suffix) {
+				t.Errorf("key %q for %v doesn't end in %q", key, metadata, test.suffix)
+			}
+		})
+	}
+}
+
+func TestUploadNeutralExtension(t *testing.T) {
+	t.Setenv("S3_UPLOAD_EXTENSION_POLICY", "neutral")
+	t.Setenv("S3_UPLOAD_KEY_TEMPLATE", "{name}")
+	tests := []struct {
+		name      string
+		key       string
+		extension string
+	}{
+		{name: "report.pdf", key: "report.bin", extension: ".pdf"},
+		{name: "archive.tar.gz", key: "archive.tar.bin", extension: ".gz"},
+		{name: "README", key: "README.bin", extension: "none"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := newFakeS3(t)
+			content := "contents of " + test.name
+			body, contentType := multipartBody(t, testFile{name: test.name, contentType: "application/octet-stream", data: content})
+			upload(t, map[string]string{"Content-Type": contentType}, body)
+			bucket := fake.bucketNames()[0]
+			if keys := fake.keys(bucket); len(keys) != 1 || keys[0] != test.key {
+				t.Fatalf("stored %v, want %q", keys, test.key)
+			}
+			_, metadata, _ := fake.object(bucket, test.key)
+			if metadata["original-extension"] != test.extension {
+				t.Errorf("original-extension = %q, want %q", metadata["original-extension"], test.extension)
+			}
+			if name := originalName(test.key, metadata); name != test.name {
+				t.Errorf("originalName() = %q, want %q", name, test.name)
+			}
+
+			// Downloads are offered under the name the file was uploaded with
+			response := handleDownload(t.Context(), events.APIGatewayProxyRequest{
+				QueryStringParameters: map[string]string{"action": "download", "bucket": bucket, "key": test.key},
+				RequestContext:        events.APIGatewayProxyRequestContext{Authorizer: map[string]interface{}{"principalId": "user-1"}},
+			}, testConfig(t, nil))
+			if response.StatusCode != http.StatusOK {
+				t.Fatalf("handleDownload() = %d %q", response.StatusCode, response.Body)
+			}
+			if _, params, err := mime.ParseMediaType(response.Headers["Content-Disposition"]); err != nil || params["filename"] != test.name {
+				t.Errorf("Content-Disposition = %q, want filename %q", response.Headers["Content-Disposition"], test.name)
+			}
+			if data, _ := base64.StdEncoding.DecodeString(response.Body); string(data) != content {
+				t.Errorf("downloaded %q, want %q", data, content)
+			}
+		})
+	}
+}
+
+func TestExtensionPolicyConfig(t *testing.T) {
+	if err := configError(t, map[string]string{"S3_UPLOAD_EXTENSION_POLICY": "zip"}); err == nil {
+		t.Error("loadConfig() accepted an unknown extension policy")
+	}
+	if cfg := testConfig(t, map[string]string{"S3_UPLOAD_EXTENSION_POLICY": "Transforms"}); cfg.ExtensionPolicy != "transforms" {
+		t.Errorf("ExtensionPolicy = %q", cfg.ExtensionPolicy)
+	}
+}
+
+func TestHashedKeyDeterministic(t *testing.T) {
+	tests := []struct {
+		key    string
+		length int
+	}{
+		{"upload-20240131-120000.zst", 4},
+		{"docs/report.pdf", 1},
+		{"upload-20240131-120000.zst", 64},
+	}
+	for _, test := range tests {
+		first := hashedKey(test.key, test.length)
+		if second := hashedKey(test.key, test.length); second != first {
+			t.Errorf("hashedKey(%q) = %q then %q", test.key, first, second)
+		}
+		prefix, rest, _ := strings.Cut(first, "/")
+		if len(prefix) != test.length || rest != test.key {
+			t.Errorf("hashedKey(%q, %d) = %q", test.key, test.length, first)
+		}
+		if strings.Trim(prefix, "0123456789abcdef") != "" {
+			t.Errorf("prefix %q isn't hex", prefix)
+		}
+	}
+	// Shorter prefixes are prefixes of longer ones, so changing the length regroups keys
+	if long, short := hashedKey("a", 8), hashedKey("a", 2); !strings.HasPrefix(long, short[:2]) {
+		t.Errorf("hashedKey lengths disagree: %q, %q", long, short)
+	}
+}
+
+func TestHashedKeyDistribution(t *testing.T) {
+	const keys = 16 * 1024
+	counts := make(map[string]int)
+	for i := 0; i < keys; i++ {
+		prefix, _, _ := strings.Cut(hashedKey(fmt.Sprintf("upload-20240131-120000-%d.zst", i), 2), "/")
+		counts[prefix]++
+	}
+	// Sequential keys must land in every one of the 256 prefixes, roughly evenly
+	if len(counts) != 256 {
+		t.Errorf("keys land in %d of 256 prefixes", len(counts))
+	}
+	for prefix, count := range counts {
+		if count < keys/256/2 || count > keys/256*2 {
+			t.Errorf("prefix %s holds %d keys, expected about %d", prefix, count, keys/256)
+		}
+	}
+}
+
+func TestUploadHashPrefix(t *testing.T) {
+	t.Setenv("S3_UPLOAD_HASH_PREFIX", "true")
+	t.Setenv("S3_UPLOAD_HASH_PREFIX_LENGTH", "3")
+	fake := newFakeS3(t)
+	upload(t, nil, "spread across partitions")
+	bucket := fake.bucketNames()[0]
+	key := fake.keys(bucket)[0]
+	prefix, rest, _ := strings.Cut(key, "/")
+	if hashedKey(rest, 3) != key || len(prefix) != 3 {
+		t.Errorf("stored as %q, want a 3 character hash prefix", key)
+	}
+	if err := configError(t, map[string]string{"S3_UPLOAD_HASH_PREFIX_LENGTH": "65"}); err == nil {
+		t.Error("loadConfig() accepted a 65 character prefix")
+	}
+}
+
+func TestNamespacedKey(t *testing.T) {
+	tests := []struct {
+		namespace string
+		uploaded  time.Time
+		want      string
+	}{
+		{namespace: "images", uploaded: time.Date(2024, 6, 15, 12, 0, 0, 0, time.UTC), want: "images/2024/06/15/a.png"},
+		{namespace: "docs/", uploaded: time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC), want: "docs/2024/01/02/a.png"},
+		// Partitions follow the UTC date wherever the function runs
+		{namespace: "images", uploaded: time.Date(2024, 6, 15, 23, 30, 0, 0, time.FixedZone("UTC-5", -5*3600)), want: "images/2024/06/16/a.png"},
+		{namespace: "archive/raw", uploaded: time.Date(2023, 12, 31, 23, 59, 59, 0, time.UTC), want: "archive/raw/2023/12/31/a.png"},
+	}
+	for _, test := range tests {
+		if got := namespacedKey("a.png", test.namespace, test.uploaded); got != test.want {
+			t.Errorf("namespacedKey(%q, %v) = %q, want %q", test.namespace, test.uploaded, got, test.want)
+		}
+	}
+}
+
+func TestDetectContentType(t *testing.T) {
+	tests := []struct {
+		name string
+		file uploadFile
+		want string
+	}{
+		{name: "declared", file: uploadFile{ContentType: "application/pdf", Data: []byte("plain text")}, want: "application/pdf"},
+		{name: "sniffed png", file: uploadFile{Data: []byte("\x89PNG\r\n\x1a\n0000")}, want: "image/png"},
+		{name: "sniffed text", file: uploadFile{Data: []byte("just some words")}, want: "text/plain; charset=utf-8"},
+		// Sniffing a zstd stream would only ever find octet-stream
+		{name: "pre-compressed", file: uploadFile{PreCompressed: true, Data: []byte("\x28\xb5\x2f\xfd")}, want: ""},
+	}
+	for _, test := range tests {
+		if got := detectContentType(test.file); got != test.want {
+			t.Errorf("%s: detectContentType() = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestUploadNamespaces(t *testing.T) {
+	t.Setenv("S3_UPLOAD_NAMESPACES", "image/*=images,application/pdf=docs,text/plain=")
+	t.Setenv("S3_UPLOAD_KEY_TEMPLATE", "{name}")
+	tests := []struct {
+		name      string
+		file      testFile
+		namespace string
+	}{
+		{name: "image", file: testFile{name: "photo.png", contentType: "image/png", data: "png"}, namespace: "images"},
+		{name: "pdf", file: testFile{name: "report.pdf", contentType: "application/pdf", data: "pdf"}, namespace: "docs"},
+		{name: "sniffed image", file: testFile{name: "photo.gif", data: "GIF89a....."}, namespace: "images"},
+		{name: "unmapped", file: testFile{name: "data.csv", contentType: "text/csv", data: "a,b"}},
+		{name: "mapped to no namespace", file: testFile{name: "notes.txt", contentType: "text/plain", data: "notes"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := newFakeS3(t)
+			before := time.Now().UTC()
+			body, contentType := multipartBody(t, test.file)
+			upload(t, map[string]string{"Content-Type": contentType}, body)
+			after := time.Now().UTC()
+
+			keys := fake.keys(fake.bucketNames()[0])
+			if len(keys) != 1 {
+				t.Fatalf("stored %v, want one object", keys)
+			}
+			if test.namespace == "" {
+				if !strings.HasPrefix(keys[0], test.file.name) {
+					t.Errorf("key %q, want %q without a namespace", keys[0], test.file.name)
+				}
+				return
+			}
+			// The upload may straddle midnight, so either date is right
+			var prefixes []string
+			for _, day := range []time.Time{before, after} {
+				prefix := fmt.Sprintf("%s/%s/%s", test.namespace, day.Format("2006/01/02"), test.file.name)
+				prefixes = append(prefixes, prefix)
+				if strings.HasPrefix(keys[0], prefix) {
+					return
+				}
+			}
+			t.Errorf("key %q, want one of %v", keys[0], prefixes)
+		})
+	}
+}
+
+func TestEnforceKeyCharset(t *testing.T) {
+	custom := regexp.MustCompile(`^(?:[a-z0-9/.])$`)
+	tests := []struct {
+		name    string
+		key     string
+		allowed *regexp.Regexp
+		action  string
+		want    string
+		err     error
+	}{
+		{name: "permissive", key: "my report+final é.txt", action: "reject", want: "my report+final é.txt"},
+		{name: "safe-ascii keeps safe keys", key: "2024/Q1_(draft)!.txt", allowed: keyCharsets["safe-ascii"], action: "replace", want: "2024/Q1_(draft)!.txt"},
+		{name: "safe-ascii replaces", key: "my report+final é.txt", allowed: keyCharsets["safe-ascii"], action: "replace", want: "my_report_final__.txt"},
+		{name: "safe-ascii rejects", key: "my report.txt", allowed: keyCharsets["safe-ascii"], action: "reject", err: ErrDisallowedKeyCharacter},
+		{name: "url-safe replaces", key: "a (copy)~1.txt", allowed: keyCharsets["url-safe"], action: "replace", want: "a__copy_~1.txt"},
+		{name: "url-safe rejects", key: "it's.txt", allowed: keyCharsets["url-safe"], action: "reject", err: ErrDisallowedKeyCharacter},
+		{name: "custom replaces", key: "Dir/File-1.txt", allowed: custom, action: "replace", want: "_ir/_ile_1.txt"},
+		{name: "custom rejects", key: "Dir/file.txt", allowed: custom, action: "reject", err: ErrDisallowedKeyCharacter},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := enforceKeyCharset(test.key, test.allowed, test.action, "_")
+			if !errors.Is(err, test.err) {
+				t.Fatalf("enforceKeyCharset(%q) error = %v, want %v", test.key, err, test.err)
+			}
+			if got != test.want {
+				t.Errorf("enforceKeyCharset(%q) = %q, want %q", test.key, got, test.want)
+			}
+		})
+	}
+}
+
+func TestKeyCharsetConfig(t *testing.T) {
+	if cfg := testConfig(t, nil); cfg.KeyCharset != nil {
+		t.Errorf("KeyCharset = %v, want permissive by default", cfg.KeyCharset)
+	}
+	cfg := testConfig(t, map[string]string{"S3_UPLOAD_KEY_CHARSET": "custom", "S3_UPLOAD_KEY_CHARSET_REGEX": "[a-z_]|/"})
+	// The custom pattern is anchored, so it can't match part of a longer string
+	if !cfg.KeyCharset.MatchString("a") || !cfg.KeyCharset.MatchString("/") || cfg.KeyCharset.MatchString("ab") {
+		t.Errorf("KeyCharset = %v, want it anchored to one character", cfg.KeyCharset)
+	}
+	for _, env := range []map[string]string{
+		{"S3_UPLOAD_KEY_CHARSET": "ascii"},
+		{"S3_UPLOAD_KEY_CHARSET": "custom", "S3_UPLOAD_KEY_CHARSET_REGEX": ""},
+		{"S3_UPLOAD_KEY_CHARSET": "custom", "S3_UPLOAD_KEY_CHARSET_REGEX": "[a-"},
+		{"S3_UPLOAD_KEY_CHARSET": "url-safe", "S3_UPLOAD_KEY_CHARSET_ACTION": "drop"},
+		{"S3_UPLOAD_KEY_CHARSET": "url-safe", "S3_UPLOAD_KEY_CHARSET_REPLACEMENT": "+"},
+	} {
+		if err := configError(t, env); err == nil {
+			t.Errorf("loadConfig() accepted %v", env)
+		}
+	}
+}
+
+func TestUploadKeyCharset(t *testing.T) {
+	t.Setenv("S3_UPLOAD_KEY_TEMPLATE", "{name}")
+	tests := []struct {
+		name    string
+		env     map[string]string
+		file    string
+		status  int
+		wantKey string
+	}{
+		{name: "permissive", file: "my report+1.txt", status: http.StatusOK, wantKey: "my report+1.txt.zst"},
+		{name: "safe-ascii", env: map[string]string{"S3_UPLOAD_KEY_CHARSET": "safe-ascii"}, file: "my report+1.txt", status: http.StatusOK, wantKey: "my_report_1.txt.zst"},
+		{name: "url-safe replacement", env: map[string]string{"S3_UPLOAD_KEY_CHARSET": "url-safe", "S3_UPLOAD_KEY_CHARSET_REPLACEMENT": "-"}, file: "my report+1.txt", status: http.StatusOK, wantKey: "my-report-1.txt.zst"},
+		{name: "rejected", env: map[string]string{"S3_UPLOAD_KEY_CHARSET": "url-safe", "S3_UPLOAD_KEY_CHARSET_ACTION": "reject"}, file: "my report.txt", status: http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+			fake := newFakeS3(t)
+			body, contentType := multipartBody(t, testFile{name: test.file, contentType: "text/plain", data: "contents"})
+			response := handle(t, map[string]string{"Content-Type": contentType}, body)
+			if response.StatusCode != test.status {
+				t.Fatalf("Handler() = %d %q, want %d", response.StatusCode, response.Body, test.status)
+			}
+			if test.wantKey == "" {
+				if puts := fake.count("PutObject"); puts != 0 {
+					t.Errorf("PutObject called %d times for a rejected key", puts)
+				}
+				return
+			}
+			if keys := fake.keys(fake.bucketNames()[0]); len(keys) != 1 || keys[0] != test.wantKey {
+				t.Errorf("stored %v, want %q", keys, test.wantKey)
+			}
+		})
+	}
+}
+
+func TestIsEmptyKey(t *testing.T) {
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{key: "", want: true},
+		{key: ".zst", want: true},
+		{key: "docs/", want: true},
+		{key: "docs/.zst", want: true},
+		{key: "docs/2024/.zst", want: true},
+		{key: "report.txt.zst"},
+		{key: "docs/report.zst"},
+		{key: "docs/.zst.zst"},
+	}
+	for _, test := range tests {
+		if got := isEmptyKey(test.key, ".zst"); got != test.want {
+			t.Errorf("isEmptyKey(%q) = %v, want %v", test.key, got, test.want)
+		}
+	}
+}
+
+func TestGeneratedKey(t *testing.T) {
+	uuid := `[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}`
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{key: ".zst", want: `^upload-20240615-120000-` + uuid + `\.zst$`},
+		{key: "docs/.zst", want: `^docs/upload-20240615-120000-` + uuid + `\.zst$`},
+		{key: "a/b/", want: `^a/b/upload-20240615-120000-` + uuid + `\.zst$`},
+	}
+	for _, test := range tests {
+		got := generatedKey(test.key, ".zst", "20240615-120000")
+		if !regexp.MustCompile(test.want).MatchString(got) {
+			t.Errorf("generatedKey(%q) = %q, want a match for %s", test.key, got, test.want)
+		}
+	}
+	// Concurrent uploads in the same second still get distinct keys
+	if first, second := generatedKey("", "", "20240615-120000"), generatedKey("", "", "20240615-120000"); first == second {
+		t.Errorf("generatedKey() returned %q twice", first)
+	}
+}
+
+func TestUploadEmptyKey(t *testing.T) {
+	t.Setenv("S3_UPLOAD_KEY_TEMPLATE", "docs/{name}")
+	tests := []struct {
+		name   string
+		policy string
+		status int
+	}{
+		{name: "generate by default", status: http.StatusOK},
+		{name: "generate", policy: "generate", status: http.StatusOK},
+		{name: "reject", policy: "reject", status: http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.policy != "" {
+				t.Setenv("S3_UPLOAD_EMPTY_KEY_POLICY", test.policy)
+			}
+			fake := newFakeS3(t)
+			// A raw body has no file name, so the template leaves only the prefix
+			response := handle(t, map[string]string{"Content-Type": "text/plain"}, "nameless")
+			if response.StatusCode != test.status {
+				t.Fatalf("Handler() = %d %q, want %d", response.StatusCode, response.Body, test.status)
+			}
+			if test.status != http.StatusOK {
+				if puts := fake.count("PutObject"); puts != 0 {
+					t.Errorf("PutObject called %d times for an empty key", puts)
+				}
+				return
+			}
+			keys := fake.keys(fake.bucketNames()[0])
+			if len(keys) != 1 || !regexp.MustCompile(`^docs/upload-\d{8}-\d{6}-[0-9a-f-]{36}\.zst$`).MatchString(keys[0]) {
+				t.Errorf("stored %v, want a generated key under docs/", keys)
+			}
+		})
+	}
+	if err := configError(t, map[string]string{"S3_UPLOAD_EMPTY_KEY_POLICY": "skip"}); err == nil {
+		t.Error("loadConfig() accepted an unknown empty key policy")
+	}
+}
+
+func TestJSONField(t *testing.T) {
+	var document interface{}
+	if err := json.Unmarshal([]byte(`{"userId": "u-42", "age": 37, "rate": 0.25, "admin": false, "empty": "",
+		"profile": {"team": "billing"}, "items": [{"id": "first"}, {"id": "second"}], "nothing": null}`), &document); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path string
+		want string
+		ok   bool
+	}{
+		{path: ".userId", want: "u-42", ok: true},
+		{path: ".age", want: "37", ok: true},
+		{path: ".rate", want: "0.25", ok: true},
+		{path: ".admin", want: "false", ok: true},
+		{path: ".profile.team", want: "billing", ok: true},
+		{path: ".items.1.id", want: "second", ok: true},
+		{path: ".missing"},
+		{path: ".empty"},
+		{path: ".nothing"},
+		{path: ".profile"},
+		{path: ".items"},
+		{path: ".items.2.id"},
+		{path: ".items.-1.id"},
+		{path: ".items.first"},
+		{path: ".userId.length"},
+	}
+	for _, test := range tests {
+		got, ok := jsonField(document, test.path)
+		if got != test.want || ok != test.ok {
+			t.Errorf("jsonField(%q) = %q, %v, want %q, %v", test.path, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestKeySegment(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{value: "u-42", want: "u-42"},
+		{value: "a/b", want: "a_b"},
+		{value: "..", want: "__"},
+		{value: "../../etc", want: "______etc"},
+		{value: "{seq}", want: "_seq_"},
+		{value: "José Smith", want: "Jos__Smith"},
+		{value: strings.Repeat("x", 200), want: strings.Repeat("x", maxKeyFieldLength)},
+	}
+	for _, test := range tests {
+		if got := keySegment(test.value); got != test.want {
+			t.Errorf("keySegment(%q) = %q, want %q", test.value, got, test.want)
+		}
+	}
+}
+
+func TestRenderKeyJSONFields(t *testing.T) {
+	document := []byte(`{"userId": "u-42", "docType": "invoice", "owner": {"team": "../billing"}, "label": "{seq}"}`)
+	tests := []struct {
+		name     string
+		template string
+		document []byte
+		want     string
+		err      error
+	}{
+		{name: "fields and file name", template: "{.userId}/{.docType}/{filename}", document: document, want: "u-42/invoice/report.json"},
+		{name: "nested field sanitized", template: "teams/{.owner.team}/{name}", document: document, want: "teams/___billing/report.json"},
+		{name: "placeholder in a value", template: "{.label}-{name}", document: document, want: "_seq_-report.json"},
+		{name: "missing field", template: "{.userId}/{.tenant}/{filename}", document: document, err: ErrMissingKeyField},
+		{name: "not JSON", template: "{.userId}/{filename}", document: []byte("plain text"), err: ErrMissingKeyField},
+		{name: "no fields referenced", template: "plain/{filename}", document: []byte("plain text"), want: "plain/report.json"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := renderKey(t.Context(), test.template, keyFields{Name: "report.json", Document: test.document}, nil)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("renderKey() error = %v, want %v", err, test.err)
+			}
+			if got != test.want {
+				t.Errorf("renderKey() = %q, want %q", got, test.want)
+			}
+		})
+	}
+	for template, ok := range map[string]bool{"{.userId}/{filename}": true, "{.items.0.id}": true, "{.}": false, "{.user id}": false} {
+		if err := validateKeyTemplate(template); (err == nil) != ok {
+			t.Errorf("validateKeyTemplate(%q) = %v, want ok %v", template, err, ok)
+		}
+	}
+}
+
+func TestUploadJSONFieldKeys(t *testing.T) {
+	t.Setenv("S3_UPLOAD_KEY_TEMPLATE", "{.userId}/{.docType}/{filename}")
+	tests := []struct {
+		name    string
+		data    string
+		status  int
+		wantKey string
+	}{
+		{name: "fields present", data: `{"userId": "u-42", "docType": "invoice"}`, status: http.StatusOK, wantKey: "u-42/invoice/doc.json.zst"},
+		{name: "field missing", data: `{"userId": "u-42"}`, status: http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := newFakeS3(t)
+			body, contentType := multipartBody(t, testFile{name: "doc.json", contentType: "application/json", data: test.data})
+			response := handle(t, map[string]string{"Content-Type": contentType}, body)
+			if response.StatusCode != test.status {
+				t.Fatalf("Handler() = %d %q, want %d", response.StatusCode, response.Body, test.status)
+			}
+			if test.wantKey == "" {
+				if puts := fake.count("PutObject"); puts != 0 {
+					t.Errorf("PutObject called %d times for an upload missing a key field", puts)
+				}
+				return
+			}
+			if keys := fake.keys(fake.bucketNames()[0]); len(keys) != 1 || keys[0] != test.wantKey {
+				t.Errorf("stored %v, want %q", keys, test.wantKey)
+			}
+		})
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"log"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// logRequest logs the safe metadata of a request. Bodies, header values other than
+// the content type, and anything derived from key material are never logged,
+// whatever the log level.
+func logRequest(request events.APIGatewayProxyRequest) {
+	size := len(request.Body)
+	if request.IsBase64Encoded {
+		size = size / 4 * 3
+	}
+	log.Printf("Request: method=%v action=%q contentType=%q size=%d\n",
+		request.HTTPMethod,
+		request.QueryStringParameters["action"],
+		headerValue(request.Headers, "Content-Type"),
+		size)
+}
+
+// logUpload logs the safe metadata of a file being uploaded
+func logUpload(bucketName string, fileName string, file uploadFile) {
+	log.Printf("Uploading %v:%v contentType=%q size=%d\n", bucketName, fileName, file.ContentType, len(file.Data))
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// captureLogs collects everything logged until the test ends
+func captureLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	previous := log.Writer()
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(previous) })
+	return &buf
+}
+
+func TestLogsRedactSensitiveData(t *testing.T) {
+	secrets := []string{
+		"top-secret-body-content",
+		"Bearer eyJhbGciOiJIUzI1NiJ9.secret-token",
+		"session=secret-session",
+		"secret-api-key",
+		"deadbeefcafebabe",
+		"shared-trust-secret",
+		string(testEncryptionKey),
+	}
+	tests := []struct {
+		name    string
+		request events.APIGatewayProxyRequest
+	}{
+		{
+			name: "raw upload",
+			request: events.APIGatewayProxyRequest{
+				HTTPMethod: "POST",
+				Headers: map[string]string{
+					"Content-Type":       "text/plain",
+					"Authorization":      secrets[1],
+					"Cookie":             secrets[2],
+					"X-Api-Key":          secrets[3],
+					"X-Upload-Signature": secrets[4],
+				},
+				Body: secrets[0],
+			},
+		},
+		{
+			name: "base64 upload",
+			request: events.APIGatewayProxyRequest{
+				HTTPMethod:      "POST",
+				Headers:         map[string]string{"Content-Type": "text/plain", "Authorization": secrets[1]},
+				Body:            base64.StdEncoding.EncodeToString([]byte(secrets[0])),
+				IsBase64Encoded: true,
+			},
+		},
+		{
+			name: "rejected upload",
+			request: events.APIGatewayProxyRequest{
+				HTTPMethod: "POST",
+				Headers:    map[string]string{"Content-Encoding": "zstd", "X-Api-Key": secrets[3]},
+				Body:       secrets[0],
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("S3_UPLOAD_TRUST_SECRET", secrets[5])
+			newFakeS3(t)
+			logs := captureLogs(t)
+			if _, err := Handler(t.Context(), test.request); err != nil {
+				t.Fatal(err)
+			}
+			if logs.Len() == 0 {
+				t.Fatal("nothing was logged")
+			}
+			for _, secret := range secrets {
+				if strings.Contains(logs.String(), secret) {
+					t.Errorf("logs contain %q:\n%s", secret, logs)
+				}
+			}
+			if encoded := base64.StdEncoding.EncodeToString([]byte(secrets[0])); strings.Contains(logs.String(), encoded) {
+				t.Error("logs contain the base64-encoded body")
+			}
+		})
+	}
+}
+
+func TestLogRequest(t *testing.T) {
+	logs := captureLogs(t)
+	logRequest(events.APIGatewayProxyRequest{
+		HTTPMethod:            "POST",
+		Headers:               map[string]string{"content-type": "text/csv", "Authorization": "Bearer token"},
+		QueryStringParameters: map[string]string{"action": "upload"},
+		Body:                  base64.StdEncoding.EncodeToString([]byte("123456")),
+		IsBase64Encoded:       true,
+	})
+	want := `Request: method=POST action="upload" contentType="text/csv" size=6`
+	if got := strings.TrimSpace(logs.String()); !strings.HasSuffix(got, want) {
+		t.Errorf("logged %q, want %q", got, want)
+	}
+}
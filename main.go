@@ -2,143 +2,1193 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/base64"
+	"errors"
 	"fmt"
-
+	"io"
+	"io/fs"
 	"log"
+	"mime"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/klauspost/compress/zstd"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // BucketBasics encapsulates the Amazon Simple Storage Service (Amazon S3) actions
 type BucketBasics struct {
 	S3Client *s3.Client
+	Config   Config
 }
 
 // CreateBucket creates a bucket with the specified name in the specified Region.
 func (basics BucketBasics) CreateBucket(name string, region string) error {
+	objectLock := basics.Config.ObjectLockMode != ""
 	_, err := basics.S3Client.CreateBucket(context.TODO(), &s3.CreateBucketInput{
 		Bucket: aws.String(name),
 		CreateBucketConfiguration: &types.CreateBucketConfiguration{
 			LocationConstraint: types.BucketLocationConstraint(region),
 		},
+		ObjectLockEnabledForBucket: aws.Bool(objectLock),
 	})
+	// Concurrent invocations share the bucket; the one that created it configures it
+	if isBucketCreateRace(err) {
+		log.Printf("Bucket %v is being created concurrently, waiting for it\n", name)
+		return basics.waitForBucket(name)
+	}
 	if err != nil {
 		log.Printf("Couldn't create bucket %v in Region %v. Here's why: %v\n", name, region, err)
+		return err
+	}
+
+	// Protect objects with a default retention so uploads don't need per-object settings
+	if objectLock {
+		_, err = basics.S3Client.PutObjectLockConfiguration(context.TODO(), &s3.PutObjectLockConfigurationInput{
+			Bucket: aws.String(name),
+			ObjectLockConfiguration: &types.ObjectLockConfiguration{
+				ObjectLockEnabled: types.ObjectLockEnabledEnabled,
+				Rule: &types.ObjectLockRule{
+					DefaultRetention: &types.DefaultRetention{
+						Mode: basics.Config.ObjectLockMode,
+						Days: aws.Int32(int32(basics.Config.ObjectLockDays)),
+					},
+				},
+			},
+		})
+		if err != nil {
+			log.Printf("Couldn't set object lock configuration on bucket %v. Here's why: %v\n", name, err)
+			return err
+		}
+	}
+
+	// Disable ACLs so access is governed by policies alone, unless ACLs were requested
+	if !basics.Config.EnableACLs {
+		_, err = basics.S3Client.PutBucketOwnershipControls(context.TODO(), &s3.PutBucketOwnershipControlsInput{
+			Bucket: aws.String(name),
+			OwnershipControls: &types.OwnershipControls{
+				Rules: []types.OwnershipControlsRule{
+					{ObjectOwnership: types.ObjectOwnershipBucketOwnerEnforced},
+				},
+			},
+		})
+		if err != nil {
+			log.Printf("Couldn't set ownership controls on bucket %v. Here's why: %v\n", name, err)
+			return err
+		}
+	}
+
+	if basics.Config.BucketPolicy != "" {
+		if err = basics.ApplyBucketPolicy(name); err != nil {
+			return err
+		}
+	}
+
+	if basics.Config.ReplicationDestination != "" {
+		err = basics.ConfigureReplication(name)
 	}
 	return err
 }
 
-// UploadFileToS3 uploads a file to an S3 bucket
-func (basics BucketBasics) UploadFileToS3(bucketName string, fileName string, fileData []byte) error {
-	_, err := basics.S3Client.PutObject(context.TODO(), &s3.PutObjectInput{
-		Bucket: aws.String(bucketName),
-		Key:    aws.String(fileName),
-		Body:   bytes.NewReader(fileData),
+// UploadOptions carries the optional PutObject settings for an upload
+type UploadOptions struct {
+	ContentType  string
+	StorageClass types.StorageClass
+	Metadata     map[string]string
+	Tags         map[string]string
+	// CreateOnly fails the upload instead of overwriting an existing object
+	CreateOnly bool
+	// IfMatch only replaces an existing object with this ETag, e.g. a reservation
+	IfMatch string
+}
+
+// UploadFileToS3 uploads a file to an S3 bucket. Files above MultipartThreshold
+// are streamed through UploadFromReader.
+func (basics BucketBasics) UploadFileToS3(bucketName string, fileName string, fileData []byte, opts UploadOptions) error {
+	// PutObject is limited to 5 GB, so large bodies go through the multipart uploader
+	if len(fileData) > basics.Config.MultipartThreshold {
+		return basics.UploadFromReader(bucketName, fileName, bytes.NewReader(fileData), opts)
+	}
+
+	input := basics.putObjectInput(bucketName, fileName, bytes.NewReader(fileData), opts)
+	// Store a checksum so downloads can be verified against it
+	input.ChecksumSHA256 = aws.String(sha256Checksum(fileData))
+	result, err := basics.S3Client.PutObject(context.TODO(), input)
+	if err != nil {
+		log.Printf("Couldn't upload file to %v:%v. Here's why: %v\n", bucketName, fileName, err)
+		return err
+	}
+
+	if basics.Config.VerifyWrites {
+		return basics.VerifyWrite(bucketName, fileName, aws.ToString(result.ETag))
+	}
+	return nil
+}
+
+// UploadFromReader streams an object of any size to an S3 bucket through the
+// multipart uploader, which holds at most PartConcurrency parts in memory
+func (basics BucketBasics) UploadFromReader(bucketName string, fileName string, body io.Reader, opts UploadOptions) error {
+	input := basics.putObjectInput(bucketName, fileName, body, opts)
+	// Multipart uploads carry per-part checksums rather than a whole-object one
+	input.ChecksumAlgorithm = types.ChecksumAlgorithmSha256
+	uploader := manager.NewUploader(basics.S3Client, func(u *manager.Uploader) {
+		u.PartSize = int64(basics.Config.PartSize)
+		u.Concurrency = basics.Config.PartConcurrency
+		// A body that fails or ends early aborts the upload, so no partial object or
+		// orphaned parts are left behind
+		u.LeavePartsOnError = false
+		if opts.CreateOnly {
+			u.ClientOptions = append(u.ClientOptions, func(o *s3.Options) {
+				o.APIOptions = append(o.APIOptions, createOnlyMiddleware)
+			})
+		}
+		if opts.IfMatch != "" {
+			u.ClientOptions = append(u.ClientOptions, func(o *s3.Options) {
+				o.APIOptions = append(o.APIOptions, replaceOnlyMiddleware(opts.IfMatch))
+			})
+		}
 	})
+	result, err := uploader.Upload(context.TODO(), input)
 	if err != nil {
 		log.Printf("Couldn't upload file to %v:%v. Here's why: %v\n", bucketName, fileName, err)
+		return err
 	}
-	return err
+
+	if basics.Config.VerifyWrites {
+		return basics.VerifyWrite(bucketName, fileName, aws.ToString(result.ETag))
+	}
+	return nil
+}
+
+// putObjectInput builds the PutObject request shared by both upload paths
+func (basics BucketBasics) putObjectInput(bucketName string, fileName string, body io.Reader, opts UploadOptions) *s3.PutObjectInput {
+	input := &s3.PutObjectInput{
+		Bucket:       aws.String(bucketName),
+		Key:          aws.String(fileName),
+		Body:         body,
+		StorageClass: opts.StorageClass,
+		Metadata:     opts.Metadata,
+	}
+	if opts.ContentType != "" {
+		input.ContentType = aws.String(opts.ContentType)
+	}
+	if len(opts.Tags) > 0 {
+		tags := url.Values{}
+		for key, value := range opts.Tags {
+			tags.Set(key, value)
+		}
+		input.Tagging = aws.String(tags.Encode())
+	}
+	if opts.CreateOnly {
+		input.IfNoneMatch = aws.String("*")
+	}
+	if opts.IfMatch != "" {
+		input.IfMatch = aws.String(opts.IfMatch)
+	}
+	if basics.Config.ServerSideEncryption != "" {
+		input.ServerSideEncryption = basics.Config.ServerSideEncryption
+	}
+	if basics.Config.usesKMS() {
+		if basics.Config.KMSKeyID != "" {
+			input.SSEKMSKeyId = aws.String(basics.Config.KMSKeyID)
+		}
+		// Bucket Keys only apply to SSE-KMS
+		if basics.Config.KMSBucketKey {
+			input.BucketKeyEnabled = aws.Bool(true)
+		}
+	}
+	return input
 }
 
 // compressAndEncrypt compresses and encrypts the data using Zstandard and AES
 func compressAndEncrypt(data []byte) ([]byte, error) {
 	// Compress the data using Zstandard
-	compressedData, err := compressZstd(data)
+	compressedData, err := compressZstd(data, zstd.SpeedDefault)
 	if err != nil {
 		return nil, fmt.Errorf("zstandard compression error: %v", err)
 	}
 
-	// Implement your own encryption logic or use an encryption library
-	// For demonstration purposes, the encrypt function just returns the input
-	key := []byte("your-encryption-key")
+	return encryptCompressed(compressedData)
+}
+
+// encryptCompressed encrypts already-compressed data with the configured key
+func encryptCompressed(compressedData []byte) ([]byte, error) {
+	key, err := encryptionKey()
+	if err != nil {
+		return nil, err
+	}
+
+	// Encrypt the data in AES-GCM frames
 	encryptedData, err := encrypt(compressedData, key)
 	if err != nil {
 		return nil, fmt.Errorf("AES encryption error: %v", err)
 	}
+	return encryptedData, nil
+}
+
+// compressData compresses data with the named algorithm, "zstd" at the given level or
+// "gzip". Compression is abandoned with ctx's error once ctx is done.
+func compressData(ctx context.Context, data []byte, algorithm string, level zstd.EncoderLevel, dictionary []byte) ([]byte, error) {
+	r := &contextReader{ctx: ctx, r: bytes.NewReader(data)}
+	if algorithm == "gzip" {
+		return compressGzipReader(r)
+	}
+	if dictionary != nil {
+		return compressZstdReader(r, level, zstd.WithEncoderDict(dictionary))
+	}
+	return compressZstdReader(r, level)
+}
 
-	// Concatenate the key and encrypted data
-	result := append(key, encryptedData...)
+// contextReader fails reads once its context is done, stopping whatever consumes it
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
 
-	return result, nil
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// compressGzipReader compresses everything read from r using gzip at the default level
+func compressGzipReader(r io.Reader) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := io.Copy(writer, r); err != nil {
+		return nil, fmt.Errorf("gzip compression error: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("gzip compression error: %v", err)
+	}
+	return buf.Bytes(), nil
 }
 
-// compressZstd compresses data using Zstandard
-func compressZstd(data []byte) ([]byte, error) {
+// requestCompressionLevel returns the zstd level named by a request's X-Compression-Level
+// header, or the configured level when the header is absent
+func requestCompressionLevel(headers map[string]string, cfg Config) (zstd.EncoderLevel, error) {
+	name := strings.TrimSpace(headerValue(headers, "X-Compression-Level"))
+	if name == "" {
+		return cfg.CompressionLevel, nil
+	}
+	ok, level := zstd.EncoderLevelFromString(name)
+	if !ok {
+		return 0, fmt.Errorf("unknown compression level %q", name)
+	}
+	return level, nil
+}
+
+// compressZstd compresses data using Zstandard at the given level
+func compressZstd(data []byte, level zstd.EncoderLevel) ([]byte, error) {
+	return compressZstdReader(bytes.NewReader(data), level)
+}
+
+// compressZstdReader compresses everything read from r using Zstandard. The
+// reader is consumed until EOF, so readers that return short reads are fine.
+func compressZstdReader(r io.Reader, level zstd.EncoderLevel, options ...zstd.EOption) ([]byte, error) {
 	var buf bytes.Buffer
-	encoder, err := zstd.NewWriter(&buf)
+	encoder, err := zstd.NewWriter(&buf, append([]zstd.EOption{zstd.WithEncoderLevel(level)}, options...)...)
 	if err != nil {
 		return nil, fmt.Errorf("zstandard compression initialization error: %v", err)
 	}
-	_, err = encoder.Write(data)
-	if err != nil {
+	if _, err = io.Copy(encoder, r); err != nil {
+		encoder.Close()
+		return nil, fmt.Errorf("zstandard compression error: %v", err)
+	}
+	// The encoder buffers input until a block fills; Close flushes the last block and
+	// writes the frame trailer, so the output is incomplete unless Close succeeds
+	if err = encoder.Close(); err != nil {
 		return nil, fmt.Errorf("zstandard compression error: %v", err)
 	}
-	encoder.Close()
 	return buf.Bytes(), nil
 }
 
-// encrypt is your existing encryption function
+// encrypt encrypts data as a framed AES-GCM stream keyed by key
 func encrypt(data []byte, key []byte) ([]byte, error) {
-	// Implement your encryption logic using the provided key
-	// This function is assumed to be your existing implementation
-	// Replace it with your actual encryption code
-	return data, nil
+	var buf bytes.Buffer
+	if err := encryptStream(&buf, bytes.NewReader(data), key); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// uploadResponse is the JSON body returned for a successful upload
+type uploadResponse struct {
+	Version int            `json:"version"`
+	Message string         `json:"message"`
+	Files   []uploadedFile `json:"files"`
+	Timings *phaseTimings  `json:"timings,omitempty"`
+	// Manifest is the key of the signed batch manifest, if one was written
+	Manifest string `json:"manifest,omitempty"`
+}
+
+// phaseTimings are the milliseconds a request spent in each phase, summed over its
+// files, returned for ?debug=true
+type phaseTimings struct {
+	Parse    float64 `json:"parse"`
+	Compress float64 `json:"compress"`
+	Encrypt  float64 `json:"encrypt"`
+	Upload   float64 `json:"upload"`
+}
+
+// uploadedFile describes where one uploaded file was stored
+type uploadedFile struct {
+	Bucket       string `json:"bucket"`
+	Key          string `json:"key"`
+	StorageClass string `json:"storageClass,omitempty"`
+	Thumbnail    string `json:"thumbnail,omitempty"`
+}
+
+// storageClass returns the storage class shared by all uploaded files, or "" if
+// they differ or it isn't known
+func (response uploadResponse) storageClass() string {
+	storageClass := ""
+	for i, file := range response.Files {
+		if i > 0 && file.StorageClass != storageClass {
+			return ""
+		}
+		storageClass = file.StorageClass
+	}
+	return storageClass
 }
 
 // Handler is the main Lambda function handler
 func Handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
-	// Initialize AWS SDK configuration
-	cfg, err := config.LoadDefaultConfig(ctx)
+	ctx, span := tracer.Start(ctx, "Handler")
+	defer flushTelemetry(ctx)
+	defer span.End()
+	normalizeRequest(&request)
+
+	// Load the handler configuration
+	appCfg, err := loadConfig()
 	if err != nil {
-		log.Printf("Failed to load AWS config: %v", err)
+		log.Printf("Invalid configuration: %v", err)
 		return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}, nil
 	}
 
-	// Create S3 client
-	s3Client := s3.NewFromConfig(cfg)
+	logRequest(request)
+
+	switch request.QueryStringParameters["action"] {
+	case "download":
+		return handleDownload(ctx, request, appCfg), nil
+	case "presign":
+		return handlePresign(ctx, request, appCfg), nil
+	case "benchmark":
+		return handleBenchmark(request, appCfg), nil
+	case "train-dictionary":
+		return handleTrainDictionary(ctx, request, appCfg), nil
+	}
 
-	// Generate a unique bucket name based on the current timestamp
-	bucketName := "filename" + time.Now().Format("20060102-150405")
+	// Extract the files to upload before touching S3
+	if request.Body == "" {
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusBadRequest, Body: "The request body is empty."}, nil
+	}
+	var timings phaseTimings
+	parseStart := time.Now()
+	files, err := requestFiles(request, appCfg)
+	if errors.Is(err, ErrNotZstd) {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "Content-Encoding is zstd but the body is not a zstd stream.",
+		}, nil
+	}
+	if errors.Is(err, ErrTooManyFiles) {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusRequestEntityTooLarge,
+			Body:       fmt.Sprintf("At most %d files may be uploaded per request.", appCfg.MaxFiles),
+		}, nil
+	}
+	if errors.Is(err, ErrDuplicateName) {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "Files uploaded in one request must have distinct names.",
+		}, nil
+	}
+	if errors.Is(err, ErrFetchNotAllowed) {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusForbidden,
+			Body:       "Files may only be fetched from the origins on the fetch allowlist.",
+		}, nil
+	}
+	if errors.Is(err, ErrFetchFailed) {
+		log.Printf("Couldn't fetch a listed file. Here's why: %v\n", err)
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusBadGateway, Body: "A listed URL couldn't be fetched."}, nil
+	}
+	if errors.Is(err, ErrFetchTooLarge) {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusRequestEntityTooLarge,
+			Body:       fmt.Sprintf("Fetched files may be at most %d bytes.", appCfg.FetchMaxSize),
+		}, nil
+	}
+	if errors.Is(err, ErrInvalidEnvelope) {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "The upload envelope must be a JSON object with filename, contentType and base64 data.",
+		}, nil
+	}
+	if errors.Is(err, ErrTruncatedBody) {
+		// Every file is read before anything is uploaded, so nothing partial is stored
+		log.Printf("Request body was truncated, nothing uploaded\n")
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "The request body ended before the upload was complete.",
+		}, nil
+	}
+	if err != nil {
+		log.Printf("Couldn't parse request body. Here's why: %v\n", err)
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusBadRequest}, nil
+	}
+	if len(files) == 0 {
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusBadRequest, Body: "The request carries no files."}, nil
+	}
 
-	// Create S3 bucket
-	basics := BucketBasics{S3Client: s3Client}
-	err = basics.CreateBucket(bucketName, "ap-south-1")
+	// Clients pin the response shape they were written against
+	responseVersion, err := requestResponseVersion(request.Headers, request.QueryStringParameters, appCfg)
 	if err != nil {
-		return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}, nil
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       fmt.Sprintf("Supported response versions are 1 to %d.", latestResponseVersion),
+		}, nil
+	}
+
+	// Clients may trade compression ratio for speed on their own uploads
+	if appCfg.CompressionLevel, err = requestCompressionLevel(request.Headers, appCfg); err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "X-Compression-Level must be one of fastest, default, better or best.",
+		}, nil
 	}
 
-	// Generate a unique file name based on the current timestamp
-	fileName := "upload-" + time.Now().Format("20060102-150405") + ".zst"
+	// Many small files are cheaper to store as one archive
+	if appCfg.BundleFiles && len(files) > 1 {
+		bundle, err := bundleFiles(files, time.Now())
+		if err != nil {
+			log.Printf("Couldn't bundle %d files. Here's why: %v\n", len(files), err)
+			return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}, nil
+		}
+		files = []uploadFile{bundle}
+	}
+
+	// Echo returns a single file inline, so it has to fit in the response
+	echo := request.QueryStringParameters["action"] == "echo"
+	if echo && len(files) != 1 {
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusBadRequest, Body: "Echo takes exactly one file."}, nil
+	}
+	if echo && len(files[0].Data) > maxEchoSize {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusRequestEntityTooLarge,
+			Body:       fmt.Sprintf("Echo takes files of at most %d bytes.", maxEchoSize),
+		}, nil
+	}
 
-	// Compress and encrypt the file data
-	compressedAndEncryptedData, err := compressAndEncrypt([]byte(request.Body))
+	// Collect user metadata for the objects
+	userMetadata, err := requestMetadata(request, appCfg)
 	if err != nil {
-		return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}, nil
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusBadRequest, Body: err.Error()}, nil
 	}
 
-	// Upload compressed and encrypted data to S3 bucket
-	err = basics.UploadFileToS3(bucketName, fileName, compressedAndEncryptedData)
+	// Internal, already-encrypted traffic may skip client-side encryption
+	encryptFiles, err := requestEncryption(request, appCfg)
+	if errors.Is(err, ErrUntrustedRequest) {
+		log.Printf("Rejected untrusted request to disable encryption\n")
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusForbidden,
+			Body:       "Request is not trusted to disable encryption.",
+		}, nil
+	}
 	if err != nil {
-		return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}, nil
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusBadRequest}, nil
+	}
+	timings.Parse = milliseconds(time.Since(parseStart))
+
+	// A retried upload gets the answer the original got, without storing it twice.
+	// Only requests that passed the checks above get this far, so a replay is never
+	// an answer the caller couldn't have got by uploading.
+	var resultKey string
+	if appCfg.ResultCacheTTL > 0 {
+		resultKey = resultCacheKey(request)
+		if cached, ok := uploadResults.lookup(resultKey, appCfg.ResultCacheTTL, time.Now()); ok {
+			log.Printf("Returning the cached result of an earlier identical upload\n")
+			cached.Headers["Idempotent-Replayed"] = "true"
+			return cached, nil
+		}
+	}
+
+	// Fail fast while S3 is known to be unavailable
+	if !s3Breaker.allow(appCfg, time.Now()) {
+		return serviceUnavailable(), nil
+	}
+
+	// Create S3 client, unless objects only go to local storage
+	var s3Client *s3.Client
+	if appCfg.usesS3() {
+		if s3Client, err = newS3Client(ctx, appCfg); err != nil {
+			return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}, nil
+		}
+	}
+
+	basics := BucketBasics{S3Client: s3Client, Config: appCfg}
+	basics.useDictionaries()
+	storage := newStorage(basics)
+
+	// Small files of one kind compress far better with a dictionary trained on them
+	var dictionary []byte
+	if appCfg.DictionaryBucket != "" {
+		if dictionary, err = basics.activeDictionary(); err != nil {
+			log.Printf("Compressing without a dictionary. Here's why: %v\n", err)
+		}
+	}
+	bucketName := appCfg.AccessPointARN
+	if bucketName == "" {
+		// Generate a unique bucket name based on the current timestamp
+		bucketName = uploadBucketName(time.Now())
+
+		// Create S3 bucket
+		if appCfg.usesS3() {
+			if err = basics.CreateBucket(bucketName, "ap-south-1"); err != nil {
+				s3Breaker.record(appCfg, err, time.Now())
+				return s3ErrorResponse(err, appCfg), nil
+			}
+		}
+	}
+
+	var counter sequenceCounter
+	if appCfg.usesSequence() {
+		if counter, err = newSequenceCounter(ctx, appCfg); err != nil {
+			return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}, nil
+		}
+	}
+
+	// Placeholders still held when the handler returns belong to failed uploads
+	reservations := map[string]string{}
+	defer basics.releaseReservations(bucketName, reservations)
+
+	response := uploadResponse{Files: make([]uploadedFile, 0, len(files))}
+	var manifest batchManifest
+	for _, file := range files {
+		// Hash the plaintext, so identical content is recognised whatever the compression
+		var hash string
+		var plaintextSize int
+		if appCfg.DedupWindow > 0 || appCfg.KeyStrategy == "content-hash" || strings.Contains(appCfg.KeyTemplate, "{hash}") {
+			hash, plaintextSize, err = plaintextHash(file)
+			if err != nil {
+				log.Printf("Couldn't hash %v. Here's why: %v\n", file.Name, err)
+				return events.APIGatewayProxyResponse{StatusCode: http.StatusBadRequest}, nil
+			}
+		}
+
+		// Generate a unique file name based on the current timestamp, or on the content
+		uploadTime := time.Now()
+		timestamp := uploadTime.Format("20060102-150405")
+		fileName := "upload-" + timestamp
+		if file.Name != "" {
+			fileName += "-" + file.Name
+		}
+		if appCfg.KeyStrategy == "content-hash" {
+			fileName = hash
+		}
+		if appCfg.KeyTemplate != "" {
+			fileName, err = renderKey(ctx, appCfg.KeyTemplate, keyFields{Name: file.Name, Timestamp: timestamp, Hash: hash, Document: file.Data}, counter)
+			if errors.Is(err, ErrMissingKeyField) {
+				return events.APIGatewayProxyResponse{
+					StatusCode: http.StatusBadRequest,
+					Body:       "The upload is missing a JSON field the key template needs.",
+				}, nil
+			}
+			if err != nil {
+				return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}, nil
+			}
+		}
+		// Pick the algorithm for the content type; small files of types that compress
+		// poorly aren't worth compressing at all
+		compression := appCfg.compressionFor(file.ContentType, len(file.Data))
+		if file.PreCompressed {
+			compression = "zstd"
+		}
+		extension := objectExtension(appCfg.ExtensionPolicy, compression, encryptFiles)
+		// An encrypted blob isn't a PDF any more; keep its real extension for downloads
+		originalExtension := ""
+		if extension == neutralExtension {
+			fileName, originalExtension = stripExtension(fileName)
+		}
+		fileName += extension
+		if namespace, ok := lookupContentType(appCfg.Namespaces, detectContentType(file)); ok && namespace != "" {
+			fileName = namespacedKey(fileName, namespace, uploadTime)
+		}
+		if appCfg.HashPrefix {
+			fileName = hashedKey(fileName, appCfg.HashPrefixLength)
+		}
+
+		// Give the pre-upload hook a chance to veto or enrich the upload
+		fileMetadata := userMetadata
+		if PreUploadHook != nil {
+			upload := &UploadContext{
+				Request:     request,
+				Bucket:      bucketName,
+				Key:         fileName,
+				Name:        file.Name,
+				ContentType: file.ContentType,
+				Data:        file.Data,
+				Metadata:    make(map[string]string, len(userMetadata)),
+			}
+			for key, value := range userMetadata {
+				upload.Metadata[key] = value
+			}
+			if err = PreUploadHook(ctx, upload); err != nil {
+				log.Printf("Pre-upload hook rejected %v:%v. Here's why: %v\n", bucketName, fileName, err)
+				return events.APIGatewayProxyResponse{StatusCode: appCfg.PreHookStatus, Body: err.Error()}, nil
+			}
+			if err = checkMetadata(upload.Metadata); err != nil {
+				log.Printf("Pre-upload hook set invalid metadata on %v:%v. Here's why: %v\n", bucketName, fileName, err)
+				return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}, nil
+			}
+			fileName, fileMetadata = upload.Key, upload.Metadata
+		}
+
+		// A template or hook can leave nothing to name the object by
+		if isEmptyKey(fileName, extension) {
+			if appCfg.EmptyKeyPolicy == "reject" {
+				return events.APIGatewayProxyResponse{StatusCode: http.StatusBadRequest, Body: "The upload resolves to an empty key."}, nil
+			}
+			generated := generatedKey(fileName, extension, timestamp)
+			log.Printf("Key for %v was empty, using %v\n", file.Name, generated)
+			fileName = generated
+		}
+
+		// Keep keys within the characters downstream tools accept
+		if allowedName, err := enforceKeyCharset(fileName, appCfg.KeyCharset, appCfg.KeyCharsetAction, appCfg.KeyCharsetReplacement); err == nil {
+			fileName = allowedName
+		} else {
+			log.Printf("Rejected key %v. Here's why: %v\n", fileName, err)
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusBadRequest,
+				Body:       fmt.Sprintf("The key %q contains characters that aren't allowed.", fileName),
+			}, nil
+		}
+
+		// Skip content that was already uploaded within the dedup window
+		if appCfg.DedupWindow > 0 {
+			if existingBucket, existingFile, ok := recentUploads.lookup(hash, appCfg.DedupWindow, time.Now()); ok {
+				log.Printf("Deduplicated upload of %v to %v:%v\n", fileName, existingBucket, existingFile)
+				response.Files = append(response.Files, uploadedFile{Bucket: existingBucket, Key: existingFile})
+				continue
+			}
+		}
+
+		// A content-hash key that is already taken must hold this very content
+		if appCfg.KeyStrategy == "content-hash" && appCfg.HashCollisionCheck {
+			exists, err := basics.CheckHashKey(bucketName, fileName, plaintextSize)
+			if errors.Is(err, ErrHashCollision) {
+				return events.APIGatewayProxyResponse{
+					StatusCode: http.StatusConflict,
+					Body:       fmt.Sprintf("The key %q holds different content of the same hash.", fileName),
+				}, nil
+			}
+			if err != nil {
+				return s3ErrorResponse(err, appCfg), nil
+			}
+			if exists {
+				log.Printf("Deduplicated upload of %v to existing %v:%v\n", file.Name, bucketName, fileName)
+				response.Files = append(response.Files, uploadedFile{Bucket: bucketName, Key: fileName})
+				continue
+			}
+		}
+
+		logUpload(bucketName, fileName, file)
+		recordBytes(ctx, "received", len(file.Data))
+
+		// Compress the file data, unless the client already compressed it
+		compressedData := file.Data
+		compressedBy := "client"
+		switch {
+		case compression == "none":
+			compressedBy = ""
+		case !file.PreCompressed:
+			compressedBy = "lambda"
+			_, endCompress := startPhase(ctx, "compress", attribute.String("algorithm", compression))
+			compressCtx, cancel := ctx, context.CancelFunc(func() {})
+			if appCfg.CompressionBudget > 0 {
+				compressCtx, cancel = context.WithTimeout(ctx, appCfg.CompressionBudget)
+			}
+			compressedData, err = compressData(compressCtx, file.Data, compression, appCfg.CompressionLevel, dictionary)
+			overBudget := err != nil && compressCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil
+			cancel()
+			timings.Compress += milliseconds(endCompress(err))
+			if overBudget {
+				// Over budget: store the file as-is rather than delay the response further
+				log.Printf("Compression of %v:%v exceeded %v, storing it uncompressed\n", bucketName, fileName, appCfg.CompressionBudget)
+				compressedData, compression, compressedBy, err = file.Data, "none", "", nil
+				uncompressed := objectExtension(appCfg.ExtensionPolicy, compression, encryptFiles)
+				if strings.HasSuffix(fileName, extension) {
+					fileName = strings.TrimSuffix(fileName, extension) + uncompressed
+					extension = uncompressed
+				}
+			}
+			if err != nil {
+				return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}, nil
+			}
+			if compressedBy == "lambda" {
+				compressionStats.record(len(file.Data), len(compressedData), time.Now())
+			}
+		}
+
+		// Encrypt the compressed data, unless a trusted caller opted out
+		compressedAndEncryptedData := compressedData
+		if encryptFiles {
+			_, endEncrypt := startPhase(ctx, "encrypt")
+			compressedAndEncryptedData, err = encryptCompressed(compressedData)
+			timings.Encrypt += milliseconds(endEncrypt(err))
+			if err != nil {
+				return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}, nil
+			}
+		}
+
+		// Record the pipeline in the object itself, so it survives losing the metadata
+		if appCfg.ObjectHeader {
+			header := objectHeader{Compression: compression, Encrypted: encryptFiles}
+			if compressedBy == "lambda" && compression == "zstd" {
+				header.Level = appCfg.CompressionLevel
+			}
+			compressedAndEncryptedData = append(header.encode(), compressedAndEncryptedData...)
+		}
+
+		// Upload compressed and encrypted data to S3 bucket
+		opts := UploadOptions{
+			StorageClass: appCfg.storageClassFor(file.ContentType),
+			CreateOnly:   appCfg.CreateOnly,
+			Metadata: map[string]string{
+				"compression": compression,
+			},
+		}
+		if compressedBy != "" {
+			opts.Metadata["compressed-by"] = compressedBy
+		}
+		if compressedBy == "lambda" && compression == "zstd" {
+			opts.Metadata["compression-level"] = appCfg.CompressionLevel.String()
+		}
+		// Recording encryption either way lets the read path insist on authentication
+		opts.Metadata["encryption"] = "none"
+		if encryptFiles {
+			opts.Metadata["encryption"] = "aes-gcm"
+		}
+		if originalExtension != "" {
+			opts.Metadata["original-extension"] = originalExtension
+		}
+		if appCfg.KeyStrategy == "content-hash" {
+			opts.Metadata[originalSizeMetadata] = strconv.Itoa(plaintextSize)
+		}
+
+		// Prove the stored bytes can be read back before persisting them
+		if appCfg.VerifyRoundtrip {
+			if err = verifyRoundtrip(compressedAndEncryptedData, opts.Metadata, file); err != nil {
+				log.Printf("Round trip check failed for %v:%v. Here's why: %v\n", bucketName, fileName, err)
+				return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}, nil
+			}
+		}
+		if appCfg.ObjectTTL > 0 {
+			opts.Metadata[expiresAtMetadata] = uploadTime.Add(appCfg.ObjectTTL).UTC().Format(time.RFC3339)
+		}
+		mergeMetadata(opts.Metadata, fileMetadata)
+		// Tag the object with its uploader for audit
+		if principal := requestPrincipal(request); principal != "" {
+			opts.Tags = map[string]string{"uploaded-by": tagValue(principal)}
+		}
+		if appCfg.BackupOnOverwrite {
+			if err = basics.BackupExisting(bucketName, fileName); err != nil {
+				s3Breaker.record(appCfg, err, time.Now())
+				return s3ErrorResponse(err, appCfg), nil
+			}
+		}
+		// With reservations the key is claimed before the upload, so a concurrent
+		// request can't take it while the data is in flight
+		put := func(key string) error {
+			if !appCfg.ReserveKeys {
+				return storage.Put(bucketName, key, compressedAndEncryptedData, opts)
+			}
+			etag, err := basics.ReserveKey(bucketName, key)
+			if err != nil {
+				return err
+			}
+			reservations[key] = etag
+			reserved := opts
+			reserved.CreateOnly, reserved.IfMatch = false, etag
+			return basics.UploadFileToS3(bucketName, key, compressedAndEncryptedData, reserved)
+		}
+		_, endUpload := startPhase(ctx, "upload", attribute.String("bucket", bucketName), attribute.String("key", fileName))
+		err = put(fileName)
+		// A create-only upload whose key is taken moves on to a numbered key
+		baseName := fileName
+		for attempt := 1; isObjectExists(err) && attempt <= appCfg.CollisionRetries; attempt++ {
+			time.Sleep(collisionDelay(appCfg.CollisionBackoff, attempt))
+			fileName = collisionKey(baseName, extension, attempt)
+			err = put(fileName)
+		}
+		timings.Upload += milliseconds(endUpload(err))
+		if isObjectExists(err) {
+			// S3 is healthy and the data is safe in the existing object
+			if appCfg.CollisionRetries > 0 {
+				return events.APIGatewayProxyResponse{
+					StatusCode: http.StatusConflict,
+					Body:       fmt.Sprintf("No free key for %v after %d attempts.", baseName, appCfg.CollisionRetries+1),
+				}, nil
+			}
+			return s3ErrorResponse(err, appCfg), nil
+		}
+		if err != nil {
+			s3Breaker.record(appCfg, err, time.Now())
+			basics.WriteDeadLetter(bucketName, fileName, compressedAndEncryptedData, err)
+			return s3ErrorResponse(err, appCfg), nil
+		}
+		delete(reservations, fileName)
+		recordBytes(ctx, "stored", len(compressedAndEncryptedData))
+		manifest.add(bucketName, fileName, compressedAndEncryptedData)
+
+		// Record the full metadata next to the object
+		if appCfg.MetadataSidecar {
+			err = basics.WriteSidecar(objectSidecar{
+				Bucket:         bucketName,
+				Key:            fileName,
+				OriginalName:   file.Name,
+				ContentType:    file.ContentType,
+				Size:           len(compressedAndEncryptedData),
+				OriginalSize:   len(file.Data),
+				ChecksumSHA256: sha256Checksum(compressedAndEncryptedData),
+				StorageClass:   string(opts.StorageClass),
+				Metadata:       opts.Metadata,
+				Headers:        safeHeaders(request.Headers),
+			})
+			if err != nil {
+				return s3ErrorResponse(err, appCfg), nil
+			}
+		}
+		if hash != "" {
+			recentUploads.add(hash, bucketName, fileName, appCfg.DedupMaxEntries, time.Now())
+		}
+		uploaded := uploadedFile{Bucket: bucketName, Key: fileName, StorageClass: string(opts.StorageClass)}
+
+		// Upload a thumbnail of images alongside them
+		if appCfg.Thumbnails && !file.PreCompressed && isImage(file) {
+			thumbnail, err := makeThumbnail(file.Data, appCfg.ThumbnailSize)
+			if err != nil {
+				log.Printf("Skipping thumbnail for %v:%v. Here's why: %v\n", bucketName, fileName, err)
+			} else {
+				thumbnailName := thumbnailPrefix + fileName + ".jpg"
+				thumbnail, thumbnailOpts, err := thumbnailUpload(thumbnail, encryptFiles, appCfg)
+				if err != nil {
+					return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}, nil
+				}
+				if err = storage.Put(bucketName, thumbnailName, thumbnail, thumbnailOpts); err != nil {
+					return s3ErrorResponse(err, appCfg), nil
+				}
+				uploaded.Thumbnail = thumbnailName
+			}
+		}
+
+		if PostUploadHook != nil {
+			err = PostUploadHook(ctx, &UploadResult{
+				Request:      request,
+				Bucket:       bucketName,
+				Key:          fileName,
+				Name:         file.Name,
+				ContentType:  file.ContentType,
+				StorageClass: uploaded.StorageClass,
+				Size:         len(compressedAndEncryptedData),
+				OriginalSize: len(file.Data),
+				Metadata:     opts.Metadata,
+				Thumbnail:    uploaded.Thumbnail,
+			})
+			if err != nil {
+				log.Printf("Post-upload hook failed for %v:%v. Here's why: %v\n", bucketName, fileName, err)
+				if appCfg.PostHookStrict {
+					return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}, nil
+				}
+			}
+		}
+		response.Files = append(response.Files, uploaded)
+	}
+
+	s3Breaker.success()
+	if appCfg.StatsTarget != "" {
+		basics.flushCompressionStats(time.Now())
+	}
+
+	// Let consumers verify the batch as a whole
+	if appCfg.ManifestSecret != "" && len(manifest.Objects) > 0 {
+		if response.Manifest, err = basics.WriteManifest(bucketName, &manifest); err != nil {
+			return s3ErrorResponse(err, appCfg), nil
+		}
+	}
+
+	if echo {
+		return basics.echoObject(storage, response.Files[0], files[0]), nil
 	}
 
 	// Return a success response
+	if request.QueryStringParameters["debug"] == "true" {
+		response.Timings = &timings
+	}
+	response.Message = "File successfully uploaded to S3."
+	if len(files) > 1 {
+		response.Message = fmt.Sprintf("%d files successfully uploaded to S3.", len(files))
+	}
+	body, err := response.encode(responseVersion)
+	if err != nil {
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}, nil
+	}
+	headers := map[string]string{"Content-Type": contentType(responseVersion)}
+	if responseVersion != plainResponseVersion {
+		headers["Content-Version"] = strconv.Itoa(responseVersion)
+	}
+	if storageClass := response.storageClass(); storageClass != "" {
+		headers["X-Amz-Storage-Class"] = storageClass
+	}
+	// The plain-text body has nowhere to name a thumbnail, so it goes in a header
+	if len(response.Files) == 1 && response.Files[0].Thumbnail != "" {
+		headers["X-Thumbnail-Key"] = response.Files[0].Thumbnail
+	}
+	status := http.StatusOK
+	if appCfg.Location != "none" {
+		// A Location names a single resource, so batches only get the 201
+		status = http.StatusCreated
+		if len(response.Files) == 1 {
+			if location, err := basics.objectLocation(request.Path, response.Files[0]); err == nil {
+				headers["Location"] = location
+			}
+		}
+	}
+	result := events.APIGatewayProxyResponse{
+		StatusCode: status,
+		Headers:    headers,
+		Body:       string(body),
+	}
+	if resultKey != "" {
+		uploadResults.add(resultKey, result, appCfg.ResultCacheMaxEntries, time.Now())
+	}
+	return result, nil
+}
+
+// handleDownload serves ?action=download&bucket=<bucket>&key=<key>, returning the
+// decrypted and decompressed object content
+func handleDownload(ctx context.Context, request events.APIGatewayProxyRequest, appCfg Config) events.APIGatewayProxyResponse {
+	bucketName, fileName, denied := authorizeRead(request, appCfg)
+	if denied != nil {
+		return *denied
+	}
+
+	if !s3Breaker.allow(appCfg, time.Now()) {
+		return serviceUnavailable()
+	}
+
+	var s3Client *s3.Client
+	if appCfg.usesS3() {
+		var err error
+		if s3Client, err = newS3Client(ctx, appCfg); err != nil {
+			return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}
+		}
+	}
+	basics := BucketBasics{S3Client: s3Client, Config: appCfg}
+	basics.useDictionaries()
+
+	data, metadata, err := newStorage(basics).Get(bucketName, fileName, appCfg.VerifyChecksums)
+	s3Breaker.record(appCfg, err, time.Now())
+	if err != nil {
+		return downloadErrorResponse(err, appCfg)
+	}
+
+	headers, passthrough := downloadHeaders(request, fileName, metadata, appCfg)
+	if !passthrough {
+		if data, err = decodeObject(data, metadata); err != nil {
+			log.Printf("Couldn't decode %v:%v. Here's why: %v\n", bucketName, fileName, err)
+			return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}
+		}
+	}
+	return events.APIGatewayProxyResponse{
+		StatusCode:      http.StatusOK,
+		Headers:         headers,
+		Body:            base64.StdEncoding.EncodeToString(data),
+		IsBase64Encoded: true,
+	}
+}
+
+// downloadHeaders returns the headers a download is served with, and whether the
+// object goes out as stored: gzip-encoded objects from other tools are passed
+// through to clients that can decode them
+func downloadHeaders(request events.APIGatewayProxyRequest, fileName string, metadata map[string]string, appCfg Config) (map[string]string, bool) {
+	headers := map[string]string{"Content-Type": "application/octet-stream"}
+	if isGzipEncoded(metadata) && !isPipelineObject(nil, metadata) && passGzipThrough(request, appCfg) {
+		headers["Content-Encoding"] = "gzip"
+		headers["Vary"] = "Accept-Encoding"
+		return headers, true
+	}
+	if _, ok := metadata["original-extension"]; ok {
+		headers["Content-Disposition"] = mime.FormatMediaType("attachment", map[string]string{"filename": originalName(fileName, metadata)})
+	}
+	return headers, false
+}
+
+// downloadErrorResponse maps a failed read of an object to the response returned to the client
+func downloadErrorResponse(err error, appCfg Config) events.APIGatewayProxyResponse {
+	if errors.Is(err, ErrChecksumMismatch) {
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusBadGateway, Body: "Stored object failed checksum verification."}
+	}
+	if isNotFound(err) {
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusNotFound, Body: "The object does not exist."}
+	}
+	return s3ErrorResponse(err, appCfg)
+}
+
+// isNotFound reports whether a read failed because the object or its bucket doesn't exist
+func isNotFound(err error) bool {
+	var noSuchKey *types.NoSuchKey
+	var noSuchBucket *types.NoSuchBucket
+	var notFound *types.NotFound
+	return errors.As(err, &noSuchKey) || errors.As(err, &noSuchBucket) || errors.As(err, &notFound) || errors.Is(err, fs.ErrNotExist)
+}
+
+// passGzipThrough reports whether a gzip-encoded object is returned still compressed
+func passGzipThrough(request events.APIGatewayProxyRequest, appCfg Config) bool {
+	switch appCfg.GzipDownloads {
+	case "passthrough":
+		return true
+	case "decompress":
+		return false
+	}
+	return acceptsGzip(request.Headers)
+}
+
+// handlePresign serves ?action=presign&bucket=<bucket>&key=<key>, returning a presigned
+// download URL. Optional disposition and content_type parameters override the
+// response headers of the download.
+func handlePresign(ctx context.Context, request events.APIGatewayProxyRequest, appCfg Config) events.APIGatewayProxyResponse {
+	bucketName, fileName, denied := authorizeRead(request, appCfg)
+	if denied != nil {
+		return *denied
+	}
+
+	s3Client, err := newS3Client(ctx, appCfg)
+	if err != nil {
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}
+	}
+	basics := BucketBasics{S3Client: s3Client, Config: appCfg}
+
+	url, err := basics.PresignDownload(bucketName, fileName, appCfg.PresignExpiry, PresignOptions{
+		ResponseContentDisposition: request.QueryStringParameters["disposition"],
+		ResponseContentType:        request.QueryStringParameters["content_type"],
+	})
+	if err != nil {
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}
+	}
+	return events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Body: url}
+}
+
+// objectLocation returns where an uploaded object can be retrieved: the download
+// action under the handler's path, or a presigned URL
+func (basics BucketBasics) objectLocation(handlerPath string, file uploadedFile) (string, error) {
+	if basics.Config.Location == "presigned" {
+		return basics.PresignDownload(file.Bucket, file.Key, basics.Config.PresignExpiry, PresignOptions{})
+	}
+	if handlerPath == "" {
+		handlerPath = "/"
+	}
+	query := url.Values{"action": {"download"}, "bucket": {file.Bucket}, "key": {file.Key}}
+	return handlerPath + "?" + query.Encode(), nil
+}
+
+// requestBucket returns the bucket a read request targets: the bucket query
+// parameter, or the configured access point when it is omitted
+func requestBucket(params map[string]string, appCfg Config) string {
+	if bucket := params["bucket"]; bucket != "" {
+		return bucket
+	}
+	return appCfg.AccessPointARN
+}
+
+// s3ErrorResponse maps a failed S3 operation to the response returned to the client
+func s3ErrorResponse(err error, appCfg Config) events.APIGatewayProxyResponse {
+	if errors.Is(err, ErrRateLimited) {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusServiceUnavailable,
+			Body:       "Too many concurrent uploads, please retry later.",
+		}
+	}
+	if errors.Is(err, ErrObjectExpired) {
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusGone, Body: "The object has expired."}
+	}
+	if errors.Is(err, ErrWriteNotVisible) {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusServiceUnavailable,
+			Body:       "The upload isn't readable yet, please retry later.",
+		}
+	}
+	if isObjectExists(err) {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusConflict,
+			Body:       "An object with this key already exists.",
+		}
+	}
+	if message, ok := quotaMessage(err); ok {
+		log.Printf("S3 refused to store more data. Here's why: %v\n", err)
+		if appCfg.ReportQuota {
+			return events.APIGatewayProxyResponse{StatusCode: http.StatusInsufficientStorage, Body: message}
+		}
+	}
+	if isAccessDenied(err) {
+		// Almost always a missing IAM permission on the function's role
+		log.Printf("S3 denied access. Check that the function's role grants %v on the bucket. Here's why: %v\n", requiredPermission(err), err)
+		if appCfg.ReportAccessDenied {
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusForbidden,
+				Body:       "The uploader is not permitted to write to the bucket.",
+			}
+		}
+	}
+	return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}
+}
+
+// serviceUnavailable is returned while the S3 circuit breaker is open
+func serviceUnavailable() events.APIGatewayProxyResponse {
 	return events.APIGatewayProxyResponse{
-		StatusCode: http.StatusOK,
-		Body:       "File successfully uploaded to S3.",
-	}, nil
+		StatusCode: http.StatusServiceUnavailable,
+		Body:       "S3 is currently unavailable, please retry later.",
+	}
+}
+
+// newS3Client creates an S3 client from the default AWS configuration for the
+// invocation identified by ctx
+func newS3Client(ctx context.Context, appCfg Config) (*s3.Client, error) {
+	cfg, err := loadAWSConfig(ctx, appCfg)
+	if err != nil {
+		return nil, err
+	}
+	return s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if appCfg.RateLimit > 0 {
+			o.APIOptions = append(o.APIOptions, rateLimitMiddleware(ctx, limiterFor(appCfg)))
+		}
+	}), nil
 }
 
 func main() {
-	lambda.Start(Handler)
+	initTelemetry(context.Background())
+	uploader := NewUploader()
+	shutdownOnSignal(uploader)
+
+	// Function URLs configured with the RESPONSE_STREAM invoke mode use the streaming handler
+	if os.Getenv("S3_UPLOAD_ENTRYPOINT") == "function-url" {
+		lambda.Start(uploader.StreamHandler)
+		return
+	}
+	lambda.Start(uploader.Handler)
 }
@@ -0,0 +1,647 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go/middleware"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestCompressShortReads(t *testing.T) {
+	data := append(bytes.Repeat([]byte("short reads "), 20_000), randomBytes(t, 300_000)...)
+	readers := []struct {
+		name string
+		wrap func(io.Reader) io.Reader
+	}{
+		{"one byte", iotest.OneByteReader},
+		{"half", iotest.HalfReader},
+		{"data with EOF", iotest.DataErrReader},
+	}
+	algorithms := []struct {
+		name       string
+		compress   func(io.Reader) ([]byte, error)
+		decompress func([]byte) ([]byte, error)
+	}{
+		{"zstd", func(r io.Reader) ([]byte, error) { return compressZstdReader(r, zstd.SpeedDefault) }, decompressZstd},
+		{"gzip", compressGzipReader, decompressGzip},
+	}
+	for _, algorithm := range algorithms {
+		for _, reader := range readers {
+			t.Run(algorithm.name+"/"+reader.name, func(t *testing.T) {
+				compressed, err := algorithm.compress(reader.wrap(bytes.NewReader(data)))
+				if err != nil {
+					t.Fatalf("compress: %v", err)
+				}
+				got, err := algorithm.decompress(compressed)
+				if err != nil {
+					t.Fatalf("decompress: %v", err)
+				}
+				if !bytes.Equal(got, data) {
+					t.Errorf("decompressed %d bytes, want %d", len(got), len(data))
+				}
+			})
+		}
+	}
+}
+
+func TestCompressReaderError(t *testing.T) {
+	failing := io.MultiReader(bytes.NewReader([]byte("partial")), iotest.ErrReader(io.ErrUnexpectedEOF))
+	if _, err := compressZstdReader(iotest.OneByteReader(failing), zstd.SpeedDefault); err == nil {
+		t.Error("compressZstdReader() succeeded on a failing reader")
+	}
+}
+
+func TestZstdInterleavedFlush(t *testing.T) {
+	repeated := func(i int) []byte { return bytes.Repeat([]byte{byte(i)}, i*997) }
+	tests := []struct {
+		name       string
+		flushEvery int
+		chunk      func(i int) []byte
+	}{
+		{name: "flush after every write", flushEvery: 1, chunk: repeated},
+		{name: "flush every third write", flushEvery: 3, chunk: repeated},
+		{name: "never flush", chunk: repeated},
+		{name: "tiny writes", flushEvery: 2, chunk: func(i int) []byte { return []byte{byte(i)} }},
+		{name: "incompressible", flushEvery: 2, chunk: func(i int) []byte { return randomBytes(t, 50_000) }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			encoder, err := zstd.NewWriter(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var want []byte
+			for i := 0; i < 50; i++ {
+				chunk := test.chunk(i)
+				want = append(want, chunk...)
+				if _, err := encoder.Write(chunk); err != nil {
+					t.Fatalf("Write() error = %v", err)
+				}
+				if test.flushEvery > 0 && i%test.flushEvery == 0 {
+					if err := encoder.Flush(); err != nil {
+						t.Fatalf("Flush() error = %v", err)
+					}
+				}
+			}
+			if err := encoder.Close(); err != nil {
+				t.Fatalf("Close() error = %v", err)
+			}
+
+			got, err := decompressZstd(buf.Bytes())
+			if err != nil {
+				t.Fatalf("decompressZstd() error = %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("decompressed %d bytes, want %d", len(got), len(want))
+			}
+		})
+	}
+}
+
+// failingWriter accepts limit bytes and then fails every write
+type failingWriter struct {
+	limit   int
+	written int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.written+len(p) > w.limit {
+		return 0, io.ErrShortWrite
+	}
+	w.written += len(p)
+	return len(p), nil
+}
+
+func TestZstdEncoderWriteError(t *testing.T) {
+	data := randomBytes(t, 100_000)
+	tests := []struct {
+		name  string
+		flush bool
+	}{
+		{name: "error surfaces from Flush", flush: true},
+		{name: "error surfaces from Close"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encoder, err := zstd.NewWriter(&failingWriter{limit: 1024})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Writes may be buffered, so the failure must surface by the time the
+			// buffered data is flushed or the frame is closed
+			_, writeErr := encoder.Write(data)
+			var flushErr error
+			if test.flush {
+				flushErr = encoder.Flush()
+			}
+			closeErr := encoder.Close()
+			if writeErr == nil && flushErr == nil && closeErr == nil {
+				t.Fatal("encoder reported success writing to a failing destination")
+			}
+			if test.flush && writeErr == nil && flushErr == nil {
+				t.Error("Flush() succeeded writing to a failing destination")
+			}
+			if closeErr == nil {
+				t.Error("Close() succeeded after the destination failed")
+			}
+		})
+	}
+}
+
+func TestPutObjectInputBucketKey(t *testing.T) {
+	tests := []struct {
+		name      string
+		sse       types.ServerSideEncryption
+		keyID     string
+		bucketKey bool
+		want      bool
+	}{
+		{name: "SSE-KMS with bucket keys", sse: types.ServerSideEncryptionAwsKms, keyID: "alias/uploads", bucketKey: true, want: true},
+		{name: "DSSE-KMS with bucket keys", sse: types.ServerSideEncryptionAwsKmsDsse, bucketKey: true, want: true},
+		{name: "SSE-KMS without bucket keys", sse: types.ServerSideEncryptionAwsKms, bucketKey: false, want: false},
+		{name: "SSE-S3 with bucket keys", sse: types.ServerSideEncryptionAes256, bucketKey: true, want: false},
+		{name: "no SSE with bucket keys", bucketKey: true, want: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			basics := BucketBasics{Config: Config{ServerSideEncryption: test.sse, KMSKeyID: test.keyID, KMSBucketKey: test.bucketKey}}
+			input := basics.putObjectInput("bucket", "key", strings.NewReader("data"), UploadOptions{})
+			if got := aws.ToBool(input.BucketKeyEnabled); got != test.want {
+				t.Errorf("BucketKeyEnabled = %v, want %v", got, test.want)
+			}
+			if input.ServerSideEncryption != test.sse {
+				t.Errorf("ServerSideEncryption = %q, want %q", input.ServerSideEncryption, test.sse)
+			}
+			if got := aws.ToString(input.SSEKMSKeyId); got != test.keyID {
+				t.Errorf("SSEKMSKeyId = %q, want %q", got, test.keyID)
+			}
+		})
+	}
+}
+
+func TestUploadBucketKey(t *testing.T) {
+	tests := []struct {
+		sse  string
+		want string
+	}{
+		{sse: "aws:kms", want: "true"},
+		{sse: "AES256", want: ""},
+	}
+	for _, test := range tests {
+		t.Run(test.sse, func(t *testing.T) {
+			t.Setenv("S3_UPLOAD_SSE", test.sse)
+			t.Setenv("S3_UPLOAD_KMS_BUCKET_KEY", "true")
+			fake := newFakeS3(t)
+			upload(t, nil, "bucket key data")
+			bucket := fake.bucketNames()[0]
+			header := fake.header(bucket, fake.keys(bucket)[0])
+			if got := header.Get("X-Amz-Server-Side-Encryption-Bucket-Key-Enabled"); got != test.want {
+				t.Errorf("bucket key header = %q, want %q", got, test.want)
+			}
+			if got := header.Get("X-Amz-Server-Side-Encryption"); got != test.sse {
+				t.Errorf("SSE header = %q, want %q", got, test.sse)
+			}
+		})
+	}
+}
+
+func TestUploadFileToS3PathSelection(t *testing.T) {
+	const threshold = 6 << 20
+	tests := []struct {
+		name      string
+		size      int
+		multipart bool
+	}{
+		{name: "below the threshold", size: threshold - 1},
+		{name: "at the threshold", size: threshold},
+		{name: "above the threshold", size: threshold + 1, multipart: true},
+		{name: "well above the threshold", size: 2 * threshold, multipart: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := newFakeS3(t)
+			basics := fake.basics(Config{MultipartThreshold: threshold, PartSize: 5 << 20, PartConcurrency: 2})
+			data := randomBytes(t, test.size)
+			if err := basics.UploadFileToS3("bucket", "key", data, UploadOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			if got := fake.count("CreateMultipartUpload") == 1; got != test.multipart {
+				t.Errorf("multipart = %v, want %v (calls %v)", got, test.multipart, fake.calls)
+			}
+			wantPuts := 1
+			if test.multipart {
+				wantPuts = 0
+			}
+			if got := fake.count("PutObject"); got != wantPuts {
+				t.Errorf("PutObject called %d times, want %d", got, wantPuts)
+			}
+			if stored, _, _ := fake.object("bucket", "key"); !bytes.Equal(stored, data) {
+				t.Errorf("stored %d bytes, want %d", len(stored), len(data))
+			}
+		})
+	}
+}
+
+func TestDefaultMultipartThreshold(t *testing.T) {
+	tests := []struct {
+		memory int
+		want   int
+	}{
+		{memory: 0, want: 100 << 20},
+		{memory: 128 << 20, want: 16 << 20},
+		{memory: 1 << 30, want: 100 << 20},
+		{memory: 10 << 30, want: 100 << 20},
+		{memory: 32 << 20, want: 5 << 20},
+	}
+	for _, test := range tests {
+		if got := defaultMultipartThreshold(test.memory); got != test.want {
+			t.Errorf("defaultMultipartThreshold(%d) = %d, want %d", test.memory, got, test.want)
+		}
+	}
+}
+
+// recordBuckets makes every client created by the test record the Bucket field of
+// each operation it calls, keyed by operation name
+func recordBuckets(t *testing.T) func() map[string][]string {
+	t.Helper()
+	var mu sync.Mutex
+	buckets := make(map[string][]string)
+	record := middleware.InitializeMiddlewareFunc("RecordBucket", func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+		if field := reflect.ValueOf(in.Parameters).Elem().FieldByName("Bucket"); field.IsValid() {
+			mu.Lock()
+			buckets[middleware.GetOperationName(ctx)] = append(buckets[middleware.GetOperationName(ctx)], aws.ToString(field.Interface().(*string)))
+			mu.Unlock()
+		}
+		return next.HandleInitialize(ctx, in)
+	})
+	previous := loadDefaultConfig
+	loadDefaultConfig = func(ctx context.Context, optFns ...func(*config.LoadOptions) error) (aws.Config, error) {
+		cfg, err := previous(ctx, optFns...)
+		cfg.APIOptions = append(cfg.APIOptions, func(stack *middleware.Stack) error {
+			return stack.Initialize.Add(record, middleware.After)
+		})
+		return cfg, err
+	}
+	t.Cleanup(func() { loadDefaultConfig = previous })
+	return func() map[string][]string {
+		mu.Lock()
+		defer mu.Unlock()
+		return buckets
+	}
+}
+
+func TestAccessPointTarget(t *testing.T) {
+	const accessPoint = "arn:aws:s3:ap-south-1:123456789012:accesspoint/uploads"
+	t.Setenv("S3_UPLOAD_ACCESS_POINT_ARN", accessPoint)
+	fake := newFakeS3(t)
+	buckets := recordBuckets(t)
+
+	files := uploadedFiles(t, upload(t, map[string]string{"Accept": "application/json"}, "through the access point"))
+	if len(files) != 1 || files[0].Bucket != accessPoint {
+		t.Fatalf("uploaded to %+v, want the access point", files)
+	}
+	if fake.count("CreateBucket") != 0 {
+		t.Error("a bucket was created for an access point upload")
+	}
+	// The SDK addresses the access point by its own endpoint
+	if _, _, ok := fake.object("uploads-123456789012", files[0].Key); !ok {
+		t.Errorf("object not stored through the access point endpoint: %v", fake.calls)
+	}
+
+	cfg := testConfig(t, nil)
+	response := handleDownload(t.Context(), events.APIGatewayProxyRequest{
+		QueryStringParameters: map[string]string{"action": "download", "key": files[0].Key},
+		RequestContext:        events.APIGatewayProxyRequestContext{Authorizer: map[string]interface{}{"principalId": "user-1"}},
+	}, cfg)
+	body, _ := base64.StdEncoding.DecodeString(response.Body)
+	if response.StatusCode != http.StatusOK || string(body) != "through the access point" {
+		t.Errorf("handleDownload() = %d %q", response.StatusCode, body)
+	}
+
+	for _, operation := range []string{"PutObject", "GetObject"} {
+		got := buckets()[operation]
+		if len(got) == 0 {
+			t.Errorf("%s wasn't called", operation)
+		}
+		for _, bucket := range got {
+			if bucket != accessPoint {
+				t.Errorf("%s Bucket = %q, want the access point ARN", operation, bucket)
+			}
+		}
+	}
+}
+
+func TestUploadLocation(t *testing.T) {
+	tests := []struct {
+		name     string
+		location string
+		path     string
+		files    int
+		status   int
+	}{
+		{name: "disabled", location: "none", files: 1, status: http.StatusOK},
+		{name: "relative path", location: "path", files: 1, status: http.StatusCreated},
+		{name: "relative path under a stage", location: "path", path: "/prod/upload", files: 1, status: http.StatusCreated},
+		{name: "presigned", location: "presigned", files: 1, status: http.StatusCreated},
+		{name: "batch", location: "path", files: 3, status: http.StatusCreated},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("S3_UPLOAD_LOCATION", test.location)
+			newFakeS3(t)
+			body, contentType := multipartBody(t, numberedFiles(test.files)...)
+			response, err := Handler(t.Context(), events.APIGatewayProxyRequest{
+				HTTPMethod: "POST",
+				Path:       test.path,
+				Headers:    map[string]string{"Content-Type": contentType, "Accept": "application/json"},
+				Body:       body,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response.StatusCode != test.status {
+				t.Fatalf("Handler() status = %d, want %d: %s", response.StatusCode, test.status, response.Body)
+			}
+			files := uploadedFiles(t, response)
+			if len(files) != test.files {
+				t.Fatalf("response lists %d files, want %d", len(files), test.files)
+			}
+
+			location, ok := response.Headers["Location"]
+			// A Location names a single resource, so batches and plain 200s carry none
+			if test.location == "none" || test.files > 1 {
+				if ok {
+					t.Errorf("Location = %q, want none", location)
+				}
+				return
+			}
+			parsed, err := url.Parse(location)
+			if err != nil {
+				t.Fatalf("Location %q doesn't parse: %v", location, err)
+			}
+			query := parsed.Query()
+			switch test.location {
+			case "path":
+				wantPath := test.path
+				if wantPath == "" {
+					wantPath = "/"
+				}
+				if parsed.IsAbs() || parsed.Path != wantPath {
+					t.Errorf("Location = %q, want a relative URL under %q", location, wantPath)
+				}
+				if query.Get("action") != "download" || query.Get("bucket") != files[0].Bucket || query.Get("key") != files[0].Key {
+					t.Errorf("Location = %q, want the download of %s/%s", location, files[0].Bucket, files[0].Key)
+				}
+			case "presigned":
+				if !parsed.IsAbs() || query.Get("X-Amz-Signature") == "" {
+					t.Errorf("Location = %q, want a presigned URL", location)
+				}
+				if !strings.HasSuffix(parsed.Path, "/"+files[0].Key) {
+					t.Errorf("Location = %q doesn't address key %q", location, files[0].Key)
+				}
+			}
+		})
+	}
+}
+
+func TestLocationConfig(t *testing.T) {
+	for value, ok := range map[string]bool{"": true, "none": true, "path": true, "PRESIGNED": true, "absolute": false} {
+		t.Run(value, func(t *testing.T) {
+			if err := configError(t, map[string]string{"S3_UPLOAD_LOCATION": value}); (err == nil) != ok {
+				t.Errorf("loadConfig() error = %v, want ok %v", err, ok)
+			}
+		})
+	}
+}
+
+func TestCompressDataCancelled(t *testing.T) {
+	data := bytes.Repeat([]byte("budget "), 100_000)
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	for _, algorithm := range []string{"zstd", "gzip"} {
+		// The error is wrapped with %v, so only its message carries the cause
+		if _, err := compressData(ctx, data, algorithm, zstd.SpeedDefault, nil); err == nil || !strings.Contains(err.Error(), context.Canceled.Error()) {
+			t.Errorf("compressData(%s) error = %v, want the context's", algorithm, err)
+		}
+	}
+}
+
+func TestUploadCompressionBudget(t *testing.T) {
+	data := strings.Repeat("a large and very compressible input ", 200_000)
+	tests := []struct {
+		name        string
+		budget      string
+		compression string
+	}{
+		{name: "unbounded", budget: "0s", compression: "zstd"},
+		{name: "within budget", budget: "1m", compression: "zstd"},
+		{name: "over budget", budget: "1ns", compression: "none"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("S3_UPLOAD_COMPRESSION_BUDGET", test.budget)
+			t.Setenv("S3_UPLOAD_EXTENSION_POLICY", "transforms")
+			fake := newFakeS3(t)
+			upload(t, map[string]string{"Content-Type": "text/plain"}, data)
+			bucket := fake.bucketNames()[0]
+			key := fake.keys(bucket)[0]
+			stored, metadata, _ := fake.object(bucket, key)
+			if metadata["compression"] != test.compression {
+				t.Fatalf("compression metadata = %q, want %q", metadata["compression"], test.compression)
+			}
+			// The key's extension follows what was actually applied
+			if strings.Contains(key, ".zst") != (test.compression == "zstd") {
+				t.Errorf("key %q doesn't match compression %q", key, test.compression)
+			}
+			got, err := decodeObject(stored, metadata)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != data {
+				t.Errorf("decoded %d bytes, want %d", len(got), len(data))
+			}
+		})
+	}
+}
+
+func TestUploadDebugTimings(t *testing.T) {
+	tests := []struct {
+		name  string
+		debug string
+		want  bool
+	}{
+		{name: "debug", debug: "true", want: true},
+		{name: "no debug", debug: "", want: false},
+		{name: "debug off", debug: "false", want: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			newFakeS3(t)
+			body, contentType := multipartBody(t, numberedFiles(2)...)
+			response, err := Handler(t.Context(), events.APIGatewayProxyRequest{
+				HTTPMethod:            "POST",
+				Headers:               map[string]string{"Content-Type": contentType, "Accept": "application/json"},
+				QueryStringParameters: map[string]string{"debug": test.debug},
+				Body:                  body,
+			})
+			if err != nil || response.StatusCode != http.StatusOK {
+				t.Fatalf("Handler() = %d %q, %v", response.StatusCode, response.Body, err)
+			}
+			var decoded struct {
+				Timings map[string]any `json:"timings"`
+			}
+			if err := json.Unmarshal([]byte(response.Body), &decoded); err != nil {
+				t.Fatal(err)
+			}
+			if (decoded.Timings != nil) != test.want {
+				t.Fatalf("timings = %v, want present %v", decoded.Timings, test.want)
+			}
+			if !test.want {
+				return
+			}
+			for _, phase := range []string{"parse", "compress", "encrypt", "upload"} {
+				value, ok := decoded.Timings[phase].(float64)
+				if !ok || value < 0 {
+					t.Errorf("timings[%q] = %v, want a non-negative number", phase, decoded.Timings[phase])
+				}
+			}
+		})
+	}
+}
+
+func TestMilliseconds(t *testing.T) {
+	for d, want := range map[time.Duration]float64{0: 0, time.Millisecond: 1, 1500 * time.Microsecond: 1.5, 2 * time.Second: 2000} {
+		if got := milliseconds(d); got != want {
+			t.Errorf("milliseconds(%v) = %v, want %v", d, got, want)
+		}
+	}
+}
+
+func TestUploadFromReaderAbortsOnEarlyEOF(t *testing.T) {
+	tests := []struct {
+		name string
+		// sent is how much of the body arrives before the client disconnects
+		sent int64
+	}{
+		{name: "within the first part", sent: 1 << 20},
+		{name: "after a whole part", sent: 7 << 20},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := newFakeS3(t)
+			basics := fake.basics(Config{PartSize: 5 << 20, PartConcurrency: 1})
+			body := io.MultiReader(syntheticStream(test.sent), iotest.ErrReader(io.ErrUnexpectedEOF))
+			if err := basics.UploadFromReader("uploads", "partial.bin", body, UploadOptions{}); err == nil {
+				t.Fatal("UploadFromReader() succeeded with a body that ended early")
+			}
+			if _, _, exists := fake.object("uploads", "partial.bin"); exists {
+				t.Error("a partial object was stored")
+			}
+			// A started multipart upload is aborted rather than left holding its parts
+			if fake.count("CreateMultipartUpload") > 0 && fake.count("AbortMultipartUpload") != 1 {
+				t.Errorf("calls = %v, want the multipart upload aborted", fake.calls)
+			}
+			fake.mu.Lock()
+			pending := len(fake.uploads)
+			fake.mu.Unlock()
+			if pending != 0 {
+				t.Errorf("%d multipart uploads left open", pending)
+			}
+		})
+	}
+}
+
+func TestRequestCompressionLevel(t *testing.T) {
+	tests := []struct {
+		header string
+		want   zstd.EncoderLevel
+		ok     bool
+	}{
+		{header: "", want: zstd.SpeedBetterCompression, ok: true},
+		{header: "fastest", want: zstd.SpeedFastest, ok: true},
+		{header: "default", want: zstd.SpeedDefault, ok: true},
+		{header: " better ", want: zstd.SpeedBetterCompression, ok: true},
+		{header: "BEST", want: zstd.SpeedBestCompression, ok: true},
+		{header: "19"},
+		{header: "fast"},
+	}
+	for _, test := range tests {
+		level, err := requestCompressionLevel(map[string]string{"x-compression-level": test.header}, Config{CompressionLevel: zstd.SpeedBetterCompression})
+		if (err == nil) != test.ok {
+			t.Errorf("requestCompressionLevel(%q) error = %v, want ok %v", test.header, err, test.ok)
+			continue
+		}
+		if test.ok && level != test.want {
+			t.Errorf("requestCompressionLevel(%q) = %v, want %v", test.header, level, test.want)
+		}
+	}
+}
+
+func TestUploadCompressionLevel(t *testing.T) {
+	data := []byte(strings.Repeat("a log line that repeats with small changes: 0123456789\n", 20_000))
+	tests := []struct {
+		header string
+		want   zstd.EncoderLevel
+	}{
+		{header: "", want: zstd.SpeedDefault},
+		{header: "fastest", want: zstd.SpeedFastest},
+		{header: "default", want: zstd.SpeedDefault},
+		{header: "better", want: zstd.SpeedBetterCompression},
+		{header: "best", want: zstd.SpeedBestCompression},
+	}
+	for _, test := range tests {
+		t.Run(test.want.String(), func(t *testing.T) {
+			fake := newFakeS3(t)
+			upload(t, map[string]string{"Content-Type": "text/plain", "X-Compression-Level": test.header}, string(data))
+			bucket := fake.bucketNames()[0]
+			stored, metadata, _ := fake.object(bucket, fake.keys(bucket)[0])
+			if metadata["compression-level"] != test.want.String() {
+				t.Errorf("compression-level metadata = %q, want %q", metadata["compression-level"], test.want.String())
+			}
+
+			// The stored frame is what the encoder produces at that level
+			if hasObjectHeader(stored) {
+				stored = stored[objectHeaderSize:]
+			}
+			compressed, err := decryptPayload(stored, metadata["encryption"] == "aes-gcm")
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := compressZstd(data, test.want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(compressed, want) {
+				t.Errorf("stored %d compressed bytes, want the %d bytes of level %v", len(compressed), len(want), test.want)
+			}
+		})
+	}
+}
+
+func TestUploadCompressionLevelInvalid(t *testing.T) {
+	fake := newFakeS3(t)
+	response := handle(t, map[string]string{"Content-Type": "text/plain", "X-Compression-Level": "maximum"}, "never stored")
+	if response.StatusCode != http.StatusBadRequest || !strings.Contains(response.Body, "X-Compression-Level") {
+		t.Errorf("Handler() = %d %q, want 400 naming the header", response.StatusCode, response.Body)
+	}
+	if puts := fake.count("PutObject"); puts != 0 {
+		t.Errorf("PutObject called %d times for an invalid level", puts)
+	}
+}
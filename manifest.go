@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// ErrManifestSignature is returned when a batch manifest doesn't match its signature
+var ErrManifestSignature = errors.New("batch manifest signature mismatch")
+
+// batchManifest lists the objects stored by one request, so consumers can verify
+// the whole batch. Signature is the hex HMAC-SHA256, under the manifest secret, of
+// the manifest's JSON encoding without the signature.
+type batchManifest struct {
+	Created   string          `json:"created"`
+	Objects   []manifestEntry `json:"objects"`
+	Signature string          `json:"signature,omitempty"`
+}
+
+// manifestEntry describes one stored object; Size and SHA256 cover its bytes as stored
+type manifestEntry struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	Size   int    `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// add records an uploaded object in the manifest
+func (manifest *batchManifest) add(bucketName string, fileName string, data []byte) {
+	sum := sha256.Sum256(data)
+	manifest.Objects = append(manifest.Objects, manifestEntry{
+		Bucket: bucketName,
+		Key:    fileName,
+		Size:   len(data),
+		SHA256: hex.EncodeToString(sum[:]),
+	})
+}
+
+// sign sets the manifest's signature
+func (manifest *batchManifest) sign(secret string) error {
+	mac, err := manifest.mac(secret)
+	if err != nil {
+		return err
+	}
+	manifest.Signature = hex.EncodeToString(mac)
+	return nil
+}
+
+// mac returns the HMAC of the manifest without its signature
+func (manifest batchManifest) mac(secret string) ([]byte, error) {
+	manifest.Signature = ""
+	body, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return mac.Sum(nil), nil
+}
+
+// VerifyManifest parses a manifest written by WriteManifest and checks its signature
+func VerifyManifest(data []byte, secret string) (*batchManifest, error) {
+	var manifest batchManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, err
+	}
+	signature, err := hex.DecodeString(manifest.Signature)
+	if err != nil {
+		return nil, ErrManifestSignature
+	}
+	expected, err := manifest.mac(secret)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(signature, expected) {
+		return nil, ErrManifestSignature
+	}
+	return &manifest, nil
+}
+
+// WriteManifest signs a batch manifest and stores it under the manifest prefix,
+// returning its key
+func (basics BucketBasics) WriteManifest(bucketName string, manifest *batchManifest) (string, error) {
+	manifest.Created = time.Now().UTC().Format(time.RFC3339Nano)
+	if err := manifest.sign(basics.Config.ManifestSecret); err != nil {
+		return "", err
+	}
+	body, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	key := basics.Config.ManifestPrefix + "upload-" + time.Now().Format("20060102-150405.000000000") + ".json"
+	_, err = basics.S3Client.PutObject(context.TODO(), &s3.PutObjectInput{
+		Bucket:      aws.String(bucketName),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		log.Printf("Couldn't write batch manifest to %v:%v. Here's why: %v\n", bucketName, key, err)
+		return "", err
+	}
+	return key, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// signedManifest returns the encoding of a manifest of two objects signed with secret
+func signedManifest(t *testing.T, secret string) (batchManifest, []byte) {
+	t.Helper()
+	var manifest batchManifest
+	manifest.Created = "2024-06-15T12:00:00Z"
+	manifest.add("uploads", "a.txt.zst", []byte("first object"))
+	manifest.add("uploads", "b.txt.zst", []byte("second object"))
+	if err := manifest.sign(secret); err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return manifest, data
+}
+
+func TestManifestGeneration(t *testing.T) {
+	manifest, _ := signedManifest(t, "secret")
+	sum := sha256.Sum256([]byte("first object"))
+	want := manifestEntry{Bucket: "uploads", Key: "a.txt.zst", Size: len("first object"), SHA256: hex.EncodeToString(sum[:])}
+	if len(manifest.Objects) != 2 || manifest.Objects[0] != want {
+		t.Fatalf("manifest objects = %+v, want %+v first", manifest.Objects, want)
+	}
+
+	// The signature is the HMAC of the manifest encoded without it
+	unsigned := manifest
+	unsigned.Signature = ""
+	body, err := json.Marshal(unsigned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(body)
+	if manifest.Signature != hex.EncodeToString(mac.Sum(nil)) {
+		t.Errorf("signature = %s, want the HMAC-SHA256 of %s", manifest.Signature, body)
+	}
+}
+
+func TestVerifyManifest(t *testing.T) {
+	tests := []struct {
+		name   string
+		secret string
+		tamper func(manifest *batchManifest)
+		err    error
+	}{
+		{name: "intact", secret: "secret"},
+		{name: "wrong secret", secret: "other", err: ErrManifestSignature},
+		{name: "tampered size", secret: "secret", tamper: func(m *batchManifest) { m.Objects[1].Size++ }, err: ErrManifestSignature},
+		{name: "tampered hash", secret: "secret", tamper: func(m *batchManifest) { m.Objects[0].SHA256 = strings.Repeat("0", 64) }, err: ErrManifestSignature},
+		{name: "tampered key", secret: "secret", tamper: func(m *batchManifest) { m.Objects[0].Key = "c.txt.zst" }, err: ErrManifestSignature},
+		{name: "dropped entry", secret: "secret", tamper: func(m *batchManifest) { m.Objects = m.Objects[:1] }, err: ErrManifestSignature},
+		{name: "added entry", secret: "secret", tamper: func(m *batchManifest) { m.add("uploads", "c.txt.zst", []byte("extra")) }, err: ErrManifestSignature},
+		{name: "garbled signature", secret: "secret", tamper: func(m *batchManifest) { m.Signature = "not hex" }, err: ErrManifestSignature},
+		{name: "missing signature", secret: "secret", tamper: func(m *batchManifest) { m.Signature = "" }, err: ErrManifestSignature},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			manifest, data := signedManifest(t, "secret")
+			if test.tamper != nil {
+				test.tamper(&manifest)
+				var err error
+				if data, err = json.Marshal(manifest); err != nil {
+					t.Fatal(err)
+				}
+			}
+			verified, err := VerifyManifest(data, test.secret)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("VerifyManifest() error = %v, want %v", err, test.err)
+			}
+			if err == nil && len(verified.Objects) != 2 {
+				t.Errorf("VerifyManifest() = %+v, want both objects", verified)
+			}
+		})
+	}
+	if _, err := VerifyManifest([]byte("{not json"), "secret"); err == nil {
+		t.Error("VerifyManifest() accepted malformed JSON")
+	}
+}
+
+func TestUploadManifest(t *testing.T) {
+	tests := []struct {
+		name   string
+		secret string
+	}{
+		{name: "enabled", secret: "manifest-secret"},
+		{name: "disabled"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("S3_UPLOAD_MANIFEST_SECRET", test.secret)
+			fake := newFakeS3(t)
+			body, contentType := multipartBody(t, numberedFiles(3)...)
+			response := upload(t, map[string]string{"Content-Type": contentType, "Accept": "application/json"}, body)
+			var decoded uploadResponse
+			if err := json.Unmarshal([]byte(response.Body), &decoded); err != nil {
+				t.Fatal(err)
+			}
+			if test.secret == "" {
+				if decoded.Manifest != "" {
+					t.Errorf("manifest %q written though disabled", decoded.Manifest)
+				}
+				return
+			}
+
+			bucket := fake.bucketNames()[0]
+			if !strings.HasPrefix(decoded.Manifest, "manifests/") {
+				t.Fatalf("manifest key = %q, want one under manifests/", decoded.Manifest)
+			}
+			data, _, ok := fake.object(bucket, decoded.Manifest)
+			if !ok {
+				t.Fatalf("manifest %q wasn't stored", decoded.Manifest)
+			}
+			manifest, err := VerifyManifest(data, test.secret)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Every entry must describe the object's bytes as stored
+			if len(manifest.Objects) != 3 {
+				t.Fatalf("manifest lists %d objects, want 3", len(manifest.Objects))
+			}
+			for _, entry := range manifest.Objects {
+				stored, _, _ := fake.object(entry.Bucket, entry.Key)
+				sum := sha256.Sum256(stored)
+				if entry.Size != len(stored) || entry.SHA256 != hex.EncodeToString(sum[:]) {
+					t.Errorf("entry %+v doesn't match the %d stored bytes", entry, len(stored))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// maxUserMetadataSize is the S3 limit on the combined size of user metadata keys and values
+const maxUserMetadataSize = 2048
+
+// reservedMetadataSize leaves room within the limit for the metadata the handler records itself
+const reservedMetadataSize = 256
+
+// maxUserAgentLength truncates captured user agents, which can run to hundreds of bytes
+const maxUserAgentLength = 128
+
+// reservedMetadata are the names the handler records an object's pipeline under. The
+// read path trusts them to decode the object, so a client can't set them itself.
+var reservedMetadata = map[string]bool{
+	"compression":          true,
+	"compressed-by":        true,
+	"compression-level":    true,
+	"encryption":           true,
+	"original-extension":   true,
+	originalSizeMetadata:   true,
+	expiresAtMetadata:      true,
+	reservationMetadata:    true,
+	storedEncodingMetadata: true,
+}
+
+// ErrMetadataTooLarge is returned when request metadata doesn't fit the S3 user metadata limit
+var ErrMetadataTooLarge = errors.New("object metadata is too large")
+
+// requestMetadata collects user metadata from X-Upload-Meta-* headers and, for
+// clients that can't set custom headers, meta_* query parameters. A header wins
+// over a query parameter with the same name. Forwarded request headers are added
+// as header-<name> unless the client already set that name, and the captured
+// source replaces anything the client sent under its names.
+func requestMetadata(request events.APIGatewayProxyRequest, cfg Config) (map[string]string, error) {
+	metadata := make(map[string]string)
+	for name, value := range request.QueryStringParameters {
+		if key, ok := strings.CutPrefix(name, "meta_"); ok {
+			metadata[strings.ToLower(key)] = value
+		}
+	}
+	for name, value := range request.Headers {
+		if len(name) > len("x-upload-meta-") && strings.EqualFold(name[:len("x-upload-meta-")], "x-upload-meta-") {
+			metadata[strings.ToLower(name[len("x-upload-meta-"):])] = value
+		}
+	}
+
+	for name, value := range request.Headers {
+		key := "header-" + strings.ToLower(name)
+		if _, ok := metadata[key]; ok || !cfg.forwardsHeader(name) {
+			continue
+		}
+		// Headers that can't be stored as metadata aren't worth failing the upload over
+		if validateMetadata(key, value) == nil {
+			metadata[key] = value
+		}
+	}
+
+	if cfg.CaptureSource {
+		for key, value := range sourceMetadata(request) {
+			metadata[key] = value
+		}
+	}
+
+	if err := checkMetadata(metadata); err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+// sourceMetadata records where an upload came from, from the API Gateway request
+// context. Fields the context lacks are left out; the user agent falls back to the
+// User-Agent header and is truncated.
+func sourceMetadata(request events.APIGatewayProxyRequest) map[string]string {
+	metadata := make(map[string]string)
+	if sourceIP := request.RequestContext.Identity.SourceIP; sourceIP != "" {
+		metadata["uploaded-from"] = printableValue(sourceIP)
+	}
+	userAgent := request.RequestContext.Identity.UserAgent
+	if userAgent == "" {
+		userAgent = headerValue(request.Headers, "User-Agent")
+	}
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+	if userAgent != "" {
+		metadata["user-agent"] = printableValue(userAgent)
+	}
+	return metadata
+}
+
+// printableValue replaces the characters S3 metadata can't carry
+func printableValue(value string) string {
+	return strings.Map(func(r rune) rune {
+		if r < ' ' || r > '~' {
+			return '?'
+		}
+		return r
+	}, value)
+}
+
+// checkMetadata checks that user metadata can be stored alongside the handler's own
+func checkMetadata(metadata map[string]string) error {
+	for key, value := range metadata {
+		if err := validateMetadata(key, value); err != nil {
+			return err
+		}
+		if reservedMetadata[key] {
+			return fmt.Errorf("metadata name %q is reserved", key)
+		}
+	}
+	if metadataSize(metadata) > maxUserMetadataSize-reservedMetadataSize {
+		return ErrMetadataTooLarge
+	}
+	return nil
+}
+
+// validateMetadata checks that a metadata entry can be sent as an x-amz-meta-* header
+func validateMetadata(key string, value string) error {
+	if key == "" {
+		return errors.New("metadata name is empty")
+	}
+	for _, r := range key {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return fmt.Errorf("metadata name %q may only contain letters, digits, '-' and '_'", key)
+		}
+	}
+	for _, r := range value {
+		if r < ' ' || r > '~' {
+			return fmt.Errorf("metadata %q must be printable ASCII", key)
+		}
+	}
+	return nil
+}
+
+// metadataSize returns the size S3 counts against the user metadata limit
+func metadataSize(metadata map[string]string) int {
+	size := 0
+	for key, value := range metadata {
+		size += len(key) + len(value)
+	}
+	return size
+}
+
+// mergeMetadata adds user metadata to the handler's own without overriding it
+func mergeMetadata(metadata map[string]string, user map[string]string) {
+	for key, value := range user {
+		if _, ok := metadata[key]; !ok {
+			metadata[key] = value
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"errors"
+	"maps"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+type metadataTest struct {
+	name    string
+	request events.APIGatewayProxyRequest
+	want    map[string]string
+	err     string
+}
+
+func TestRequestMetadata(t *testing.T) {
+	tests := []metadataTest{
+		{
+			name: "header and query",
+			request: events.APIGatewayProxyRequest{
+				Headers:               map[string]string{"X-Upload-Meta-Owner": "billing"},
+				QueryStringParameters: map[string]string{"meta_project": "q3", "fileName": "a.txt"},
+			},
+			want: map[string]string{"owner": "billing", "project": "q3"},
+		},
+		{
+			name: "header wins over query",
+			request: events.APIGatewayProxyRequest{
+				Headers:               map[string]string{"x-upload-meta-owner": "header"},
+				QueryStringParameters: map[string]string{"meta_owner": "query"},
+			},
+			want: map[string]string{"owner": "header"},
+		},
+		{
+			name:    "invalid name",
+			request: events.APIGatewayProxyRequest{Headers: map[string]string{"X-Upload-Meta-Own.er": "billing"}},
+			err:     "may only contain",
+		},
+		{
+			name:    "unprintable value",
+			request: events.APIGatewayProxyRequest{QueryStringParameters: map[string]string{"meta_owner": "bi\nlling"}},
+			err:     "printable ASCII",
+		},
+		{
+			name:    "too large",
+			request: events.APIGatewayProxyRequest{QueryStringParameters: map[string]string{"meta_notes": strings.Repeat("x", maxUserMetadataSize)}},
+			err:     ErrMetadataTooLarge.Error(),
+		},
+	}
+	for name := range reservedMetadata {
+		tests = append(tests,
+			metadataTest{
+				name:    "reserved header " + name,
+				request: events.APIGatewayProxyRequest{Headers: map[string]string{"X-Upload-Meta-" + name: "none"}},
+				err:     "is reserved",
+			},
+			metadataTest{
+				name:    "reserved query " + name,
+				request: events.APIGatewayProxyRequest{QueryStringParameters: map[string]string{"meta_" + strings.ToUpper(name): "none"}},
+				err:     "is reserved",
+			})
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			metadata, err := requestMetadata(test.request, Config{})
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("requestMetadata() error = %v, want one containing %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("requestMetadata() error = %v", err)
+			}
+			if len(metadata) != len(test.want) {
+				t.Fatalf("requestMetadata() = %v, want %v", metadata, test.want)
+			}
+			for key, value := range test.want {
+				if metadata[key] != value {
+					t.Errorf("requestMetadata()[%q] = %q, want %q", key, metadata[key], value)
+				}
+			}
+		})
+	}
+}
+
+func TestUploadRejectsReservedMetadata(t *testing.T) {
+	response, err := Handler(t.Context(), events.APIGatewayProxyRequest{
+		HTTPMethod: "POST",
+		Headers:    map[string]string{"Content-Type": "text/plain", "X-Upload-Meta-Encryption": "none"},
+		Body:       "plaintext that must not be stored unencrypted",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusBadRequest || !strings.Contains(response.Body, "reserved") {
+		t.Errorf("Handler() = %d %q, want %d naming the reserved metadata", response.StatusCode, response.Body, http.StatusBadRequest)
+	}
+}
+
+func TestForwardHeaders(t *testing.T) {
+	headers := map[string]string{
+		"X-Request-Id":  "req-1",
+		"Authorization": "Bearer secret",
+		"Cookie":        "session=secret",
+		"User-Agent":    "curl/8.0",
+		"Content-Type":  "text/plain",
+	}
+	tests := []struct {
+		name    string
+		env     map[string]string
+		headers map[string]string
+		want    map[string]string
+		err     error
+	}{
+		{
+			name: "default allowlist",
+			want: map[string]string{"header-x-request-id": "req-1"},
+		},
+		{
+			name: "custom allowlist",
+			env:  map[string]string{"S3_UPLOAD_FORWARD_HEADERS": "User-Agent, content-type"},
+			want: map[string]string{"header-user-agent": "curl/8.0", "header-content-type": "text/plain"},
+		},
+		{
+			name: "sensitive headers can't be allowlisted",
+			env:  map[string]string{"S3_UPLOAD_FORWARD_HEADERS": "authorization,cookie,x-request-id"},
+			want: map[string]string{"header-x-request-id": "req-1"},
+		},
+		{
+			name: "wildcard",
+			env:  map[string]string{"S3_UPLOAD_FORWARD_HEADERS": "*"},
+			want: map[string]string{"header-x-request-id": "req-1", "header-user-agent": "curl/8.0", "header-content-type": "text/plain"},
+		},
+		{
+			name: "denylist",
+			env:  map[string]string{"S3_UPLOAD_FORWARD_HEADERS": "*", "S3_UPLOAD_BLOCKED_HEADERS": "User-Agent"},
+			want: map[string]string{"header-x-request-id": "req-1", "header-content-type": "text/plain"},
+		},
+		{
+			name:    "client metadata wins",
+			headers: map[string]string{"X-Upload-Meta-Header-X-Request-Id": "from-client"},
+			want:    map[string]string{"header-x-request-id": "from-client"},
+		},
+		{
+			name:    "unstorable value dropped",
+			headers: map[string]string{"X-Request-Id": "café"},
+			want:    map[string]string{},
+		},
+		{
+			name:    "size cap applies to forwarded headers",
+			env:     map[string]string{"S3_UPLOAD_FORWARD_HEADERS": "x-request-id,x-trace"},
+			headers: map[string]string{"X-Trace": strings.Repeat("t", maxUserMetadataSize-reservedMetadataSize)},
+			err:     ErrMetadataTooLarge,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := testConfig(t, test.env)
+			request := events.APIGatewayProxyRequest{Headers: map[string]string{}}
+			for name, value := range headers {
+				request.Headers[name] = value
+			}
+			for name, value := range test.headers {
+				request.Headers[name] = value
+			}
+			metadata, err := requestMetadata(request, cfg)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("requestMetadata() error = %v, want %v", err, test.err)
+			}
+			if err != nil {
+				return
+			}
+			if len(metadata) != len(test.want) {
+				t.Fatalf("requestMetadata() = %v, want %v", metadata, test.want)
+			}
+			for key, value := range test.want {
+				if metadata[key] != value {
+					t.Errorf("requestMetadata()[%q] = %q, want %q", key, metadata[key], value)
+				}
+			}
+		})
+	}
+}
+
+func TestUploadForwardHeaders(t *testing.T) {
+	fake := newFakeS3(t)
+	upload(t, map[string]string{"Content-Type": "text/plain", "X-Request-Id": "req-1", "Authorization": "Bearer secret"}, "forwarded")
+	bucket := fake.bucketNames()[0]
+	_, metadata, _ := fake.object(bucket, fake.keys(bucket)[0])
+	if metadata["header-x-request-id"] != "req-1" {
+		t.Errorf("metadata = %v, want the request ID forwarded", metadata)
+	}
+	for key, value := range metadata {
+		if strings.Contains(key, "authorization") || strings.Contains(value, "secret") {
+			t.Errorf("metadata %s = %q leaks the Authorization header", key, value)
+		}
+	}
+}
+
+func TestSourceMetadata(t *testing.T) {
+	long := strings.Repeat("Mozilla/5.0 ", 20)
+	tests := []struct {
+		name     string
+		identity events.APIGatewayRequestIdentity
+		headers  map[string]string
+		want     map[string]string
+	}{
+		{
+			name:     "from the request context",
+			identity: events.APIGatewayRequestIdentity{SourceIP: "203.0.113.7", UserAgent: "curl/8.4.0"},
+			want:     map[string]string{"uploaded-from": "203.0.113.7", "user-agent": "curl/8.4.0"},
+		},
+		{
+			name:     "user agent header fallback",
+			identity: events.APIGatewayRequestIdentity{SourceIP: "203.0.113.7"},
+			headers:  map[string]string{"user-agent": "aws-cli/2.15"},
+			want:     map[string]string{"uploaded-from": "203.0.113.7", "user-agent": "aws-cli/2.15"},
+		},
+		{
+			name:     "truncated user agent",
+			identity: events.APIGatewayRequestIdentity{UserAgent: long},
+			want:     map[string]string{"user-agent": long[:maxUserAgentLength]},
+		},
+		{
+			name:     "unprintable user agent",
+			identity: events.APIGatewayRequestIdentity{UserAgent: "agent\r\nX-Injected: 1 é"},
+			want:     map[string]string{"user-agent": "agent??X-Injected: 1 ?"},
+		},
+		{name: "missing context", want: map[string]string{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := sourceMetadata(events.APIGatewayProxyRequest{
+				Headers:        test.headers,
+				RequestContext: events.APIGatewayProxyRequestContext{Identity: test.identity},
+			})
+			if !maps.Equal(got, test.want) {
+				t.Errorf("sourceMetadata() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestUploadCaptureSource(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled string
+		want    map[string]string
+	}{
+		{name: "disabled", enabled: "false", want: map[string]string{"uploaded-from": "10.0.0.1", "user-agent": ""}},
+		{name: "enabled", enabled: "true", want: map[string]string{"uploaded-from": "198.51.100.20", "user-agent": "uploader/1.0"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("S3_UPLOAD_CAPTURE_SOURCE", test.enabled)
+			fake := newFakeS3(t)
+			response, err := Handler(t.Context(), events.APIGatewayProxyRequest{
+				HTTPMethod: "POST",
+				// A client can't pass off its own values as the captured source
+				Headers: map[string]string{"Content-Type": "text/plain", "X-Upload-Meta-Uploaded-From": "10.0.0.1"},
+				Body:    "audited upload",
+				RequestContext: events.APIGatewayProxyRequestContext{
+					Identity: events.APIGatewayRequestIdentity{SourceIP: "198.51.100.20", UserAgent: "uploader/1.0"},
+				},
+			})
+			if err != nil || response.StatusCode != http.StatusOK {
+				t.Fatalf("Handler() = %d %q, %v", response.StatusCode, response.Body, err)
+			}
+			bucket := fake.bucketNames()[0]
+			_, metadata, _ := fake.object(bucket, fake.keys(bucket)[0])
+			for key, want := range test.want {
+				if metadata[key] != want {
+					t.Errorf("metadata %s = %q, want %q", key, metadata[key], want)
+				}
+			}
+		})
+	}
+}
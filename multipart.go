@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"path/filepath"
+	"strings"
+)
+
+// ErrTooManyFiles is returned when a multipart request carries more file parts than allowed
+var ErrTooManyFiles = errors.New("too many files in multipart request")
+
+// ErrTruncatedBody is returned when a multipart body ends before its closing
+// boundary, as it does when the client disconnects mid-upload
+var ErrTruncatedBody = errors.New("multipart body ended early")
+
+// ErrDuplicateName is returned when a batch repeats a filename and duplicates are rejected
+var ErrDuplicateName = errors.New("duplicate filename in multipart request")
+
+// multipartSource yields the file parts of a multipart/form-data body. Parts are
+// counted as they are streamed so an oversized request is cut off as soon as it
+// passes maxFiles, before any file is uploaded. Form fields without a filename
+// are skipped.
+type multipartSource struct {
+	reader   *multipart.Reader
+	body     *closingReader
+	part     *multipart.Part
+	maxFiles int
+	files    int
+}
+
+func newMultipartSource(body io.Reader, boundary string, maxFiles int) *multipartSource {
+	closing := &closingReader{r: body, dash: []byte("--" + boundary)}
+	return &multipartSource{reader: multipart.NewReader(closing, boundary), body: closing, maxFiles: maxFiles}
+}
+
+func (src *multipartSource) Next() (*BodyPart, error) {
+	for {
+		if src.part != nil {
+			src.part.Close()
+			src.part = nil
+		}
+		part, err := src.reader.NextPart()
+		// NextPart also reports a body cut off within part headers as a plain EOF
+		if err == io.EOF && !src.body.closed {
+			return nil, ErrTruncatedBody
+		}
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, ErrTruncatedBody
+		}
+		if err != nil {
+			return nil, fmt.Errorf("multipart read error: %v", err)
+		}
+		src.part = part
+		if part.FileName() == "" {
+			continue
+		}
+		if src.files == src.maxFiles {
+			return nil, ErrTooManyFiles
+		}
+		src.files++
+		return &BodyPart{
+			Reader:      part,
+			Name:        filepath.Base(part.FileName()),
+			ContentType: part.Header.Get("Content-Type"),
+		}, nil
+	}
+}
+
+// closingReader watches a multipart body for its closing delimiter, which a body
+// cut short never reaches. Like mime/multipart, it only counts a delimiter at the
+// start of a line: after a CRLF, or after a bare LF in bodies whose first boundary
+// line ended in one. The same text anywhere inside part data doesn't close the body.
+type closingReader struct {
+	r    io.Reader
+	dash []byte // "--" + boundary
+	// line holds the start of the line being read, as much as a delimiter needs
+	line []byte
+	// afterCRLF reports whether the line being read follows a CRLF
+	afterCRLF bool
+	// opened is set once the first boundary line has been read, and lf when it
+	// ended in a bare LF
+	opened, lf bool
+	last       byte
+	closed     bool
+}
+
+func (c *closingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	data := p[:n]
+	for len(data) > 0 && !c.closed {
+		segment := data
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			segment = data[:i+1]
+		}
+		data = data[len(segment):]
+		if room := len(c.dash) + 2 - len(c.line); room > 0 {
+			c.line = append(c.line, segment[:min(room, len(segment))]...)
+		}
+		c.closed = c.isDelimiter()
+
+		previous := c.last
+		c.last = segment[len(segment)-1]
+		if c.last != '\n' {
+			continue
+		}
+		// The line ended; note how, for the line that follows
+		if len(segment) > 1 {
+			previous = segment[len(segment)-2]
+		}
+		crlf := previous == '\r'
+		if !c.opened && bytes.HasPrefix(c.line, c.dash) {
+			c.opened, c.lf = true, !crlf
+		}
+		c.line, c.afterCRLF = c.line[:0], crlf
+	}
+	return n, err
+}
+
+// isDelimiter reports whether the line being read is the closing delimiter
+func (c *closingReader) isDelimiter() bool {
+	if len(c.line) < len(c.dash)+2 || !bytes.HasPrefix(c.line, c.dash) || !bytes.HasSuffix(c.line, []byte("--")) {
+		return false
+	}
+	// Before the first boundary any line start counts, as it does for mime/multipart
+	return !c.opened || c.lf || c.afterCRLF
+}
+
+// uniqueName suffixes a repeated filename before its extension, e.g. report-2.pdf,
+// picking the first suffix not already taken in the batch
+func uniqueName(name string, seen map[string]bool) string {
+	extension := filepath.Ext(name)
+	base := strings.TrimSuffix(name, extension)
+	for n := 2; ; n++ {
+		candidate := fmt.Sprintf("%s-%d%s", base, n, extension)
+		if !seen[candidate] {
+			return candidate
+		}
+	}
+}
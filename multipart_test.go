@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// testFile is one file part of a multipart test body
+type testFile struct {
+	name        string
+	contentType string
+	data        string
+}
+
+// multipartBody encodes files as a multipart/form-data body and returns it with
+// its Content-Type
+func multipartBody(t *testing.T, files ...testFile) (string, string) {
+	t.Helper()
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	for _, file := range files {
+		header := make(map[string][]string)
+		header["Content-Disposition"] = []string{fmt.Sprintf(`form-data; name="file"; filename="%s"`, file.name)}
+		if file.contentType != "" {
+			header["Content-Type"] = []string{file.contentType}
+		}
+		part, err := writer.CreatePart(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(part, file.data)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String(), writer.FormDataContentType()
+}
+
+// numberedFiles returns n small text files
+func numberedFiles(n int) []testFile {
+	files := make([]testFile, n)
+	for i := range files {
+		files[i] = testFile{name: fmt.Sprintf("file-%d.txt", i), contentType: "text/plain", data: fmt.Sprintf("contents of file %d", i)}
+	}
+	return files
+}
+
+// countingReader records how many bytes were read through it
+type countingReader struct {
+	reader io.Reader
+	n      int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.n += n
+	return n, err
+}
+
+func TestMultipartSourceMaxFiles(t *testing.T) {
+	tests := []struct {
+		name     string
+		files    int
+		maxFiles int
+		err      error
+	}{
+		{name: "under the limit", files: 2, maxFiles: 3},
+		{name: "at the limit", files: 3, maxFiles: 3},
+		{name: "one over the limit", files: 4, maxFiles: 3, err: ErrTooManyFiles},
+		{name: "single file allowed", files: 1, maxFiles: 1},
+		{name: "single file limit exceeded", files: 2, maxFiles: 1, err: ErrTooManyFiles},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			body, contentType := multipartBody(t, numberedFiles(test.files)...)
+			_, params, _ := strings.Cut(contentType, "boundary=")
+			src := newMultipartSource(strings.NewReader(body), params, test.maxFiles)
+
+			yielded := 0
+			var err error
+			for {
+				var part *BodyPart
+				if part, err = src.Next(); err != nil {
+					break
+				}
+				yielded++
+				io.Copy(io.Discard, part.Reader)
+			}
+			if test.err == nil && err == io.EOF {
+				err = nil
+			}
+			if !errors.Is(err, test.err) {
+				t.Fatalf("Next() error = %v, want %v", err, test.err)
+			}
+			if want := min(test.files, test.maxFiles); yielded != want {
+				t.Errorf("yielded %d files, want %d", yielded, want)
+			}
+		})
+	}
+}
+
+func TestMultipartSourceStopsEarly(t *testing.T) {
+	body, contentType := multipartBody(t, numberedFiles(2000)...)
+	_, boundary, _ := strings.Cut(contentType, "boundary=")
+	counter := &countingReader{reader: strings.NewReader(body)}
+	src := newMultipartSource(counter, boundary, 3)
+
+	var err error
+	for err == nil {
+		_, err = src.Next()
+	}
+	if !errors.Is(err, ErrTooManyFiles) {
+		t.Fatalf("Next() error = %v, want ErrTooManyFiles", err)
+	}
+	if counter.n > len(body)/10 {
+		t.Errorf("read %d of %d bytes before refusing the request", counter.n, len(body))
+	}
+}
+
+func TestUploadMaxFiles(t *testing.T) {
+	tests := []struct {
+		name   string
+		files  int
+		status int
+	}{
+		{name: "at the limit", files: 2, status: http.StatusOK},
+		{name: "over the limit", files: 3, status: http.StatusRequestEntityTooLarge},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("S3_UPLOAD_MAX_FILES", "2")
+			fake := newFakeS3(t)
+			body, contentType := multipartBody(t, numberedFiles(test.files)...)
+			response, err := Handler(t.Context(), events.APIGatewayProxyRequest{
+				HTTPMethod: "POST",
+				Headers:    map[string]string{"Content-Type": contentType},
+				Body:       body,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response.StatusCode != test.status {
+				t.Fatalf("Handler() = %d %q, want %d", response.StatusCode, response.Body, test.status)
+			}
+			wantPuts := test.files
+			if test.status != http.StatusOK {
+				wantPuts = 0
+			}
+			if puts := fake.count("PutObject"); puts != wantPuts {
+				t.Errorf("stored %d objects, want %d", puts, wantPuts)
+			}
+		})
+	}
+}
+
+func TestUniqueName(t *testing.T) {
+	tests := []struct {
+		name string
+		seen []string
+		want string
+	}{
+		{name: "report.pdf", seen: []string{"report.pdf"}, want: "report-2.pdf"},
+		{name: "report.pdf", seen: []string{"report.pdf", "report-2.pdf", "report-3.pdf"}, want: "report-4.pdf"},
+		{name: "archive.tar.gz", seen: []string{"archive.tar.gz"}, want: "archive.tar-2.gz"},
+		{name: "README", seen: []string{"README"}, want: "README-2"},
+	}
+	for _, test := range tests {
+		seen := map[string]bool{}
+		for _, name := range test.seen {
+			seen[name] = true
+		}
+		if got := uniqueName(test.name, seen); got != test.want {
+			t.Errorf("uniqueName(%q, %v) = %q, want %q", test.name, test.seen, got, test.want)
+		}
+	}
+}
+
+func TestUploadDuplicateNames(t *testing.T) {
+	files := []testFile{
+		{name: "report.txt", contentType: "text/plain", data: "first"},
+		{name: "report.txt", contentType: "text/plain", data: "second"},
+		{name: "report-2.txt", contentType: "text/plain", data: "third"},
+		{name: "report.txt", contentType: "text/plain", data: "fourth"},
+	}
+	tests := []struct {
+		policy string
+		status int
+		keys   []string
+	}{
+		// A renamed file takes report-2.txt, so the file actually named so is renamed in turn
+		{policy: "suffix", status: http.StatusOK, keys: []string{"report-2-2.txt.zst", "report-2.txt.zst", "report-3.txt.zst", "report.txt.zst"}},
+		{policy: "reject", status: http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.policy, func(t *testing.T) {
+			t.Setenv("S3_UPLOAD_DUPLICATE_NAMES", test.policy)
+			t.Setenv("S3_UPLOAD_KEY_TEMPLATE", "{name}")
+			fake := newFakeS3(t)
+			body, contentType := multipartBody(t, files...)
+			response := handle(t, map[string]string{"Content-Type": contentType}, body)
+			if response.StatusCode != test.status {
+				t.Fatalf("Handler() = %d %q, want %d", response.StatusCode, response.Body, test.status)
+			}
+			if test.status != http.StatusOK {
+				// The batch is refused before any of it is stored
+				if puts := fake.count("PutObject"); puts != 0 {
+					t.Errorf("stored %d objects of a rejected batch", puts)
+				}
+				return
+			}
+			keys := fake.keys(fake.bucketNames()[0])
+			if strings.Join(keys, ",") != strings.Join(test.keys, ",") {
+				t.Errorf("stored %v, want %v", keys, test.keys)
+			}
+		})
+	}
+}
+
+func TestDuplicateNamesConfig(t *testing.T) {
+	for value, ok := range map[string]bool{"": true, "suffix": true, "REJECT": true, "overwrite": false} {
+		t.Run(value, func(t *testing.T) {
+			if err := configError(t, map[string]string{"S3_UPLOAD_DUPLICATE_NAMES": value}); (err == nil) != ok {
+				t.Errorf("loadConfig() error = %v, want ok %v", err, ok)
+			}
+		})
+	}
+}
+
+func TestRequestFilesTruncated(t *testing.T) {
+	body, contentType := multipartBody(t,
+		testFile{name: "first.txt", contentType: "text/plain", data: "the first file arrives whole"},
+		testFile{name: "second.txt", contentType: "text/plain", data: "the second file is cut off part way"},
+	)
+	second := strings.Index(body, "the second file")
+	tests := []struct {
+		name string
+		body string
+	}{
+		{name: "within a file", body: body[:second+10]},
+		{name: "within part headers", body: body[:strings.Index(body, `filename="second.txt"`)]},
+		{name: "before the closing boundary", body: body[:strings.LastIndex(body, "\r\n--")]},
+		{name: "nothing after the first boundary", body: body[:strings.Index(body, "\r\n")+2]},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := requestFiles(events.APIGatewayProxyRequest{
+				Headers: map[string]string{"Content-Type": contentType},
+				Body:    test.body,
+			}, Config{MaxFiles: 10})
+			if !errors.Is(err, ErrTruncatedBody) {
+				t.Errorf("requestFiles() error = %v, want %v", err, ErrTruncatedBody)
+			}
+		})
+	}
+}
+
+func TestMultipartSourceSplitDelimiter(t *testing.T) {
+	// The closing delimiter counts even when it arrives a byte at a time
+	body, contentType := multipartBody(t, numberedFiles(2)...)
+	_, boundary, _ := strings.Cut(contentType, "boundary=")
+	parts := readSource(t, newMultipartSource(iotest.OneByteReader(strings.NewReader(body)), boundary, 10))
+	if len(parts) != 2 {
+		t.Errorf("read %d parts, want 2", len(parts))
+	}
+}
+
+func TestMultipartSourceDelimiterInData(t *testing.T) {
+	const boundary = "b0undary"
+	part := func(nl string, name string, data string) string {
+		return "--" + boundary + nl + `Content-Disposition: form-data; name="file"; filename="` + name + `"` + nl + nl + data + nl
+	}
+	tests := []struct {
+		name  string
+		body  string
+		files int
+		err   error
+	}{
+		{
+			name: "delimiter text inside data, cut in part headers",
+			body: part("\r\n", "first.txt", "quoting --"+boundary+"-- mid-line") + "--" + boundary + "\r\nContent-Type: text/plain\r\n",
+			err:  ErrTruncatedBody,
+		},
+		{
+			name: "delimiter after a bare LF in a CRLF body, cut in part headers",
+			body: part("\r\n", "first.txt", "line one\n--"+boundary+"--\nline three") + "--" + boundary + "\r\nContent-Type: text/plain\r\n",
+			err:  ErrTruncatedBody,
+		},
+		{
+			name:  "delimiter text inside data, body complete",
+			body:  part("\r\n", "first.txt", "quoting --"+boundary+"-- mid-line") + part("\r\n", "second.txt", "second") + "--" + boundary + "--\r\n",
+			files: 2,
+		},
+		{
+			name:  "LF line breaks",
+			body:  part("\n", "first.txt", "first") + part("\n", "second.txt", "second") + "--" + boundary + "--\n",
+			files: 2,
+		},
+		{
+			name: "LF line breaks, cut in part headers",
+			body: part("\n", "first.txt", "first") + "--" + boundary + "\nContent-Type: text/plain\n",
+			err:  ErrTruncatedBody,
+		},
+		{name: "no parts", body: "--" + boundary + "--"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// A byte at a time, so no delimiter arrives within a single read
+			src := newMultipartSource(iotest.OneByteReader(strings.NewReader(test.body)), boundary, 10)
+			files := 0
+			var err error
+			for {
+				var part *BodyPart
+				if part, err = src.Next(); err != nil {
+					break
+				}
+				if _, err = io.ReadAll(part.Reader); err != nil {
+					break
+				}
+				files++
+			}
+			if err == io.EOF {
+				err = nil
+			}
+			if !errors.Is(err, test.err) || (test.err == nil && files != test.files) {
+				t.Errorf("read %d files, error %v, want %d files, error %v", files, err, test.files, test.err)
+			}
+		})
+	}
+}
+
+func TestUploadTruncatedBody(t *testing.T) {
+	fake := newFakeS3(t)
+	body, contentType := multipartBody(t,
+		testFile{name: "first.txt", contentType: "text/plain", data: "complete"},
+		testFile{name: "second.txt", contentType: "text/plain", data: "the client went away here"},
+	)
+	truncated := body[:strings.Index(body, "went away")]
+	response := handle(t, map[string]string{"Content-Type": contentType}, truncated)
+	if response.StatusCode != http.StatusBadRequest || !strings.Contains(response.Body, "ended before") {
+		t.Fatalf("Handler() = %d %q, want 400 for a truncated body", response.StatusCode, response.Body)
+	}
+	// Not even the complete first file is stored
+	for _, operation := range []string{"PutObject", "CreateMultipartUpload"} {
+		if calls := fake.count(operation); calls != 0 {
+			t.Errorf("%s called %d times for a truncated body", operation, calls)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// preflight validates the headers of a direct upload before its body is read. Clients
+// sending "Expect: 100-continue" wait for the go-ahead before transmitting the body,
+// so answering with a final status instead lets them skip sending a body that would
+// be rejected anyway. It returns nil when the request may proceed.
+func preflight(headers map[string]string, cfg Config) *events.LambdaFunctionURLStreamingResponse {
+	if expect := headerValue(headers, "Expect"); expect != "" && !strings.EqualFold(expect, "100-continue") {
+		return preflightResponse(http.StatusExpectationFailed, fmt.Sprintf("Unsupported expectation %q.", expect))
+	}
+
+	// A chunked body's length is only known once it has arrived, and any Content-Length
+	// sent alongside it, often 0, must be ignored
+	if isChunked(headers) {
+		if !cfg.AllowChunked {
+			return preflightResponse(http.StatusLengthRequired, "Send the request body with a Content-Length.")
+		}
+	} else if length := headerValue(headers, "Content-Length"); length != "" {
+		size, err := strconv.Atoi(length)
+		if err != nil || size < 0 {
+			return preflightResponse(http.StatusBadRequest, "Invalid Content-Length.")
+		}
+		if cfg.MaxBodySize > 0 && size > cfg.MaxBodySize {
+			return preflightResponse(http.StatusRequestEntityTooLarge,
+				fmt.Sprintf("The request body may be at most %d bytes.", cfg.MaxBodySize))
+		}
+	}
+
+	// The signature itself covers the body, but a request that can't be trusted is known now
+	if mode := headerValue(headers, "X-Upload-Encryption"); mode != "" {
+		_, err := hex.DecodeString(headerValue(headers, "X-Upload-Signature"))
+		if err == nil {
+			err = checkSignatureTimestamp(headers, cfg, time.Now())
+		}
+		if !strings.EqualFold(mode, "none") || cfg.TrustSecret == "" || err != nil {
+			return preflightResponse(http.StatusForbidden, "Request is not trusted to disable encryption.")
+		}
+	}
+	return nil
+}
+
+// checkChunkedBody applies the body size limit preflight couldn't to a chunked request,
+// whose body Lambda has reassembled by now, and returns the headers with
+// Transfer-Encoding replaced by the real Content-Length of the body
+func checkChunkedBody(request events.LambdaFunctionURLRequest, cfg Config) (map[string]string, *events.LambdaFunctionURLStreamingResponse) {
+	size := bodySize(request.Body, request.IsBase64Encoded)
+	if cfg.MaxBodySize > 0 && size > cfg.MaxBodySize {
+		return nil, preflightResponse(http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("The request body may be at most %d bytes.", cfg.MaxBodySize))
+	}
+
+	headers := make(map[string]string, len(request.Headers))
+	for name, value := range request.Headers {
+		if !strings.EqualFold(name, "Transfer-Encoding") && !strings.EqualFold(name, "Content-Length") {
+			headers[name] = value
+		}
+	}
+	headers["content-length"] = strconv.Itoa(size)
+	return headers, nil
+}
+
+// isChunked reports whether a request body was sent with chunked transfer encoding,
+// which is always the last coding applied
+func isChunked(headers map[string]string) bool {
+	codings := strings.Split(headerValue(headers, "Transfer-Encoding"), ",")
+	return strings.EqualFold(strings.TrimSpace(codings[len(codings)-1]), "chunked")
+}
+
+// bodySize returns the length of a request body once decoded
+func bodySize(body string, base64Encoded bool) int {
+	if !base64Encoded {
+		return len(body)
+	}
+	return base64.StdEncoding.DecodedLen(len(body)) - strings.Count(body[len(body)-min(len(body), 2):], "=")
+}
+
+// preflightResponse is the final response sent in place of 100 Continue
+func preflightResponse(status int, message string) *events.LambdaFunctionURLStreamingResponse {
+	return &events.LambdaFunctionURLStreamingResponse{
+		StatusCode: status,
+		Body:       strings.NewReader(message),
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestPreflight(t *testing.T) {
+	limited := Config{MaxBodySize: 1024, AllowChunked: true, TrustSecret: "shared-secret"}
+	tests := []struct {
+		name    string
+		headers map[string]string
+		cfg     Config
+		status  int
+	}{
+		{name: "100-continue within the limit", headers: map[string]string{"Expect": "100-continue", "Content-Length": "1024"}, cfg: limited},
+		{name: "expectation case", headers: map[string]string{"expect": "100-Continue", "content-length": "10"}, cfg: limited},
+		{name: "no expectation", headers: map[string]string{"Content-Length": "10"}, cfg: limited},
+		{name: "unknown expectation", headers: map[string]string{"Expect": "200-ok"}, cfg: limited, status: http.StatusExpectationFailed},
+		{name: "oversized", headers: map[string]string{"Expect": "100-continue", "Content-Length": "1025"}, cfg: limited, status: http.StatusRequestEntityTooLarge},
+		{name: "invalid length", headers: map[string]string{"Content-Length": "ten"}, cfg: limited, status: http.StatusBadRequest},
+		{name: "negative length", headers: map[string]string{"Content-Length": "-1"}, cfg: limited, status: http.StatusBadRequest},
+		{name: "chunked ignores the length", headers: map[string]string{"Transfer-Encoding": "gzip, chunked", "Content-Length": "0"}, cfg: limited},
+		{name: "chunked disallowed", headers: map[string]string{"Transfer-Encoding": "chunked"}, status: http.StatusLengthRequired},
+		{name: "unlimited", headers: map[string]string{"Content-Length": "1000000000"}},
+		{name: "unsigned encryption opt-out", headers: map[string]string{"X-Upload-Encryption": "none"}, cfg: limited, status: http.StatusForbidden},
+		{name: "encryption opt-out without a secret", headers: map[string]string{"X-Upload-Encryption": "none", "X-Upload-Signature": "00"}, status: http.StatusForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := preflight(test.headers, test.cfg)
+			if test.status == 0 {
+				if response != nil {
+					t.Errorf("preflight() = %d, want the request to proceed", response.StatusCode)
+				}
+				return
+			}
+			if response == nil || response.StatusCode != test.status {
+				t.Fatalf("preflight() = %+v, want status %d", response, test.status)
+			}
+		})
+	}
+}
+
+func TestCheckChunkedBody(t *testing.T) {
+	body := base64.StdEncoding.EncodeToString([]byte("chunked body"))
+	request := events.LambdaFunctionURLRequest{
+		Headers:         map[string]string{"Transfer-Encoding": "chunked", "Content-Length": "0", "Content-Type": "text/plain"},
+		Body:            body,
+		IsBase64Encoded: true,
+	}
+	headers, response := checkChunkedBody(request, Config{MaxBodySize: 12})
+	if response != nil {
+		t.Fatalf("checkChunkedBody() = %d", response.StatusCode)
+	}
+	if headers["content-length"] != "12" || headerValue(headers, "Transfer-Encoding") != "" || headers["Content-Type"] != "text/plain" {
+		t.Errorf("checkChunkedBody() headers = %v", headers)
+	}
+	if _, response := checkChunkedBody(request, Config{MaxBodySize: 11}); response == nil || response.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("checkChunkedBody() accepted a body over the limit")
+	}
+}
+
+func TestStreamHandlerExpectContinue(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+		body    string
+		status  int
+		stored  bool
+	}{
+		{
+			name:    "rejected before the body",
+			headers: map[string]string{"Expect": "100-continue", "Content-Length": "4096"},
+			status:  http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:    "accepted",
+			headers: map[string]string{"Expect": "100-continue", "Content-Length": "13"},
+			body:    "small enough.",
+			status:  http.StatusOK,
+			stored:  true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("S3_UPLOAD_MAX_BODY_SIZE", "1024")
+			fake := newFakeS3(t)
+			response, err := StreamHandler(t.Context(), events.LambdaFunctionURLRequest{
+				Headers:        test.headers,
+				Body:           test.body,
+				RequestContext: events.LambdaFunctionURLRequestContext{HTTP: events.LambdaFunctionURLRequestContextHTTPDescription{Method: "POST"}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response.StatusCode != test.status {
+				message, _ := io.ReadAll(response.Body)
+				t.Fatalf("StreamHandler() = %d %q, want %d", response.StatusCode, message, test.status)
+			}
+			if stored := fake.count("PutObject") == 1; stored != test.stored {
+				t.Errorf("stored = %v, want %v (calls %v)", stored, test.stored, fake.calls)
+			}
+			if !test.stored && len(fake.calls) != 0 {
+				t.Errorf("rejected request reached S3: %v", fake.calls)
+			}
+		})
+	}
+}
+
+func TestBodySize(t *testing.T) {
+	for _, body := range []string{"", "a", "ab", "abc", "chunked body of some length"} {
+		encoded := base64.StdEncoding.EncodeToString([]byte(body))
+		if size := bodySize(encoded, true); size != len(body) {
+			t.Errorf("bodySize(%q, true) = %d, want %d", encoded, size, len(body))
+		}
+		if size := bodySize(body, false); size != len(body) {
+			t.Errorf("bodySize(%q, false) = %d, want %d", body, size, len(body))
+		}
+	}
+}
+
+func TestStreamHandlerChunked(t *testing.T) {
+	payload := testPayload(3 << 20)
+	multipart, multipartType := multipartBody(t, testFile{name: "chunked.txt", contentType: "text/plain", data: string(payload)})
+	tests := []struct {
+		name    string
+		env     map[string]string
+		headers map[string]string
+		body    string
+		base64  bool
+		status  int
+		want    []byte
+	}{
+		{
+			name:    "no Content-Length",
+			headers: map[string]string{"Transfer-Encoding": "chunked", "Content-Type": "text/plain"},
+			body:    base64.StdEncoding.EncodeToString(payload),
+			base64:  true,
+			status:  http.StatusOK,
+			want:    payload,
+		},
+		{
+			name:    "zero Content-Length",
+			headers: map[string]string{"Transfer-Encoding": "chunked", "Content-Length": "0", "Content-Type": "text/plain"},
+			body:    string(payload),
+			status:  http.StatusOK,
+			want:    payload,
+		},
+		{
+			name:    "multipart",
+			headers: map[string]string{"transfer-encoding": "Chunked", "Content-Type": multipartType},
+			body:    multipart,
+			status:  http.StatusOK,
+			want:    payload,
+		},
+		{
+			name:    "over the limit once read",
+			env:     map[string]string{"S3_UPLOAD_MAX_BODY_SIZE": "1048576"},
+			headers: map[string]string{"Transfer-Encoding": "chunked", "Content-Length": "0", "Content-Type": "text/plain"},
+			body:    string(payload),
+			status:  http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:    "chunked disallowed",
+			env:     map[string]string{"S3_UPLOAD_ALLOW_CHUNKED": "false"},
+			headers: map[string]string{"Transfer-Encoding": "chunked", "Content-Type": "text/plain"},
+			body:    string(payload),
+			status:  http.StatusLengthRequired,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+			fake := newFakeS3(t)
+			response, err := StreamHandler(t.Context(), events.LambdaFunctionURLRequest{
+				Headers:         test.headers,
+				Body:            test.body,
+				IsBase64Encoded: test.base64,
+				RequestContext:  events.LambdaFunctionURLRequestContext{HTTP: events.LambdaFunctionURLRequestContextHTTPDescription{Method: "POST"}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response.StatusCode != test.status {
+				message, _ := io.ReadAll(response.Body)
+				t.Fatalf("StreamHandler() = %d %q, want %d", response.StatusCode, message, test.status)
+			}
+			if test.want == nil {
+				if len(fake.calls) != 0 {
+					t.Errorf("rejected request reached S3: %v", fake.calls)
+				}
+				return
+			}
+			// Every chunk made it into the stored object
+			bucket := fake.bucketNames()[0]
+			keys := fake.keys(bucket)
+			if len(keys) != 1 {
+				t.Fatalf("stored %v, want one object", keys)
+			}
+			stored, metadata, _ := fake.object(bucket, keys[0])
+			got, err := decodeObject(stored, metadata)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, test.want) {
+				t.Errorf("stored %d bytes, want the full %d byte payload", len(got), len(test.want))
+			}
+		})
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// maxTagValueLength is the S3 limit on object tag values
+const maxTagValueLength = 256
+
+// requestPrincipal returns who made the request, from the API Gateway authorizer
+// context: Cognito/JWT claims, then a Lambda authorizer principal, then the IAM
+// caller. It returns "" for unauthenticated requests.
+func requestPrincipal(request events.APIGatewayProxyRequest) string {
+	if claims, ok := request.RequestContext.Authorizer["claims"].(map[string]interface{}); ok {
+		for _, claim := range []string{"cognito:username", "username", "sub"} {
+			if value, ok := claims[claim].(string); ok && value != "" {
+				return value
+			}
+		}
+	}
+	if principalID, ok := request.RequestContext.Authorizer["principalId"].(string); ok && principalID != "" {
+		return principalID
+	}
+	return request.RequestContext.Identity.UserArn
+}
+
+// tagValue makes a string safe to use as an S3 object tag value
+func tagValue(value string) string {
+	value = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case strings.ContainsRune(" +-=._:/@", r):
+			return r
+		default:
+			return '_'
+		}
+	}, value)
+	if len(value) > maxTagValueLength {
+		value = value[:maxTagValueLength]
+	}
+	return value
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestRequestPrincipal(t *testing.T) {
+	tests := []struct {
+		name    string
+		context events.APIGatewayProxyRequestContext
+		want    string
+	}{
+		{
+			name: "cognito username",
+			context: events.APIGatewayProxyRequestContext{Authorizer: map[string]interface{}{
+				"claims":      map[string]interface{}{"cognito:username": "alice", "sub": "1234"},
+				"principalId": "ignored",
+			}},
+			want: "alice",
+		},
+		{
+			name: "JWT subject",
+			context: events.APIGatewayProxyRequestContext{Authorizer: map[string]interface{}{
+				"claims": map[string]interface{}{"username": "", "sub": "1234"},
+			}},
+			want: "1234",
+		},
+		{
+			name:    "Lambda authorizer",
+			context: events.APIGatewayProxyRequestContext{Authorizer: map[string]interface{}{"principalId": "user-1"}},
+			want:    "user-1",
+		},
+		{
+			name:    "IAM caller",
+			context: events.APIGatewayProxyRequestContext{Identity: events.APIGatewayRequestIdentity{UserArn: "arn:aws:iam::123456789012:user/bob"}},
+			want:    "arn:aws:iam::123456789012:user/bob",
+		},
+		{
+			name:    "malformed claims",
+			context: events.APIGatewayProxyRequestContext{Authorizer: map[string]interface{}{"claims": "alice", "principalId": 7}},
+			want:    "",
+		},
+		{name: "anonymous", want: ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := requestPrincipal(events.APIGatewayProxyRequest{RequestContext: test.context}); got != test.want {
+				t.Errorf("requestPrincipal() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestTagValue(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"arn:aws:iam::123456789012:user/bob", "arn:aws:iam::123456789012:user/bob"},
+		{"alice@example.com", "alice@example.com"},
+		{"name\twith\"quotes", "name_with_quotes"},
+		{"zoë", "zo_"},
+		{strings.Repeat("a", 300), strings.Repeat("a", maxTagValueLength)},
+	}
+	for _, test := range tests {
+		if got := tagValue(test.value); got != test.want {
+			t.Errorf("tagValue(%.20q) = %.20q, want %.20q", test.value, got, test.want)
+		}
+	}
+}
+
+func TestUploadTagsPrincipal(t *testing.T) {
+	tests := []struct {
+		name       string
+		authorizer map[string]interface{}
+		want       string
+	}{
+		{name: "authenticated", authorizer: map[string]interface{}{"claims": map[string]interface{}{"cognito:username": "alice"}}, want: "alice"},
+		{name: "anonymous", want: ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := newFakeS3(t)
+			response, err := Handler(t.Context(), events.APIGatewayProxyRequest{
+				HTTPMethod:     "POST",
+				Body:           "audited content",
+				RequestContext: events.APIGatewayProxyRequestContext{Authorizer: test.authorizer},
+			})
+			if err != nil || response.StatusCode != http.StatusOK {
+				t.Fatalf("Handler() = %d %q, %v", response.StatusCode, response.Body, err)
+			}
+			bucket := fake.bucketNames()[0]
+			tags, err := url.ParseQuery(fake.header(bucket, fake.keys(bucket)[0]).Get("X-Amz-Tagging"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := tags.Get("uploaded-by"); got != test.want {
+				t.Errorf("uploaded-by tag = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
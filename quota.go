@@ -0,0 +1,30 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/aws/smithy-go"
+)
+
+// quotaMessages maps the S3 error codes for an account or bucket that can't take
+// more data to what the operator has to do about it
+var quotaMessages = map[string]string{
+	"TooManyBuckets":                "The account has reached its bucket limit. Delete unused buckets or request a higher limit.",
+	"QuotaExceeded":                 "The storage quota is exhausted. Free up space or raise the quota.",
+	"ServiceQuotaExceededException": "The storage quota is exhausted. Free up space or raise the quota.",
+	"AccountProblem":                "The AWS account is restricted. Check its billing and status in the AWS console.",
+	"AllAccessDisabled":             "All access to the bucket has been disabled. Contact AWS support.",
+	"NotSignedUp":                   "The AWS account is not signed up for S3.",
+	"InvalidPayer":                  "All access to the bucket has been disabled for its payer. Contact AWS support.",
+}
+
+// quotaMessage returns the actionable message for an S3 error caused by the account
+// or bucket being over quota or restricted, and false for any other error
+func quotaMessage(err error) (string, bool) {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return "", false
+	}
+	message, ok := quotaMessages[apiErr.ErrorCode()]
+	return message, ok
+}
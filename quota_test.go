@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/aws/smithy-go"
+)
+
+func TestQuotaMessage(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{err: &smithy.GenericAPIError{Code: "QuotaExceeded"}, want: "storage quota is exhausted"},
+		{err: &smithy.OperationError{ServiceID: "S3", OperationName: "PutObject", Err: &smithy.GenericAPIError{Code: "AccountProblem"}}, want: "account is restricted"},
+		{err: fmt.Errorf("upload failed: %w", &smithy.GenericAPIError{Code: "TooManyBuckets"}), want: "bucket limit"},
+		{err: &smithy.GenericAPIError{Code: "AllAccessDisabled"}, want: "access to the bucket has been disabled"},
+		{err: &smithy.GenericAPIError{Code: "AccessDenied"}},
+		{err: errors.New("QuotaExceeded")},
+		{err: nil},
+	}
+	for _, test := range tests {
+		message, ok := quotaMessage(test.err)
+		if ok != (test.want != "") || !strings.Contains(message, test.want) {
+			t.Errorf("quotaMessage(%v) = %q, %v, want a message containing %q", test.err, message, ok, test.want)
+		}
+	}
+}
+
+func TestUploadQuotaExceeded(t *testing.T) {
+	tests := []struct {
+		name      string
+		operation string
+		status    int
+		code      string
+		report    string
+		want      int
+		message   string
+	}{
+		{name: "quota exhausted", operation: "PutObject", status: http.StatusForbidden, code: "QuotaExceeded", report: "true",
+			want: http.StatusInsufficientStorage, message: "Free up space or raise the quota."},
+		{name: "bucket limit", operation: "CreateBucket", status: http.StatusBadRequest, code: "TooManyBuckets", report: "true",
+			want: http.StatusInsufficientStorage, message: "Delete unused buckets or request a higher limit."},
+		{name: "restricted account", operation: "PutObject", status: http.StatusForbidden, code: "AccountProblem", report: "true",
+			want: http.StatusInsufficientStorage, message: "Check its billing and status in the AWS console."},
+		{name: "access disabled", operation: "PutObject", status: http.StatusForbidden, code: "AllAccessDisabled", report: "true",
+			want: http.StatusInsufficientStorage, message: "Contact AWS support."},
+		{name: "not reported", operation: "PutObject", status: http.StatusForbidden, code: "QuotaExceeded", report: "false",
+			want: http.StatusInternalServerError},
+		{name: "other errors", operation: "PutObject", status: http.StatusInternalServerError, code: "InternalError", report: "true",
+			want: http.StatusInternalServerError},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("S3_UPLOAD_REPORT_QUOTA", test.report)
+			t.Setenv("S3_UPLOAD_BREAKER_THRESHOLD", "0")
+			fake := newFakeS3(t)
+			fake.Fail = func(operation string, bucket string, key string) (int, string) {
+				if operation == test.operation {
+					return test.status, test.code
+				}
+				return 0, ""
+			}
+			response := handle(t, map[string]string{"Content-Type": "text/plain"}, "one more file")
+			if response.StatusCode != test.want {
+				t.Fatalf("Handler() = %d %q, want %d", response.StatusCode, response.Body, test.want)
+			}
+			if test.message != "" && !strings.HasSuffix(response.Body, test.message) {
+				t.Errorf("Handler() body = %q, want it to end %q", response.Body, test.message)
+			}
+		})
+	}
+}
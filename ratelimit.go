@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/aws/smithy-go/middleware"
+	"golang.org/x/time/rate"
+)
+
+// ErrRateLimited is returned when an S3 call couldn't be issued within the request deadline
+var ErrRateLimited = errors.New("S3 request rate limit exceeded")
+
+// s3Limiter paces S3 calls made by this Lambda container, so a burst of
+// invocations doesn't get itself throttled by S3
+var s3Limiter struct {
+	mu      sync.Mutex
+	limiter *rate.Limiter
+}
+
+// limiterFor returns the shared limiter, adjusted to the configured rate
+func limiterFor(cfg Config) *rate.Limiter {
+	s3Limiter.mu.Lock()
+	defer s3Limiter.mu.Unlock()
+
+	if s3Limiter.limiter == nil {
+		s3Limiter.limiter = rate.NewLimiter(rate.Limit(cfg.RateLimit), cfg.RateBurst)
+	} else {
+		s3Limiter.limiter.SetLimit(rate.Limit(cfg.RateLimit))
+		s3Limiter.limiter.SetBurst(cfg.RateBurst)
+	}
+	return s3Limiter.limiter
+}
+
+// rateLimitMiddleware waits for the limiter before every S3 operation. Waiting is
+// bounded by the invocation context: when the next slot lies beyond its deadline
+// the operation fails straight away with ErrRateLimited.
+func rateLimitMiddleware(ctx context.Context, limiter *rate.Limiter) func(*middleware.Stack) error {
+	return func(stack *middleware.Stack) error {
+		return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("S3UploadRateLimit",
+			func(opCtx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+				if err := limiter.Wait(ctx); err != nil {
+					return middleware.InitializeOutput{}, middleware.Metadata{}, ErrRateLimited
+				}
+				return next.HandleInitialize(opCtx, in)
+			}), middleware.Before)
+	}
+}
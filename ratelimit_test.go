@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"golang.org/x/time/rate"
+)
+
+// limitedClient returns a client of fake whose calls are paced by limiter within ctx
+func limitedClient(ctx context.Context, fake *fakeS3, limiter *rate.Limiter) *s3.Client {
+	return s3.NewFromConfig(fake.config(), func(o *s3.Options) {
+		o.APIOptions = append(o.APIOptions, rateLimitMiddleware(ctx, limiter))
+	})
+}
+
+func TestRateLimitPacesRequests(t *testing.T) {
+	tests := []struct {
+		rate  rate.Limit
+		burst int
+		calls int
+	}{
+		{rate: 20, burst: 1, calls: 6},
+		{rate: 50, burst: 3, calls: 8},
+	}
+	for _, test := range tests {
+		fake := newFakeS3(t)
+		var mu sync.Mutex
+		var issued []time.Time
+		fake.Before = func(operation string, bucket string, key string) {
+			mu.Lock()
+			issued = append(issued, time.Now())
+			mu.Unlock()
+		}
+		client := limitedClient(t.Context(), fake, rate.NewLimiter(test.rate, test.burst))
+
+		start := time.Now()
+		var wg sync.WaitGroup
+		for i := 0; i < test.calls; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				client.HeadBucket(t.Context(), &s3.HeadBucketInput{Bucket: aws.String("uploads")})
+			}()
+		}
+		wg.Wait()
+
+		// Beyond the burst every call waits for its own token
+		want := time.Duration(float64(test.calls-test.burst) / float64(test.rate) * float64(time.Second))
+		if elapsed := time.Since(start); elapsed < want-10*time.Millisecond {
+			t.Errorf("rate %v burst %d: %d calls took %v, want at least %v", test.rate, test.burst, test.calls, elapsed, want)
+		}
+		if len(issued) != test.calls {
+			t.Fatalf("rate %v: %d calls reached S3, want %d", test.rate, len(issued), test.calls)
+		}
+		// No window of one second's worth of calls may be shorter than a second
+		window := int(test.rate) + test.burst
+		for i := window; i < len(issued); i++ {
+			if gap := issued[i].Sub(issued[i-window]); gap < time.Second-10*time.Millisecond {
+				t.Errorf("rate %v: %d calls within %v", test.rate, window+1, gap)
+			}
+		}
+	}
+}
+
+func TestRateLimitPastDeadline(t *testing.T) {
+	fake := newFakeS3(t)
+	ctx, cancel := context.WithTimeout(t.Context(), 200*time.Millisecond)
+	defer cancel()
+	client := limitedClient(ctx, fake, rate.NewLimiter(1, 1))
+
+	if _, err := client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String("uploads")}); err == nil || errors.Is(err, ErrRateLimited) {
+		t.Fatalf("first call error = %v, want the fake's not found", err)
+	}
+	// The next token is a second away, past the deadline, so the call fails at once
+	start := time.Now()
+	_, err := client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String("uploads")})
+	if !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("second call error = %v, want ErrRateLimited", err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("rate limited call waited %v", elapsed)
+	}
+	if fake.count("HeadBucket") != 1 {
+		t.Errorf("HeadBucket reached S3 %d times, want 1", fake.count("HeadBucket"))
+	}
+	if response := s3ErrorResponse(err, Config{}); response.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("s3ErrorResponse() status = %d, want %d", response.StatusCode, http.StatusServiceUnavailable)
+	}
+}
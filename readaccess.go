@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Without an access point, Handler uploads each request into a new bucket named
+// uploadBucketPrefix followed by the time in uploadBucketLayout
+const (
+	uploadBucketPrefix = "filename"
+	uploadBucketLayout = "20060102-150405"
+)
+
+// uploadBucketName returns the name of the bucket created for an upload at now
+func uploadBucketName(now time.Time) string {
+	return uploadBucketPrefix + now.Format(uploadBucketLayout)
+}
+
+// isReadableBucket reports whether read requests may target a bucket: only the
+// configured access point and the buckets Handler creates are served, so the
+// function's role can't be used to read anything else it happens to have access to
+func isReadableBucket(bucketName string, appCfg Config) bool {
+	if appCfg.AccessPointARN != "" && bucketName == appCfg.AccessPointARN {
+		return true
+	}
+	stamp, ok := strings.CutPrefix(bucketName, uploadBucketPrefix)
+	if !ok {
+		return false
+	}
+	_, err := time.Parse(uploadBucketLayout, stamp)
+	return err == nil
+}
+
+// authorizeRead returns the bucket and key a download or presign request reads. The
+// caller must be an authenticated principal or sign the request under the trust
+// secret, and the bucket must be one isReadableBucket allows; otherwise it returns
+// the response refusing the request.
+func authorizeRead(request events.APIGatewayProxyRequest, appCfg Config) (string, string, *events.APIGatewayProxyResponse) {
+	bucketName := requestBucket(request.QueryStringParameters, appCfg)
+	fileName := request.QueryStringParameters["key"]
+	if bucketName == "" || fileName == "" {
+		return "", "", &events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "The bucket and key query parameters are required.",
+		}
+	}
+	if requestPrincipal(request) == "" && verifySignature(request, appCfg, time.Now()) != nil {
+		return "", "", &events.APIGatewayProxyResponse{
+			StatusCode: http.StatusForbidden,
+			Body:       "Reads need an authenticated caller or a signed request.",
+		}
+	}
+	if !isReadableBucket(bucketName, appCfg) {
+		return "", "", &events.APIGatewayProxyResponse{
+			StatusCode: http.StatusForbidden,
+			Body:       "The bucket is not served by this function.",
+		}
+	}
+	return bucketName, fileName, nil
+}
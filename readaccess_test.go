@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestIsReadableBucket(t *testing.T) {
+	accessPoint := "arn:aws:s3:ap-south-1:123456789012:accesspoint/uploads"
+	tests := []struct {
+		bucket      string
+		accessPoint string
+		want        bool
+	}{
+		{bucket: uploadBucketName(time.Now()), want: true},
+		{bucket: "filename20240131-235959", accessPoint: accessPoint, want: true},
+		{bucket: accessPoint, accessPoint: accessPoint, want: true},
+		{bucket: accessPoint, want: false},
+		{bucket: "filename", want: false},
+		{bucket: "filename-backups", want: false},
+		{bucket: "filename20241341-000000", want: false},
+		{bucket: "company-payroll", accessPoint: accessPoint, want: false},
+		{bucket: "", accessPoint: "", want: false},
+	}
+	for _, test := range tests {
+		if got := isReadableBucket(test.bucket, Config{AccessPointARN: test.accessPoint}); got != test.want {
+			t.Errorf("isReadableBucket(%q) with access point %q = %v, want %v", test.bucket, test.accessPoint, got, test.want)
+		}
+	}
+}
+
+func TestAuthorizeRead(t *testing.T) {
+	cfg := Config{TrustSecret: "shared-secret", TrustMaxSkew: time.Minute}
+	bucket := uploadBucketName(time.Now())
+	authenticated := events.APIGatewayProxyRequestContext{
+		Authorizer: map[string]interface{}{"principalId": "user-1"},
+	}
+	signed := func(params map[string]string) events.APIGatewayProxyRequest {
+		request := events.APIGatewayProxyRequest{
+			HTTPMethod:            "GET",
+			Headers:               map[string]string{"X-Upload-Timestamp": strconv.FormatInt(time.Now().Unix(), 10)},
+			QueryStringParameters: params,
+		}
+		request.Headers["X-Upload-Signature"] = hex.EncodeToString(requestSignature(request, nil, cfg.TrustSecret))
+		return request
+	}
+
+	tests := []struct {
+		name    string
+		request events.APIGatewayProxyRequest
+		status  int
+	}{
+		{
+			name: "authenticated principal",
+			request: events.APIGatewayProxyRequest{
+				QueryStringParameters: map[string]string{"action": "download", "bucket": bucket, "key": "a.txt"},
+				RequestContext:        authenticated,
+			},
+		},
+		{
+			name:    "signed request",
+			request: signed(map[string]string{"action": "download", "bucket": bucket, "key": "a.txt"}),
+		},
+		{
+			name: "signed for another key",
+			request: func() events.APIGatewayProxyRequest {
+				request := signed(map[string]string{"action": "download", "bucket": bucket, "key": "a.txt"})
+				request.QueryStringParameters["key"] = "b.txt"
+				return request
+			}(),
+			status: http.StatusForbidden,
+		},
+		{
+			name: "anonymous",
+			request: events.APIGatewayProxyRequest{
+				QueryStringParameters: map[string]string{"action": "download", "bucket": bucket, "key": "a.txt"},
+			},
+			status: http.StatusForbidden,
+		},
+		{
+			name: "foreign bucket",
+			request: events.APIGatewayProxyRequest{
+				QueryStringParameters: map[string]string{"action": "download", "bucket": "company-payroll", "key": "a.txt"},
+				RequestContext:        authenticated,
+			},
+			status: http.StatusForbidden,
+		},
+		{
+			name: "missing key",
+			request: events.APIGatewayProxyRequest{
+				QueryStringParameters: map[string]string{"action": "download", "bucket": bucket},
+				RequestContext:        authenticated,
+			},
+			status: http.StatusBadRequest,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bucketName, fileName, denied := authorizeRead(test.request, cfg)
+			if test.status != 0 {
+				if denied == nil || denied.StatusCode != test.status {
+					t.Fatalf("authorizeRead() = %+v, want status %d", denied, test.status)
+				}
+				return
+			}
+			if denied != nil {
+				t.Fatalf("authorizeRead() refused with %d: %s", denied.StatusCode, denied.Body)
+			}
+			if bucketName != bucket || fileName != "a.txt" {
+				t.Errorf("authorizeRead() = %q, %q, want %q, %q", bucketName, fileName, bucket, "a.txt")
+			}
+		})
+	}
+}
+
+func TestDownloadRefusesForeignBucket(t *testing.T) {
+	response := handleDownload(t.Context(), events.APIGatewayProxyRequest{
+		QueryStringParameters: map[string]string{"action": "download", "bucket": "company-payroll", "key": "salaries.csv"},
+		RequestContext:        events.APIGatewayProxyRequestContext{Authorizer: map[string]interface{}{"principalId": "user-1"}},
+	}, Config{})
+	if response.StatusCode != http.StatusForbidden {
+		t.Errorf("handleDownload() status = %d, want %d", response.StatusCode, http.StatusForbidden)
+	}
+}
+
+func TestPresignRefusesUnauthorizedReads(t *testing.T) {
+	authenticated := events.APIGatewayProxyRequestContext{Authorizer: map[string]interface{}{"principalId": "user-1"}}
+	tests := []struct {
+		name    string
+		request events.APIGatewayProxyRequest
+	}{
+		{
+			name: "anonymous",
+			request: events.APIGatewayProxyRequest{
+				QueryStringParameters: map[string]string{"action": "presign", "bucket": uploadBucketName(time.Now()), "key": "a.txt"},
+			},
+		},
+		{
+			name: "foreign bucket",
+			request: events.APIGatewayProxyRequest{
+				QueryStringParameters: map[string]string{"action": "presign", "bucket": "company-payroll", "key": "salaries.csv"},
+				RequestContext:        authenticated,
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if response := handlePresign(t.Context(), test.request, Config{}); response.StatusCode != http.StatusForbidden {
+				t.Errorf("handlePresign() status = %d, want %d", response.StatusCode, http.StatusForbidden)
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// replicationRuleID names the rule replicating every object of a new bucket
+const replicationRuleID = "replicate-all"
+
+// ConfigureReplication replicates every object written to a bucket to the configured
+// destination bucket. Replication requires versioning, so it is enabled first.
+func (basics BucketBasics) ConfigureReplication(name string) error {
+	_, err := basics.S3Client.PutBucketVersioning(context.TODO(), &s3.PutBucketVersioningInput{
+		Bucket: aws.String(name),
+		VersioningConfiguration: &types.VersioningConfiguration{
+			Status: types.BucketVersioningStatusEnabled,
+		},
+	})
+	if err != nil {
+		log.Printf("Couldn't enable versioning on bucket %v. Here's why: %v\n", name, err)
+		return err
+	}
+
+	_, err = basics.S3Client.PutBucketReplication(context.TODO(), &s3.PutBucketReplicationInput{
+		Bucket:                   aws.String(name),
+		ReplicationConfiguration: replicationConfiguration(basics.Config),
+	})
+	if err != nil {
+		log.Printf("Couldn't configure replication of bucket %v to %v. Here's why: %v\n", name, basics.Config.ReplicationDestination, err)
+	}
+	return err
+}
+
+// replicationConfiguration builds the replication settings for new buckets
+func replicationConfiguration(cfg Config) *types.ReplicationConfiguration {
+	return &types.ReplicationConfiguration{
+		Role: aws.String(cfg.ReplicationRole),
+		Rules: []types.ReplicationRule{
+			{
+				ID:       aws.String(replicationRuleID),
+				Status:   types.ReplicationRuleStatusEnabled,
+				Priority: aws.Int32(1),
+				// An empty prefix filter selects every object
+				Filter: &types.ReplicationRuleFilter{Prefix: aws.String("")},
+				DeleteMarkerReplication: &types.DeleteMarkerReplication{
+					Status: types.DeleteMarkerReplicationStatusDisabled,
+				},
+				Destination: &types.Destination{
+					Bucket: aws.String(cfg.ReplicationDestination),
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCreateBucketReplication(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		enabled bool
+	}{
+		{
+			name: "enabled",
+			cfg: Config{
+				ReplicationDestination: "arn:aws:s3:::uploads-replica",
+				ReplicationRole:        "arn:aws:iam::123456789012:role/s3-replication",
+			},
+			enabled: true,
+		},
+		{name: "disabled", cfg: Config{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := newFakeS3(t)
+			if err := fake.basics(test.cfg).CreateBucket("uploads", "ap-south-1"); err != nil {
+				t.Fatal(err)
+			}
+			replication := fake.bucketConfig("uploads", "replication")
+			if !test.enabled {
+				if fake.count("PutBucket:replication") != 0 || fake.count("PutBucket:versioning") != 0 {
+					t.Errorf("calls = %v, want no replication setup", fake.calls)
+				}
+				return
+			}
+			// Replication is rejected on buckets without versioning
+			versioning, put := slices.Index(fake.calls, "PutBucket:versioning"), slices.Index(fake.calls, "PutBucket:replication")
+			if versioning < 0 || put < versioning {
+				t.Errorf("calls = %v, want versioning enabled before replication", fake.calls)
+			}
+			if status := fake.bucketConfig("uploads", "versioning"); !strings.Contains(status, "<Status>Enabled</Status>") {
+				t.Errorf("versioning configuration = %s, want Enabled", status)
+			}
+			for _, want := range []string{
+				"<Role>arn:aws:iam::123456789012:role/s3-replication</Role>",
+				"<ID>" + replicationRuleID + "</ID>",
+				"<Bucket>arn:aws:s3:::uploads-replica</Bucket>",
+				"<Status>Enabled</Status>",
+				"<Prefix></Prefix>",
+			} {
+				if !strings.Contains(replication, want) {
+					t.Errorf("replication configuration %s is missing %s", replication, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCreateBucketReplicationFailure(t *testing.T) {
+	cfg := Config{
+		ReplicationDestination: "arn:aws:s3:::uploads-replica",
+		ReplicationRole:        "arn:aws:iam::123456789012:role/s3-replication",
+	}
+	for _, operation := range []string{"PutBucket:versioning", "PutBucket:replication"} {
+		t.Run(operation, func(t *testing.T) {
+			fake := newFakeS3(t)
+			fake.Fail = func(op string, bucket string, key string) (int, string) {
+				if op == operation {
+					return 403, "AccessDenied"
+				}
+				return 0, ""
+			}
+			if err := fake.basics(cfg).CreateBucket("uploads", "ap-south-1"); err == nil {
+				t.Errorf("CreateBucket() succeeded though %s failed", operation)
+			}
+			if operation == "PutBucket:versioning" && fake.count("PutBucket:replication") != 0 {
+				t.Errorf("calls = %v, want replication skipped without versioning", fake.calls)
+			}
+		})
+	}
+}
+
+func TestReplicationConfig(t *testing.T) {
+	const (
+		destination = "arn:aws:s3:::uploads-replica"
+		role        = "arn:aws:iam::123456789012:role/s3-replication"
+	)
+	tests := []struct {
+		name        string
+		destination string
+		role        string
+		ok          bool
+	}{
+		{name: "unset", ok: true},
+		{name: "valid", destination: destination, role: role, ok: true},
+		{name: "destination without role", destination: destination},
+		{name: "role without destination", role: role},
+		{name: "destination not an ARN", destination: "uploads-replica", role: role},
+		{name: "destination not a bucket", destination: "arn:aws:s3:::uploads-replica/prefix", role: role},
+		{name: "destination another service", destination: "arn:aws:sqs:eu-west-1:123456789012:queue", role: role},
+		{name: "role not an ARN", destination: destination, role: "s3-replication"},
+		{name: "role not a role", destination: destination, role: "arn:aws:iam::123456789012:user/alice"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := configError(t, map[string]string{
+				"S3_UPLOAD_REPLICATION_DESTINATION": test.destination,
+				"S3_UPLOAD_REPLICATION_ROLE":        test.role,
+			})
+			if (err == nil) != test.ok {
+				t.Errorf("loadConfig() error = %v, want ok %v", err, test.ok)
+			}
+		})
+	}
+}
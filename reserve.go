@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// reservationMetadata marks a zero-byte placeholder holding a key for an upload in progress
+const reservationMetadata = "reservation"
+
+// ReserveKey claims a key by writing a zero-byte placeholder under create-only
+// semantics, and returns the placeholder's ETag. A key that is already taken fails
+// with an error isObjectExists recognises.
+func (basics BucketBasics) ReserveKey(bucketName string, fileName string) (string, error) {
+	result, err := basics.S3Client.PutObject(context.TODO(), &s3.PutObjectInput{
+		Bucket:      aws.String(bucketName),
+		Key:         aws.String(fileName),
+		Body:        bytes.NewReader(nil),
+		IfNoneMatch: aws.String("*"),
+		Metadata:    map[string]string{reservationMetadata: "pending"},
+	})
+	if err != nil {
+		log.Printf("Couldn't reserve %v:%v. Here's why: %v\n", bucketName, fileName, err)
+		return "", err
+	}
+	return aws.ToString(result.ETag), nil
+}
+
+// ReleaseKey deletes a placeholder left by a failed upload. The delete is
+// conditional on the placeholder's ETag, so an object that replaced it is kept.
+func (basics BucketBasics) ReleaseKey(bucketName string, fileName string, etag string) {
+	_, err := basics.S3Client.DeleteObject(context.TODO(), &s3.DeleteObjectInput{
+		Bucket:  aws.String(bucketName),
+		Key:     aws.String(fileName),
+		IfMatch: aws.String(etag),
+	})
+	if err != nil {
+		log.Printf("Couldn't release reservation of %v:%v. Here's why: %v\n", bucketName, fileName, err)
+	}
+}
+
+// releaseReservations releases every reservation still held, i.e. those whose upload failed
+func (basics BucketBasics) releaseReservations(bucketName string, reservations map[string]string) {
+	for fileName, etag := range reservations {
+		basics.ReleaseKey(bucketName, fileName, etag)
+	}
+}
+
+// replaceOnlyMiddleware makes multipart uploads conditional on the object still
+// having the given ETag, so an upload only replaces its own reservation
+func replaceOnlyMiddleware(etag string) func(*middleware.Stack) error {
+	return func(stack *middleware.Stack) error {
+		return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("S3UploadReplaceOnly",
+			func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+				if input, ok := in.Parameters.(*s3.CompleteMultipartUploadInput); ok {
+					input.IfMatch = aws.String(etag)
+				}
+				return next.HandleInitialize(ctx, in)
+			}), middleware.Before)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestReserveKey(t *testing.T) {
+	fake := newFakeS3(t)
+	basics := fake.basics(Config{})
+	reservation, err := basics.ReserveKey("uploads", "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, metadata, ok := fake.object("uploads", "a.txt")
+	if !ok || len(data) != 0 || metadata[reservationMetadata] != "pending" {
+		t.Fatalf("placeholder = %q %v, want a zero-byte reservation", data, metadata)
+	}
+	if reservation != etag(nil) {
+		t.Errorf("ReserveKey() = %q, want the placeholder's ETag", reservation)
+	}
+
+	// A key that is already reserved or stored can't be claimed again
+	if _, err := basics.ReserveKey("uploads", "a.txt"); !isObjectExists(err) {
+		t.Errorf("ReserveKey() of a taken key = %v, want a create-only conflict", err)
+	}
+}
+
+func TestReleaseKey(t *testing.T) {
+	tests := []struct {
+		name     string
+		replaced bool
+		kept     bool
+	}{
+		{name: "placeholder", kept: false},
+		{name: "replaced by the upload", replaced: true, kept: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := newFakeS3(t)
+			basics := fake.basics(Config{})
+			reservation, err := basics.ReserveKey("uploads", "a.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.replaced {
+				fake.put("uploads", "a.txt", []byte("the finished upload"), nil)
+			}
+			basics.ReleaseKey("uploads", "a.txt", reservation)
+			if _, _, exists := fake.object("uploads", "a.txt"); exists != test.kept {
+				t.Errorf("object exists = %v after release, want %v", exists, test.kept)
+			}
+		})
+	}
+}
+
+func TestUploadReserveKeys(t *testing.T) {
+	small := "reserved contents"
+	large := string(randomBytes(t, 6<<20))
+	tests := []struct {
+		name string
+		data string
+		// failOp fails the upload of the data itself, after the reservation succeeded
+		failOp string
+		status int
+	}{
+		{name: "reserve then complete", data: small, status: http.StatusOK},
+		{name: "reserve then complete multipart", data: large, status: http.StatusOK},
+		{name: "reserve then fail", data: small, failOp: "PutObject", status: http.StatusForbidden},
+		{name: "reserve then fail multipart", data: large, failOp: "UploadPart", status: http.StatusForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("S3_UPLOAD_CREATE_ONLY", "true")
+			t.Setenv("S3_UPLOAD_RESERVE_KEYS", "true")
+			t.Setenv("S3_UPLOAD_KEY_TEMPLATE", "{name}")
+			t.Setenv("S3_UPLOAD_MULTIPART_THRESHOLD", "1024")
+			t.Setenv("S3_UPLOAD_BREAKER_THRESHOLD", "0")
+			fake := newFakeS3(t)
+			puts := 0
+			fake.Fail = func(operation string, bucket string, key string) (int, string) {
+				if operation == "PutObject" && key == "report.txt.zst" {
+					puts++
+					if test.failOp == "PutObject" && puts > 1 {
+						return http.StatusForbidden, "AccessDenied"
+					}
+				}
+				if operation == test.failOp && operation == "UploadPart" {
+					return http.StatusForbidden, "AccessDenied"
+				}
+				return 0, ""
+			}
+
+			body, contentType := multipartBody(t, testFile{name: "report.txt", contentType: "text/plain", data: test.data})
+			response := handle(t, map[string]string{"Content-Type": contentType}, body)
+			if response.StatusCode != test.status {
+				t.Fatalf("Handler() = %d %q, want %d", response.StatusCode, response.Body, test.status)
+			}
+			bucket := fake.bucketNames()[0]
+			data, metadata, exists := fake.object(bucket, "report.txt.zst")
+			if test.failOp != "" {
+				// The placeholder of a failed upload is cleaned up
+				if exists {
+					t.Errorf("placeholder %q %v left behind after the upload failed", data, metadata)
+				}
+				if deletes := fake.count("DeleteObject"); deletes != 1 {
+					t.Errorf("DeleteObject called %d times, want 1", deletes)
+				}
+				return
+			}
+			// The upload replaced its placeholder, which is left alone afterwards
+			if !exists || len(data) == 0 || metadata[reservationMetadata] != "" {
+				t.Errorf("object = %d bytes %v, want the upload in place of the placeholder", len(data), metadata)
+			}
+			if deletes := fake.count("DeleteObject"); deletes != 0 {
+				t.Errorf("DeleteObject called %d times after a successful upload", deletes)
+			}
+			if completes := fake.count("CompleteMultipartUpload"); (completes == 1) != (len(test.data) == len(large)) {
+				t.Errorf("CompleteMultipartUpload called %d times for %d bytes", completes, len(test.data))
+			}
+		})
+	}
+}
+
+func TestUploadReserveKeysTaken(t *testing.T) {
+	t.Setenv("S3_UPLOAD_CREATE_ONLY", "true")
+	t.Setenv("S3_UPLOAD_RESERVE_KEYS", "true")
+	t.Setenv("S3_UPLOAD_KEY_TEMPLATE", "{name}")
+	fake := newFakeS3(t)
+	bucket := uploadBucketName(time.Now())
+	fake.put(bucket, "report.txt.zst", []byte("another uploader"), nil)
+
+	body, contentType := multipartBody(t, testFile{name: "report.txt", contentType: "text/plain", data: "too late"})
+	response := handle(t, map[string]string{"Content-Type": contentType}, body)
+	if response.StatusCode != http.StatusConflict {
+		t.Fatalf("Handler() = %d %q, want 409", response.StatusCode, response.Body)
+	}
+	// The key was never reserved, so the other uploader's object must survive
+	if data, _, _ := fake.object(bucket, "report.txt.zst"); string(data) != "another uploader" {
+		t.Errorf("object = %q, want the other uploader's", data)
+	}
+}
+
+func TestReserveKeysConfig(t *testing.T) {
+	if err := configError(t, map[string]string{"S3_UPLOAD_RESERVE_KEYS": "true"}); err == nil {
+		t.Error("loadConfig() accepted reservations without create-only uploads")
+	}
+	cfg := testConfig(t, map[string]string{"S3_UPLOAD_RESERVE_KEYS": "true", "S3_UPLOAD_CREATE_ONLY": "true"})
+	if !cfg.ReserveKeys {
+		t.Error("ReserveKeys = false, want true")
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// latestResponseVersion is the newest upload response shape
+const latestResponseVersion = 2
+
+// plainResponseVersion is the original plain-text response, bare of the JSON envelope
+const plainResponseVersion = 0
+
+// ErrUnsupportedVersion is returned for a response version the handler can't produce
+var ErrUnsupportedVersion = errors.New("unsupported response version")
+
+// uploadResponseV2 nests the uploaded objects under data, leaving the top level for
+// fields describing the response itself
+type uploadResponseV2 struct {
+	Version int           `json:"version"`
+	Message string        `json:"message"`
+	Data    uploadedBatch `json:"data"`
+	Timings *phaseTimings `json:"timings,omitempty"`
+}
+
+// uploadedBatch is what a v2 response reports about the stored objects
+type uploadedBatch struct {
+	Files    []uploadedFile `json:"files"`
+	Count    int            `json:"count"`
+	Manifest string         `json:"manifest,omitempty"`
+}
+
+// requestResponseVersion returns the response version a client asked for with the
+// Accept-Version header or the version query parameter, e.g. "2" or "v2", and the
+// configured default otherwise. Clients that accept JSON, or want ?debug=true
+// timings, get at least version 1 when the default is plain text.
+func requestResponseVersion(headers map[string]string, params map[string]string, cfg Config) (int, error) {
+	requested := headerValue(headers, "Accept-Version")
+	if requested == "" {
+		requested = params["version"]
+	}
+	if requested == "" {
+		if cfg.ResponseVersion == plainResponseVersion && (acceptsJSON(headers) || params["debug"] == "true") {
+			return 1, nil
+		}
+		return cfg.ResponseVersion, nil
+	}
+	version, err := strconv.Atoi(strings.TrimPrefix(strings.ToLower(strings.TrimSpace(requested)), "v"))
+	if err != nil || version < 1 || version > latestResponseVersion {
+		return 0, ErrUnsupportedVersion
+	}
+	return version, nil
+}
+
+// acceptsJSON reports whether a client's Accept header lists application/json
+func acceptsJSON(headers map[string]string) bool {
+	for _, mediaType := range strings.Split(headerValue(headers, "Accept"), ",") {
+		name, _, _ := strings.Cut(mediaType, ";")
+		if strings.EqualFold(strings.TrimSpace(name), "application/json") {
+			return true
+		}
+	}
+	return false
+}
+
+// contentType returns the Content-Type of a response of the given version
+func contentType(version int) string {
+	if version == plainResponseVersion {
+		return "text/plain; charset=utf-8"
+	}
+	return "application/json"
+}
+
+// encode renders the response in the shape of the given version. Version 0 is just
+// the message, as the handler first answered, and version 1 the original JSON shape,
+// both kept for existing clients.
+func (response uploadResponse) encode(version int) ([]byte, error) {
+	if version == plainResponseVersion {
+		return []byte(response.Message), nil
+	}
+	if version == 1 {
+		response.Version = 1
+		return json.Marshal(response)
+	}
+	return json.Marshal(uploadResponseV2{
+		Version: version,
+		Message: response.Message,
+		Data: uploadedBatch{
+			Files:    response.Files,
+			Count:    len(response.Files),
+			Manifest: response.Manifest,
+		},
+		Timings: response.Timings,
+	})
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"maps"
+	"net/http"
+	"slices"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestRequestResponseVersion(t *testing.T) {
+	tests := []struct {
+		name     string
+		headers  map[string]string
+		params   map[string]string
+		fallback int
+		want     int
+		err      error
+	}{
+		{name: "plain text default", fallback: 0, want: 0},
+		{name: "configured default", fallback: 2, want: 2},
+		{name: "accepts json", headers: map[string]string{"Accept": "text/html, application/json;q=0.9"}, want: 1},
+		{name: "accepts json with configured default", headers: map[string]string{"accept": "application/json"}, fallback: 2, want: 2},
+		{name: "debug timings", params: map[string]string{"debug": "true"}, want: 1},
+		{name: "header", headers: map[string]string{"Accept-Version": "v2"}, want: 2},
+		{name: "query", params: map[string]string{"version": "1"}, fallback: 2, want: 1},
+		{name: "header wins", headers: map[string]string{"accept-version": "2"}, params: map[string]string{"version": "1"}, want: 2},
+		{name: "too new", headers: map[string]string{"Accept-Version": "3"}, err: ErrUnsupportedVersion},
+		{name: "plain text can't be asked for", params: map[string]string{"version": "0"}, err: ErrUnsupportedVersion},
+		{name: "garbage", params: map[string]string{"version": "latest"}, err: ErrUnsupportedVersion},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			version, err := requestResponseVersion(test.headers, test.params, Config{ResponseVersion: test.fallback})
+			if !errors.Is(err, test.err) {
+				t.Fatalf("requestResponseVersion() error = %v, want %v", err, test.err)
+			}
+			if err == nil && version != test.want {
+				t.Errorf("requestResponseVersion() = %d, want %d", version, test.want)
+			}
+		})
+	}
+}
+
+func TestEncodeResponse(t *testing.T) {
+	response := uploadResponse{
+		Message: "File successfully uploaded to S3.",
+		Files:   []uploadedFile{{Bucket: "filename20240131-120000", Key: "cat.png.zst.enc", Thumbnail: "thumbnails/cat.png.zst.enc.jpg"}},
+	}
+
+	body, err := response.encode(plainResponseVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "File successfully uploaded to S3." {
+		t.Errorf("plain-text body = %q, want the bare message", body)
+	}
+	if contentType(plainResponseVersion) != "text/plain; charset=utf-8" || contentType(1) != "application/json" {
+		t.Errorf("content types = %q, %q", contentType(plainResponseVersion), contentType(1))
+	}
+
+	body, err = response.encode(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v1 uploadResponse
+	if err := json.Unmarshal(body, &v1); err != nil {
+		t.Fatal(err)
+	}
+	if v1.Version != 1 || len(v1.Files) != 1 || v1.Files[0].Thumbnail != response.Files[0].Thumbnail {
+		t.Errorf("version 1 body = %s", body)
+	}
+
+	body, err = response.encode(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v2 uploadResponseV2
+	if err := json.Unmarshal(body, &v2); err != nil {
+		t.Fatal(err)
+	}
+	if v2.Version != 2 || v2.Data.Count != 1 || v2.Data.Files[0].Key != response.Files[0].Key {
+		t.Errorf("version 2 body = %s", body)
+	}
+}
+
+func TestUploadResponseStorageClass(t *testing.T) {
+	t.Setenv("S3_UPLOAD_STORAGE_CLASS", "INTELLIGENT_TIERING")
+	t.Setenv("S3_UPLOAD_STORAGE_CLASS_MAP", "image/*=GLACIER_IR")
+	tests := []struct {
+		name    string
+		files   []testFile
+		classes []string
+		header  string
+	}{
+		{
+			name:    "single file",
+			files:   []testFile{{name: "a.png", contentType: "image/png", data: "png bytes"}},
+			classes: []string{"GLACIER_IR"},
+			header:  "GLACIER_IR",
+		},
+		{
+			name: "shared class",
+			files: []testFile{
+				{name: "a.txt", contentType: "text/plain", data: "a"},
+				{name: "b.csv", contentType: "text/csv", data: "b"},
+			},
+			classes: []string{"INTELLIGENT_TIERING", "INTELLIGENT_TIERING"},
+			header:  "INTELLIGENT_TIERING",
+		},
+		{
+			name: "mixed classes",
+			files: []testFile{
+				{name: "a.txt", contentType: "text/plain", data: "a"},
+				{name: "b.png", contentType: "image/png", data: "b"},
+			},
+			classes: []string{"INTELLIGENT_TIERING", "GLACIER_IR"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			newFakeS3(t)
+			body, contentType := multipartBody(t, test.files...)
+			response := upload(t, map[string]string{"Content-Type": contentType, "Accept": "application/json"}, body)
+			files := uploadedFiles(t, response)
+			if len(files) != len(test.classes) {
+				t.Fatalf("response lists %d files, want %d", len(files), len(test.classes))
+			}
+			for i, file := range files {
+				if file.StorageClass != test.classes[i] {
+					t.Errorf("file %d storageClass = %q, want %q", i, file.StorageClass, test.classes[i])
+				}
+			}
+			if got := response.Headers["X-Amz-Storage-Class"]; got != test.header {
+				t.Errorf("X-Amz-Storage-Class = %q, want %q", got, test.header)
+			}
+		})
+	}
+}
+
+func TestUploadResponseVersions(t *testing.T) {
+	t.Setenv("S3_UPLOAD_KEY_TEMPLATE", "{name}")
+	tests := []struct {
+		name        string
+		headers     map[string]string
+		params      map[string]string
+		status      int
+		version     string
+		contentType string
+		keys        []string
+	}{
+		{name: "plain text", status: http.StatusOK, contentType: "text/plain; charset=utf-8"},
+		{name: "v1 header", headers: map[string]string{"Accept-Version": "1"}, status: http.StatusOK, version: "1", contentType: "application/json",
+			keys: []string{"files", "message", "version"}},
+		{name: "v2 header", headers: map[string]string{"Accept-Version": "v2"}, status: http.StatusOK, version: "2", contentType: "application/json",
+			keys: []string{"data", "message", "version"}},
+		{name: "v2 query", params: map[string]string{"version": "2"}, status: http.StatusOK, version: "2", contentType: "application/json",
+			keys: []string{"data", "message", "version"}},
+		{name: "unsupported", headers: map[string]string{"Accept-Version": "9"}, status: http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := newFakeS3(t)
+			body, contentType := multipartBody(t, testFile{name: "a.txt", contentType: "text/plain", data: "first"}, testFile{name: "b.txt", contentType: "text/plain", data: "second"})
+			headers := map[string]string{"Content-Type": contentType}
+			maps.Copy(headers, test.headers)
+			response, err := Handler(t.Context(), events.APIGatewayProxyRequest{HTTPMethod: "POST", Headers: headers, QueryStringParameters: test.params, Body: body})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response.StatusCode != test.status {
+				t.Fatalf("Handler() = %d %q, want %d", response.StatusCode, response.Body, test.status)
+			}
+			if test.status != http.StatusOK {
+				// The version is checked before anything is stored
+				if puts := fake.count("PutObject"); puts != 0 {
+					t.Errorf("PutObject called %d times for an unsupported version", puts)
+				}
+				return
+			}
+			if response.Headers["Content-Type"] != test.contentType || response.Headers["Content-Version"] != test.version {
+				t.Errorf("headers = %v, want Content-Type %q and Content-Version %q", response.Headers, test.contentType, test.version)
+			}
+			if test.keys == nil {
+				if response.Body != "2 files successfully uploaded to S3." {
+					t.Errorf("plain-text body = %q", response.Body)
+				}
+				return
+			}
+
+			// Each version keeps its own top-level shape
+			var fields map[string]json.RawMessage
+			if err := json.Unmarshal([]byte(response.Body), &fields); err != nil {
+				t.Fatalf("response %q isn't JSON: %v", response.Body, err)
+			}
+			if keys := slices.Sorted(maps.Keys(fields)); !slices.Equal(keys, test.keys) {
+				t.Errorf("top-level fields = %v, want %v", keys, test.keys)
+			}
+			if string(fields["version"]) != test.version {
+				t.Errorf("version = %s, want %s", fields["version"], test.version)
+			}
+			var files []uploadedFile
+			if test.version == "1" {
+				files = uploadedFiles(t, response)
+			} else {
+				var v2 uploadResponseV2
+				if err := json.Unmarshal([]byte(response.Body), &v2); err != nil {
+					t.Fatal(err)
+				}
+				if v2.Data.Count != 2 {
+					t.Errorf("data.count = %d, want 2", v2.Data.Count)
+				}
+				files = v2.Data.Files
+			}
+			if len(files) != 2 || files[0].Key != "a.txt.zst" || files[1].Key != "b.txt.zst" {
+				t.Errorf("files = %+v", files)
+			}
+		})
+	}
+}
+
+func TestResponseVersionConfig(t *testing.T) {
+	for value, want := range map[string]int{"": plainResponseVersion, "1": 1, "2": 2} {
+		if cfg := testConfig(t, map[string]string{"S3_UPLOAD_RESPONSE_VERSION": value}); cfg.ResponseVersion != want {
+			t.Errorf("ResponseVersion for %q = %d, want %d", value, cfg.ResponseVersion, want)
+		}
+	}
+	for _, value := range []string{"-1", "3", "v2"} {
+		if err := configError(t, map[string]string{"S3_UPLOAD_RESPONSE_VERSION": value}); err == nil {
+			t.Errorf("loadConfig() accepted response version %q", value)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// uploadResults remembers the responses to recent uploads handled by this warm
+// Lambda container, so a retried request gets the same answer without uploading again
+var uploadResults = newResultCache()
+
+// resultEntry is the response an upload request was answered with
+type resultEntry struct {
+	key      string
+	response events.APIGatewayProxyResponse
+	storedAt time.Time
+}
+
+// resultCache is an LRU of upload responses keyed by resultCacheKey
+type resultCache struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+func newResultCache() *resultCache {
+	return &resultCache{entries: make(map[string]*list.Element), order: list.New()}
+}
+
+// lookup returns the response stored for key, if it was stored within ttl
+func (c *resultCache) lookup(key string, ttl time.Duration, now time.Time) (events.APIGatewayProxyResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return events.APIGatewayProxyResponse{}, false
+	}
+	entry := element.Value.(*resultEntry)
+	if now.Sub(entry.storedAt) > ttl {
+		c.order.Remove(element)
+		delete(c.entries, key)
+		return events.APIGatewayProxyResponse{}, false
+	}
+	c.order.MoveToFront(element)
+
+	// Callers may set headers on the response they get back
+	response := entry.response
+	response.Headers = make(map[string]string, len(entry.response.Headers))
+	for name, value := range entry.response.Headers {
+		response.Headers[name] = value
+	}
+	return response, true
+}
+
+// add stores a response, evicting the least recently used entries beyond maxEntries
+func (c *resultCache) add(key string, response events.APIGatewayProxyResponse, maxEntries int, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		c.order.Remove(element)
+	}
+	c.entries[key] = c.order.PushFront(&resultEntry{key: key, response: response, storedAt: now})
+	for c.order.Len() > maxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*resultEntry).key)
+	}
+}
+
+// resultCacheHeaders are the headers besides X-Upload-* that change how an upload is
+// stored or answered, so requests differing in them mustn't share a cached result
+var resultCacheHeaders = []string{"accept", "accept-version", "content-encoding", "content-type", "x-compression-level"}
+
+// resultCacheKey identifies an upload request for result caching: by its
+// Idempotency-Key header when the client sent one, and otherwise by its body and
+// query parameters. Either way the key covers the caller and the headers that shape
+// the upload, so one client's key can't replay another's result, nor a retry with
+// different metadata or encryption get the earlier request's answer.
+func resultCacheKey(request events.APIGatewayProxyRequest) string {
+	hash := sha256.New()
+	if principal := requestPrincipal(request); principal != "" {
+		hash.Write([]byte("principal:" + principal + "\x00"))
+	} else {
+		hash.Write([]byte("source:" + request.RequestContext.Identity.SourceIP + "\x00"))
+	}
+
+	headers := make(map[string]string)
+	for name, value := range request.Headers {
+		name = strings.ToLower(name)
+		shaping := strings.HasPrefix(name, "x-upload-") && name != "x-upload-signature" && name != "x-upload-timestamp"
+		for _, header := range resultCacheHeaders {
+			shaping = shaping || name == header
+		}
+		if shaping {
+			headers[name] = value
+		}
+	}
+	writeSorted(hash, headers)
+
+	if key := headerValue(request.Headers, "Idempotency-Key"); key != "" {
+		hash.Write([]byte("idempotency:" + key))
+		return "idempotency:" + hex.EncodeToString(hash.Sum(nil))
+	}
+	writeSorted(hash, request.QueryStringParameters)
+	// The same text stores different bytes raw and base64-decoded
+	hash.Write([]byte("base64:" + strconv.FormatBool(request.IsBase64Encoded) + "\x00"))
+	hash.Write([]byte(request.Body))
+	return "content:" + hex.EncodeToString(hash.Sum(nil))
+}
+
+// writeSorted writes a map's entries to w as name=value, in name order
+func writeSorted(w io.Writer, values map[string]string) {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		io.WriteString(w, name+"="+values[name]+"\x00")
+	}
+	io.WriteString(w, "\x00")
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// cacheRequest returns an upload by principal with the given extra headers
+func cacheRequest(principal string, headers map[string]string) events.APIGatewayProxyRequest {
+	request := events.APIGatewayProxyRequest{
+		HTTPMethod:            "POST",
+		Headers:               map[string]string{"Content-Type": "text/plain"},
+		QueryStringParameters: map[string]string{"fileName": "a.txt"},
+		Body:                  "hello",
+	}
+	if principal != "" {
+		request.RequestContext.Authorizer = map[string]interface{}{"principalId": principal}
+	}
+	for name, value := range headers {
+		request.Headers[name] = value
+	}
+	return request
+}
+
+func TestResultCacheKey(t *testing.T) {
+	base := resultCacheKey(cacheRequest("alice", nil))
+	tests := []struct {
+		name    string
+		request events.APIGatewayProxyRequest
+		same    bool
+	}{
+		{name: "identical", request: cacheRequest("alice", nil), same: true},
+		{name: "header name case", request: func() events.APIGatewayProxyRequest {
+			request := cacheRequest("alice", nil)
+			request.Headers = map[string]string{"content-type": "text/plain"}
+			return request
+		}(), same: true},
+		{name: "new signature", request: cacheRequest("alice", map[string]string{"X-Upload-Signature": "00", "X-Upload-Timestamp": "1"}), same: true},
+		{name: "other principal", request: cacheRequest("mallory", nil)},
+		{name: "anonymous", request: cacheRequest("", nil)},
+		{name: "content type", request: cacheRequest("alice", map[string]string{"Content-Type": "application/json"})},
+		{name: "content encoding", request: cacheRequest("alice", map[string]string{"Content-Encoding": "gzip"})},
+		{name: "metadata", request: cacheRequest("alice", map[string]string{"X-Upload-Meta-Owner": "billing"})},
+		{name: "compression level", request: cacheRequest("alice", map[string]string{"X-Compression-Level": "best"})},
+		{name: "encryption", request: cacheRequest("alice", map[string]string{"X-Upload-Encryption": "none"})},
+		{name: "response version", request: cacheRequest("alice", map[string]string{"Accept-Version": "2"})},
+		{name: "body", request: func() events.APIGatewayProxyRequest {
+			request := cacheRequest("alice", nil)
+			request.Body = "goodbye"
+			return request
+		}()},
+		{name: "base64 body", request: func() events.APIGatewayProxyRequest {
+			request := cacheRequest("alice", nil)
+			request.IsBase64Encoded = true
+			return request
+		}()},
+		{name: "query", request: func() events.APIGatewayProxyRequest {
+			request := cacheRequest("alice", nil)
+			request.QueryStringParameters["fileName"] = "b.txt"
+			return request
+		}()},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if same := resultCacheKey(test.request) == base; same != test.same {
+				t.Errorf("key matches the base request's = %v, want %v", same, test.same)
+			}
+		})
+	}
+}
+
+func TestResultCacheKeyIdempotency(t *testing.T) {
+	first := cacheRequest("alice", map[string]string{"Idempotency-Key": "order-1"})
+	retry := cacheRequest("alice", map[string]string{"Idempotency-Key": "order-1"})
+	retry.QueryStringParameters["attempt"] = "2"
+	if resultCacheKey(first) != resultCacheKey(retry) {
+		t.Error("retry under the same Idempotency-Key got a different key")
+	}
+	for name, request := range map[string]events.APIGatewayProxyRequest{
+		"other caller":   cacheRequest("mallory", map[string]string{"Idempotency-Key": "order-1"}),
+		"other key":      cacheRequest("alice", map[string]string{"Idempotency-Key": "order-2"}),
+		"other metadata": cacheRequest("alice", map[string]string{"Idempotency-Key": "order-1", "X-Upload-Meta-Owner": "x"}),
+	} {
+		if resultCacheKey(request) == resultCacheKey(first) {
+			t.Errorf("%s shares the Idempotency-Key's cached result", name)
+		}
+	}
+}
+
+func TestResultCacheTTLAndEviction(t *testing.T) {
+	cache := newResultCache()
+	now := time.Now()
+	response := events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Headers: map[string]string{"A": "1"}, Body: "stored"}
+	cache.add("a", response, 2, now)
+
+	tests := []struct {
+		name  string
+		after time.Duration
+		found bool
+	}{
+		{name: "within ttl", after: 30 * time.Second, found: true},
+		{name: "at ttl", after: time.Minute, found: true},
+		{name: "past ttl", after: time.Minute + time.Nanosecond, found: false},
+		{name: "expired entries are dropped", after: 0, found: false},
+	}
+	for _, test := range tests {
+		got, ok := cache.lookup("a", time.Minute, now.Add(test.after))
+		if ok != test.found {
+			t.Fatalf("%s: lookup() found = %v, want %v", test.name, ok, test.found)
+		}
+		if ok && got.Body != "stored" {
+			t.Errorf("%s: lookup() = %+v", test.name, got)
+		}
+	}
+
+	cache.add("a", response, 2, now)
+	cache.add("b", response, 2, now)
+	cache.lookup("a", time.Minute, now)
+	cache.add("c", response, 2, now)
+	if _, ok := cache.lookup("b", time.Minute, now); ok {
+		t.Error("least recently used entry survived eviction")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok := cache.lookup(key, time.Minute, now); !ok {
+			t.Errorf("entry %q was evicted", key)
+		}
+	}
+
+	replayed, _ := cache.lookup("a", time.Minute, now)
+	replayed.Headers["Idempotent-Replayed"] = "true"
+	if again, _ := cache.lookup("a", time.Minute, now); again.Headers["Idempotent-Replayed"] != "" {
+		t.Error("header set on a replay leaked into the cached response")
+	}
+}
+
+func TestResultCacheReplaysOnlyAfterAuthorization(t *testing.T) {
+	t.Setenv("S3_UPLOAD_RESULT_CACHE_TTL", "1m")
+	t.Setenv("S3_UPLOAD_TRUST_SECRET", "shared-secret")
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A stale signature was once accepted and its result cached
+	request := cacheRequest("alice", map[string]string{
+		"X-Upload-Encryption": "none",
+		"X-Upload-Timestamp":  strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10),
+		"X-Upload-Signature":  "00",
+	})
+	uploadResults.add(resultCacheKey(request), events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Headers:    map[string]string{},
+		Body:       "File successfully uploaded to S3.",
+	}, cfg.ResultCacheMaxEntries, time.Now())
+	t.Cleanup(func() { uploadResults = newResultCache() })
+
+	response, err := Handler(t.Context(), request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusForbidden || response.Headers["Idempotent-Replayed"] != "" {
+		t.Errorf("Handler() = %d %v, want the untrusted request refused rather than replayed", response.StatusCode, response.Headers)
+	}
+}
+
+func TestResultCacheReplaysRetries(t *testing.T) {
+	t.Setenv("S3_UPLOAD_RESULT_CACHE_TTL", "1m")
+	t.Cleanup(func() { uploadResults = newResultCache() })
+
+	request := cacheRequest("alice", map[string]string{"Idempotency-Key": "order-1"})
+	uploadResults.add(resultCacheKey(request), events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Headers:    map[string]string{},
+		Body:       "File successfully uploaded to S3.",
+	}, 10, time.Now())
+
+	response, err := Handler(t.Context(), request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Body != "File successfully uploaded to S3." || response.Headers["Idempotent-Replayed"] != "true" {
+		t.Errorf("Handler() = %d %q %v, want the cached result replayed", response.StatusCode, response.Body, response.Headers)
+	}
+}
+
+func TestResultCacheSeparatesBase64Bodies(t *testing.T) {
+	t.Setenv("S3_UPLOAD_RESULT_CACHE_TTL", "1m")
+	// Unnamed bodies get distinct keys rather than both taking the timestamped name
+	t.Setenv("S3_UPLOAD_KEY_TEMPLATE", "{name}")
+	t.Cleanup(func() { uploadResults = newResultCache() })
+	fake := newFakeS3(t)
+
+	raw := cacheRequest("alice", nil)
+	raw.Body = "aGVsbG8="
+	encoded := raw
+	encoded.IsBase64Encoded = true
+	for _, request := range []events.APIGatewayProxyRequest{raw, encoded} {
+		response, err := Handler(t.Context(), request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.StatusCode != http.StatusOK || response.Headers["Idempotent-Replayed"] == "true" {
+			t.Fatalf("Handler() = %d %q %v, want a fresh upload", response.StatusCode, response.Body, response.Headers)
+		}
+	}
+	// Each body was stored as its own bytes
+	bucket := fake.bucketNames()[0]
+	stored := map[string]bool{}
+	for _, key := range fake.keys(bucket) {
+		data, metadata, _ := fake.object(bucket, key)
+		plain, err := decodeObject(data, metadata)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored[string(plain)] = true
+	}
+	if len(stored) != 2 || !stored["aGVsbG8="] || !stored["hello"] {
+		t.Errorf("stored %v, want both the raw and the decoded body", stored)
+	}
+}
@@ -0,0 +1,619 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// fakeS3 is an in-memory S3 that clients reach through the SDK's HTTPClient
+// interface, so the real request serialization and response parsing are exercised
+// without a network
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string]*fakeObject
+	buckets map[string]http.Header
+	uploads map[string]*fakeUpload
+	calls   []string
+	nextID  int
+
+	// Fail, when set, is consulted before every operation; a non-zero status fails
+	// the operation with that status and S3 error code
+	Fail func(operation string, bucket string, key string) (int, string)
+	// Before, when set, runs before every operation with the lock released
+	Before func(operation string, bucket string, key string)
+}
+
+// fakeObject is a stored object with the headers it was put with
+type fakeObject struct {
+	data     []byte
+	header   http.Header
+	etag     string
+	modified time.Time
+}
+
+// fakeUpload is a multipart upload in progress
+type fakeUpload struct {
+	bucket, key string
+	header      http.Header
+	parts       map[int][]byte
+}
+
+// newFakeS3 returns an empty fake and makes every client created by the test use it
+func newFakeS3(t *testing.T) *fakeS3 {
+	t.Helper()
+	fake := &fakeS3{
+		objects: make(map[string]*fakeObject),
+		buckets: make(map[string]http.Header),
+		uploads: make(map[string]*fakeUpload),
+	}
+	previous := loadDefaultConfig
+	loadDefaultConfig = func(ctx context.Context, optFns ...func(*config.LoadOptions) error) (aws.Config, error) {
+		return fake.config(), nil
+	}
+	t.Cleanup(func() { loadDefaultConfig = previous })
+	return fake
+}
+
+// config returns an AWS configuration whose clients talk to the fake
+func (f *fakeS3) config() aws.Config {
+	return aws.Config{
+		Region:      "ap-south-1",
+		Credentials: credentials.NewStaticCredentialsProvider("AKIDUNITTEST", "unit-test-secret", ""),
+		HTTPClient:  f,
+		Retryer:     func() aws.Retryer { return aws.NopRetryer{} },
+	}
+}
+
+// client returns an S3 client backed by the fake
+func (f *fakeS3) client() *s3.Client {
+	return s3.NewFromConfig(f.config())
+}
+
+// basics returns BucketBasics backed by the fake
+func (f *fakeS3) basics(cfg Config) BucketBasics {
+	return BucketBasics{S3Client: f.client(), Config: cfg}
+}
+
+// put stores an object directly, as if another tool had written it
+func (f *fakeS3) put(bucket string, key string, data []byte, header http.Header) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if header == nil {
+		header = http.Header{}
+	}
+	f.objects[bucket+"/"+key] = &fakeObject{data: data, header: header, etag: etag(data), modified: time.Now()}
+}
+
+// object returns a stored object's data and metadata
+func (f *fakeS3) object(bucket string, key string) ([]byte, map[string]string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	object, ok := f.objects[bucket+"/"+key]
+	if !ok {
+		return nil, nil, false
+	}
+	return object.data, objectMetadata(object.header), true
+}
+
+// header returns the headers a stored object was put with
+func (f *fakeS3) header(bucket string, key string) http.Header {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if object, ok := f.objects[bucket+"/"+key]; ok {
+		return object.header
+	}
+	return nil
+}
+
+// keys returns the keys stored in a bucket, sorted
+func (f *fakeS3) keys(bucket string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var keys []string
+	for name := range f.objects {
+		if key, ok := strings.CutPrefix(name, bucket+"/"); ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// bucketNames returns the buckets created, sorted
+func (f *fakeS3) bucketNames() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var names []string
+	for name := range f.buckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// count returns how many times an operation was called
+func (f *fakeS3) count(operation string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, call := range f.calls {
+		if call == operation {
+			n++
+		}
+	}
+	return n
+}
+
+// objectMetadata returns the user metadata among an object's headers
+func objectMetadata(header http.Header) map[string]string {
+	metadata := make(map[string]string)
+	for name, values := range header {
+		if key, ok := strings.CutPrefix(strings.ToLower(name), "x-amz-meta-"); ok {
+			metadata[key] = values[0]
+		}
+	}
+	return metadata
+}
+
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// Do serves one SDK request
+func (f *fakeS3) Do(request *http.Request) (*http.Response, error) {
+	bucket, key := f.target(request)
+	query := request.URL.Query()
+	operation := operationName(request.Method, bucket, key, query, request.Header)
+
+	body, trailer, err := readBody(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.Before != nil {
+		f.Before(operation, bucket, key)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, operation)
+	if f.Fail != nil {
+		if status, code := f.Fail(operation, bucket, key); status != 0 {
+			return errorResponse(request, status, code), nil
+		}
+	}
+	return f.serve(request, operation, bucket, key, query, body, trailer), nil
+}
+
+// target returns the bucket and key a request addresses, virtual-hosted or path style
+func (f *fakeS3) target(request *http.Request) (string, string) {
+	path := strings.TrimPrefix(request.URL.EscapedPath(), "/")
+	host := request.URL.Hostname()
+	if bucket, _, ok := strings.Cut(host, ".s3"); ok && !strings.HasPrefix(host, "s3.") {
+		key, _ := url.PathUnescape(path)
+		return bucket, key
+	}
+	bucket, key, _ := strings.Cut(path, "/")
+	bucket, _ = url.PathUnescape(bucket)
+	key, _ = url.PathUnescape(key)
+	return bucket, key
+}
+
+// operationName names the S3 API operation of a request
+func operationName(method string, bucket string, key string, query url.Values, header http.Header) string {
+	if key == "" {
+		for _, sub := range []string{"policy", "versioning", "replication", "ownershipControls", "object-lock", "tagging"} {
+			if _, ok := query[sub]; ok && method == http.MethodPut {
+				return "PutBucket:" + sub
+			}
+		}
+		switch method {
+		case http.MethodPut:
+			return "CreateBucket"
+		case http.MethodHead:
+			return "HeadBucket"
+		case http.MethodGet:
+			return "ListObjectsV2"
+		}
+		return method + "Bucket"
+	}
+	_, uploads := query["uploads"]
+	uploadID := query.Get("uploadId")
+	switch {
+	case method == http.MethodPost && uploads:
+		return "CreateMultipartUpload"
+	case method == http.MethodPut && uploadID != "":
+		return "UploadPart"
+	case method == http.MethodPost && uploadID != "":
+		return "CompleteMultipartUpload"
+	case method == http.MethodDelete && uploadID != "":
+		return "AbortMultipartUpload"
+	case method == http.MethodPut && header.Get("X-Amz-Copy-Source") != "":
+		return "CopyObject"
+	case method == http.MethodPut:
+		return "PutObject"
+	case method == http.MethodGet:
+		return "GetObject"
+	case method == http.MethodHead:
+		return "HeadObject"
+	case method == http.MethodDelete:
+		return "DeleteObject"
+	}
+	return method + "Object"
+}
+
+// readBody returns a request body, decoding the aws-chunked encoding the SDK uses to
+// send trailing checksums
+func readBody(request *http.Request) ([]byte, http.Header, error) {
+	if request.Body == nil {
+		return nil, nil, nil
+	}
+	data, err := io.ReadAll(request.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !strings.Contains(request.Header.Get("Content-Encoding"), "aws-chunked") {
+		return data, nil, nil
+	}
+
+	reader := bufio.NewReader(bytes.NewReader(data))
+	var decoded bytes.Buffer
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, nil, fmt.Errorf("aws-chunked body: %v", err)
+		}
+		sizeField, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		size, err := strconv.ParseInt(sizeField, 16, 64)
+		if err != nil {
+			return nil, nil, fmt.Errorf("aws-chunked size %q: %v", line, err)
+		}
+		if size == 0 {
+			break
+		}
+		if _, err := io.CopyN(&decoded, reader, size); err != nil {
+			return nil, nil, err
+		}
+		reader.ReadString('\n')
+	}
+	trailer := http.Header{}
+	for {
+		line, err := reader.ReadString('\n')
+		line = strings.TrimSpace(line)
+		if line == "" || err != nil {
+			break
+		}
+		if name, value, ok := strings.Cut(line, ":"); ok {
+			trailer.Set(name, strings.TrimSpace(value))
+		}
+	}
+	return decoded.Bytes(), trailer, nil
+}
+
+// storedHeaders are the request headers an object keeps and returns on reads
+var storedHeaders = []string{
+	"Content-Type", "Content-Encoding", "Content-Disposition", "Content-Language", "Cache-Control",
+	"X-Amz-Storage-Class", "X-Amz-Tagging", "X-Amz-Checksum-Sha256",
+	"X-Amz-Server-Side-Encryption", "X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id",
+	"X-Amz-Server-Side-Encryption-Bucket-Key-Enabled",
+}
+
+// requestOnlyHeaders are the stored headers a copy takes from its own request
+// rather than from the source object
+var requestOnlyHeaders = []string{
+	"X-Amz-Storage-Class", "X-Amz-Server-Side-Encryption", "X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id",
+	"X-Amz-Server-Side-Encryption-Bucket-Key-Enabled",
+}
+
+// keptHeaders returns the headers of a put an object keeps
+func keptHeaders(request *http.Request, trailer http.Header) http.Header {
+	header := http.Header{}
+	for name, values := range request.Header {
+		if strings.HasPrefix(strings.ToLower(name), "x-amz-meta-") {
+			header[name] = values
+		}
+	}
+	for _, name := range storedHeaders {
+		if value := request.Header.Get(name); value != "" {
+			header.Set(name, value)
+		}
+		if value := trailer.Get(name); value != "" {
+			header.Set(name, value)
+		}
+	}
+	if encoding := header.Get("Content-Encoding"); encoding != "" {
+		// aws-chunked only describes the request, not the stored object
+		var codings []string
+		for _, coding := range strings.Split(encoding, ",") {
+			if coding = strings.TrimSpace(coding); coding != "aws-chunked" && coding != "" {
+				codings = append(codings, coding)
+			}
+		}
+		header.Del("Content-Encoding")
+		if len(codings) > 0 {
+			header.Set("Content-Encoding", strings.Join(codings, ","))
+		}
+	}
+	return header
+}
+
+func (f *fakeS3) serve(request *http.Request, operation string, bucket string, key string, query url.Values, body []byte, trailer http.Header) *http.Response {
+	name := bucket + "/" + key
+	switch operation {
+	case "CreateBucket":
+		if _, ok := f.buckets[bucket]; ok {
+			return errorResponse(request, http.StatusConflict, "BucketAlreadyOwnedByYou")
+		}
+		f.buckets[bucket] = http.Header{}
+		if enabled := request.Header.Get("X-Amz-Bucket-Object-Lock-Enabled"); enabled != "" {
+			f.buckets[bucket].Set("objectLockEnabled", enabled)
+		}
+		return response(request, http.StatusOK, nil, nil)
+
+	case "HeadBucket":
+		if _, ok := f.buckets[bucket]; !ok {
+			return response(request, http.StatusNotFound, nil, nil)
+		}
+		return response(request, http.StatusOK, nil, nil)
+
+	case "ListObjectsV2":
+		type content struct {
+			Key  string
+			Size int
+			ETag string
+		}
+		result := struct {
+			XMLName     xml.Name `xml:"ListBucketResult"`
+			Name        string
+			Prefix      string
+			KeyCount    int
+			IsTruncated bool
+			Contents    []content
+		}{Name: bucket, Prefix: query.Get("prefix")}
+		var keys []string
+		for stored := range f.objects {
+			if k, ok := strings.CutPrefix(stored, bucket+"/"); ok && strings.HasPrefix(k, result.Prefix) {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			object := f.objects[bucket+"/"+k]
+			result.Contents = append(result.Contents, content{Key: k, Size: len(object.data), ETag: object.etag})
+		}
+		result.KeyCount = len(result.Contents)
+		return xmlResponse(request, result)
+
+	case "PutObject":
+		existing, exists := f.objects[name]
+		if request.Header.Get("If-None-Match") == "*" && exists {
+			return errorResponse(request, http.StatusPreconditionFailed, "PreconditionFailed")
+		}
+		if match := request.Header.Get("If-Match"); match != "" && (!exists || existing.etag != match) {
+			return errorResponse(request, http.StatusPreconditionFailed, "PreconditionFailed")
+		}
+		object := &fakeObject{data: body, header: keptHeaders(request, trailer), etag: etag(body), modified: time.Now()}
+		f.objects[name] = object
+		return response(request, http.StatusOK, http.Header{"Etag": {object.etag}}, nil)
+
+	case "CopyObject":
+		source, _ := url.PathUnescape(strings.TrimPrefix(request.Header.Get("X-Amz-Copy-Source"), "/"))
+		original, ok := f.objects[source]
+		if !ok {
+			return errorResponse(request, http.StatusNotFound, "NoSuchKey")
+		}
+		header := original.header.Clone()
+		if request.Header.Get("X-Amz-Metadata-Directive") == "REPLACE" {
+			header = keptHeaders(request, nil)
+		}
+		// Like S3, a copy only gets the storage class and encryption its request asks for
+		for _, name := range requestOnlyHeaders {
+			header.Del(name)
+			if value := request.Header.Get(name); value != "" {
+				header.Set(name, value)
+			}
+		}
+		header.Del("X-Amz-Checksum-Sha256")
+		if request.Header.Get("X-Amz-Checksum-Algorithm") != "" {
+			header.Set("X-Amz-Checksum-Sha256", sha256Checksum(original.data))
+		}
+		object := &fakeObject{data: append([]byte{}, original.data...), header: header, etag: original.etag, modified: time.Now()}
+		f.objects[name] = object
+		return xmlResponse(request, struct {
+			XMLName xml.Name `xml:"CopyObjectResult"`
+			ETag    string
+		}{ETag: object.etag})
+
+	case "GetObject", "HeadObject":
+		object, ok := f.objects[name]
+		if !ok {
+			if operation == "HeadObject" {
+				return response(request, http.StatusNotFound, nil, nil)
+			}
+			return errorResponse(request, http.StatusNotFound, "NoSuchKey")
+		}
+		header := object.header.Clone()
+		if !strings.EqualFold(request.Header.Get("X-Amz-Checksum-Mode"), "ENABLED") {
+			header.Del("X-Amz-Checksum-Sha256")
+		}
+		header.Set("Etag", object.etag)
+		header.Set("Content-Length", strconv.Itoa(len(object.data)))
+		header.Set("Last-Modified", object.modified.UTC().Format(http.TimeFormat))
+		if operation == "HeadObject" {
+			return response(request, http.StatusOK, header, nil)
+		}
+		return response(request, http.StatusOK, header, object.data)
+
+	case "DeleteObject":
+		if match := request.Header.Get("If-Match"); match != "" && (f.objects[name] == nil || f.objects[name].etag != match) {
+			return errorResponse(request, http.StatusPreconditionFailed, "PreconditionFailed")
+		}
+		delete(f.objects, name)
+		return response(request, http.StatusNoContent, nil, nil)
+
+	case "CreateMultipartUpload":
+		f.nextID++
+		id := fmt.Sprintf("upload-%d", f.nextID)
+		f.uploads[id] = &fakeUpload{bucket: bucket, key: key, header: keptHeaders(request, nil), parts: make(map[int][]byte)}
+		return xmlResponse(request, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadId string
+		}{Bucket: bucket, Key: key, UploadId: id})
+
+	case "UploadPart":
+		upload, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			return errorResponse(request, http.StatusNotFound, "NoSuchUpload")
+		}
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		upload.parts[number] = body
+		header := http.Header{"Etag": {etag(body)}}
+		for _, name := range []string{"X-Amz-Checksum-Sha256"} {
+			if value := request.Header.Get(name); value != "" {
+				header.Set(name, value)
+			} else if value := trailer.Get(name); value != "" {
+				header.Set(name, value)
+			}
+		}
+		return response(request, http.StatusOK, header, nil)
+
+	case "CompleteMultipartUpload":
+		id := query.Get("uploadId")
+		upload, ok := f.uploads[id]
+		if !ok {
+			return errorResponse(request, http.StatusNotFound, "NoSuchUpload")
+		}
+		delete(f.uploads, id)
+		if request.Header.Get("If-None-Match") == "*" && f.objects[name] != nil {
+			return errorResponse(request, http.StatusPreconditionFailed, "PreconditionFailed")
+		}
+		if match := request.Header.Get("If-Match"); match != "" && (f.objects[name] == nil || f.objects[name].etag != match) {
+			return errorResponse(request, http.StatusPreconditionFailed, "PreconditionFailed")
+		}
+		numbers := make([]int, 0, len(upload.parts))
+		for number := range upload.parts {
+			numbers = append(numbers, number)
+		}
+		sort.Ints(numbers)
+		var data []byte
+		for _, number := range numbers {
+			data = append(data, upload.parts[number]...)
+		}
+		object := &fakeObject{data: data, header: upload.header, etag: fmt.Sprintf(`"%s-%d"`, strings.Trim(etag(data), `"`), len(numbers)), modified: time.Now()}
+		f.objects[name] = object
+		return xmlResponse(request, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Bucket  string
+			Key     string
+			ETag    string
+		}{Bucket: bucket, Key: key, ETag: object.etag})
+
+	case "AbortMultipartUpload":
+		delete(f.uploads, query.Get("uploadId"))
+		return response(request, http.StatusNoContent, nil, nil)
+	}
+
+	if strings.HasPrefix(operation, "PutBucket:") {
+		if header, ok := f.buckets[bucket]; ok {
+			header.Set(strings.TrimPrefix(operation, "PutBucket:"), string(body))
+		}
+		return response(request, http.StatusOK, nil, nil)
+	}
+	return errorResponse(request, http.StatusNotImplemented, "NotImplemented")
+}
+
+// bucketConfig returns the body of a bucket configuration call such as "policy"
+func (f *fakeS3) bucketConfig(bucket string, sub string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if header, ok := f.buckets[bucket]; ok {
+		return header.Get(sub)
+	}
+	return ""
+}
+
+func response(request *http.Request, status int, header http.Header, body []byte) *http.Response {
+	if header == nil {
+		header = http.Header{}
+	}
+	return &http.Response{
+		StatusCode:    status,
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       request,
+	}
+}
+
+func xmlResponse(request *http.Request, value interface{}) *http.Response {
+	body, err := xml.Marshal(value)
+	if err != nil {
+		panic(err)
+	}
+	return response(request, http.StatusOK, http.Header{"Content-Type": {"application/xml"}}, body)
+}
+
+// errorResponse returns an S3 error. HEAD responses carry no body, so their code
+// only shows through the status.
+func errorResponse(request *http.Request, status int, code string) *http.Response {
+	if request.Method == http.MethodHead {
+		return response(request, status, nil, nil)
+	}
+	body := fmt.Sprintf("<Error><Code>%s</Code><Message>%s</Message><RequestId>fake</RequestId></Error>", code, code)
+	return response(request, status, http.Header{"Content-Type": {"application/xml"}}, []byte(body))
+}
+
+// handle sends a single-file upload through Handler
+func handle(t *testing.T, headers map[string]string, body string) events.APIGatewayProxyResponse {
+	t.Helper()
+	response, err := Handler(t.Context(), events.APIGatewayProxyRequest{HTTPMethod: "POST", Headers: headers, Body: body})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+// upload sends a single-file upload through Handler and fails the test unless it succeeds
+func upload(t *testing.T, headers map[string]string, body string) events.APIGatewayProxyResponse {
+	t.Helper()
+	response := handle(t, headers, body)
+	if response.StatusCode != http.StatusOK && response.StatusCode != http.StatusCreated {
+		t.Fatalf("Handler() = %d %q", response.StatusCode, response.Body)
+	}
+	return response
+}
+
+// uploadedFiles returns the files listed in a JSON upload response
+func uploadedFiles(t *testing.T, response events.APIGatewayProxyResponse) []uploadedFile {
+	t.Helper()
+	var body uploadResponse
+	if err := json.Unmarshal([]byte(response.Body), &body); err != nil {
+		t.Fatalf("response %q isn't JSON: %v", response.Body, err)
+	}
+	return body.Files
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// sequenceCounter hands out increasing sequence numbers per counter name
+type sequenceCounter interface {
+	Next(ctx context.Context, name string) (int64, error)
+}
+
+// dynamoCounter keeps sequence counters in a DynamoDB table keyed by the string
+// attribute "counter". Increments are atomic, so concurrent uploads never share a
+// number, but a number drawn for an upload that then fails is skipped: sequences
+// are increasing, not gapless.
+type dynamoCounter struct {
+	client *dynamodb.Client
+	table  string
+}
+
+// newSequenceCounter creates the counter backing {seq} key placeholders
+func newSequenceCounter(ctx context.Context, appCfg Config) (sequenceCounter, error) {
+	cfg, err := loadAWSConfig(ctx, appCfg)
+	if err != nil {
+		return nil, err
+	}
+	client := dynamodb.NewFromConfig(cfg, func(o *dynamodb.Options) {
+		// Hot counters are throttled under contention; keep retrying rather than failing the upload
+		o.RetryMaxAttempts = 10
+	})
+	return dynamoCounter{client: client, table: appCfg.SequenceTable}, nil
+}
+
+func (counter dynamoCounter) Next(ctx context.Context, name string) (int64, error) {
+	result, err := counter.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(counter.table),
+		Key: map[string]types.AttributeValue{
+			// Key attributes can't be empty, and {seq} may lead the template
+			"counter": &types.AttributeValueMemberS{Value: "seq:" + name},
+		},
+		UpdateExpression:          aws.String("ADD seq :one"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{":one": &types.AttributeValueMemberN{Value: "1"}},
+		ReturnValues:              types.ReturnValueUpdatedNew,
+	})
+	if err != nil {
+		log.Printf("Couldn't increment sequence %q in %v. Here's why: %v\n", name, counter.table, err)
+		return 0, err
+	}
+	seq, ok := result.Attributes["seq"].(*types.AttributeValueMemberN)
+	if !ok {
+		return 0, fmt.Errorf("sequence %q returned no number", name)
+	}
+	return strconv.ParseInt(seq.Value, 10, 64)
+}
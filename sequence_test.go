@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/config"
+)
+
+// fakeDynamoDB is an in-memory DynamoDB table serving the UpdateItem calls that
+// dynamoCounter makes, reached through the SDK's HTTPClient interface
+type fakeDynamoDB struct {
+	mu       sync.Mutex
+	counters map[string]int64
+	calls    int
+	// Throttle, when set, fails the nth UpdateItem call with a throttling error
+	Throttle func(call int) bool
+}
+
+// newFakeDynamoDB returns an empty table and routes the DynamoDB calls of every
+// client created by the test to it; S3 calls still go to whatever served them before
+func newFakeDynamoDB(t *testing.T) *fakeDynamoDB {
+	t.Helper()
+	fake := &fakeDynamoDB{counters: make(map[string]int64)}
+	previous := loadDefaultConfig
+	loadDefaultConfig = func(ctx context.Context, optFns ...func(*config.LoadOptions) error) (aws.Config, error) {
+		cfg, err := previous(ctx, optFns...)
+		cfg.HTTPClient = dynamoRouter{dynamo: fake, other: cfg.HTTPClient}
+		// Retry like the real SDK does, without waiting between attempts
+		cfg.Retryer = func() aws.Retryer {
+			return retry.NewStandard(func(o *retry.StandardOptions) {
+				o.Backoff = retry.BackoffDelayerFunc(func(int, error) (time.Duration, error) { return 0, nil })
+			})
+		}
+		return cfg, err
+	}
+	t.Cleanup(func() { loadDefaultConfig = previous })
+	return fake
+}
+
+// dynamoRouter sends DynamoDB requests to the fake and everything else on
+type dynamoRouter struct {
+	dynamo *fakeDynamoDB
+	other  aws.HTTPClient
+}
+
+func (router dynamoRouter) Do(request *http.Request) (*http.Response, error) {
+	if strings.HasPrefix(request.URL.Hostname(), "dynamodb.") {
+		return router.dynamo.Do(request)
+	}
+	return router.other.Do(request)
+}
+
+func (f *fakeDynamoDB) Do(request *http.Request) (*http.Response, error) {
+	body, err := io.ReadAll(request.Body)
+	if err != nil {
+		return nil, err
+	}
+	if target := request.Header.Get("X-Amz-Target"); target != "DynamoDB_20120810.UpdateItem" {
+		return dynamoResponse(request, http.StatusBadRequest, fmt.Sprintf(`{"__type":"UnknownOperationException","message":%q}`, target)), nil
+	}
+	var input struct {
+		TableName        string
+		Key              map[string]map[string]string
+		UpdateExpression string
+	}
+	if err := json.Unmarshal(body, &input); err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	if f.Throttle != nil && f.Throttle(f.calls) {
+		return dynamoResponse(request, http.StatusBadRequest, `{"__type":"com.amazonaws.dynamodb.v20120810#ProvisionedThroughputExceededException","message":"throttled"}`), nil
+	}
+	if input.UpdateExpression != "ADD seq :one" {
+		return dynamoResponse(request, http.StatusBadRequest, `{"__type":"ValidationException","message":"unexpected update"}`), nil
+	}
+	name := input.TableName + "/" + input.Key["counter"]["S"]
+	f.counters[name]++
+	return dynamoResponse(request, http.StatusOK, fmt.Sprintf(`{"Attributes":{"seq":{"N":"%d"}}}`, f.counters[name])), nil
+}
+
+func dynamoResponse(request *http.Request, status int, body string) *http.Response {
+	return &http.Response{
+		StatusCode:    status,
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		Header:        http.Header{"Content-Type": {"application/x-amz-json-1.0"}},
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       request,
+	}
+}
+
+// memoryCounter is a sequenceCounter kept in memory
+type memoryCounter struct {
+	mu       sync.Mutex
+	counters map[string]int64
+	err      error
+}
+
+func (counter *memoryCounter) Next(ctx context.Context, name string) (int64, error) {
+	counter.mu.Lock()
+	defer counter.mu.Unlock()
+	if counter.err != nil {
+		return 0, counter.err
+	}
+	if counter.counters == nil {
+		counter.counters = make(map[string]int64)
+	}
+	counter.counters[name]++
+	return counter.counters[name], nil
+}
+
+// renderConcurrently renders template n times at once and returns the keys sorted
+func renderConcurrently(t *testing.T, template string, n int, counter sequenceCounter) []string {
+	t.Helper()
+	keys := make([]string, n)
+	var wg sync.WaitGroup
+	for i := range keys {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			key, err := renderKey(t.Context(), template, keyFields{Name: "file-" + strconv.Itoa(i)}, counter)
+			if err != nil {
+				t.Error(err)
+			}
+			keys[i] = key
+		}()
+	}
+	wg.Wait()
+	sort.Strings(keys)
+	return keys
+}
+
+func TestRenderKeySequential(t *testing.T) {
+	tests := []struct {
+		name    string
+		counter func(t *testing.T) sequenceCounter
+	}{
+		{name: "memory counter", counter: func(t *testing.T) sequenceCounter { return &memoryCounter{} }},
+		{
+			name: "DynamoDB counter",
+			counter: func(t *testing.T) sequenceCounter {
+				newFakeDynamoDB(t)
+				counter, err := newSequenceCounter(t.Context(), Config{SequenceTable: "sequences"})
+				if err != nil {
+					t.Fatal(err)
+				}
+				return counter
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			counter := test.counter(t)
+			keys := renderConcurrently(t, "batches/{seq}", 40, counter)
+			// Zero padding makes the sorted keys the sequence 1, 2, 3, ...
+			for i, key := range keys {
+				if want := fmt.Sprintf("batches/%012d", i+1); key != want {
+					t.Fatalf("key %d = %q, want %q", i, key, want)
+				}
+			}
+			// Each prefix counts on its own
+			if key, err := renderKey(t.Context(), "other/{seq}", keyFields{}, counter); err != nil || key != "other/000000000001" {
+				t.Errorf("renderKey() for a new prefix = %q, %v", key, err)
+			}
+		})
+	}
+}
+
+func TestRenderKeySequenceGaps(t *testing.T) {
+	fake := newFakeDynamoDB(t)
+	counter, err := newSequenceCounter(t.Context(), Config{SequenceTable: "sequences"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every third call is throttled and retried, which must neither fail the upload nor
+	// repeat numbers
+	fake.Throttle = func(call int) bool { return call%3 == 0 }
+	keys := renderConcurrently(t, "{seq}-{name}", 20, counter)
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		seq, _, _ := strings.Cut(key, "-")
+		if seen[seq] {
+			t.Errorf("sequence number %s drawn twice", seq)
+		}
+		seen[seq] = true
+	}
+	if len(seen) != 20 {
+		t.Errorf("drew %d numbers, want 20", len(seen))
+	}
+}
+
+func TestRenderKeySequenceFailure(t *testing.T) {
+	counter := &memoryCounter{err: errors.New("table unavailable")}
+	if _, err := renderKey(t.Context(), "batches/{seq}", keyFields{}, counter); err == nil {
+		t.Error("renderKey() succeeded without a sequence number")
+	}
+	// Templates without {seq} never touch the counter
+	if key, err := renderKey(t.Context(), "batches/{name}", keyFields{Name: "{seq}.txt"}, counter); err != nil || key != "batches/{seq}.txt" {
+		t.Errorf("renderKey() = %q, %v", key, err)
+	}
+}
+
+func TestUploadSequenceKeys(t *testing.T) {
+	t.Setenv("S3_UPLOAD_SEQUENCE_TABLE", "sequences")
+	t.Setenv("S3_UPLOAD_KEY_TEMPLATE", "batches/{seq}-{name}")
+	fake := newFakeS3(t)
+	newFakeDynamoDB(t)
+	body, contentType := multipartBody(t, numberedFiles(3)...)
+	upload(t, map[string]string{"Content-Type": contentType}, body)
+
+	bucket := fake.bucketNames()[0]
+	want := []string{"batches/000000000001-file-0.txt", "batches/000000000002-file-1.txt", "batches/000000000003-file-2.txt"}
+	keys := fake.keys(bucket)
+	if len(keys) != len(want) {
+		t.Fatalf("stored %v, want %v", keys, want)
+	}
+	for i := range want {
+		if !strings.HasPrefix(keys[i], want[i]) {
+			t.Errorf("key %d = %q, want %q", i, keys[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Uploader serves requests through Handler and StreamHandler for a long-running
+// process, tracking the ones in flight so Shutdown can wait for them. A streamed
+// download stays in flight until its body has been read or closed.
+type Uploader struct {
+	// mu orders accepting against inFlight.Add, so nothing is added once Shutdown waits
+	mu        sync.Mutex
+	accepting bool
+	inFlight  sync.WaitGroup
+}
+
+// NewUploader returns an Uploader accepting requests
+func NewUploader() *Uploader {
+	return &Uploader{accepting: true}
+}
+
+// begin registers a request, or reports false once shutdown has begun
+func (u *Uploader) begin() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if !u.accepting {
+		return false
+	}
+	u.inFlight.Add(1)
+	return true
+}
+
+// Handler serves a request like the package-level Handler while tracking it
+func (u *Uploader) Handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	if !u.begin() {
+		return shuttingDown(), nil
+	}
+	defer u.inFlight.Done()
+	return Handler(ctx, request)
+}
+
+// StreamHandler serves a request like the package-level StreamHandler while tracking
+// it until its response body is done
+func (u *Uploader) StreamHandler(ctx context.Context, request events.LambdaFunctionURLRequest) (*events.LambdaFunctionURLStreamingResponse, error) {
+	if !u.begin() {
+		return streamingResponse(shuttingDown()), nil
+	}
+	response, err := StreamHandler(ctx, request)
+	if err != nil || response == nil || response.Body == nil {
+		u.inFlight.Done()
+		return response, err
+	}
+	response.Body = &trackedBody{r: response.Body, done: u.inFlight.Done}
+	return response, nil
+}
+
+// Shutdown stops accepting new requests and waits for in-flight ones to complete,
+// or returns ctx's error if it expires first
+func (u *Uploader) Shutdown(ctx context.Context) error {
+	u.mu.Lock()
+	u.accepting = false
+	u.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		u.inFlight.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// shuttingDown is returned for requests arriving once shutdown has begun
+func shuttingDown() events.APIGatewayProxyResponse {
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusServiceUnavailable,
+		Body:       "The uploader is shutting down, please retry.",
+	}
+}
+
+// trackedBody calls done once its body has been read to the end, failed or been closed
+type trackedBody struct {
+	r    io.Reader
+	once sync.Once
+	done func()
+}
+
+func (b *trackedBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err != nil {
+		b.once.Do(b.done)
+	}
+	return n, err
+}
+
+func (b *trackedBody) Close() error {
+	defer b.once.Do(b.done)
+	if closer, ok := b.r.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// shutdownOnSignal drains the uploader's in-flight requests and flushes telemetry
+// when the process is asked to stop, waiting at most S3_UPLOAD_SHUTDOWN_TIMEOUT
+func shutdownOnSignal(uploader *Uploader) {
+	timeout, err := envDuration("S3_UPLOAD_SHUTDOWN_TIMEOUT", 500*time.Millisecond)
+	if err != nil {
+		log.Printf("Invalid configuration: %v", err)
+		timeout = 500 * time.Millisecond
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		<-signals
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if err := uploader.Shutdown(ctx); err != nil {
+			log.Printf("Stopped before in-flight uploads completed. Here's why: %v\n", err)
+		}
+		flushTelemetry(ctx)
+		os.Exit(0)
+	}()
+}
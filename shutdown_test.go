@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// blockUploads holds every PutObject until release is closed, reporting each one
+// on started once it is in flight
+func blockUploads(t *testing.T) (started chan struct{}, release chan struct{}) {
+	t.Helper()
+	fake := newFakeS3(t)
+	started, release = make(chan struct{}, 16), make(chan struct{})
+	fake.Before = func(operation string, bucket string, key string) {
+		if operation == "PutObject" {
+			started <- struct{}{}
+			<-release
+		}
+	}
+	return started, release
+}
+
+// uploadThrough sends a plain-text upload through an uploader
+func uploadThrough(t *testing.T, uploader *Uploader, body string) events.APIGatewayProxyResponse {
+	t.Helper()
+	response, err := uploader.Handler(t.Context(), events.APIGatewayProxyRequest{
+		HTTPMethod: "POST",
+		Headers:    map[string]string{"Content-Type": "text/plain"},
+		Body:       body,
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	return response
+}
+
+func TestShutdownDrainsUploads(t *testing.T) {
+	const uploads = 3
+	started, release := blockUploads(t)
+	uploader := NewUploader()
+	statuses := make(chan int, uploads)
+	for range uploads {
+		go func() {
+			statuses <- uploadThrough(t, uploader, "in flight").StatusCode
+		}()
+	}
+	for range uploads {
+		<-started
+	}
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- uploader.Shutdown(context.Background()) }()
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown() = %v while uploads were in flight", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// New requests are refused while draining, on both handlers
+	if response := uploadThrough(t, uploader, "too late"); response.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Handler() during shutdown = %d %q, want 503", response.StatusCode, response.Body)
+	}
+	streamed, err := uploader.StreamHandler(t.Context(), events.LambdaFunctionURLRequest{})
+	if err != nil || streamed.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("StreamHandler() during shutdown = %+v, %v, want 503", streamed, err)
+	}
+
+	close(release)
+	if err := <-shutdown; err != nil {
+		t.Fatalf("Shutdown() = %v", err)
+	}
+	// Every in-flight upload finished before Shutdown returned
+	for range uploads {
+		select {
+		case status := <-statuses:
+			if status != http.StatusOK {
+				t.Errorf("in-flight upload answered %d", status)
+			}
+		default:
+			t.Fatal("Shutdown() returned before an in-flight upload completed")
+		}
+	}
+
+	// Other uploaders are unaffected by this one's shutdown
+	if response := uploadThrough(t, NewUploader(), "elsewhere"); response.StatusCode != http.StatusOK {
+		t.Errorf("a fresh Uploader answered %d %q", response.StatusCode, response.Body)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	started, release := blockUploads(t)
+	uploader := NewUploader()
+	done := make(chan int, 1)
+	go func() {
+		done <- uploadThrough(t, uploader, "slow").StatusCode
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := uploader.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Shutdown() = %v, want context.DeadlineExceeded", err)
+	}
+
+	// The upload still completes after Shutdown gives up on it
+	close(release)
+	if status := <-done; status != http.StatusOK {
+		t.Errorf("upload answered %d", status)
+	}
+	if err := uploader.Shutdown(context.Background()); err != nil {
+		t.Errorf("Shutdown() once drained = %v", err)
+	}
+}
+
+func TestShutdownWaitsForStreamedDownloads(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("S3_UPLOAD_LOCAL_DIR", dir)
+	const bucket = "filename20240131-120000"
+	data := testPayload(1 << 20)
+	stored, metadata := pipelineObject(t, data)
+	if err := (fsStorage{Dir: dir}).Put(bucket, "large.txt.zst.enc", stored, UploadOptions{Metadata: metadata}); err != nil {
+		t.Fatal(err)
+	}
+	download := events.LambdaFunctionURLRequest{
+		QueryStringParameters: map[string]string{"action": "download", "bucket": bucket, "key": "large.txt.zst.enc"},
+		RequestContext:        iamCaller,
+	}
+
+	tests := []struct {
+		name   string
+		finish func(t *testing.T, body io.Reader)
+	}{
+		{name: "read to the end", finish: func(t *testing.T, body io.Reader) {
+			if streamed, err := io.ReadAll(body); err != nil || len(streamed) != len(data) {
+				t.Errorf("streamed %d bytes, %v, want %d", len(streamed), err, len(data))
+			}
+		}},
+		{name: "closed early", finish: func(t *testing.T, body io.Reader) {
+			if err := body.(io.Closer).Close(); err != nil {
+				t.Error(err)
+			}
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			uploader := NewUploader()
+			response, err := uploader.StreamHandler(t.Context(), download)
+			if err != nil || response.StatusCode != http.StatusOK {
+				t.Fatalf("StreamHandler() = %+v, %v", response, err)
+			}
+
+			// The response has been returned, but its body is still being streamed
+			shutdown := make(chan error, 1)
+			go func() { shutdown <- uploader.Shutdown(context.Background()) }()
+			select {
+			case err := <-shutdown:
+				t.Fatalf("Shutdown() = %v while a download was streaming", err)
+			case <-time.After(50 * time.Millisecond):
+			}
+
+			test.finish(t, response.Body)
+			select {
+			case err := <-shutdown:
+				if err != nil {
+					t.Errorf("Shutdown() = %v", err)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("Shutdown() still waiting once the download was done")
+			}
+		})
+	}
+}
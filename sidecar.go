@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// sidecarSuffix is appended to an object key to name its metadata sidecar
+const sidecarSuffix = ".meta.json"
+
+// sensitiveHeaders are request headers that are never copied anywhere
+var sensitiveHeaders = map[string]bool{
+	"authorization":        true,
+	"cookie":               true,
+	"proxy-authorization":  true,
+	"x-amz-security-token": true,
+	"x-api-key":            true,
+	"x-upload-signature":   true,
+}
+
+// objectSidecar is the full metadata of an uploaded object, beyond what fits in S3
+// user metadata, stored as JSON next to the object for downstream indexing
+type objectSidecar struct {
+	Bucket         string            `json:"bucket"`
+	Key            string            `json:"key"`
+	OriginalName   string            `json:"originalName,omitempty"`
+	ContentType    string            `json:"contentType,omitempty"`
+	Size           int               `json:"size"`
+	OriginalSize   int               `json:"originalSize"`
+	ChecksumSHA256 string            `json:"checksumSha256"`
+	StorageClass   string            `json:"storageClass,omitempty"`
+	Metadata       map[string]string `json:"metadata,omitempty"`
+	Headers        map[string]string `json:"headers,omitempty"`
+}
+
+// WriteSidecar stores the metadata sidecar alongside its object
+func (basics BucketBasics) WriteSidecar(sidecar objectSidecar) error {
+	body, err := json.MarshalIndent(sidecar, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = basics.S3Client.PutObject(context.TODO(), &s3.PutObjectInput{
+		Bucket:      aws.String(sidecar.Bucket),
+		Key:         aws.String(sidecar.Key + sidecarSuffix),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		log.Printf("Couldn't write metadata sidecar for %v:%v. Here's why: %v\n", sidecar.Bucket, sidecar.Key, err)
+	}
+	return err
+}
+
+// safeHeaders returns a copy of the request headers without sensitive ones
+func safeHeaders(headers map[string]string) map[string]string {
+	safe := make(map[string]string, len(headers))
+	for name, value := range headers {
+		if !sensitiveHeaders[strings.ToLower(name)] {
+			safe[name] = value
+		}
+	}
+	return safe
+}
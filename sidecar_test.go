@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestUploadSidecar(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled string
+		want    bool
+	}{
+		{name: "enabled", enabled: "true", want: true},
+		{name: "disabled", enabled: "false", want: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("S3_UPLOAD_METADATA_SIDECAR", test.enabled)
+			fake := newFakeS3(t)
+			upload(t, map[string]string{
+				"Content-Type":  "text/plain",
+				"Authorization": "Bearer secret-token",
+				"X-Upload-Tag":  "quarterly",
+			}, "sidecar content")
+
+			bucket := fake.bucketNames()[0]
+			keys := fake.keys(bucket)
+			if !test.want {
+				if len(keys) != 1 {
+					t.Errorf("stored %v, want just the object", keys)
+				}
+				return
+			}
+			if len(keys) != 2 || keys[1] != keys[0]+sidecarSuffix {
+				t.Fatalf("stored %v, want the object and its sidecar", keys)
+			}
+			object, metadata, _ := fake.object(bucket, keys[0])
+			body, _, _ := fake.object(bucket, keys[1])
+			if contentType := fake.header(bucket, keys[1]).Get("Content-Type"); contentType != "application/json" {
+				t.Errorf("sidecar Content-Type = %q", contentType)
+			}
+
+			var sidecar objectSidecar
+			if err := json.Unmarshal(body, &sidecar); err != nil {
+				t.Fatalf("sidecar isn't JSON: %v", err)
+			}
+			if sidecar.Bucket != bucket || sidecar.Key != keys[0] {
+				t.Errorf("sidecar describes %v:%v, want %v:%v", sidecar.Bucket, sidecar.Key, bucket, keys[0])
+			}
+			if sidecar.Size != len(object) || sidecar.OriginalSize != len("sidecar content") || sidecar.ChecksumSHA256 != sha256Checksum(object) {
+				t.Errorf("sidecar size %d/%d checksum %q don't match the object", sidecar.Size, sidecar.OriginalSize, sidecar.ChecksumSHA256)
+			}
+			if sidecar.ContentType != "text/plain" || sidecar.StorageClass != "STANDARD" {
+				t.Errorf("sidecar content type %q, storage class %q", sidecar.ContentType, sidecar.StorageClass)
+			}
+			for name, value := range metadata {
+				if sidecar.Metadata[name] != value {
+					t.Errorf("sidecar metadata %s = %q, want %q", name, sidecar.Metadata[name], value)
+				}
+			}
+			if sidecar.Headers["X-Upload-Tag"] != "quarterly" {
+				t.Errorf("sidecar headers = %v", sidecar.Headers)
+			}
+			if _, ok := sidecar.Headers["Authorization"]; ok {
+				t.Error("sidecar recorded the Authorization header")
+			}
+		})
+	}
+}
+
+func TestSafeHeaders(t *testing.T) {
+	headers := map[string]string{
+		"Content-Type":         "text/plain",
+		"authorization":        "Bearer token",
+		"Cookie":               "session=1",
+		"X-Api-Key":            "key",
+		"X-Amz-Security-Token": "token",
+		"X-Upload-Signature":   "00",
+		"X-Upload-Tag":         "kept",
+	}
+	safe := safeHeaders(headers)
+	if len(safe) != 2 || safe["Content-Type"] != "text/plain" || safe["X-Upload-Tag"] != "kept" {
+		t.Errorf("safeHeaders() = %v", safe)
+	}
+	if len(headers) != 7 {
+		t.Errorf("safeHeaders() modified its argument, %d headers left", len(headers))
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// statsNamespace is the CloudWatch namespace compression statistics are published under
+const statsNamespace = "S3Upload"
+
+// ratioBuckets are the upper bounds of the compression ratio histogram buckets;
+// a last bucket catches every higher ratio. Ratios below 1 mean compression grew the data.
+var ratioBuckets = [...]float64{1, 1.5, 2, 4, 8}
+
+// compressionStats accumulates how well the handler compresses, across the
+// invocations a container serves, until it is flushed
+var compressionStats = &statsAccumulator{}
+
+// statsAccumulator totals compression results between flushes
+type statsAccumulator struct {
+	mu       sync.Mutex
+	since    time.Time
+	files    int64
+	bytesIn  int64
+	bytesOut int64
+	ratios   [len(ratioBuckets) + 1]int64
+}
+
+// statsSnapshot is one flushed period of compression statistics
+type statsSnapshot struct {
+	Start     string        `json:"start"`
+	End       string        `json:"end"`
+	Files     int64         `json:"files"`
+	BytesIn   int64         `json:"bytesIn"`
+	BytesOut  int64         `json:"bytesOut"`
+	Ratio     float64       `json:"ratio"`
+	Histogram []ratioBucket `json:"histogram"`
+}
+
+// ratioBucket counts the files whose compression ratio fell at or below Le
+type ratioBucket struct {
+	Le    string `json:"le"`
+	Count int64  `json:"count"`
+}
+
+// ratioBucketIndex returns the histogram bucket for a compression ratio
+func ratioBucketIndex(ratio float64) int {
+	for i, bound := range ratioBuckets {
+		if ratio <= bound {
+			return i
+		}
+	}
+	return len(ratioBuckets)
+}
+
+// record adds one compressed file
+func (stats *statsAccumulator) record(in int, out int, now time.Time) {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	if stats.files == 0 && stats.since.IsZero() {
+		stats.since = now
+	}
+	stats.files++
+	stats.bytesIn += int64(in)
+	stats.bytesOut += int64(out)
+	ratio := math.Inf(1)
+	if out > 0 {
+		ratio = float64(in) / float64(out)
+	}
+	stats.ratios[ratioBucketIndex(ratio)]++
+}
+
+// take returns and resets the statistics once interval has passed since the period
+// began. Periods without files are never flushed.
+func (stats *statsAccumulator) take(interval time.Duration, now time.Time) (statsSnapshot, bool) {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	if stats.files == 0 || now.Sub(stats.since) < interval {
+		return statsSnapshot{}, false
+	}
+
+	snapshot := statsSnapshot{
+		Start:    stats.since.UTC().Format(time.RFC3339),
+		End:      now.UTC().Format(time.RFC3339),
+		Files:    stats.files,
+		BytesIn:  stats.bytesIn,
+		BytesOut: stats.bytesOut,
+	}
+	if stats.bytesOut > 0 {
+		snapshot.Ratio = float64(stats.bytesIn) / float64(stats.bytesOut)
+	}
+	for i, count := range stats.ratios {
+		le := "+Inf"
+		if i < len(ratioBuckets) {
+			le = strconv.FormatFloat(ratioBuckets[i], 'g', -1, 64)
+		}
+		snapshot.Histogram = append(snapshot.Histogram, ratioBucket{Le: le, Count: count})
+	}
+	stats.since, stats.files, stats.bytesIn, stats.bytesOut = now, 0, 0, 0
+	stats.ratios = [len(stats.ratios)]int64{}
+	return snapshot, true
+}
+
+// flushCompressionStats writes the accumulated statistics to the configured target
+// once StatsInterval has passed. A failed flush is logged and its period dropped.
+func (basics BucketBasics) flushCompressionStats(now time.Time) {
+	snapshot, ok := compressionStats.take(basics.Config.StatsInterval, now)
+	if !ok {
+		return
+	}
+
+	switch basics.Config.StatsTarget {
+	case "s3":
+		body, err := json.Marshal(snapshot)
+		if err != nil {
+			log.Printf("Couldn't encode compression statistics. Here's why: %v\n", err)
+			return
+		}
+		statsKey := fmt.Sprintf("%s%s-%d.json", basics.Config.StatsPrefix, now.UTC().Format("2006/01/02/150405"), os.Getpid())
+		_, err = basics.S3Client.PutObject(context.TODO(), &s3.PutObjectInput{
+			Bucket:      aws.String(basics.Config.StatsBucket),
+			Key:         aws.String(statsKey),
+			Body:        bytes.NewReader(body),
+			ContentType: aws.String("application/json"),
+		})
+		if err != nil {
+			log.Printf("Couldn't write compression statistics to %v:%v. Here's why: %v\n", basics.Config.StatsBucket, statsKey, err)
+		}
+	case "cloudwatch":
+		line, err := embeddedMetrics(snapshot, now)
+		if err != nil {
+			log.Printf("Couldn't encode compression statistics. Here's why: %v\n", err)
+			return
+		}
+		// Lambda forwards stdout to CloudWatch Logs, which extracts the metrics
+		fmt.Fprintln(os.Stdout, string(line))
+	}
+}
+
+// embeddedMetrics renders a snapshot in the CloudWatch Embedded Metric Format
+func embeddedMetrics(snapshot statsSnapshot, now time.Time) ([]byte, error) {
+	document := map[string]interface{}{
+		"_aws": map[string]interface{}{
+			"Timestamp": now.UnixMilli(),
+			"CloudWatchMetrics": []map[string]interface{}{{
+				"Namespace":  statsNamespace,
+				"Dimensions": [][]string{{}},
+				"Metrics": []map[string]string{
+					{"Name": "CompressedFiles", "Unit": "Count"},
+					{"Name": "CompressionBytesIn", "Unit": "Bytes"},
+					{"Name": "CompressionBytesOut", "Unit": "Bytes"},
+					{"Name": "CompressionRatio", "Unit": "None"},
+				},
+			}},
+		},
+		"CompressedFiles":     snapshot.Files,
+		"CompressionBytesIn":  snapshot.BytesIn,
+		"CompressionBytesOut": snapshot.BytesOut,
+		"CompressionRatio":    snapshot.Ratio,
+		"RatioHistogram":      snapshot.Histogram,
+	}
+	return json.Marshal(document)
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useCompressionStats gives the test a fresh statistics accumulator
+func useCompressionStats(t *testing.T) *statsAccumulator {
+	t.Helper()
+	previous := compressionStats
+	compressionStats = &statsAccumulator{}
+	t.Cleanup(func() { compressionStats = previous })
+	return compressionStats
+}
+
+func TestRatioBucketIndex(t *testing.T) {
+	tests := []struct {
+		ratio float64
+		want  int
+	}{
+		{ratio: 0.5, want: 0},
+		{ratio: 1, want: 0},
+		{ratio: 1.01, want: 1},
+		{ratio: 1.5, want: 1},
+		{ratio: 2, want: 2},
+		{ratio: 3, want: 3},
+		{ratio: 4, want: 3},
+		{ratio: 8, want: 4},
+		{ratio: 8.5, want: 5},
+		{ratio: math.Inf(1), want: 5},
+	}
+	for _, test := range tests {
+		if got := ratioBucketIndex(test.ratio); got != test.want {
+			t.Errorf("ratioBucketIndex(%v) = %d, want %d", test.ratio, got, test.want)
+		}
+	}
+}
+
+func TestStatsAccumulatorTake(t *testing.T) {
+	start := time.Date(2024, 6, 15, 12, 0, 0, 0, time.UTC)
+	stats := &statsAccumulator{}
+	if _, ok := stats.take(0, start); ok {
+		t.Error("take() flushed a period without files")
+	}
+
+	stats.record(100, 200, start)                     // grew: ratio 0.5
+	stats.record(300, 200, start.Add(time.Second))    // 1.5
+	stats.record(1000, 100, start.Add(2*time.Second)) // 10
+	stats.record(50, 0, start.Add(3*time.Second))     // nothing left: +Inf
+	if _, ok := stats.take(time.Minute, start.Add(30*time.Second)); ok {
+		t.Error("take() flushed before the interval passed")
+	}
+
+	end := start.Add(time.Minute)
+	snapshot, ok := stats.take(time.Minute, end)
+	if !ok {
+		t.Fatal("take() didn't flush once the interval passed")
+	}
+	want := statsSnapshot{
+		Start:    "2024-06-15T12:00:00Z",
+		End:      "2024-06-15T12:01:00Z",
+		Files:    4,
+		BytesIn:  1450,
+		BytesOut: 500,
+		Ratio:    2.9,
+		Histogram: []ratioBucket{
+			{Le: "1", Count: 1}, {Le: "1.5", Count: 1}, {Le: "2", Count: 0},
+			{Le: "4", Count: 0}, {Le: "8", Count: 0}, {Le: "+Inf", Count: 2},
+		},
+	}
+	got, _ := json.Marshal(snapshot)
+	if expected, _ := json.Marshal(want); string(got) != string(expected) {
+		t.Errorf("take() = %s, want %s", got, expected)
+	}
+
+	// The next period starts empty at the flush
+	if _, ok := stats.take(0, end.Add(time.Hour)); ok {
+		t.Error("take() flushed the same files twice")
+	}
+	stats.record(10, 5, end.Add(time.Hour))
+	if snapshot, _ := stats.take(0, end.Add(time.Hour)); snapshot.Start != "2024-06-15T12:01:00Z" || snapshot.Files != 1 {
+		t.Errorf("next period = %+v, want one file since the last flush", snapshot)
+	}
+}
+
+func TestStatsSnapshotJSON(t *testing.T) {
+	snapshot := statsSnapshot{Start: "2024-06-15T12:00:00Z", End: "2024-06-15T12:05:00Z", Files: 2, BytesIn: 300, BytesOut: 100, Ratio: 3,
+		Histogram: []ratioBucket{{Le: "4", Count: 2}}}
+	got, err := json.Marshal(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"start":"2024-06-15T12:00:00Z","end":"2024-06-15T12:05:00Z","files":2,"bytesIn":300,"bytesOut":100,"ratio":3,"histogram":[{"le":"4","count":2}]}`
+	if string(got) != want {
+		t.Errorf("snapshot = %s, want %s", got, want)
+	}
+}
+
+func TestEmbeddedMetrics(t *testing.T) {
+	now := time.Date(2024, 6, 15, 12, 5, 0, 0, time.UTC)
+	line, err := embeddedMetrics(statsSnapshot{Files: 2, BytesIn: 300, BytesOut: 100, Ratio: 3, Histogram: []ratioBucket{{Le: "4", Count: 2}}}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var document struct {
+		AWS struct {
+			Timestamp         int64
+			CloudWatchMetrics []struct {
+				Namespace string
+				Metrics   []struct{ Name, Unit string }
+			}
+		} `json:"_aws"`
+		CompressedFiles     int64
+		CompressionBytesIn  int64
+		CompressionBytesOut int64
+		CompressionRatio    float64
+		RatioHistogram      []ratioBucket
+	}
+	if err := json.Unmarshal(line, &document); err != nil {
+		t.Fatalf("metrics %s aren't JSON: %v", line, err)
+	}
+	if document.AWS.Timestamp != now.UnixMilli() || len(document.AWS.CloudWatchMetrics) != 1 || document.AWS.CloudWatchMetrics[0].Namespace != statsNamespace {
+		t.Fatalf("metrics envelope = %+v", document.AWS)
+	}
+	// Every declared metric must have a value at the top level
+	values := map[string]bool{"CompressedFiles": document.CompressedFiles == 2, "CompressionBytesIn": document.CompressionBytesIn == 300,
+		"CompressionBytesOut": document.CompressionBytesOut == 100, "CompressionRatio": document.CompressionRatio == 3}
+	for _, metric := range document.AWS.CloudWatchMetrics[0].Metrics {
+		if !values[metric.Name] {
+			t.Errorf("metric %s has no matching value in %s", metric.Name, line)
+		}
+	}
+	if len(document.RatioHistogram) != 1 || document.RatioHistogram[0] != (ratioBucket{Le: "4", Count: 2}) {
+		t.Errorf("histogram = %+v", document.RatioHistogram)
+	}
+}
+
+func TestFlushCompressionStatsS3(t *testing.T) {
+	stats := useCompressionStats(t)
+	fake := newFakeS3(t)
+	now := time.Date(2024, 6, 15, 12, 5, 0, 0, time.UTC)
+	stats.record(400, 100, now.Add(-time.Hour))
+	basics := fake.basics(Config{StatsTarget: "s3", StatsBucket: "stats", StatsPrefix: "stats/compression/", StatsInterval: time.Minute})
+	basics.flushCompressionStats(now)
+
+	keys := fake.keys("stats")
+	if len(keys) != 1 || !strings.HasPrefix(keys[0], "stats/compression/2024/06/15/120500-") || !strings.HasSuffix(keys[0], ".json") {
+		t.Fatalf("stats objects = %v", keys)
+	}
+	data, _, _ := fake.object("stats", keys[0])
+	var snapshot statsSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		t.Fatalf("stats object %q isn't JSON: %v", data, err)
+	}
+	if snapshot.Files != 1 || snapshot.BytesIn != 400 || snapshot.BytesOut != 100 || snapshot.Ratio != 4 {
+		t.Errorf("stats object = %+v", snapshot)
+	}
+	if fake.header("stats", keys[0]).Get("Content-Type") != "application/json" {
+		t.Errorf("stats Content-Type = %q", fake.header("stats", keys[0]).Get("Content-Type"))
+	}
+
+	// Nothing new, so the next flush writes nothing
+	basics.flushCompressionStats(now.Add(time.Hour))
+	if keys := fake.keys("stats"); len(keys) != 1 {
+		t.Errorf("stats objects = %v after an empty period", keys)
+	}
+}
+
+func TestFlushCompressionStatsCloudWatch(t *testing.T) {
+	stats := useCompressionStats(t)
+	stats.record(400, 100, time.Now().Add(-time.Hour))
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = writer
+	BucketBasics{Config: Config{StatsTarget: "cloudwatch", StatsInterval: time.Minute}}.flushCompressionStats(time.Now())
+	os.Stdout = stdout
+	writer.Close()
+	output, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var document map[string]any
+	if err := json.Unmarshal(output, &document); err != nil || document["_aws"] == nil || document["CompressedFiles"] != 1.0 {
+		t.Errorf("stdout = %q, want one embedded metrics line", output)
+	}
+}
+
+func TestUploadFlushesCompressionStats(t *testing.T) {
+	useCompressionStats(t)
+	t.Setenv("S3_UPLOAD_STATS_TARGET", "s3")
+	t.Setenv("S3_UPLOAD_STATS_BUCKET", "upload-stats")
+	t.Setenv("S3_UPLOAD_STATS_INTERVAL", "0s")
+	fake := newFakeS3(t)
+	upload(t, map[string]string{"Content-Type": "text/plain"}, strings.Repeat("compress me ", 100))
+	keys := fake.keys("upload-stats")
+	if len(keys) != 1 {
+		t.Fatalf("stats objects = %v, want one after the upload", keys)
+	}
+	data, _, _ := fake.object("upload-stats", keys[0])
+	var snapshot statsSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil || snapshot.Files != 1 || snapshot.BytesIn != 1200 || snapshot.Ratio <= 1 {
+		t.Errorf("stats object = %s, %v", data, err)
+	}
+}
+
+func TestStatsConfig(t *testing.T) {
+	for _, env := range []map[string]string{
+		{"S3_UPLOAD_STATS_TARGET": "prometheus"},
+		{"S3_UPLOAD_STATS_TARGET": "s3", "S3_UPLOAD_STATS_BUCKET": ""},
+		{"S3_UPLOAD_STATS_TARGET": "cloudwatch", "S3_UPLOAD_STATS_INTERVAL": "often"},
+	} {
+		if err := configError(t, env); err == nil {
+			t.Errorf("loadConfig() accepted %v", env)
+		}
+	}
+	cfg := testConfig(t, map[string]string{"S3_UPLOAD_STATS_TARGET": "cloudwatch", "S3_UPLOAD_STATS_INTERVAL": ""})
+	if cfg.StatsInterval != 5*time.Minute || cfg.StatsPrefix != "stats/compression/" {
+		t.Errorf("stats defaults = %v %q", cfg.StatsInterval, cfg.StatsPrefix)
+	}
+}
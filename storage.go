@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Storage is where uploaded objects are written and read back
+type Storage interface {
+	// Put stores an object under a bucket and key
+	Put(bucketName string, fileName string, data []byte, opts UploadOptions) error
+	// Get returns an object and its user metadata
+	Get(bucketName string, fileName string, verify bool) ([]byte, map[string]string, error)
+	// Open returns an object for streaming, without reading it into memory
+	Open(bucketName string, fileName string, verify bool) (storedObject, error)
+}
+
+// newStorage picks the backend for the configuration: S3, the local directory in
+// S3_UPLOAD_LOCAL_DIR, or both
+func newStorage(basics BucketBasics) Storage {
+	local := fsStorage{Dir: basics.Config.LocalDir, EnforceTTL: basics.Config.EnforceTTL}
+	switch {
+	case basics.Config.LocalDir == "":
+		return s3Storage{basics}
+	case basics.Config.LocalMode == "dual":
+		return dualStorage{Primary: s3Storage{basics}, Mirror: local}
+	default:
+		return local
+	}
+}
+
+// s3Storage stores objects in S3
+type s3Storage struct {
+	basics BucketBasics
+}
+
+func (storage s3Storage) Put(bucketName string, fileName string, data []byte, opts UploadOptions) error {
+	return storage.basics.UploadFileToS3(bucketName, fileName, data, opts)
+}
+
+func (storage s3Storage) Get(bucketName string, fileName string, verify bool) ([]byte, map[string]string, error) {
+	return storage.basics.DownloadFile(bucketName, fileName, verify)
+}
+
+func (storage s3Storage) Open(bucketName string, fileName string, verify bool) (storedObject, error) {
+	return storage.basics.OpenObject(bucketName, fileName, verify)
+}
+
+// fsStorage stores objects as files under Dir, at <bucket>/<key> with the key's
+// slashes as directories, and their metadata next to them in a .metadata.json file.
+// It is meant for local development without AWS.
+type fsStorage struct {
+	Dir string
+	// EnforceTTL makes Get refuse objects past their expires-at time
+	EnforceTTL bool
+}
+
+// bucketNamePattern matches names following the S3 bucket naming rules: 3 to 63
+// lowercase letters, digits, dots and hyphens, starting and ending with a letter or digit
+var bucketNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+
+// isValidBucketName reports whether a name could be an S3 bucket's, which also
+// keeps it from holding path separators or parent references
+func isValidBucketName(bucketName string) bool {
+	return bucketNamePattern.MatchString(bucketName) && !strings.Contains(bucketName, "..")
+}
+
+// path maps a bucket and key to a file, refusing names that would escape Dir or the
+// bucket's directory in it
+func (storage fsStorage) path(bucketName string, fileName string) (string, error) {
+	if !isValidBucketName(bucketName) {
+		return "", fmt.Errorf("bucket %q is not a valid bucket name", bucketName)
+	}
+	dir := filepath.Clean(storage.Dir)
+	root := filepath.Join(dir, bucketName)
+	path := filepath.Join(root, filepath.FromSlash(fileName))
+	if !isWithin(dir, root) || !isWithin(root, path) {
+		return "", fmt.Errorf("key %q escapes the local storage directory", fileName)
+	}
+	return path, nil
+}
+
+// isWithin reports whether path is strictly inside dir
+func isWithin(dir string, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
+
+func (storage fsStorage) Put(bucketName string, fileName string, data []byte, opts UploadOptions) error {
+	path, err := storage.path(bucketName, fileName)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("local storage error: %v", err)
+	}
+
+	// Create-only writes fail on an existing file, which isObjectExists recognises
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if opts.CreateOnly {
+		flags |= os.O_EXCL
+	}
+	file, err := os.OpenFile(path, flags, 0o644)
+	if err != nil {
+		log.Printf("Couldn't write %v:%v locally. Here's why: %v\n", bucketName, fileName, err)
+		return err
+	}
+	if _, err = file.Write(data); err != nil {
+		file.Close()
+		return fmt.Errorf("local storage error: %v", err)
+	}
+	if err = file.Close(); err != nil {
+		return fmt.Errorf("local storage error: %v", err)
+	}
+
+	metadata, err := json.Marshal(opts.Metadata)
+	if err != nil {
+		return fmt.Errorf("local storage error: %v", err)
+	}
+	if err = os.WriteFile(path+".metadata.json", metadata, 0o644); err != nil {
+		return fmt.Errorf("local storage error: %v", err)
+	}
+	return nil
+}
+
+// Get reads an object back. Local files carry no checksum, so verify is ignored.
+func (storage fsStorage) Get(bucketName string, fileName string, verify bool) ([]byte, map[string]string, error) {
+	object, err := storage.Open(bucketName, fileName, verify)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer object.Body.Close()
+	data, err := io.ReadAll(object.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("local storage error: %v", err)
+	}
+	return data, object.Metadata, nil
+}
+
+// Open opens an object's file for streaming; like Get it ignores verify
+func (storage fsStorage) Open(bucketName string, fileName string, verify bool) (storedObject, error) {
+	path, err := storage.path(bucketName, fileName)
+	if err != nil {
+		return storedObject{}, err
+	}
+
+	var metadata map[string]string
+	if encoded, err := os.ReadFile(path + ".metadata.json"); err == nil {
+		if err = json.Unmarshal(encoded, &metadata); err != nil {
+			return storedObject{}, fmt.Errorf("invalid local metadata for %v:%v: %v", bucketName, fileName, err)
+		}
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		log.Printf("Couldn't read %v:%v locally. Here's why: %v\n", bucketName, fileName, err)
+		return storedObject{}, err
+	}
+	if storage.EnforceTTL && objectExpired(metadata, time.Now()) {
+		file.Close()
+		return storedObject{}, ErrObjectExpired
+	}
+	return storedObject{Body: file, Metadata: metadata}, nil
+}
+
+// dualStorage writes objects to S3 and mirrors them to local storage. Reads come
+// from S3, and a failed mirror write is only logged.
+type dualStorage struct {
+	Primary Storage
+	Mirror  Storage
+}
+
+func (storage dualStorage) Put(bucketName string, fileName string, data []byte, opts UploadOptions) error {
+	if err := storage.Primary.Put(bucketName, fileName, data, opts); err != nil {
+		return err
+	}
+	// The mirror follows S3, which has already decided whether the write may happen
+	opts.CreateOnly, opts.IfMatch = false, ""
+	if err := storage.Mirror.Put(bucketName, fileName, data, opts); err != nil {
+		log.Printf("Couldn't mirror %v:%v locally. Here's why: %v\n", bucketName, fileName, err)
+	}
+	return nil
+}
+
+func (storage dualStorage) Get(bucketName string, fileName string, verify bool) ([]byte, map[string]string, error) {
+	return storage.Primary.Get(bucketName, fileName, verify)
+}
+
+func (storage dualStorage) Open(bucketName string, fileName string, verify bool) (storedObject, error) {
+	return storage.Primary.Open(bucketName, fileName, verify)
+}
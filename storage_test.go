@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestIsValidBucketName(t *testing.T) {
+	tests := []struct {
+		bucket string
+		want   bool
+	}{
+		{"filename20240131-120000", true},
+		{"my.bucket-1", true},
+		{"abc", true},
+		{"ab", false},
+		{strings.Repeat("a", 63), true},
+		{strings.Repeat("a", 64), false},
+		{"..", false},
+		{"../..", false},
+		{"a..b", false},
+		{"a/b", false},
+		{`a\b`, false},
+		{"Uppercase", false},
+		{"-leading", false},
+		{"trailing.", false},
+		{"arn:aws:s3:ap-south-1:123456789012:accesspoint/uploads", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		if got := isValidBucketName(test.bucket); got != test.want {
+			t.Errorf("isValidBucketName(%q) = %v, want %v", test.bucket, got, test.want)
+		}
+	}
+}
+
+func TestFSStoragePath(t *testing.T) {
+	dir := t.TempDir()
+	storage := fsStorage{Dir: dir}
+	tests := []struct {
+		name   string
+		bucket string
+		key    string
+		want   string
+	}{
+		{name: "nested key", bucket: "uploads", key: "a/b/c.txt", want: filepath.Join(dir, "uploads", "a", "b", "c.txt")},
+		{name: "dot segments inside the bucket", bucket: "uploads", key: "a/../b.txt", want: filepath.Join(dir, "uploads", "b.txt")},
+		{name: "key escapes bucket", bucket: "uploads", key: "../other/b.txt"},
+		{name: "key escapes dir", bucket: "uploads", key: "../../etc/passwd"},
+		{name: "key is the bucket", bucket: "uploads", key: "."},
+		{name: "bucket escapes dir", bucket: "../..", key: "etc/passwd"},
+		{name: "bucket with separator", bucket: "uploads/../../x", key: "a.txt"},
+		{name: "parent bucket", bucket: "..", key: "a.txt"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path, err := storage.path(test.bucket, test.key)
+			if test.want == "" {
+				if err == nil {
+					t.Fatalf("path(%q, %q) = %q, want an error", test.bucket, test.key, path)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("path(%q, %q) error = %v", test.bucket, test.key, err)
+			}
+			if path != test.want {
+				t.Errorf("path(%q, %q) = %q, want %q", test.bucket, test.key, path, test.want)
+			}
+		})
+	}
+}
+
+func TestFSStorageRoundTrip(t *testing.T) {
+	storage := fsStorage{Dir: t.TempDir()}
+	metadata := map[string]string{"compression": "none", "encryption": "none"}
+	if err := storage.Put("uploads", "a/b.txt", []byte("hello"), UploadOptions{Metadata: metadata}); err != nil {
+		t.Fatal(err)
+	}
+	data, got, err := storage.Get("uploads", "a/b.txt", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, []byte("hello")) || got["compression"] != "none" {
+		t.Errorf("Get() = %q, %v", data, got)
+	}
+
+	err = storage.Put("uploads", "a/b.txt", []byte("again"), UploadOptions{CreateOnly: true})
+	if !isObjectExists(err) {
+		t.Errorf("create-only Put over an existing file error = %v, want an exists error", err)
+	}
+	if _, _, err := storage.Get("uploads", "missing.txt", false); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Get() of a missing file error = %v, want fs.ErrNotExist", err)
+	}
+	if err := storage.Put("../escape", "a.txt", []byte("x"), UploadOptions{}); err == nil {
+		t.Error("Put() into an invalid bucket succeeded")
+	}
+}
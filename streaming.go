@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/klauspost/compress/zstd"
+)
+
+// StreamHandler is the Lambda Function URL handler for the RESPONSE_STREAM invoke mode.
+// Downloads are streamed back incrementally, which lifts the 6 MB buffered response
+// limit; every other request is served by Handler.
+func StreamHandler(ctx context.Context, request events.LambdaFunctionURLRequest) (*events.LambdaFunctionURLStreamingResponse, error) {
+	appCfg, err := loadConfig()
+	if err != nil {
+		log.Printf("Invalid configuration: %v", err)
+		return &events.LambdaFunctionURLStreamingResponse{StatusCode: http.StatusInternalServerError}, nil
+	}
+
+	// Both paths see the request exactly as Handler would
+	proxy := proxyRequest(request)
+	normalizeRequest(&proxy)
+
+	if proxy.QueryStringParameters["action"] == "download" {
+		return streamDownload(ctx, proxy, appCfg), nil
+	}
+
+	// Reject what the headers alone rule out before the body is decoded
+	if response := preflight(proxy.Headers, appCfg); response != nil {
+		return response, nil
+	}
+	if isChunked(proxy.Headers) {
+		headers, response := checkChunkedBody(request, appCfg)
+		if response != nil {
+			return response, nil
+		}
+		proxy.Headers = headers
+	}
+
+	// Serve everything else through the API Gateway handler
+	response, err := Handler(ctx, proxy)
+	if err != nil {
+		return nil, err
+	}
+	return streamingResponse(response), nil
+}
+
+// proxyRequest converts a Function URL request to the API Gateway form Handler
+// takes. The caller's IAM identity and address are carried over, so the principal
+// and source captured from it are the same whichever way the function is invoked.
+func proxyRequest(request events.LambdaFunctionURLRequest) events.APIGatewayProxyRequest {
+	proxy := events.APIGatewayProxyRequest{
+		HTTPMethod:            request.RequestContext.HTTP.Method,
+		Path:                  request.RawPath,
+		Headers:               request.Headers,
+		QueryStringParameters: request.QueryStringParameters,
+		Body:                  request.Body,
+		IsBase64Encoded:       request.IsBase64Encoded,
+		RequestContext: events.APIGatewayProxyRequestContext{
+			AccountID:  request.RequestContext.AccountID,
+			RequestID:  request.RequestContext.RequestID,
+			APIID:      request.RequestContext.APIID,
+			DomainName: request.RequestContext.DomainName,
+			HTTPMethod: request.RequestContext.HTTP.Method,
+			Path:       request.RequestContext.HTTP.Path,
+			Protocol:   request.RequestContext.HTTP.Protocol,
+			Identity: events.APIGatewayRequestIdentity{
+				SourceIP:  request.RequestContext.HTTP.SourceIP,
+				UserAgent: request.RequestContext.HTTP.UserAgent,
+			},
+		},
+	}
+	if authorizer := request.RequestContext.Authorizer; authorizer != nil && authorizer.IAM != nil {
+		identity := &proxy.RequestContext.Identity
+		identity.AccessKey = authorizer.IAM.AccessKey
+		identity.AccountID = authorizer.IAM.AccountID
+		identity.Caller = authorizer.IAM.CallerID
+		identity.User = authorizer.IAM.UserID
+		identity.UserArn = authorizer.IAM.UserARN
+	}
+	return proxy
+}
+
+// streamingResponse converts a buffered API Gateway response to a streaming one
+func streamingResponse(response events.APIGatewayProxyResponse) *events.LambdaFunctionURLStreamingResponse {
+	var body io.Reader = strings.NewReader(response.Body)
+	if response.IsBase64Encoded {
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	}
+	return &events.LambdaFunctionURLStreamingResponse{
+		StatusCode: response.StatusCode,
+		Headers:    response.Headers,
+		Body:       body,
+	}
+}
+
+// streamDownload serves ?action=download&bucket=<bucket>&key=<key> like handleDownload,
+// decrypting and decompressing the object as it is streamed to the client
+func streamDownload(ctx context.Context, request events.APIGatewayProxyRequest, appCfg Config) *events.LambdaFunctionURLStreamingResponse {
+	bucketName, fileName, denied := authorizeRead(request, appCfg)
+	if denied != nil {
+		return streamingResponse(*denied)
+	}
+
+	if !s3Breaker.allow(appCfg, time.Now()) {
+		return streamingResponse(serviceUnavailable())
+	}
+
+	var s3Client *s3.Client
+	if appCfg.usesS3() {
+		var err error
+		if s3Client, err = newS3Client(ctx, appCfg); err != nil {
+			return &events.LambdaFunctionURLStreamingResponse{StatusCode: http.StatusInternalServerError}
+		}
+	}
+	basics := BucketBasics{S3Client: s3Client, Config: appCfg}
+	basics.useDictionaries()
+
+	object, err := newStorage(basics).Open(bucketName, fileName, appCfg.VerifyChecksums)
+	s3Breaker.record(appCfg, err, time.Now())
+	if err != nil {
+		return streamingResponse(downloadErrorResponse(err, appCfg))
+	}
+	headers, passthrough := downloadHeaders(request, fileName, object.Metadata, appCfg)
+
+	// Decode in the background; the runtime streams the pipe to the client as it fills
+	reader, writer := io.Pipe()
+	go func() {
+		defer object.Body.Close()
+
+		var err error
+		if passthrough {
+			err = copyVerified(writer, object)
+		} else {
+			err = decodeStream(writer, object.Body, object.Checksum, object.Metadata)
+		}
+		if err != nil {
+			log.Printf("Couldn't stream file %v:%v. Here's why: %v\n", bucketName, fileName, err)
+		}
+		writer.CloseWithError(err)
+	}()
+
+	return &events.LambdaFunctionURLStreamingResponse{
+		StatusCode: http.StatusOK,
+		Headers:    headers,
+		Body:       reader,
+	}
+}
+
+// decodeStream is the streaming counterpart of decodeObject. When checksum is set
+// the stored bytes are hashed as they pass through and a mismatch fails the
+// stream with ErrChecksumMismatch once the whole object has been read.
+func decodeStream(dst io.Writer, src io.Reader, checksum string, metadata map[string]string) error {
+	hash := sha256.New()
+	if checksum != "" {
+		src = io.TeeReader(src, hash)
+	}
+	if err := decodeStored(dst, src, metadata); err != nil {
+		return err
+	}
+
+	if checksum != "" {
+		// Drain anything the decoders didn't consume so the whole object is hashed
+		if _, err := io.Copy(io.Discard, src); err != nil {
+			return err
+		}
+		if base64.StdEncoding.EncodeToString(hash.Sum(nil)) != checksum {
+			return ErrChecksumMismatch
+		}
+	}
+	return nil
+}
+
+// decodeStored reverses the upload pipeline of the stored bytes read from src
+func decodeStored(dst io.Writer, src io.Reader, metadata map[string]string) error {
+	gzipped := isGzipEncoded(metadata)
+	if gzipped {
+		reader, err := gzip.NewReader(src)
+		if err != nil {
+			return fmt.Errorf("gzip decompression error: %v", err)
+		}
+		src = reader
+	}
+
+	// Prefer the pipeline described by an embedded object header over the metadata
+	buffered := bufio.NewReader(src)
+	src = buffered
+	prefix, _ := buffered.Peek(objectHeaderSize)
+	if gzipped && !isPipelineObject(prefix, metadata) {
+		// Objects this handler didn't write carry the file itself under the encoding
+		if _, err := io.Copy(dst, buffered); err != nil {
+			return fmt.Errorf("gzip decompression error: %v", err)
+		}
+		return nil
+	}
+	if hasObjectHeader(prefix) {
+		header, err := parseObjectHeader(prefix)
+		if err != nil {
+			return err
+		}
+		buffered.Discard(objectHeaderSize)
+		metadata = header.metadata()
+	}
+
+	compressed := src
+	var decrypted *io.PipeReader
+	var decryptDone chan error
+	if metadata["encryption"] != "none" {
+		if legacy, _ := buffered.Peek(len(legacyKeyPrefix)); bytes.Equal(legacy, legacyKeyPrefix) {
+			return ErrLegacyKeyPrefix
+		}
+		key, err := encryptionKey()
+		if err != nil {
+			return err
+		}
+		encrypted := metadata["encryption"] == "aes-gcm"
+
+		// Objects written before encryption was implemented hold the plain zstd stream,
+		// but one recorded as encrypted must carry an authenticated stream
+		compressed = buffered
+		magic, _ := buffered.Peek(len(encryptionMagic))
+		if !bytes.Equal(magic, encryptionMagic) && encrypted {
+			return ErrDecryption
+		}
+		if bytes.Equal(magic, encryptionMagic) {
+			var writer *io.PipeWriter
+			decrypted, writer = io.Pipe()
+			decryptDone = make(chan error, 1)
+			go func() {
+				err := decryptStream(writer, buffered, key)
+				writer.CloseWithError(err)
+				decryptDone <- err
+			}()
+			defer decrypted.Close()
+			compressed = decrypted
+		}
+	}
+
+	switch metadata["compression"] {
+	case "none":
+		if _, err := io.Copy(dst, compressed); err != nil {
+			return err
+		}
+	case "gzip":
+		reader, err := gzip.NewReader(compressed)
+		if err != nil {
+			return fmt.Errorf("gzip decompression error: %v", err)
+		}
+		if _, err := io.Copy(dst, reader); err != nil {
+			return fmt.Errorf("gzip decompression error: %v", err)
+		}
+	default:
+		// The frame header names the dictionary, if any, the object was compressed with
+		buffered := bufio.NewReader(compressed)
+		frame, _ := buffered.Peek(zstd.HeaderMaxSize)
+		dictionary, err := frameDictionary(frame)
+		if err != nil {
+			return err
+		}
+		var decoder *zstd.Decoder
+		if dictionary != nil {
+			if decoder, err = zstd.NewReader(buffered, zstd.WithDecoderConcurrency(1), zstd.WithDecoderDicts(dictionary)); err == nil {
+				defer decoder.Close()
+			}
+		} else if decoder, err = decoders.get(buffered); err == nil {
+			defer decoders.put(decoder)
+		}
+		if err != nil {
+			return fmt.Errorf("zstandard decompression initialization error: %v", err)
+		}
+		if _, err := io.Copy(dst, decoder); err != nil {
+			return fmt.Errorf("zstandard decompression error: %v", err)
+		}
+	}
+
+	if decryptDone != nil {
+		// Let the decryption finish consuming the object before it is drained
+		decrypted.Close()
+		if err := <-decryptDone; err != nil && err != io.ErrClosedPipe {
+			return err
+		}
+	}
+	return nil
+}
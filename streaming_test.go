@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/klauspost/compress/zstd"
+)
+
+// iamCaller is the request context of a Function URL request signed by an IAM user
+var iamCaller = events.LambdaFunctionURLRequestContext{
+	Authorizer: &events.LambdaFunctionURLRequestContextAuthorizerDescription{
+		IAM: &events.LambdaFunctionURLRequestContextAuthorizerIAMDescription{
+			AccountID: "123456789012",
+			UserARN:   "arn:aws:iam::123456789012:user/uploader",
+		},
+	},
+	HTTP: events.LambdaFunctionURLRequestContextHTTPDescription{
+		Method:    "GET",
+		SourceIP:  "203.0.113.7",
+		UserAgent: "uploader-test/1.0",
+	},
+}
+
+// testPayload returns size bytes of compressible but not repetitive data
+func testPayload(size int) []byte {
+	var buf bytes.Buffer
+	for i := 0; buf.Len() < size; i++ {
+		buf.WriteString(base64.StdEncoding.EncodeToString([]byte{byte(i), byte(i >> 8), byte(i * 7)}))
+		buf.WriteByte(' ')
+	}
+	return buf.Bytes()[:size]
+}
+
+// pipelineObject returns data compressed and encrypted the way Handler stores it
+func pipelineObject(t *testing.T, data []byte) ([]byte, map[string]string) {
+	t.Helper()
+	compressed, err := compressZstd(data, zstd.SpeedDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := encryptCompressed(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stored, map[string]string{"compression": "zstd", "encryption": "aes-gcm"}
+}
+
+// gzipped returns data gzip-compressed
+func gzipped(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestProxyRequestKeepsCaller(t *testing.T) {
+	proxy := proxyRequest(events.LambdaFunctionURLRequest{RawPath: "/upload", RequestContext: iamCaller})
+	if principal := requestPrincipal(proxy); principal != iamCaller.Authorizer.IAM.UserARN {
+		t.Errorf("requestPrincipal() = %q, want the IAM caller", principal)
+	}
+	source := sourceMetadata(proxy)
+	if source["uploaded-from"] != "203.0.113.7" || source["user-agent"] != "uploader-test/1.0" {
+		t.Errorf("sourceMetadata() = %v, want the Function URL caller's address and agent", source)
+	}
+	if proxy.HTTPMethod != "GET" || proxy.Path != "/upload" {
+		t.Errorf("proxyRequest() = %s %s", proxy.HTTPMethod, proxy.Path)
+	}
+
+	anonymous := proxyRequest(events.LambdaFunctionURLRequest{})
+	if principal := requestPrincipal(anonymous); principal != "" {
+		t.Errorf("requestPrincipal() of an unsigned request = %q", principal)
+	}
+}
+
+func TestStreamDownload(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("S3_UPLOAD_LOCAL_DIR", dir)
+	storage := fsStorage{Dir: dir}
+	bucket := "filename20240131-120000"
+
+	large := testPayload(8 << 20)
+	stored, metadata := pipelineObject(t, large)
+	if err := storage.Put(bucket, "large.txt.zst.enc", stored, UploadOptions{Metadata: metadata}); err != nil {
+		t.Fatal(err)
+	}
+	headerMetadata := map[string]string{"compression": "none", "encryption": "none"}
+	withHeader := append(objectHeader{Compression: "zstd", Encrypted: true}.encode(), stored...)
+	if err := storage.Put(bucket, "header.bin", withHeader, UploadOptions{Metadata: headerMetadata}); err != nil {
+		t.Fatal(err)
+	}
+	foreign := []byte("served by CloudFront as stored")
+	if err := storage.Put(bucket, "site.css", gzipped(t, foreign), UploadOptions{Metadata: map[string]string{storedEncodingMetadata: "gzip"}}); err != nil {
+		t.Fatal(err)
+	}
+	wrappedMetadata := map[string]string{storedEncodingMetadata: "gzip"}
+	for key, value := range metadata {
+		wrappedMetadata[key] = value
+	}
+	if err := storage.Put(bucket, "wrapped.zst.enc", gzipped(t, stored), UploadOptions{Metadata: wrappedMetadata}); err != nil {
+		t.Fatal(err)
+	}
+	tampered := append([]byte{}, stored...)
+	tampered[len(tampered)/2] ^= 1
+	if err := storage.Put(bucket, "tampered.zst.enc", tampered, UploadOptions{Metadata: metadata}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		key      string
+		bucket   string
+		headers  map[string]string
+		context  events.LambdaFunctionURLRequestContext
+		status   int
+		want     []byte
+		encoding string
+		fails    bool
+	}{
+		{name: "multi-megabyte object", key: "large.txt.zst.enc", context: iamCaller, status: http.StatusOK, want: large},
+		{name: "object header", key: "header.bin", context: iamCaller, status: http.StatusOK, want: large},
+		{name: "gzip passed through", key: "site.css", headers: map[string]string{"Accept-Encoding": "gzip"}, context: iamCaller, status: http.StatusOK, want: gzipped(t, foreign), encoding: "gzip"},
+		{name: "gzip decoded", key: "site.css", context: iamCaller, status: http.StatusOK, want: foreign},
+		{name: "gzip-wrapped pipeline object", key: "wrapped.zst.enc", headers: map[string]string{"Accept-Encoding": "gzip"}, context: iamCaller, status: http.StatusOK, want: large},
+		{name: "tampered object", key: "tampered.zst.enc", context: iamCaller, status: http.StatusOK, fails: true},
+		{name: "missing key", key: "missing.txt", context: iamCaller, status: http.StatusNotFound},
+		{name: "anonymous", key: "large.txt.zst.enc", status: http.StatusForbidden},
+		{name: "foreign bucket", key: "large.txt.zst.enc", bucket: "company-payroll", context: iamCaller, status: http.StatusForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.bucket == "" {
+				test.bucket = bucket
+			}
+			response, err := StreamHandler(t.Context(), events.LambdaFunctionURLRequest{
+				Headers:               test.headers,
+				QueryStringParameters: map[string]string{"action": "download", "bucket": test.bucket, "key": test.key},
+				RequestContext:        test.context,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response.StatusCode != test.status {
+				t.Fatalf("StreamHandler() status = %d, want %d", response.StatusCode, test.status)
+			}
+			if test.status != http.StatusOK {
+				return
+			}
+			body, err := io.ReadAll(response.Body)
+			if test.fails {
+				if err == nil {
+					t.Fatal("reading the stream of a tampered object succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("reading the stream error = %v", err)
+			}
+			if !bytes.Equal(body, test.want) {
+				t.Errorf("streamed %d bytes, want %d matching bytes", len(body), len(test.want))
+			}
+			if response.Headers["Content-Encoding"] != test.encoding {
+				t.Errorf("Content-Encoding = %q, want %q", response.Headers["Content-Encoding"], test.encoding)
+			}
+		})
+	}
+}
+
+func TestDecodeStreamChecksum(t *testing.T) {
+	data := testPayload(3 << 20)
+	stored, metadata := pipelineObject(t, data)
+	checksum := sha256Checksum(stored)
+
+	var out bytes.Buffer
+	if err := decodeStream(&out, bytes.NewReader(stored), checksum, metadata); err != nil {
+		t.Fatalf("decodeStream() error = %v", err)
+	}
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Error("decodeStream() changed the data")
+	}
+
+	if err := decodeStream(io.Discard, bytes.NewReader(stored), sha256Checksum([]byte("other")), metadata); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("decodeStream() with the wrong checksum error = %v, want ErrChecksumMismatch", err)
+	}
+
+	// A gzip-wrapped object is verified as stored, before it is unwrapped
+	wrapped := gzipped(t, stored)
+	wrappedMetadata := map[string]string{storedEncodingMetadata: "gzip", "compression": "zstd", "encryption": "aes-gcm"}
+	out.Reset()
+	if err := decodeStream(&out, bytes.NewReader(wrapped), sha256Checksum(wrapped), wrappedMetadata); err != nil {
+		t.Fatalf("decodeStream() of a gzip-wrapped object error = %v", err)
+	}
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Error("decodeStream() of a gzip-wrapped object changed the data")
+	}
+}
+
+func TestStreamUploadKeepsCaller(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("S3_UPLOAD_LOCAL_DIR", dir)
+	t.Setenv("S3_UPLOAD_CAPTURE_SOURCE", "true")
+
+	upload := iamCaller
+	upload.HTTP.Method = "POST"
+	response, err := StreamHandler(t.Context(), events.LambdaFunctionURLRequest{
+		Headers:               map[string]string{"Content-Type": "text/plain", "Accept": "application/json"},
+		QueryStringParameters: map[string]string{"fileName": "notes.txt"},
+		Body:                  "uploaded through the Function URL",
+		RequestContext:        upload,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(response.Body)
+	var uploaded uploadResponse
+	if err := json.Unmarshal(body, &uploaded); err != nil || len(uploaded.Files) != 1 {
+		t.Fatalf("StreamHandler() = %d %s", response.StatusCode, body)
+	}
+
+	_, metadata, err := fsStorage{Dir: dir}.Get(uploaded.Files[0].Bucket, uploaded.Files[0].Key, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata["uploaded-from"] != "203.0.113.7" {
+		t.Errorf("stored metadata = %v, want the caller's source address", metadata)
+	}
+}
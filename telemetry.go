@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName identifies this handler's spans and metrics
+const instrumentationName = "github.com/leomehi/AWS-S3-FileUpload"
+
+// The global tracer and meter are no-ops until initTelemetry installs exporting
+// providers, so instrumented code doesn't need to know whether OTel is configured
+var (
+	tracer = otel.Tracer(instrumentationName)
+	meter  = otel.Meter(instrumentationName)
+
+	uploadBytes, _   = meter.Int64Counter("upload.bytes", metric.WithUnit("By"), metric.WithDescription("Bytes received and stored by the upload pipeline"))
+	phaseDuration, _ = meter.Float64Histogram("upload.phase.duration", metric.WithUnit("ms"), metric.WithDescription("Latency of upload pipeline phases"))
+	tracerProvider   *sdktrace.TracerProvider
+	meterProvider    *sdkmetric.MeterProvider
+)
+
+// initTelemetry installs OTLP trace and metric exporters when OTEL_EXPORTER_OTLP_ENDPOINT
+// is set. The exporters read the rest of their settings from the standard OTEL_*
+// environment variables.
+func initTelemetry(ctx context.Context) {
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" {
+		return
+	}
+
+	traceExporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		log.Printf("Couldn't create OTLP trace exporter. Here's why: %v\n", err)
+		return
+	}
+	metricExporter, err := otlpmetrichttp.New(ctx)
+	if err != nil {
+		log.Printf("Couldn't create OTLP metric exporter. Here's why: %v\n", err)
+		return
+	}
+
+	tracerProvider = sdktrace.NewTracerProvider(sdktrace.WithBatcher(traceExporter))
+	meterProvider = sdkmetric.NewMeterProvider(sdkmetric.WithReader(sdkmetric.NewPeriodicReader(metricExporter)))
+	otel.SetTracerProvider(tracerProvider)
+	otel.SetMeterProvider(meterProvider)
+}
+
+// flushTelemetry exports buffered spans and metrics before Lambda freezes the
+// container at the end of an invocation
+func flushTelemetry(ctx context.Context) {
+	if tracerProvider != nil {
+		if err := tracerProvider.ForceFlush(ctx); err != nil {
+			log.Printf("Couldn't flush traces. Here's why: %v\n", err)
+		}
+	}
+	if meterProvider != nil {
+		if err := meterProvider.ForceFlush(ctx); err != nil {
+			log.Printf("Couldn't flush metrics. Here's why: %v\n", err)
+		}
+	}
+}
+
+// startPhase starts a child span for a pipeline phase. The returned function ends
+// the span, marking it failed when err is non-nil, records the phase latency and
+// returns it.
+func startPhase(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, func(err error) time.Duration) {
+	ctx, span := tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+	start := time.Now()
+	return ctx, func(err error) time.Duration {
+		elapsed := time.Since(start)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+		phaseDuration.Record(ctx, milliseconds(elapsed), metric.WithAttributes(attribute.String("phase", name)))
+		return elapsed
+	}
+}
+
+// milliseconds converts a duration to fractional milliseconds
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// recordBytes counts bytes passing a stage of the pipeline, e.g. "received" or "stored"
+func recordBytes(ctx context.Context, stage string, n int) {
+	uploadBytes.Add(ctx, int64(n), metric.WithAttributes(attribute.String("stage", stage)))
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// The global providers delegate to the first ones installed, so every test shares
+// one in-memory exporter and reader
+var (
+	telemetryOnce sync.Once
+	testSpans     *tracetest.InMemoryExporter
+	testMetrics   *sdkmetric.ManualReader
+)
+
+// recordTelemetry routes spans and metrics to memory and clears what earlier tests recorded
+func recordTelemetry(t *testing.T) (*tracetest.InMemoryExporter, *sdkmetric.ManualReader) {
+	t.Helper()
+	telemetryOnce.Do(func() {
+		testSpans = tracetest.NewInMemoryExporter()
+		testMetrics = sdkmetric.NewManualReader()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(testSpans)))
+		otel.SetMeterProvider(sdkmetric.NewMeterProvider(sdkmetric.WithReader(testMetrics)))
+	})
+	testSpans.Reset()
+	// Metrics are cumulative, so callers compare against what was collected before
+	return testSpans, testMetrics
+}
+
+// byteCounts returns the upload.bytes counter per stage
+func byteCounts(t *testing.T, reader *sdkmetric.ManualReader) map[string]int64 {
+	t.Helper()
+	var data metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &data); err != nil {
+		t.Fatal(err)
+	}
+	counts := make(map[string]int64)
+	for _, scope := range data.ScopeMetrics {
+		for _, m := range scope.Metrics {
+			sum, ok := m.Data.(metricdata.Sum[int64])
+			if m.Name != "upload.bytes" || !ok {
+				continue
+			}
+			for _, point := range sum.DataPoints {
+				stage, _ := point.Attributes.Value(attribute.Key("stage"))
+				counts[stage.AsString()] += point.Value
+			}
+		}
+	}
+	return counts
+}
+
+func TestHandlerSpans(t *testing.T) {
+	spans, metrics := recordTelemetry(t)
+	before := byteCounts(t, metrics)
+	newFakeS3(t)
+	body := strings.Repeat("traced content ", 1000)
+	upload(t, map[string]string{"Content-Type": "text/plain"}, body)
+
+	ended := spans.GetSpans()
+	byName := make(map[string]tracetest.SpanStub)
+	for _, span := range ended {
+		byName[span.Name] = span
+	}
+	root, ok := byName["Handler"]
+	if !ok {
+		t.Fatalf("no Handler span among %d spans", len(ended))
+	}
+	if root.Parent.IsValid() {
+		t.Error("Handler span has a parent")
+	}
+	for _, name := range []string{"compress", "encrypt", "upload"} {
+		span, ok := byName[name]
+		if !ok {
+			t.Errorf("no %s span", name)
+			continue
+		}
+		if span.Parent.SpanID() != root.SpanContext.SpanID() || span.SpanContext.TraceID() != root.SpanContext.TraceID() {
+			t.Errorf("%s span isn't a child of the Handler span", name)
+		}
+		if span.Status.Code == codes.Error {
+			t.Errorf("%s span failed: %s", name, span.Status.Description)
+		}
+	}
+
+	after := byteCounts(t, metrics)
+	if got := after["received"] - before["received"]; got != int64(len(body)) {
+		t.Errorf("received bytes = %d, want %d", got, len(body))
+	}
+	if got := after["stored"] - before["stored"]; got <= 0 || got >= int64(len(body)) {
+		t.Errorf("stored bytes = %d, want the compressed size", got)
+	}
+}
+
+func TestHandlerSpanRecordsFailure(t *testing.T) {
+	spans, _ := recordTelemetry(t)
+	t.Setenv("S3_UPLOAD_BREAKER_THRESHOLD", "0")
+	fake := newFakeS3(t)
+	fake.Fail = func(operation string, bucket string, key string) (int, string) {
+		if operation == "PutObject" {
+			return http.StatusInternalServerError, "InternalError"
+		}
+		return 0, ""
+	}
+	handle(t, nil, "doomed upload")
+	for _, span := range spans.GetSpans() {
+		if span.Name == "upload" {
+			if span.Status.Code != codes.Error || len(span.Events) == 0 {
+				t.Errorf("upload span status = %v with %d events, want the error recorded", span.Status, len(span.Events))
+			}
+			return
+		}
+	}
+	t.Error("no upload span")
+}
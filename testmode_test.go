@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+)
+
+// errNetworkDisabled is returned by every AWS call a unit test makes without a fake
+var errNetworkDisabled = errors.New("AWS calls are disabled in unit tests; set S3_UPLOAD_INTEGRATION=true to allow them")
+
+// TestMain keeps AWS clients offline unless integration tests were asked for, and
+// encrypts with testEncryptionKey
+func TestMain(m *testing.M) {
+	if os.Getenv("S3_UPLOAD_INTEGRATION") != "true" {
+		loadDefaultConfig = offlineConfig
+	}
+	os.Setenv("S3_UPLOAD_ENCRYPTION_KEY", base64.StdEncoding.EncodeToString(testEncryptionKey))
+	os.Exit(m.Run())
+}
+
+// offlineConfig stands in for config.LoadDefaultConfig. It never consults the
+// environment, shared config files or instance metadata for credentials, and fails
+// every request before it reaches the network.
+func offlineConfig(ctx context.Context, optFns ...func(*config.LoadOptions) error) (aws.Config, error) {
+	return aws.Config{
+		Region:      "us-east-1",
+		Credentials: credentials.NewStaticCredentialsProvider("AKIDUNITTEST", "unit-test-secret", ""),
+		HTTPClient:  offlineHTTPClient{},
+		// Refused requests fail at once rather than backing off
+		Retryer: func() aws.Retryer { return aws.NopRetryer{} },
+	}, nil
+}
+
+// offlineHTTPClient refuses every request
+type offlineHTTPClient struct{}
+
+func (offlineHTTPClient) Do(request *http.Request) (*http.Response, error) {
+	return nil, errNetworkDisabled
+}
+
+func TestCredentialChainNotConsulted(t *testing.T) {
+	if os.Getenv("S3_UPLOAD_INTEGRATION") == "true" {
+		t.Skip("integration tests use the real credential chain")
+	}
+	// Environment the default chain would either pick up or fail on
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIAREALKEY")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "real-secret")
+	t.Setenv("AWS_PROFILE", "profile-that-does-not-exist")
+	if _, err := config.LoadDefaultConfig(context.Background()); err == nil {
+		t.Fatal("the default chain accepted a missing profile; the test environment proves nothing")
+	}
+
+	cfg, err := loadAWSConfig(context.Background(), Config{})
+	if err != nil {
+		t.Fatalf("loadAWSConfig consulted the default chain: %v", err)
+	}
+	creds, err := cfg.Credentials.Retrieve(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.AccessKeyID != "AKIDUNITTEST" {
+		t.Errorf("got access key %q, want the static test credentials", creds.AccessKeyID)
+	}
+
+	client, err := newS3Client(context.Background(), Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	basics := BucketBasics{S3Client: client}
+	if _, err = basics.ObjectExists("bucket", "key"); !errors.Is(err, errNetworkDisabled) {
+		t.Errorf("S3 call returned %v, want it refused before reaching the network", err)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"net/http"
+	"strings"
+
+	// Register the decoders for the image formats thumbnails are made from
+	_ "image/gif"
+	_ "image/png"
+)
+
+// thumbnailPrefix is prepended to the keys of generated thumbnails
+const thumbnailPrefix = "thumbnails/"
+
+// isImage reports whether an upload looks like an image, from its declared
+// content type or, failing that, its content
+func isImage(file uploadFile) bool {
+	if strings.HasPrefix(strings.ToLower(file.ContentType), "image/") {
+		return true
+	}
+	return strings.HasPrefix(http.DetectContentType(file.Data), "image/")
+}
+
+// maxThumbnailPixels bounds the size of images thumbnails are made from. Decoding
+// needs memory for every pixel, so a small file declaring huge dimensions could
+// otherwise exhaust the function's memory.
+const maxThumbnailPixels = 25_000_000
+
+// makeThumbnail decodes an image and downscales it to fit within size×size pixels,
+// returning it JPEG-encoded. Images already within the bounds keep their size.
+func makeThumbnail(data []byte, size int) ([]byte, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("image decode error: %v", err)
+	}
+	if config.Width <= 0 || config.Height <= 0 {
+		return nil, fmt.Errorf("image has no pixels")
+	}
+	if config.Width > maxThumbnailPixels/config.Height {
+		return nil, fmt.Errorf("image of %dx%d pixels is too large for a thumbnail", config.Width, config.Height)
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("image decode error: %v", err)
+	}
+
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width == 0 || height == 0 {
+		return nil, fmt.Errorf("image has no pixels")
+	}
+	if width > size || height > size {
+		if width >= height {
+			width, height = size, max(1, height*size/width)
+		} else {
+			width, height = max(1, width*size/height), size
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, downscale(src, width, height), &jpeg.Options{Quality: 80}); err != nil {
+		return nil, fmt.Errorf("thumbnail encode error: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// downscale resizes an image by averaging the source pixels covered by each
+// destination pixel, reading them straight from the decoded image
+func downscale(src image.Image, width int, height int) image.Image {
+	bounds := src.Bounds()
+	dst := image.NewRGBA64(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0, y1 := y*bounds.Dy()/height, max((y+1)*bounds.Dy()/height, y*bounds.Dy()/height+1)
+		for x := 0; x < width; x++ {
+			x0, x1 := x*bounds.Dx()/width, max((x+1)*bounds.Dx()/width, x*bounds.Dx()/width+1)
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := src.At(bounds.Min.X+sx, bounds.Min.Y+sy).RGBA()
+					r, g, b, a = r+uint64(pr), g+uint64(pg), b+uint64(pb), a+uint64(pa)
+					n++
+				}
+			}
+			dst.SetRGBA64(x, y, color.RGBA64{R: uint16(r / n), G: uint16(g / n), B: uint16(b / n), A: uint16(a / n)})
+		}
+	}
+	return dst
+}
+
+// thumbnailUpload returns the bytes and options a thumbnail is stored with. The
+// thumbnail of an encrypted upload is encrypted as well, since it is a preview of
+// the file's content, and records its pipeline like any other object so the
+// download action can decode it.
+func thumbnailUpload(thumbnail []byte, encrypted bool, cfg Config) ([]byte, UploadOptions, error) {
+	opts := UploadOptions{
+		ContentType: "image/jpeg",
+		Metadata:    map[string]string{"compression": "none", "encryption": "none"},
+	}
+	if encrypted {
+		var err error
+		if thumbnail, err = encryptCompressed(thumbnail); err != nil {
+			return nil, UploadOptions{}, err
+		}
+		opts.ContentType = ""
+		opts.Metadata["encryption"] = "aes-gcm"
+	}
+	if cfg.ObjectHeader {
+		thumbnail = append(objectHeader{Compression: "none", Encrypted: encrypted}.encode(), thumbnail...)
+	}
+	return thumbnail, opts, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// testPNG returns a PNG of the given size filled with one colour
+func testPNG(t *testing.T, width int, height int, fill color.Color) []byte {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, fill)
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// pngHeader returns just the signature and IHDR chunk of a PNG declaring the given
+// size, which is all image.DecodeConfig reads
+func pngHeader(width uint32, height uint32) []byte {
+	ihdr := make([]byte, 0, 17)
+	ihdr = append(ihdr, "IHDR"...)
+	ihdr = binary.BigEndian.AppendUint32(ihdr, width)
+	ihdr = binary.BigEndian.AppendUint32(ihdr, height)
+	ihdr = append(ihdr, 8, 6, 0, 0, 0)
+
+	data := []byte("\x89PNG\r\n\x1a\n")
+	data = binary.BigEndian.AppendUint32(data, uint32(len(ihdr)-4))
+	data = append(data, ihdr...)
+	return binary.BigEndian.AppendUint32(data, crc32.ChecksumIEEE(ihdr))
+}
+
+func TestMakeThumbnail(t *testing.T) {
+	tests := []struct {
+		name          string
+		data          []byte
+		size          int
+		width, height int
+		fails         bool
+	}{
+		{name: "landscape", data: testPNG(t, 400, 200, color.White), size: 128, width: 128, height: 64},
+		{name: "portrait", data: testPNG(t, 100, 300, color.White), size: 150, width: 50, height: 150},
+		{name: "already small", data: testPNG(t, 20, 10, color.White), size: 128, width: 20, height: 10},
+		{name: "thin strip", data: testPNG(t, 1000, 1, color.White), size: 100, width: 100, height: 1},
+		{name: "too many pixels", data: pngHeader(100_000, 100_000), size: 128, fails: true},
+		{name: "overflowing dimensions", data: pngHeader(1<<31-1, 1<<31-1), size: 128, fails: true},
+		{name: "not an image", data: []byte("plain text"), size: 128, fails: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			thumbnail, err := makeThumbnail(test.data, test.size)
+			if test.fails {
+				if err == nil {
+					t.Fatal("makeThumbnail() succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("makeThumbnail() error = %v", err)
+			}
+			config, err := jpeg.DecodeConfig(bytes.NewReader(thumbnail))
+			if err != nil {
+				t.Fatalf("thumbnail isn't a JPEG: %v", err)
+			}
+			if config.Width != test.width || config.Height != test.height {
+				t.Errorf("thumbnail is %dx%d, want %dx%d", config.Width, config.Height, test.width, test.height)
+			}
+		})
+	}
+}
+
+func TestDownscaleAveragesPixels(t *testing.T) {
+	// Alternating black and white columns average to grey
+	src := image.NewGray(image.Rect(10, 10, 14, 12))
+	for x := 10; x < 14; x += 2 {
+		for y := 10; y < 12; y++ {
+			src.SetGray(x, y, color.Gray{Y: 255})
+		}
+	}
+	dst := downscale(src, 2, 1)
+	for x := 0; x < 2; x++ {
+		r, g, b, a := dst.At(x, 0).RGBA()
+		if r>>8 != 127 || g>>8 != 127 || b>>8 != 127 || a>>8 != 255 {
+			t.Errorf("pixel %d = %d,%d,%d,%d, want mid grey", x, r>>8, g>>8, b>>8, a>>8)
+		}
+	}
+}
+
+func TestThumbnailUpload(t *testing.T) {
+	thumbnail, err := makeThumbnail(testPNG(t, 300, 300, color.RGBA{R: 200, A: 255}), 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name      string
+		encrypted bool
+		header    bool
+	}{
+		{name: "plain"},
+		{name: "encrypted", encrypted: true},
+		{name: "plain with header", header: true},
+		{name: "encrypted with header", encrypted: true, header: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			stored, opts, err := thumbnailUpload(thumbnail, test.encrypted, Config{ObjectHeader: test.header})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.encrypted {
+				if bytes.Contains(stored, thumbnail[:64]) {
+					t.Error("encrypted thumbnail holds the plaintext JPEG")
+				}
+				if opts.Metadata["encryption"] != "aes-gcm" || opts.ContentType == "image/jpeg" {
+					t.Errorf("encrypted thumbnail stored with %+v", opts)
+				}
+			}
+			if hasObjectHeader(stored) != test.header {
+				t.Errorf("object header present = %v, want %v", hasObjectHeader(stored), test.header)
+			}
+			decoded, err := decodeObject(stored, opts.Metadata)
+			if err != nil {
+				t.Fatalf("decodeObject() error = %v", err)
+			}
+			if !bytes.Equal(decoded, thumbnail) {
+				t.Error("decoded thumbnail differs from the original")
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// ErrUntrustedRequest is returned when a request asks to skip encryption without a valid signature
+var ErrUntrustedRequest = errors.New("request is not trusted to disable encryption")
+
+// signedHeaders are the headers covered by a request signature besides every
+// X-Upload-* header, because they change how the body is stored
+var signedHeaders = []string{"content-encoding", "content-type", "idempotency-key", "x-compression-level"}
+
+// requestEncryption reports whether the request's files must be encrypted. Internal
+// callers sending already-encrypted data can opt out with "X-Upload-Encryption: none",
+// which is honoured only for a request signed under the shared trust secret.
+func requestEncryption(request events.APIGatewayProxyRequest, cfg Config) (bool, error) {
+	mode := headerValue(request.Headers, "X-Upload-Encryption")
+	if mode == "" {
+		return true, nil
+	}
+	if !strings.EqualFold(mode, "none") {
+		return true, ErrUntrustedRequest
+	}
+	if err := verifySignature(request, cfg, time.Now()); err != nil {
+		return true, err
+	}
+	return false, nil
+}
+
+// verifySignature checks that a request carries an X-Upload-Signature holding the
+// hex HMAC-SHA256 of requestSignature's canonical form under the trust secret. The
+// signed X-Upload-Timestamp must be within TrustMaxSkew of now, so a captured
+// signature can't be replayed once it is stale, and because the headers, query
+// string and body are all signed it can't be replayed with different ones either.
+func verifySignature(request events.APIGatewayProxyRequest, cfg Config, now time.Time) error {
+	if cfg.TrustSecret == "" {
+		return ErrUntrustedRequest
+	}
+	if err := checkSignatureTimestamp(request.Headers, cfg, now); err != nil {
+		return err
+	}
+	signature, err := hex.DecodeString(headerValue(request.Headers, "X-Upload-Signature"))
+	if err != nil {
+		return ErrUntrustedRequest
+	}
+	body, err := requestBody(request)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(signature, requestSignature(request, body, cfg.TrustSecret)) {
+		return ErrUntrustedRequest
+	}
+	return nil
+}
+
+// checkSignatureTimestamp checks that a request's X-Upload-Timestamp, in Unix
+// seconds, is within TrustMaxSkew of now
+func checkSignatureTimestamp(headers map[string]string, cfg Config, now time.Time) error {
+	seconds, err := strconv.ParseInt(headerValue(headers, "X-Upload-Timestamp"), 10, 64)
+	if err != nil {
+		return ErrUntrustedRequest
+	}
+	if skew := now.Sub(time.Unix(seconds, 0)); skew > cfg.TrustMaxSkew || skew < -cfg.TrustMaxSkew {
+		return ErrUntrustedRequest
+	}
+	return nil
+}
+
+// requestSignature returns the HMAC-SHA256 under secret of a request's canonical form:
+//
+//	method \n query \n headers \n hex SHA-256 of the body
+//
+// The query is every parameter sorted and URL-encoded as name=value joined by "&".
+// The headers are the X-Upload-* headers, other than the signature itself, and
+// signedHeaders that are present, each as "name:value\n" with lowercase names in
+// sorted order. X-Upload-Timestamp is one of them.
+func requestSignature(request events.APIGatewayProxyRequest, body []byte, secret string) []byte {
+	query := url.Values{}
+	for name, value := range request.QueryStringParameters {
+		query.Set(name, value)
+	}
+
+	headers := map[string]string{}
+	for name, value := range request.Headers {
+		name = strings.ToLower(name)
+		signed := strings.HasPrefix(name, "x-upload-") && name != "x-upload-signature"
+		for _, header := range signedHeaders {
+			signed = signed || name == header
+		}
+		if signed {
+			headers[name] = strings.TrimSpace(value)
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strings.ToUpper(request.HTTPMethod) + "\n" + query.Encode() + "\n"))
+	for _, name := range names {
+		mac.Write([]byte(name + ":" + headers[name] + "\n"))
+	}
+	mac.Write([]byte("\n" + hex.EncodeToString(bodyHash[:])))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// signedRequest returns an upload asking to skip encryption, signed under secret at now
+func signedRequest(secret string, now time.Time) events.APIGatewayProxyRequest {
+	request := events.APIGatewayProxyRequest{
+		HTTPMethod: "POST",
+		Headers: map[string]string{
+			"Content-Type":        "application/octet-stream",
+			"X-Upload-Encryption": "none",
+			"X-Upload-Timestamp":  strconv.FormatInt(now.Unix(), 10),
+			"X-Upload-Meta-Owner": "billing",
+		},
+		QueryStringParameters: map[string]string{"fileName": "report.csv"},
+		Body:                  "already encrypted",
+	}
+	body, _ := requestBody(request)
+	request.Headers["X-Upload-Signature"] = hex.EncodeToString(requestSignature(request, body, secret))
+	return request
+}
+
+func TestRequestEncryption(t *testing.T) {
+	cfg := Config{TrustSecret: "shared-secret", TrustMaxSkew: 5 * time.Minute}
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		request events.APIGatewayProxyRequest
+		cfg     Config
+		encrypt bool
+		err     error
+	}{
+		{
+			name:    "no opt-out",
+			request: events.APIGatewayProxyRequest{HTTPMethod: "POST", Body: "data"},
+			cfg:     cfg,
+			encrypt: true,
+		},
+		{
+			name:    "signed opt-out",
+			request: signedRequest(cfg.TrustSecret, now),
+			cfg:     cfg,
+		},
+		{
+			name:    "within skew",
+			request: signedRequest(cfg.TrustSecret, now.Add(-4*time.Minute)),
+			cfg:     cfg,
+		},
+		{
+			name:    "no trust secret configured",
+			request: signedRequest(cfg.TrustSecret, now),
+			cfg:     Config{TrustMaxSkew: cfg.TrustMaxSkew},
+			encrypt: true,
+			err:     ErrUntrustedRequest,
+		},
+		{
+			name:    "wrong secret",
+			request: signedRequest("guessed-secret", now),
+			cfg:     cfg,
+			encrypt: true,
+			err:     ErrUntrustedRequest,
+		},
+		{
+			name:    "stale signature",
+			request: signedRequest(cfg.TrustSecret, now.Add(-10*time.Minute)),
+			cfg:     cfg,
+			encrypt: true,
+			err:     ErrUntrustedRequest,
+		},
+		{
+			name:    "timestamp from the future",
+			request: signedRequest(cfg.TrustSecret, now.Add(10*time.Minute)),
+			cfg:     cfg,
+			encrypt: true,
+			err:     ErrUntrustedRequest,
+		},
+		{
+			name: "missing timestamp",
+			request: func() events.APIGatewayProxyRequest {
+				request := signedRequest(cfg.TrustSecret, now)
+				delete(request.Headers, "X-Upload-Timestamp")
+				return request
+			}(),
+			cfg:     cfg,
+			encrypt: true,
+			err:     ErrUntrustedRequest,
+		},
+		{
+			name: "replayed with a new timestamp",
+			request: func() events.APIGatewayProxyRequest {
+				request := signedRequest(cfg.TrustSecret, now.Add(-10*time.Minute))
+				request.Headers["X-Upload-Timestamp"] = strconv.FormatInt(now.Unix(), 10)
+				return request
+			}(),
+			cfg:     cfg,
+			encrypt: true,
+			err:     ErrUntrustedRequest,
+		},
+		{
+			name: "tampered metadata header",
+			request: func() events.APIGatewayProxyRequest {
+				request := signedRequest(cfg.TrustSecret, now)
+				request.Headers["X-Upload-Meta-Owner"] = "attacker"
+				return request
+			}(),
+			cfg:     cfg,
+			encrypt: true,
+			err:     ErrUntrustedRequest,
+		},
+		{
+			name: "added content encoding",
+			request: func() events.APIGatewayProxyRequest {
+				request := signedRequest(cfg.TrustSecret, now)
+				request.Headers["Content-Encoding"] = "gzip"
+				return request
+			}(),
+			cfg:     cfg,
+			encrypt: true,
+			err:     ErrUntrustedRequest,
+		},
+		{
+			name: "tampered query",
+			request: func() events.APIGatewayProxyRequest {
+				request := signedRequest(cfg.TrustSecret, now)
+				request.QueryStringParameters["fileName"] = "other.csv"
+				return request
+			}(),
+			cfg:     cfg,
+			encrypt: true,
+			err:     ErrUntrustedRequest,
+		},
+		{
+			name: "tampered body",
+			request: func() events.APIGatewayProxyRequest {
+				request := signedRequest(cfg.TrustSecret, now)
+				request.Body = "plaintext"
+				return request
+			}(),
+			cfg:     cfg,
+			encrypt: true,
+			err:     ErrUntrustedRequest,
+		},
+		{
+			name: "unknown mode",
+			request: func() events.APIGatewayProxyRequest {
+				request := signedRequest(cfg.TrustSecret, now)
+				request.Headers["X-Upload-Encryption"] = "rot13"
+				return request
+			}(),
+			cfg:     cfg,
+			encrypt: true,
+			err:     ErrUntrustedRequest,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encrypt, err := requestEncryption(test.request, test.cfg)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("requestEncryption() error = %v, want %v", err, test.err)
+			}
+			if encrypt != test.encrypt {
+				t.Errorf("requestEncryption() = %v, want %v", encrypt, test.encrypt)
+			}
+		})
+	}
+}
+
+func TestSignatureIgnoresHeaderCase(t *testing.T) {
+	cfg := Config{TrustSecret: "shared-secret", TrustMaxSkew: time.Minute}
+	request := signedRequest(cfg.TrustSecret, time.Now())
+	headers := map[string]string{}
+	for name, value := range request.Headers {
+		headers[strings.ToLower(name)] = value
+	}
+	request.Headers = headers
+	if err := verifySignature(request, cfg, time.Now()); err != nil {
+		t.Fatalf("verifySignature() with lowercase headers = %v", err)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// ErrObjectExpired is returned when reading an object past the expires-at time stored with it
+var ErrObjectExpired = errors.New("object has expired")
+
+// expiresAtMetadata is the metadata key holding an object's expiry as an RFC 3339 timestamp
+const expiresAtMetadata = "expires-at"
+
+// objectExpired reports whether an object's metadata marks it as expired at now.
+// Objects without an expiry never expire.
+func objectExpired(metadata map[string]string, now time.Time) bool {
+	expiresAt, err := time.Parse(time.RFC3339, metadata[expiresAtMetadata])
+	return err == nil && !now.Before(expiresAt)
+}
+
+// checkExpiry enforces the TTL of an object being read, for buckets without a
+// lifecycle rule to expire it: expired objects are refused with ErrObjectExpired
+// and, if configured, deleted
+func (basics BucketBasics) checkExpiry(bucketName string, fileName string, metadata map[string]string) error {
+	if !basics.Config.EnforceTTL || !objectExpired(metadata, time.Now()) {
+		return nil
+	}
+	if basics.Config.DeleteExpired {
+		_, err := basics.S3Client.DeleteObject(context.TODO(), &s3.DeleteObjectInput{
+			Bucket: aws.String(bucketName),
+			Key:    aws.String(fileName),
+		})
+		if err != nil {
+			log.Printf("Couldn't delete expired %v:%v. Here's why: %v\n", bucketName, fileName, err)
+		}
+	}
+	return ErrObjectExpired
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestObjectExpired(t *testing.T) {
+	now := time.Date(2024, 6, 15, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		expiresAt string
+		want      bool
+	}{
+		{name: "no expiry", want: false},
+		{name: "future", expiresAt: "2024-06-15T13:00:00Z", want: false},
+		{name: "past", expiresAt: "2024-06-15T11:59:59Z", want: true},
+		{name: "exactly now", expiresAt: "2024-06-15T12:00:00Z", want: true},
+		{name: "other zone", expiresAt: "2024-06-15T07:30:00-04:00", want: true},
+		{name: "unparseable", expiresAt: "tomorrow", want: false},
+	}
+	for _, test := range tests {
+		metadata := map[string]string{}
+		if test.expiresAt != "" {
+			metadata[expiresAtMetadata] = test.expiresAt
+		}
+		if got := objectExpired(metadata, now); got != test.want {
+			t.Errorf("%s: objectExpired(%q) = %v, want %v", test.name, test.expiresAt, got, test.want)
+		}
+	}
+}
+
+func TestDownloadExpiry(t *testing.T) {
+	future := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	past := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	tests := []struct {
+		name      string
+		expiresAt string
+		cfg       Config
+		err       error
+		deleted   bool
+	}{
+		{name: "not expired", expiresAt: future, cfg: Config{EnforceTTL: true}},
+		{name: "without expiry", cfg: Config{EnforceTTL: true}},
+		{name: "expired", expiresAt: past, cfg: Config{EnforceTTL: true}, err: ErrObjectExpired},
+		{name: "expired and deleted", expiresAt: past, cfg: Config{EnforceTTL: true, DeleteExpired: true}, err: ErrObjectExpired, deleted: true},
+		{name: "enforcement disabled", expiresAt: past, cfg: Config{DeleteExpired: true}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := newFakeS3(t)
+			header := http.Header{}
+			if test.expiresAt != "" {
+				header.Set("X-Amz-Meta-Expires-At", test.expiresAt)
+			}
+			fake.put("uploads", "a.txt", []byte("short-lived"), header)
+
+			data, _, err := fake.basics(test.cfg).DownloadFile("uploads", "a.txt", false)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("DownloadFile() error = %v, want %v", err, test.err)
+			}
+			if err == nil && string(data) != "short-lived" {
+				t.Errorf("DownloadFile() = %q", data)
+			}
+			if _, _, exists := fake.object("uploads", "a.txt"); exists == test.deleted {
+				t.Errorf("object exists = %v, want deleted %v", exists, test.deleted)
+			}
+		})
+	}
+}
+
+func TestUploadObjectTTL(t *testing.T) {
+	t.Setenv("S3_UPLOAD_OBJECT_TTL", "2h")
+	fake := newFakeS3(t)
+	before := time.Now().Truncate(time.Second)
+	upload(t, map[string]string{"Content-Type": "text/plain"}, "expires in two hours")
+	after := time.Now()
+
+	bucket := fake.bucketNames()[0]
+	key := fake.keys(bucket)[0]
+	_, metadata, _ := fake.object(bucket, key)
+	expiresAt, err := time.Parse(time.RFC3339, metadata[expiresAtMetadata])
+	if err != nil {
+		t.Fatalf("expires-at = %q: %v", metadata[expiresAtMetadata], err)
+	}
+	if expiresAt.Before(before.Add(2*time.Hour)) || expiresAt.After(after.Add(2*time.Hour)) {
+		t.Errorf("expires-at = %v, want two hours after the upload", expiresAt)
+	}
+
+	// Until then the object reads back as usual
+	response := handleDownload(t.Context(), events.APIGatewayProxyRequest{
+		QueryStringParameters: map[string]string{"action": "download", "bucket": bucket, "key": key},
+		RequestContext:        events.APIGatewayProxyRequestContext{Authorizer: map[string]interface{}{"principalId": "user-1"}},
+	}, testConfig(t, nil))
+	if response.StatusCode != http.StatusOK {
+		t.Errorf("handleDownload() = %d %q, want 200", response.StatusCode, response.Body)
+	}
+}
+
+func TestHandleDownloadExpired(t *testing.T) {
+	fake := newFakeS3(t)
+	header := http.Header{}
+	header.Set("X-Amz-Meta-Expires-At", time.Now().Add(-time.Minute).UTC().Format(time.RFC3339))
+	bucket := uploadBucketName(time.Now())
+	fake.put(bucket, "a.txt", []byte("gone"), header)
+	response := handleDownload(t.Context(), events.APIGatewayProxyRequest{
+		QueryStringParameters: map[string]string{"action": "download", "bucket": bucket, "key": "a.txt"},
+		RequestContext:        events.APIGatewayProxyRequestContext{Authorizer: map[string]interface{}{"principalId": "user-1"}},
+	}, testConfig(t, nil))
+	if response.StatusCode != http.StatusGone {
+		t.Errorf("handleDownload() = %d %q, want 410", response.StatusCode, response.Body)
+	}
+}
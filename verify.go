@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// ErrWriteNotVisible is returned when a written object still isn't readable after every verification attempt
+var ErrWriteNotVisible = errors.New("uploaded object is not yet visible")
+
+// ErrRoundtripMismatch is returned when stored data doesn't decode back to the uploaded file
+var ErrRoundtripMismatch = errors.New("stored data doesn't decode to the upload")
+
+// verifyRoundtrip decodes the bytes about to be stored, as a download would with
+// the given metadata, and checks that they reproduce the file. It catches a
+// misconfigured pipeline before anything unreadable is persisted. Client-compressed
+// files decode to content the handler never saw, so for them only decoding is checked.
+func verifyRoundtrip(stored []byte, metadata map[string]string, file uploadFile) error {
+	plainData, err := decodeObject(stored, metadata)
+	if err != nil {
+		return err
+	}
+	if !file.PreCompressed && !bytes.Equal(plainData, file.Data) {
+		return ErrRoundtripMismatch
+	}
+	return nil
+}
+
+// VerifyWrite confirms that reads of a key return the object just written, by
+// comparing its ETag with the one the upload returned. Replicated and cross-region
+// setups can serve a stale object or none at all for a while, so it retries with
+// doubling delays before giving up.
+func (basics BucketBasics) VerifyWrite(bucketName string, fileName string, etag string) error {
+	delay := basics.Config.VerifyWriteDelay
+	for attempt := 0; ; attempt++ {
+		result, err := basics.S3Client.HeadObject(context.TODO(), &s3.HeadObjectInput{
+			Bucket: aws.String(bucketName),
+			Key:    aws.String(fileName),
+		})
+		var notFound *types.NotFound
+		if err != nil && !errors.As(err, &notFound) {
+			log.Printf("Couldn't verify %v:%v. Here's why: %v\n", bucketName, fileName, err)
+			return err
+		}
+		if err == nil && aws.ToString(result.ETag) == etag {
+			return nil
+		}
+		if attempt == basics.Config.VerifyWriteRetries {
+			log.Printf("%v:%v still isn't visible after %d attempts\n", bucketName, fileName, attempt+1)
+			return ErrWriteNotVisible
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestVerifyWrite(t *testing.T) {
+	data := []byte("the new object")
+	tests := []struct {
+		name string
+		// missing and stale are how many reads serve no object or the previous one
+		missing int
+		stale   int
+		retries int
+		heads   int
+		err     error
+	}{
+		{name: "visible immediately", retries: 3, heads: 1},
+		{name: "missing then visible", missing: 2, retries: 3, heads: 3},
+		{name: "stale then visible", stale: 2, retries: 3, heads: 3},
+		{name: "never visible", missing: 10, retries: 2, heads: 3, err: ErrWriteNotVisible},
+		{name: "stale past the retries", stale: 10, retries: 1, heads: 2, err: ErrWriteNotVisible},
+		{name: "no retries", missing: 1, heads: 1, err: ErrWriteNotVisible},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := newFakeS3(t)
+			fake.put("uploads", "a.txt", []byte("the previous object"), nil)
+			heads := 0
+			fake.Fail = func(operation string, bucket string, key string) (int, string) {
+				if operation != "HeadObject" {
+					return 0, ""
+				}
+				heads++
+				if heads <= test.missing {
+					return http.StatusNotFound, "NotFound"
+				}
+				return 0, ""
+			}
+			// Serve the previous object until the stale reads are used up
+			var current []byte
+			staleHeads := 0
+			fake.Before = func(operation string, bucket string, key string) {
+				if operation != "HeadObject" || test.stale == 0 {
+					return
+				}
+				staleHeads++
+				if staleHeads == 1 {
+					current, _, _ = fake.object(bucket, key)
+					fake.put(bucket, key, []byte("the previous object"), fake.header(bucket, key))
+				}
+				if staleHeads == test.stale+1 {
+					fake.put(bucket, key, current, fake.header(bucket, key))
+				}
+			}
+
+			basics := fake.basics(Config{
+				MultipartThreshold: 1 << 20,
+				VerifyWrites:       true,
+				VerifyWriteRetries: test.retries,
+				VerifyWriteDelay:   time.Millisecond,
+			})
+			err := basics.UploadFileToS3("uploads", "a.txt", data, UploadOptions{})
+			if !errors.Is(err, test.err) {
+				t.Fatalf("UploadFileToS3() error = %v, want %v", err, test.err)
+			}
+			if got := fake.count("HeadObject"); got != test.heads {
+				t.Errorf("HeadObject called %d times, want %d", got, test.heads)
+			}
+		})
+	}
+}
+
+func TestVerifyWriteHeadError(t *testing.T) {
+	fake := newFakeS3(t)
+	fake.Fail = func(operation string, bucket string, key string) (int, string) {
+		if operation == "HeadObject" {
+			return http.StatusForbidden, "AccessDenied"
+		}
+		return 0, ""
+	}
+	basics := fake.basics(Config{MultipartThreshold: 1 << 20, VerifyWrites: true, VerifyWriteRetries: 3, VerifyWriteDelay: time.Millisecond})
+	err := basics.UploadFileToS3("uploads", "a.txt", []byte("data"), UploadOptions{})
+	if err == nil || errors.Is(err, ErrWriteNotVisible) {
+		t.Fatalf("UploadFileToS3() error = %v, want the HeadObject failure", err)
+	}
+	// Only a missing or stale object is worth retrying
+	if heads := fake.count("HeadObject"); heads != 1 {
+		t.Errorf("HeadObject called %d times, want 1", heads)
+	}
+}
+
+func TestUploadVerifyWrites(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled string
+		missing bool
+		status  int
+		heads   int
+	}{
+		{name: "disabled", enabled: "false", status: http.StatusOK},
+		{name: "visible", enabled: "true", status: http.StatusOK, heads: 1},
+		{name: "never visible", enabled: "true", missing: true, status: http.StatusServiceUnavailable, heads: 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("S3_UPLOAD_VERIFY_WRITES", test.enabled)
+			t.Setenv("S3_UPLOAD_VERIFY_WRITE_RETRIES", "2")
+			t.Setenv("S3_UPLOAD_VERIFY_WRITE_DELAY", "1ms")
+			t.Setenv("S3_UPLOAD_BREAKER_THRESHOLD", "0")
+			fake := newFakeS3(t)
+			if test.missing {
+				fake.Fail = func(operation string, bucket string, key string) (int, string) {
+					if operation == "HeadObject" {
+						return http.StatusNotFound, "NotFound"
+					}
+					return 0, ""
+				}
+			}
+			response := handle(t, map[string]string{"Content-Type": "text/plain"}, "verified contents")
+			if response.StatusCode != test.status {
+				t.Fatalf("Handler() = %d %q, want %d", response.StatusCode, response.Body, test.status)
+			}
+			if heads := fake.count("HeadObject"); heads != test.heads {
+				t.Errorf("HeadObject called %d times, want %d", heads, test.heads)
+			}
+		})
+	}
+}
+
+func TestVerifyRoundtrip(t *testing.T) {
+	data := []byte(strings.Repeat("round trip me. ", 100))
+	compressed, err := compressData(t.Context(), data, "zstd", zstd.SpeedDefault, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := encryptCompressed(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata := map[string]string{"compression": "zstd", "encryption": "aes-gcm"}
+	tests := []struct {
+		name     string
+		stored   []byte
+		metadata map[string]string
+		file     uploadFile
+		// decodeErr is set when the stored bytes can't be decoded at all
+		decodeErr bool
+		err       error
+	}{
+		{name: "intact", stored: stored, metadata: metadata, file: uploadFile{Data: data}},
+		{name: "corrupted ciphertext", stored: flipLastByte(stored), metadata: metadata, file: uploadFile{Data: data}, decodeErr: true},
+		{name: "wrong compression recorded", stored: stored, metadata: map[string]string{"compression": "gzip", "encryption": "aes-gcm"}, file: uploadFile{Data: data}, decodeErr: true},
+		{name: "encryption not recorded", stored: stored, metadata: map[string]string{"compression": "zstd", "encryption": "none"}, file: uploadFile{Data: data}, decodeErr: true},
+		{name: "decodes to other content", stored: stored, metadata: metadata, file: uploadFile{Data: []byte("a different file")}, err: ErrRoundtripMismatch},
+		{name: "client compressed", stored: stored, metadata: metadata, file: uploadFile{Data: compressed, PreCompressed: true}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := verifyRoundtrip(test.stored, test.metadata, test.file)
+			if test.decodeErr {
+				if err == nil || errors.Is(err, ErrRoundtripMismatch) {
+					t.Errorf("verifyRoundtrip() error = %v, want a decoding failure", err)
+				}
+				return
+			}
+			if !errors.Is(err, test.err) {
+				t.Errorf("verifyRoundtrip() error = %v, want %v", err, test.err)
+			}
+		})
+	}
+}
+
+// flipLastByte returns data with its last byte altered
+func flipLastByte(data []byte) []byte {
+	corrupted := append([]byte{}, data...)
+	corrupted[len(corrupted)-1] ^= 0xff
+	return corrupted
+}
+
+func TestUploadVerifyRoundtrip(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+	}{
+		{name: "zstd"},
+		{name: "gzip", env: map[string]string{"S3_UPLOAD_COMPRESSION_MAP": "text/plain=gzip"}},
+		{name: "uncompressed", env: map[string]string{"S3_UPLOAD_COMPRESSION_MAP": "text/plain=none"}},
+		{name: "object header", env: map[string]string{"S3_UPLOAD_OBJECT_HEADER": "true"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("S3_UPLOAD_VERIFY_ROUNDTRIP", "true")
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+			fake := newFakeS3(t)
+			upload(t, map[string]string{"Content-Type": "text/plain"}, "checked before it is stored")
+			// What passed the check is what was stored, and it decodes to the upload
+			bucket := fake.bucketNames()[0]
+			stored, metadata, _ := fake.object(bucket, fake.keys(bucket)[0])
+			if decoded, err := decodeObject(stored, metadata); err != nil || string(decoded) != "checked before it is stored" {
+				t.Errorf("decodeObject() = %q, %v", decoded, err)
+			}
+		})
+	}
+}